@@ -8,18 +8,50 @@ import (
 	"io"
 	"io/ioutil"
 	"path"
-	"encoding/json"
 	"regexp"
 	"strconv"
 	"net/url"
 	"errors"
-	"log"
+	"fmt"
+	"os"
 	"bytes"
 	"sync"
+	"time"
+	"reflect"
 )
 
 const hexPrefixPat = "/[0-9a-f]{2}/[0-9a-f]{2}/[0-9a-f]{2}/"
-const rootHASPath = ".well-known/stellar-history.json"
+// Where the root HAS lives unless ConnectOptions.RootHASPath says otherwise.
+const DefaultRootHASPath = ".well-known/stellar-history.json"
+
+// A listing producer runs at most this many results ahead of its consumer
+// before blocking.
+const DefaultListBufferSize = 1000
+
+// When Mirror writes the destination's root HAS, which advertises the
+// range of checkpoints the archive serves.
+type RootHASPolicy int
+
+const (
+	// Write the root HAS once, after every other file has been copied.
+	// Readers never see a root HAS advertising a checkpoint that hasn't
+	// been copied yet (though one whose copy failed is still advertised),
+	// but see no progress until the end, and an interrupted mirror leaves
+	// the old root HAS in place.
+	RootHASLast RootHASPolicy = iota
+
+	// Advance the root HAS as copying proceeds, to the highest checkpoint
+	// at or below which every checkpoint in the range has been copied
+	// without error, then write the final one at the end as RootHASLast
+	// does. Readers see progress, and an interrupted mirror leaves a root
+	// HAS to resume from, but each intermediate root HAS is only as
+	// consistent as the destination was below the start of the range.
+	RootHASIncremental
+
+	// Never write the root HAS, leaving publishing to the caller. The
+	// destination's root HAS may be stale, or absent, indefinitely.
+	RootHASNever
+)
 
 type CommandOptions struct {
 	Concurrency int
@@ -28,26 +60,323 @@ type CommandOptions struct {
 	Force bool
 	Verify bool
 	Thorough bool
+
+	// When nonzero, ScanBuckets records existing buckets in a bloom filter
+	// of this many bits rather than an exact set, saving memory on large
+	// archives; about 10 bits per bucket is a good size. The filter has no
+	// false negatives, but has false positives (around 1% of lookups at 10
+	// bits per bucket), so CheckBucketsMissing confirms each referenced
+	// bucket it finds in the filter with an Exists check.
+	BucketBloomBits uint64
+
+	// A file in which ScanBuckets keeps the set of existing buckets between
+	// runs. When it exists, the scan trusts it instead of listing every
+	// bucket, checks only referenced buckets it doesn't name, and saves the
+	// set back with any found. A bucket deleted since the set was saved
+	// still counts as present; remove the file to force a full listing. Not
+	// usable with BucketBloomBits.
+	BucketSetFile string
+
+	// When nonzero, Mirror only copies buckets whose size in bytes is
+	// at least MinBucketBytes and/or at most MaxBucketBytes.
+	MinBucketBytes int64
+	MaxBucketBytes int64
+
+	// When non-nil, Mirror only copies the buckets in IncludeBuckets, and
+	// never those in ExcludeBuckets; others are skipped, and logged.
+	// Skipped buckets are still referenced by the checkpoints copied, so
+	// the copy is incomplete unless FailOnExcludedBucket makes them errors.
+	IncludeBuckets map[Hash]bool
+	ExcludeBuckets map[Hash]bool
+	FailOnExcludedBucket bool
+
+	// Applied to files as they are copied; nil copies everything verbatim.
+	Transform CopyTransform
+
+	// When set, copies decompress each XDR category file and recompress it
+	// with the codec the destination's categories use, writing it under
+	// the destination's name for it (so a gzip archive can be migrated to
+	// another codec, or back). Buckets are recompressed with gzip, as they
+	// are always named and read as gzip, and their content is checked
+	// against their hash as it's copied. Applied before any Transform.
+	Transcode bool
+
+	// Applied by Mirror and Repair to every HAS they write, checkpoint and
+	// root alike, before any Transform; e.g. to stamp the server field.
+	HASTransform func(HistoryArchiveState) HistoryArchiveState
+
+	// When greater than 1, Mirror copies a checkpoint's history (HAS) file
+	// only for every HASInterval'th checkpoint, though it still copies the
+	// buckets and other category files of every checkpoint. The result is
+	// NOT a standard archive: scans report the skipped HAS files as
+	// missing, and it cannot be used for ingestion, only bulk retrieval.
+	HASInterval int
+
+	// When nonzero, ScanBuckets starts fetching checkpoint HAS files
+	// before it lists the buckets, and keeps up to this many fetched ahead
+	// of the workers noting their references, so that on a high-latency
+	// backend the fetches overlap the listing and any slow verification.
+	HASPrefetch int
+
+	// Number of hex path components (1 to 3) in the prefixes that
+	// ScanCheckpoints lists. Zero picks the shallowest depth at which the
+	// range's endpoints differ.
+	ListPrefixDepth int
+
+	// When, if at all, Mirror writes the destination's root HAS.
+	RootHASPolicy RootHASPolicy
+
+	// When set, Mirror fails rather than clamping a requested range that
+	// the source's root HAS doesn't fully cover.
+	StrictRange bool
+
+	// Number of times a failed file copy is retried.
+	CopyRetries int
+
+	// When nonzero, the most retries all the workers of one Mirror or
+	// Repair may make between them. Once it's used up the operation stops
+	// copying and fails, rather than keep hammering a backend that's down.
+	RetryBudget int
+
+	// When set, copies give the destination file the source file's
+	// modification time, where the source backend can report it and the
+	// destination's can set it (the fs backend does both; S3 can only
+	// report it). Elsewhere it's ignored.
+	PreserveModTime bool
+
+	// When set, a file the destination already has is checked before it's
+	// skipped, and copied again if the check fails: a bucket must gunzip to
+	// content matching its hash, an XDR file must be a complete sequence of
+	// frames, and a JSON file must decode as a HAS.
+	VerifyExisting bool
+
+	// When nonzero, the most verifications (with Verify, or of existing
+	// files with VerifyExisting) that may run at once, whatever
+	// Concurrency is: listing is bound by request latency but verifying by
+	// CPU and bandwidth, so the best parallelism differs. Workers wait for
+	// a free slot before verifying.
+	VerifyConcurrency int
+
+	// When above 1, the most of a checkpoint's category files (its HAS
+	// among them) each Mirror worker copies at once. They're independent,
+	// so on a backend where every request is a round trip, copying them
+	// together shortens each checkpoint's critical path.
+	CategoryConcurrency int
+
+	// When nonzero, Scan and ScanCheckpoints stop making requests once
+	// this long has passed since they started, and return
+	// ErrScanIncomplete. The scan state holds what was found by then, so
+	// files the scan didn't reach count as missing; the caller decides
+	// whether the partial coverage is enough.
+	Deadline time.Duration
+
+	// When set, Repair scans with Verify and re-fetches from the source,
+	// over the existing copy, every file the scan found corrupt as well as
+	// those it found missing. A re-fetched file that still fails
+	// verification counts as an error.
+	RepairCorrupt bool
+
+	// When nonzero, Mirror and Repair only start copying a file while the
+	// sizes of the files being copied, taken from the source before each
+	// copy, sum to no more than this; a file larger than this is copied
+	// alone. Memory use then stays predictable however big the buckets,
+	// on backends that buffer whole files. Concurrency still bounds the
+	// number of copies.
+	MaxInFlightBytes int64
+
+	// When set, PutRootHAS, and so Mirror, never moves the root HAS back
+	// to an earlier ledger: it writes only if the root HAS is unchanged
+	// since it read it and older than the one being written, and retries
+	// when another writer gets in between. Needs a backend implementing
+	// ConditionalPutter.
+	OptimisticRootHAS bool
+
+	// Scope Repair to checkpoint files, skipping the bucket scan and
+	// repair, or to buckets only. At most one may be set.
+	SkipBuckets bool
+	BucketsOnly bool
+
+	// Receives a span for each Mirror, Repair and Scan; nil traces nothing.
+	Tracer Tracer
+
+	// Lets the caller pause, resume or stop a running Mirror; nil for none.
+	Controller *MirrorController
+
+	// When set, Mirror, Repair and Scan write their counts and timings to
+	// this file when they finish, in the Prometheus text format, for
+	// node_exporter's textfile collector.
+	MetricsFile string
+
+	// What the operation in progress has copied, when MetricsFile is set.
+	stats *opStats
+
+	// The budget of the operation in progress, shared by its workers.
+	retries *retryBudget
+
+	// Bounds the verifications of the Mirror or Repair in progress.
+	verifySlots verifyLimiter
+
+	// Bounds the bytes the Mirror or Repair in progress copies at once.
+	inFlight *byteBudget
+
+	// When the scan in progress must stop, given Deadline.
+	scanDeadline scanDeadline
+
+	// When set, a scan notes files that fail verification as corrupt
+	// without counting them as errors, for Repair to refetch or Reconcile
+	// to plan.
+	tolerateCorrupt bool
 }
 
 type ConnectOptions struct {
 	S3Region string
+	// Depth of the channels carrying listing results to consumers. Zero
+	// selects DefaultListBufferSize; negative means unbuffered.
+	ListBufferSize int
+	// Applied to every object the S3 backend uploads.
+	S3ObjectTags map[string]string
+	S3Metadata map[string]string
+	// Override the Content-Type and Content-Encoding headers the S3 backend
+	// sets on uploads (see DefaultS3ContentHeaders), keyed by file suffix;
+	// an empty value suppresses the header for that suffix.
+	S3ContentTypes map[string]string
+	S3ContentEncodings map[string]string
+	// Overrides the per-checkpoint file categories; nil means
+	// DefaultCategorySet().
+	Categories CategorySet
+	// When set, the archive uses the content-addressed layout (see
+	// ContentAddressedArchiveBackend), with its index under this name.
+	ContentIndex string
+	// Where the fs backend stages files before renaming them into place;
+	// empty means next to each file. It should be on the same filesystem
+	// as the archive, as a rename can't cross filesystems.
+	FsTempDir string
+	// When set, the gzipped categories' files use this registered codec
+	// (such as "zstd"; see RegisterCodec) instead, as does
+	// PutCategoryCheckpointXdr.
+	CategoryCodec string
+	// When set, every backend call is traced (see TracingBackend).
+	Tracer Tracer
+	// When set, files are stored under the keys this gives their paths
+	// (see KeyTransformBackend), for stores with key constraints.
+	KeyTransform KeyTransform
+	// When set, the backend's responses are recorded here (see
+	// RecordingBackend), for ReplayBackend to serve in a test.
+	Cassette io.Writer
+	// How gzipped files are read past their first member; the default is
+	// GzipConcatenate.
+	GzipTrailing GzipTrailing
+	// Overrides DefaultRootHASPath, for networks whose archives name their
+	// well-known file differently.
+	RootHASPath string
+	// When set, every HAS the archive reads is decoded with
+	// DecodeHASStrict, so one with fields this package doesn't know is an
+	// error rather than read as far as it's understood.
+	StrictHAS bool
+	// When set, GetRootHAS passes every root HAS it reads, and the raw
+	// bytes it was decoded from, to this, and returns its error rather
+	// than a HAS it rejects: a hook for checking a publisher's signature
+	// or provenance. Checkpoint HAS files aren't passed to it.
+	RootHASVerifier func(HistoryArchiveState, []byte) error
+	// When nonzero, a bucket larger than this is verified by fetching it
+	// in ranges of this many bytes, several at once ahead of the one being
+	// hashed, so the download overlaps decompressing and hashing, on
+	// backends that can read ranges (see RangeGetter).
+	VerifyChunkBytes int64
+	// When set, every write to the archive fails with ErrReadOnly (see
+	// ReadOnlyBackend), for inspecting an archive that mustn't change.
+	ReadOnly bool
 }
 
 type ArchiveBackend interface {
 	Exists(path string) bool
 	GetFile(path string) (io.ReadCloser, error)
+	GetFileSize(path string) (int64, error)
 	PutFile(path string, in io.ReadCloser) error
+	DeleteFile(path string) error
+	// Moves a file to a new path, replacing any file there. Atomic on the
+	// fs and mock backends; see the S3 backend's for its caveats.
+	RenameFile(from string, to string) error
+	// On a backend that can't list, sends ErrListingUnsupported on the
+	// error channel and no files, so a caller can't mistake it for an
+	// empty archive.
 	ListFiles(path string) (chan string, chan error)
 	CanListFiles() bool
 }
 
+var ErrListingUnsupported = errors.New("Backend can't list files")
+
+// A backend that can abandon a listing part-way: once done is closed it
+// stops producing (and, for a remote store, stops requesting pages) and
+// closes both channels. Backends that don't implement it have the rest of
+// an abandoned listing read and discarded instead.
+type UntilLister interface {
+	ListFilesUntil(path string, done <-chan struct{}) (chan string, chan error)
+}
+
+
+// Backends that can report when a file was last modified, and those that
+// can set it, as PreserveModTime needs.
+type ModTimeGetter interface {
+	GetFileModTime(path string) (time.Time, error)
+}
+
+type ModTimeSetter interface {
+	SetFileModTime(path string, t time.Time) error
+}
+
+// Backends that can read part of a file: length bytes from offset, which
+// must lie within it (fewer only if the file ends first).
+type RangeGetter interface {
+	GetFileRange(path string, offset int64, length int64) (io.ReadCloser, error)
+}
+
+// Backends that can hold uploads begun but never completed, which take up
+// space without showing up in ListFiles, as S3 multipart uploads do.
+type PartialUploader interface {
+	// Returns the path of each file with an incomplete upload.
+	ListPartialUploads() ([]string, error)
+	// Abandons every incomplete upload to path.
+	AbortPartialUploads(path string) error
+}
+
+// Backends that can copy a file from another backend without its bytes
+// passing through this process: an S3 server-side copy between buckets in
+// one region, or a kernel file-to-file copy between fs backends.
+// CopyFileFrom returns the number of bytes copied (0 if the store doesn't
+// say), or ErrDirectCopyUnsupported when src isn't a backend it can copy
+// from this way, for the caller to stream the file instead.
+type DirectCopier interface {
+	CopyFileFrom(src ArchiveBackend, path string) (int64, error)
+}
+
+var ErrDirectCopyUnsupported = errors.New("Backends can't copy directly between each other")
 
+// An Archive accumulates scan state (which checkpoint files and buckets
+// exist, which buckets are referenced, and verification results) in maps
+// guarded by mutex. Every method that touches that state takes the mutex
+// for the duration of the access only, never blocks on a channel or calls
+// back into the Archive while holding it, and never holds two Archives'
+// mutexes at once. So the Note*, Check*, Report*, Verify* and
+// ClearCachedInfo methods are all safe to call concurrently with a scan
+// (though Check* run mid-scan naturally see partial results).
 type Archive struct {
 	mutex sync.Mutex
 	checkpointFiles map[string](map[uint32]bool)
 	allBuckets map[Hash]bool
+	// When set, existing buckets are noted here instead of in allBuckets.
+	allBucketsBloom *bucketBloom
 	referencedBuckets map[Hash]bool
+	// Set once IngestListing has noted every bucket, so that ScanBuckets
+	// needn't list them again.
+	bucketsIngested bool
+	// Set once ScanBuckets has run to completion, with the range of
+	// checkpoints whose references it read, for UnreferencedBuckets.
+	bucketsScanned bool
+	bucketsScannedRange Range
+	// Files a scan with Verify found present but failing verification.
+	corruptCheckpointFiles map[string](map[uint32]bool)
+	corruptBuckets map[Hash]bool
 
 	expectLedgerHashes map[uint32]Hash
 	actualLedgerHashes map[uint32]Hash
@@ -63,6 +392,14 @@ type Archive struct {
 	invalidTxSets int
 	invalidTxResultSets int
 
+	listBufferSize int
+	categories CategorySet
+	rootHASPath string
+	gzipTrailing GzipTrailing
+	strictHAS bool
+	rootHASVerifier func(HistoryArchiveState, []byte) error
+	verifyChunkBytes int64
+
 	backend ArchiveBackend
 }
 
@@ -73,48 +410,110 @@ func (a *Archive) GetPathHAS(path string) (HistoryArchiveState, error) {
 		return has, err
 	}
 	defer rdr.Close()
-	dec := json.NewDecoder(rdr)
-	err = dec.Decode(&has)
-	return has, err
+	return decodeHAS(rdr, a.strictHAS)
 }
 
 func (a *Archive) PutPathHAS(path string, has HistoryArchiveState, opts *CommandOptions) error {
 	if a.backend.Exists(path) && !opts.Force {
-		log.Printf("skipping existing " + path)
+		logf("skipping existing " + path)
 		return nil
 	}
-	buf, err := json.MarshalIndent(has, "", "    ")
-	if err != nil {
+	var buf bytes.Buffer
+	if err := has.Encode(&buf); err != nil {
 		return err
 	}
 	return a.backend.PutFile(path,
-		ioutil.NopCloser(bytes.NewReader(buf)))
+		ioutil.NopCloser(bytes.NewReader(buf.Bytes())))
 }
 
 func (a *Archive) BucketExists(bucket Hash) bool {
 	return a.backend.Exists(BucketPath(bucket))
 }
 
+func (a *Archive) BucketSize(bucket Hash) (int64, error) {
+	return a.backend.GetFileSize(BucketPath(bucket))
+}
+
 func (a *Archive) CategoryCheckpointExists(cat string, chk uint32) bool {
-	return a.backend.Exists(CategoryCheckpointPath(cat, chk))
+	return a.backend.Exists(a.CategoryCheckpointPath(cat, chk))
+}
+
+// Returns the names of the checkpoint file categories this archive holds.
+func (a *Archive) Categories() []string {
+	return a.categories.Names()
+}
+
+func (a *Archive) CategoryCheckpointPath(cat string, chk uint32) string {
+	return a.categories.CheckpointPath(cat, chk)
+}
+
+func (a *Archive) CategoryPathForLedger(cat string, ledger uint32) string {
+	return a.CategoryCheckpointPath(cat, CheckpointContaining(ledger))
+}
+
+func (a *Archive) categoryRequired(cat string) bool {
+	return a.categories.Required(cat)
+}
+
+func (a *Archive) RootHASPath() string {
+	return a.rootHASPath
 }
 
 func (a *Archive) GetRootHAS() (HistoryArchiveState, error) {
-	return a.GetPathHAS(rootHASPath)
+	if a.rootHASVerifier == nil {
+		return a.GetPathHAS(a.rootHASPath)
+	}
+	var has HistoryArchiveState
+	rdr, err := a.backend.GetFile(a.rootHASPath)
+	if err != nil {
+		return has, err
+	}
+	defer rdr.Close()
+	raw, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return has, err
+	}
+	has, err = decodeHAS(bytes.NewReader(raw), a.strictHAS)
+	if err != nil {
+		return has, err
+	}
+	// A rejected HAS isn't returned, lest a caller ignoring the error
+	// act on it.
+	if err = a.rootHASVerifier(has, raw); err != nil {
+		return HistoryArchiveState{}, fmt.Errorf("Root HAS %s rejected: %s", a.rootHASPath, err)
+	}
+	return has, nil
+}
+
+// The category whose checkpoint files are the checkpoint HAS files.
+const hasCategory = "history"
+
+// Returns the path of chk's HAS-format file in cat. Only hasCategory holds
+// such files in a standard archive.
+func (a *Archive) checkpointHASPathIn(cat string, chk uint32) string {
+	return a.CategoryCheckpointPath(cat, chk)
+}
+
+// Returns the path of chk's HAS file, as GetCheckpointHAS reads it.
+func (a *Archive) CheckpointHASPath(chk uint32) string {
+	return a.checkpointHASPathIn(hasCategory, chk)
 }
 
 func (a *Archive) GetCheckpointHAS(chk uint32) (HistoryArchiveState, error) {
-	return a.GetPathHAS(CategoryCheckpointPath("history", chk))
+	return a.GetPathHAS(a.CheckpointHASPath(chk))
 }
 
 func (a *Archive) PutCheckpointHAS(chk uint32, has HistoryArchiveState, opts *CommandOptions) error {
-	return a.PutPathHAS(CategoryCheckpointPath("history", chk), has, opts)
+	return a.PutPathHAS(a.CheckpointHASPath(chk), has, opts)
 }
 
 func (a *Archive) PutRootHAS(has HistoryArchiveState, opts *CommandOptions) error {
+	if opts.OptimisticRootHAS {
+		return a.putRootHASOptimistic(has)
+	}
 	force := opts.Force
 	opts.Force = true
-	e := a.PutPathHAS(rootHASPath, has, opts)
+	e := a.PutPathHAS(a.rootHASPath, has, opts)
 	opts.Force = force
 	return e
 }
@@ -127,76 +526,303 @@ func (a *Archive) ListAllBuckets() (chan string, chan error) {
 	return a.backend.ListFiles("bucket")
 }
 
+// Lists pth, stopping once done is closed: natively if the backend is an
+// UntilLister, otherwise by discarding the rest of the listing.
+func (a *Archive) listFilesUntil(pth string, done <-chan struct{}) (chan string, chan error) {
+	return listFilesUntil(a.backend, pth, done)
+}
+
+func listFilesUntil(backend ArchiveBackend, pth string, done <-chan struct{}) (chan string, chan error) {
+	if l, ok := backend.(UntilLister); ok {
+		return l.ListFilesUntil(pth, done)
+	}
+	sch, errs := backend.ListFiles(pth)
+	if done == nil {
+		return sch, errs
+	}
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		for s := range sch {
+			select {
+			case ch <- s:
+			case <-done:
+				drainStrings(sch)
+				return
+			}
+		}
+	}()
+	return ch, errs
+}
+
+// Matches the path of a bucket file, capturing its hash.
+var bucketFileRx = regexp.MustCompile("bucket" + hexPrefixPat + "bucket-([0-9a-f]{64})\\.xdr\\.gz$")
+
+// Returns a regexp matching the path of a checkpoint file of cat, capturing
+// its checkpoint number in hex.
+func (a *Archive) categoryFileRx(cat string) *regexp.Regexp {
+	return regexp.MustCompile(cat + hexPrefixPat + cat +
+		"-([0-9a-f]{8})\\." + regexp.QuoteMeta(a.categories.Ext(cat)) + "$")
+}
+
+// Returns a channel of all bucket hashes in the archive. Equivalent to
+// ListAllBucketHashesUntil(nil).
 func (a *Archive) ListAllBucketHashes() (chan Hash, chan error) {
-	sch, errs := a.backend.ListFiles("bucket")
-	ch := make(chan Hash)
-	rx := regexp.MustCompile("bucket" + hexPrefixPat + "bucket-([0-9a-f]{64})\\.xdr\\.gz$")
+	return a.ListAllBucketHashesUntil(nil)
+}
+
+// Returns a channel of all bucket hashes in the archive, buffered to the
+// archive's list buffer size. If the consumer wants to stop early it should
+// close done; the producer then stops the backend listing and exits. The
+// error channel must still be drained.
+func (a *Archive) ListAllBucketHashesUntil(done <-chan struct{}) (chan Hash, chan error) {
+	var sch chan string
+	var errs chan error
+	if a.backend.CanListFiles() {
+		sch, errs = a.listFilesUntil("bucket", done)
+	} else {
+		sch, errs = unlistable()
+	}
+	ch := make(chan Hash, a.listBufferSize)
+	rx := bucketFileRx
 	errs = makeErrorPump(errs)
 	go func() {
+		defer close(ch)
 		for s := range sch {
 			m := rx.FindStringSubmatch(s)
 			if m != nil {
-				ch <- MustDecodeHash(m[1])
+				select {
+				case ch <- MustDecodeHash(m[1]):
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+	return ch, errs
+}
+
+// Returns a channel of at most n bucket hashes from the archive (none if n
+// isn't positive), stopping the backend listing once n have been produced.
+// Both channels must be drained.
+func (a *Archive) ListAllBucketHashesLimit(n int) (chan Hash, chan error) {
+	done := make(chan struct{})
+	hch, errs := a.ListAllBucketHashesUntil(done)
+	ch := make(chan Hash)
+	go func() {
+		defer close(ch)
+		for i := 0; i < n; i++ {
+			h, ok := <-hch
+			if !ok {
+				return
 			}
+			ch <- h
+		}
+		close(done)
+		for range hch {
 		}
-		close(ch)
 	}()
 	return ch, errs
 }
 
+// Returns a channel of checkpoint numbers present for a category under the
+// given path prefix. Equivalent to ListCategoryCheckpointsUntil(cat, pth, nil).
 func (a *Archive) ListCategoryCheckpoints(cat string, pth string) (chan uint32, chan error) {
-	ext := categoryExt(cat)
-	rx := regexp.MustCompile(cat + hexPrefixPat + cat +
-		"-([0-9a-f]{8})\\." + regexp.QuoteMeta(ext) + "$")
-	sch, errs := a.backend.ListFiles(path.Join(cat, pth))
-	ch := make(chan uint32)
-	errs = makeErrorPump(errs)
+	return a.ListCategoryCheckpointsUntil(cat, pth, nil)
+}
+
+// As ListCategoryCheckpoints, but stops producing (and stops the backend
+// listing) once done is closed. The error channel must still be drained.
+func (a *Archive) ListCategoryCheckpointsUntil(cat string, pth string, done <-chan struct{}) (chan uint32, chan error) {
+	rx := a.categoryFileRx(cat)
+	sch, errs := a.listFilesUntil(path.Join(cat, pth), done)
+	ch := make(chan uint32, a.listBufferSize)
+	// Decoding errors go through the pump too, so that reporting one never
+	// blocks the producer on a consumer that is still reading ch.
+	derrs := make(chan error)
+	errs = makeErrorPump(mergeErrors(errs, derrs))
 
 	go func() {
+		defer close(ch)
+		defer close(derrs)
 		for s := range sch {
 			m := rx.FindStringSubmatch(s)
 			if m != nil {
 				i, e := strconv.ParseUint(m[1], 16, 32)
 				if e == nil {
-					ch <- uint32(i)
+					select {
+					case ch <- uint32(i):
+					case <-done:
+						return
+					}
 				} else {
-					errs <- errors.New("decoding checkpoint number in filename " + s)
+					derrs <- errors.New("decoding checkpoint number in filename " + s)
 				}
 			}
 		}
-		close(ch)
 	}()
 	return ch, errs
 }
 
-func Connect(u string, opts *ConnectOptions) (*Archive, error) {
-	arch := Archive{
+// Constructs a backend for a URL whose scheme it was registered for.
+type BackendFactory func(u *url.URL, opts *ConnectOptions) (ArchiveBackend, error)
+
+var backendRegistryMutex sync.Mutex
+var backendRegistry = make(map[string]BackendFactory)
+
+// Teaches Connect to handle URLs with the given scheme. The built-in
+// schemes always take precedence. Like database/sql.Register, this panics
+// if factory is nil or the scheme is registered twice.
+func RegisterBackend(scheme string, factory BackendFactory) {
+	backendRegistryMutex.Lock()
+	defer backendRegistryMutex.Unlock()
+	if factory == nil {
+		panic("archivist: RegisterBackend factory is nil")
+	}
+	if _, dup := backendRegistry[scheme]; dup {
+		panic("archivist: RegisterBackend called twice for scheme " + scheme)
+	}
+	backendRegistry[scheme] = factory
+}
+
+func registeredBackend(scheme string) BackendFactory {
+	backendRegistryMutex.Lock()
+	defer backendRegistryMutex.Unlock()
+	return backendRegistry[scheme]
+}
+
+var defaultConnectMutex sync.RWMutex
+var defaultConnectOptions *ConnectOptions
+
+// Sets options that every later Connect and ConnectBackend inherits: each
+// field the caller leaves at its zero value takes the default's, and every
+// other field is the caller's. Since zero means unset, a field can't be
+// set back to its zero value over a default (though an empty, non-nil map
+// does replace a default map). nil clears the defaults.
+func SetDefaultConnectOptions(opts *ConnectOptions) {
+	defaultConnectMutex.Lock()
+	defer defaultConnectMutex.Unlock()
+	if opts == nil {
+		defaultConnectOptions = nil
+		return
+	}
+	defaults := *opts
+	defaultConnectOptions = &defaults
+}
+
+// Returns a copy of opts, which may be nil, with the defaults filled in.
+func withDefaultConnectOptions(opts *ConnectOptions) *ConnectOptions {
+	merged := new(ConnectOptions)
+	if opts != nil {
+		*merged = *opts
+	}
+	defaultConnectMutex.RLock()
+	defaults := defaultConnectOptions
+	defaultConnectMutex.RUnlock()
+	if defaults == nil {
+		return merged
+	}
+	dst := reflect.ValueOf(merged).Elem()
+	src := reflect.ValueOf(defaults).Elem()
+	for i := 0; i < dst.NumField(); i++ {
+		f := dst.Field(i)
+		if reflect.DeepEqual(f.Interface(), reflect.Zero(f.Type()).Interface()) {
+			f.Set(src.Field(i))
+		}
+	}
+	return merged
+}
+
+// Wraps backend in the layers opts asks for, ReadOnly outermost so that
+// nothing beneath it is written.
+func wrapBackend(backend ArchiveBackend, opts *ConnectOptions) ArchiveBackend {
+	if opts.KeyTransform != nil {
+		backend = KeyTransformBackend(backend, opts.KeyTransform)
+	}
+	if opts.ContentIndex != "" {
+		backend = ContentAddressedBackend(backend, opts.ContentIndex)
+	}
+	if opts.Cassette != nil {
+		backend = RecordingBackend(backend, opts.Cassette)
+	}
+	if opts.Tracer != nil {
+		backend = TracingBackend(backend, opts.Tracer)
+	}
+	if opts.ReadOnly {
+		backend = ReadOnlyBackend(backend)
+	}
+	return backend
+}
+
+// Returns a fully-initialized Archive over an already-constructed backend,
+// wrapped as opts asks (made read-only, traced, and so on) as Connect's
+// are. This is how embedders use an ArchiveBackend of their own.
+func ConnectBackend(backend ArchiveBackend, opts *ConnectOptions) *Archive {
+	opts = withDefaultConnectOptions(opts)
+	// Connect passes nil, and wraps the backend once it's made one.
+	if backend != nil {
+		backend = wrapBackend(backend, opts)
+	}
+	arch := &Archive{
 		checkpointFiles:make(map[string](map[uint32]bool)),
 		allBuckets:make(map[Hash]bool),
 		referencedBuckets:make(map[Hash]bool),
+		corruptCheckpointFiles:make(map[string](map[uint32]bool)),
+		corruptBuckets:make(map[Hash]bool),
 		expectLedgerHashes:make(map[uint32]Hash),
 		actualLedgerHashes:make(map[uint32]Hash),
 		expectTxSetHashes:make(map[uint32]Hash),
 		actualTxSetHashes:make(map[uint32]Hash),
 		expectTxResultSetHashes:make(map[uint32]Hash),
 		actualTxResultSetHashes:make(map[uint32]Hash),
+		backend:backend,
 	}
-	if opts == nil {
-		opts = new(ConnectOptions)
+	if opts.ListBufferSize == 0 {
+		arch.listBufferSize = DefaultListBufferSize
+	} else if opts.ListBufferSize > 0 {
+		arch.listBufferSize = opts.ListBufferSize
+	}
+	arch.gzipTrailing = opts.GzipTrailing
+	arch.strictHAS = opts.StrictHAS
+	arch.rootHASVerifier = opts.RootHASVerifier
+	arch.verifyChunkBytes = opts.VerifyChunkBytes
+	arch.rootHASPath = opts.RootHASPath
+	if arch.rootHASPath == "" {
+		arch.rootHASPath = DefaultRootHASPath
 	}
-	for _, cat := range Categories() {
+	arch.categories = opts.Categories
+	if arch.categories == nil {
+		arch.categories = DefaultCategorySet()
+	}
+	if opts.CategoryCodec != "" {
+		cs, err := arch.categories.WithCodec(opts.CategoryCodec)
+		if err != nil {
+			logf("Error: %s; using gzip", err)
+		}
+		arch.categories = cs
+	}
+	for _, cat := range arch.Categories() {
 		arch.checkpointFiles[cat] = make(map[uint32]bool)
 	}
+	return arch
+}
+
+func Connect(u string, opts *ConnectOptions) (*Archive, error) {
+	opts = withDefaultConnectOptions(opts)
+	arch := ConnectBackend(nil, opts)
+	if opts.CategoryCodec != "" {
+		if c, ok := lookupCodec(opts.CategoryCodec); !ok {
+			return arch, errors.New("unknown codec: '" + opts.CategoryCodec + "'")
+		} else if c.NewWriter == nil {
+			return arch, errors.New("codec can only be read: '" + opts.CategoryCodec + "'")
+		}
+	}
 	parsed, err := url.Parse(u)
 	if err != nil {
-		return &arch, err
+		return arch, err
 	}
 	pth := parsed.Path
 	if parsed.Scheme == "s3" {
-		// Inside s3, all paths start _without_ the leading /
-		if len(pth) > 0 && pth[0] == '/' {
-			pth = pth[1:]
-		}
 		arch.backend = MakeS3Backend(parsed.Host, pth, opts)
 	} else if parsed.Scheme == "file" {
 		pth = path.Join(parsed.Host, pth)
@@ -205,16 +831,26 @@ func Connect(u string, opts *ConnectOptions) (*Archive, error) {
 		arch.backend = MakeHttpBackend(parsed, opts)
 	} else if parsed.Scheme == "mock" {
 		arch.backend = MakeMockBackend(opts)
+	} else if parsed.Scheme == "image" {
+		arch.backend, err = MakeImageBackend(path.Join(parsed.Host, pth))
+	} else if parsed.Scheme == "grpc" || parsed.Scheme == "grpcs" {
+		arch.backend, err = MakeGRPCBackend(parsed, opts)
+	} else if factory := registeredBackend(parsed.Scheme); factory != nil {
+		arch.backend, err = factory(parsed, opts)
 	} else {
 		err = errors.New("unknown URL scheme: '" + parsed.Scheme + "'")
 	}
-	return &arch, err
+	if err == nil {
+		arch.backend = wrapBackend(arch.backend, opts)
+	}
+	return arch, err
 }
 
 func MustConnect(u string, opts *ConnectOptions) *Archive {
 	arch, err := Connect(u, opts)
 	if err != nil {
-		log.Fatal(err)
+		logf("%s", err)
+		os.Exit(1)
 	}
 	return arch
 }
@@ -13,6 +13,15 @@ import (
 	"io/ioutil"
 	"os"
 	"math/big"
+	"encoding/json"
+	"net/url"
+	"io"
+	"strings"
+	"time"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"compress/gzip"
 	"github.com/stretchr/testify/assert"
 	"github.com/stellar/go-stellar-base/xdr"
 )
@@ -90,7 +99,7 @@ func (arch *Archive) AddRandomCheckpoint(chk uint32) error {
 	opts := &CommandOptions{Force:true}
 	for _, cat := range Categories() {
 		if cat == "history" {
-			var has HistoryArchiveState
+			has := NewHAS()
 			has.CurrentLedger = chk
 			for i := 0; i < NumLevels; i++ {
 				curr, e := arch.AddRandomBucket()
@@ -147,6 +156,727 @@ func TestScan(t *testing.T) {
 	GetRandomPopulatedArchive().Scan(opts)
 }
 
+func TestConnectBackend(t *testing.T) {
+	defer cleanup()
+	src := GetRandomPopulatedArchive()
+	dst := ConnectBackend(MakeMockBackend(nil), nil)
+	opts := testOptions()
+	assert.Nil(t, Mirror(src, dst, opts))
+	assert.Equal(t, 0, countMissing(dst, opts))
+}
+
+func TestFsTempDir(t *testing.T) {
+	defer cleanup()
+	stage, e := ioutil.TempDir("/tmp", "archivist-stage")
+	assert.NoError(t, e)
+	tmpdirs = append(tmpdirs, stage)
+	d, e := ioutil.TempDir("/tmp", "archivist")
+	assert.NoError(t, e)
+	tmpdirs = append(tmpdirs, d)
+
+	for _, opts := range []*ConnectOptions{nil, &ConnectOptions{FsTempDir: stage}} {
+		b := MakeFsBackend(d, opts)
+		pth := CategoryCheckpointPath("ledger", 0x7f)
+		assert.Nil(t, b.PutFile(pth, ioutil.NopCloser(strings.NewReader("data"))))
+		rdr, e := b.GetFile(pth)
+		assert.NoError(t, e)
+		buf, _ := ioutil.ReadAll(rdr)
+		rdr.Close()
+		assert.Equal(t, "data", string(buf))
+		assert.Equal(t, 1, countFilesUnder(b, "ledger"))
+		staged, _ := ioutil.ReadDir(stage)
+		assert.Empty(t, staged)
+	}
+}
+
+func TestFsListChunks(t *testing.T) {
+	defer cleanup()
+	b := GetTestFileArchive().backend
+	n := fsListChunk * 2 + 5
+	for i := 0; i < n; i++ {
+		pth := fmt.Sprintf("big/%d", i)
+		assert.Nil(t, b.PutFile(pth, ioutil.NopCloser(strings.NewReader("x"))))
+	}
+	assert.Nil(t, b.PutFile("big/sub/file", ioutil.NopCloser(strings.NewReader("x"))))
+	assert.Equal(t, n + 1, countFilesUnder(b, "big"))
+	assert.Equal(t, 1, countFilesUnder(b, "big/sub/file"))
+	assert.Equal(t, 0, countFilesUnder(b, "none"))
+}
+
+func TestMirrorPreserveModTime(t *testing.T) {
+	defer cleanup()
+	src := GetTestFileArchive()
+	assert.Nil(t, src.PopulateRandomRange(testRange()))
+	pth := CategoryCheckpointPath("ledger", 0x7f)
+	then := time.Date(2015, 9, 30, 0, 0, 0, 0, time.UTC)
+	assert.Nil(t, src.backend.(ModTimeSetter).SetFileModTime(pth, then))
+
+	dst := GetTestFileArchive()
+	opts := testOptions()
+	opts.PreserveModTime = true
+	assert.Nil(t, Mirror(src, dst, opts))
+	mtime, e := dst.backend.(ModTimeGetter).GetFileModTime(pth)
+	assert.NoError(t, e)
+	assert.True(t, then.Equal(mtime))
+
+	// Without the option, the copy is stamped with the time of copying.
+	dst = GetTestFileArchive()
+	assert.Nil(t, Mirror(src, dst, testOptions()))
+	mtime, _ = dst.backend.(ModTimeGetter).GetFileModTime(pth)
+	assert.True(t, mtime.After(then))
+}
+
+func TestDirectCopy(t *testing.T) {
+	defer cleanup()
+	src := GetTestFileArchive()
+	assert.Nil(t, src.PopulateRandomRange(testRange()))
+	pth := CategoryCheckpointPath("ledger", 0x7f)
+	size, _ := src.backend.GetFileSize(pth)
+	for _, dst := range []*Archive{GetTestFileArchive(), GetTestMockArchive()} {
+		opts := testOptions()
+		opts.stats = &opStats{}
+		assert.Nil(t, copyPath(src, dst, pth, opts))
+		assert.True(t, dst.backend.Exists(pth))
+		assert.Equal(t, size, opts.stats.bytesCopied)
+		_, direct := dst.backend.(*FsArchiveBackend)
+		assert.Equal(t, direct, opts.stats.filesCopiedDirect == 1)
+	}
+
+	// A file to transform has to be read.
+	dst := GetTestFileArchive()
+	opts := testOptions()
+	opts.stats = &opStats{}
+	opts.HASTransform = func(has HistoryArchiveState) HistoryArchiveState { return has }
+	assert.Nil(t, copyPath(src, dst, CategoryCheckpointPath("history", 0x7f), opts))
+	assert.Equal(t, uint32(0), opts.stats.filesCopiedDirect)
+}
+
+func TestReadThroughBackend(t *testing.T) {
+	defer cleanup()
+	upstream := GetRandomPopulatedArchive()
+	local := MakeMockBackend(nil)
+	arch := ConnectBackend(ReadThroughBackend(local, upstream.backend), nil)
+	pth := CategoryCheckpointPath("history", 0x7f)
+	assert.False(t, local.Exists(pth))
+	has, e := arch.GetCheckpointHAS(0x7f)
+	assert.NoError(t, e)
+	assert.Equal(t, uint32(0x7f), has.CurrentLedger)
+	assert.True(t, local.Exists(pth))
+
+	opts := testOptions()
+	assert.Nil(t, arch.Scan(opts))
+	assert.Equal(t, 0, countMissing(arch, opts))
+}
+
+func countFilesUnder(backend ArchiveBackend, pth string) int {
+	n := 0
+	ch, errs := backend.ListFiles(pth)
+	for _ = range ch {
+		n++
+	}
+	drainErrors(errs)
+	return n
+}
+
+func TestMirrorContentAddressed(t *testing.T) {
+	defer cleanup()
+	src := GetRandomPopulatedArchive()
+	store := MakeMockBackend(nil)
+	dst := ConnectBackend(ContentAddressedBackend(store, "net1"), nil)
+	opts := testOptions()
+	assert.Nil(t, Mirror(src, dst, opts))
+	assert.Nil(t, dst.Scan(opts))
+	assert.Equal(t, 0, countMissing(dst, opts))
+	assert.False(t, store.Exists(CategoryCheckpointPath("history", 0x7f)))
+	assert.True(t, store.Exists("index/net1/" + CategoryCheckpointPath("history", 0x7f)))
+
+	srcRoot, _ := src.GetRootHAS()
+	dstRoot, e := dst.GetRootHAS()
+	assert.NoError(t, e)
+	assert.Equal(t, srcRoot.CurrentLedger, dstRoot.CurrentLedger)
+
+	// A second index over the same files adds no new content.
+	stored := countFilesUnder(store, "content")
+	dst2 := ConnectBackend(ContentAddressedBackend(store, "net2"), nil)
+	assert.Nil(t, Mirror(src, dst2, testOptions()))
+	assert.Equal(t, stored, countFilesUnder(store, "content"))
+	assert.Nil(t, dst2.Scan(opts))
+	assert.Equal(t, 0, countMissing(dst2, opts))
+}
+
+func TestCustomCategorySet(t *testing.T) {
+	cats := append(DefaultCategorySet(), Category{Name:"extra", Ext:"bin", Required:true})
+	arch := MustConnect("mock://test", &ConnectOptions{Categories:cats})
+	arch.PopulateRandomRange(testRange())
+	pth := arch.CategoryCheckpointPath("extra", 0x7f)
+	assert.Equal(t, "extra/00/00/00/extra-0000007f.bin", pth)
+	arch.backend.PutFile(pth, ioutil.NopCloser(bytes.NewReader([]byte("x"))))
+	opts := testOptions()
+	arch.Scan(opts)
+	missing := arch.CheckCheckpointFilesMissing(opts)
+	assert.Equal(t, 0, len(missing["ledger"]))
+	assert.Equal(t, opts.Range.Size() - 1, len(missing["extra"]))
+	assert.NotContains(t, missing["extra"], uint32(0x7f))
+}
+
+func TestRegisterBackend(t *testing.T) {
+	var seen string
+	RegisterBackend("testscheme", func(u *url.URL, opts *ConnectOptions) (ArchiveBackend, error) {
+		seen = u.Host
+		return MakeMockBackend(opts), nil
+	})
+	arch, err := Connect("testscheme://somewhere/archive", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "somewhere", seen)
+	assert.Nil(t, arch.AddRandomCheckpoint(0x3f))
+	assert.True(t, arch.CategoryCheckpointExists("history", 0x3f))
+	assert.Panics(t, func() {
+		RegisterBackend("testscheme", nil)
+	})
+	_, err = Connect("unregistered://somewhere", nil)
+	assert.NotNil(t, err)
+}
+
+func TestListAllBucketHashesEarlyStop(t *testing.T) {
+	arch := MustConnect("mock://test", &ConnectOptions{ListBufferSize:-1})
+	arch.PopulateRandomRange(testRange())
+	done := make(chan struct{})
+	ch, errs := arch.ListAllBucketHashesUntil(done)
+	<-ch
+	close(done)
+	assert.Equal(t, uint32(0), drainErrors(errs))
+	n := 0
+	for range ch {
+		n++
+	}
+	assert.True(t, n <= 1)
+}
+
+func TestListAllBucketHashesLimit(t *testing.T) {
+	defer cleanup()
+	arch := GetRandomPopulatedArchive()
+	count := func(n int) int {
+		ch, errs := arch.ListAllBucketHashesLimit(n)
+		k := 0
+		for range ch {
+			k++
+		}
+		assert.Equal(t, uint32(0), drainErrors(errs))
+		return k
+	}
+	assert.Equal(t, 5, count(5))
+	assert.Equal(t, 0, count(0))
+	assert.Equal(t, 15 * 3 * NumLevels, count(1000000))
+}
+
+func TestListFilesUntilStops(t *testing.T) {
+	defer cleanup()
+	for _, arch := range []*Archive{GetTestMockArchive(), GetTestFileArchive()} {
+		arch.PopulateRandomRange(testRange())
+		l := arch.backend.(UntilLister)
+		done := make(chan struct{})
+		ch, errs := l.ListFilesUntil("bucket", done)
+		<-ch
+		close(done)
+		n := 0
+		for range ch {
+			n++
+		}
+		assert.True(t, n <= 1)
+		assert.Equal(t, uint32(0), drainErrors(errs))
+	}
+}
+
+func TestListingUnsupported(t *testing.T) {
+	u, _ := url.Parse("http://localhost:1/archive")
+	arch := ConnectBackend(MakeHttpBackend(u, nil), nil)
+	ch, errs := arch.backend.ListFiles("bucket")
+	for range ch {
+		t.Error("listed a file over HTTP")
+	}
+	assert.Equal(t, ErrListingUnsupported, <-errs)
+
+	hashes, errs := arch.ListAllBucketHashes()
+	for range hashes {
+		t.Error("listed a bucket over HTTP")
+	}
+	assert.Equal(t, ErrListingUnsupported, <-errs)
+	assert.Equal(t, ErrListingUnsupported, arch.ScanCheckpointsFast(testOptions()))
+}
+
+func TestCountObjects(t *testing.T) {
+	defer cleanup()
+	arch := GetRandomPopulatedArchive()
+	buckets, checkpoints, e := arch.CountObjects()
+	assert.NoError(t, e)
+	assert.Equal(t, 15 * 3 * NumLevels, buckets)
+	assert.Equal(t, 15 * len(arch.Categories()), checkpoints)
+}
+
+func TestScanPrefixDepth(t *testing.T) {
+	defer cleanup()
+	arch := GetRandomPopulatedArchive()
+	for depth := 1; depth <= 3; depth++ {
+		opts := testOptions()
+		opts.ListPrefixDepth = depth
+		arch.ClearCachedInfo()
+		assert.Equal(t, 0, countMissing(arch, opts))
+	}
+}
+
+// Run under -race to check the scan-state locking.
+func TestConcurrentScansAndChecks(t *testing.T) {
+	defer cleanup()
+	arch := GetRandomPopulatedArchive()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			arch.Scan(testOptions())
+			wg.Done()
+		}()
+		go func() {
+			opts := testOptions()
+			for j := 0; j < 10; j++ {
+				arch.CheckCheckpointFilesMissing(opts)
+				arch.CheckBucketsMissing()
+				arch.MissingRanges(opts.Range)
+				arch.ReportCheckpointStats()
+				arch.ClearCachedInfo()
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	arch.ClearCachedInfo()
+	assert.Equal(t, 0, countMissing(arch, testOptions()))
+}
+
+func TestSlowScanFindsMissing(t *testing.T) {
+	defer cleanup()
+	arch := GetRandomPopulatedArchive()
+	opts := testOptions()
+	opts.Range = opts.Range.Clamp(Range{Low:63, High:0x37f})
+	assert.Nil(t, arch.ScanCheckpointsSlow(opts))
+	assert.Equal(t, 0, len(arch.CheckCheckpointFilesMissing(opts)["ledger"]))
+	arch.ClearCachedInfo()
+	opts.Range = MakeRange(0, 0x4ff)
+	arch.ScanCheckpointsSlow(opts)
+	assert.Equal(t, 5, len(arch.CheckCheckpointFilesMissing(opts)["ledger"]))
+}
+
+func TestScanHASPrefetch(t *testing.T) {
+	defer cleanup()
+	arch := GetRandomPopulatedArchive()
+	has, _ := arch.GetCheckpointHAS(0x7f)
+	gone := MustDecodeHash(has.CurrentBuckets[2].Curr)
+	arch.backend.DeleteFile(BucketPath(gone))
+	opts := testOptions()
+	opts.HASPrefetch = 4
+	assert.Nil(t, arch.Scan(opts))
+	assert.Equal(t, 15 * 3 * NumLevels, len(arch.referencedBuckets))
+	assert.Equal(t, map[Hash]bool{gone:true}, arch.CheckBucketsMissing())
+}
+
+// A backend counting the checkpoint HAS files read from it.
+type hasCountingBackend struct {
+	ArchiveBackend
+	reads int32
+}
+
+func (b *hasCountingBackend) GetFile(pth string) (io.ReadCloser, error) {
+	if strings.HasPrefix(pth, "history/") {
+		atomic.AddInt32(&b.reads, 1)
+	}
+	return b.ArchiveBackend.GetFile(pth)
+}
+
+func TestScanHASPrefetchBadBucketSet(t *testing.T) {
+	defer cleanup()
+	dir, e := ioutil.TempDir("/tmp", "archivist")
+	assert.Nil(t, e)
+	tmpdirs = append(tmpdirs, dir)
+	setFile := dir + "/buckets.txt"
+	assert.Nil(t, ioutil.WriteFile(setFile, []byte("not a hash\n"), 0644))
+
+	counting := &hasCountingBackend{ArchiveBackend: GetRandomPopulatedArchive().backend}
+	arch := ConnectBackend(counting, nil)
+	opts := testOptions()
+	assert.Nil(t, arch.ScanCheckpoints(opts))
+	opts.HASPrefetch = 4
+	opts.BucketSetFile = setFile
+	assert.Error(t, arch.ScanBuckets(opts))
+	// No prefetch was started, to be left blocked on a channel no one
+	// reads.
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&counting.reads))
+}
+
+func TestScanBucketBloom(t *testing.T) {
+	defer cleanup()
+	arch := GetRandomPopulatedArchive()
+	has, _ := arch.GetCheckpointHAS(0x7f)
+	gone := MustDecodeHash(has.CurrentBuckets[3].Snap)
+	arch.backend.DeleteFile(BucketPath(gone))
+	opts := testOptions()
+	opts.BucketBloomBits = 1 << 16
+	arch.Scan(opts)
+	assert.Equal(t, 0, len(arch.allBuckets))
+	assert.Equal(t, map[Hash]bool{gone:true}, arch.CheckBucketsMissing())
+
+	_, err := arch.UnreferencedBuckets(testRange())
+	assert.Error(t, err)
+
+	// A filter this small holds every bucket, missing or not; the missing
+	// one is still found.
+	arch.ClearCachedInfo()
+	opts = testOptions()
+	opts.BucketBloomBits = 8
+	arch.Scan(opts)
+	assert.True(t, arch.allBucketsBloom.Has(gone))
+	assert.Equal(t, map[Hash]bool{gone:true}, arch.CheckBucketsMissing())
+	assert.Equal(t, map[Hash]bool{gone:true}, arch.CheckBucketsMissing())
+}
+
+func TestUnreferencedBuckets(t *testing.T) {
+	defer cleanup()
+	arch := GetRandomPopulatedArchive()
+	extra, err := arch.AddRandomBucket()
+	assert.NoError(t, err)
+	_, err = arch.UnreferencedBuckets(testRange())
+	assert.Error(t, err)
+	opts := testOptions()
+	opts.Range = Range{Low:0xff, High:0x2ff}
+	assert.NoError(t, arch.Scan(opts))
+	// Checkpoints outside the scan can't be vouched for.
+	_, err = arch.UnreferencedBuckets(testRange())
+	assert.Error(t, err)
+	_, err = arch.UnreferencedBuckets(Range{Low:0x1ff, High:0x3bf})
+	assert.Error(t, err)
+	_, err = arch.UnreferencedBuckets(Range{Low:0x1ff, High:0x27f})
+	assert.NoError(t, err)
+
+	arch.ClearCachedInfo()
+	assert.NoError(t, arch.Scan(testOptions()))
+	unreferenced, err := arch.UnreferencedBuckets(testRange())
+	assert.NoError(t, err)
+	assert.Equal(t, map[Hash]bool{extra:true}, unreferenced)
+
+	// Narrowed to one checkpoint, every other checkpoint's buckets are
+	// dead weight too.
+	has, _ := arch.GetCheckpointHAS(0x7f)
+	unreferenced, err = arch.UnreferencedBuckets(Range{Low:0x7f, High:0x7f})
+	assert.NoError(t, err)
+	assert.True(t, unreferenced[extra])
+	for _, bucket := range has.Buckets() {
+		assert.False(t, unreferenced[bucket])
+	}
+	assert.Equal(t, len(arch.allBuckets) - len(has.Buckets()), len(unreferenced))
+}
+
+type bucketListCountingBackend struct {
+	ArchiveBackend
+	bucketLists int32
+}
+
+func (b *bucketListCountingBackend) ListFiles(pth string) (chan string, chan error) {
+	if strings.HasPrefix(pth, "bucket") {
+		atomic.AddInt32(&b.bucketLists, 1)
+	}
+	return b.ArchiveBackend.ListFiles(pth)
+}
+
+func TestScanBucketSetFile(t *testing.T) {
+	defer cleanup()
+	dir, e := ioutil.TempDir("/tmp", "archivist")
+	assert.Nil(t, e)
+	tmpdirs = append(tmpdirs, dir)
+	setFile := dir + "/buckets.txt"
+
+	arch := GetRandomPopulatedArchive()
+	has, _ := arch.GetCheckpointHAS(0x7f)
+	gone := MustDecodeHash(has.CurrentBuckets[1].Curr)
+	rdr, e := arch.backend.GetFile(BucketPath(gone))
+	assert.Nil(t, e)
+	content, _ := ioutil.ReadAll(rdr)
+	rdr.Close()
+	arch.backend.DeleteFile(BucketPath(gone))
+
+	opts := testOptions()
+	opts.BucketSetFile = setFile
+	assert.Nil(t, arch.Scan(opts))
+	assert.Equal(t, map[Hash]bool{gone:true}, arch.CheckBucketsMissing())
+	saved, e := ioutil.ReadFile(setFile)
+	assert.Nil(t, e)
+	assert.Equal(t, 15 * 3 * NumLevels - 1, strings.Count(string(saved), "\n"))
+
+	// With the set saved, a rescan lists no buckets, and finds the one
+	// restored since by checking it alone.
+	arch.backend.PutFile(BucketPath(gone), ioutil.NopCloser(bytes.NewReader(content)))
+	counting := &bucketListCountingBackend{ArchiveBackend: arch.backend}
+	again := ConnectBackend(counting, nil)
+	assert.Nil(t, again.Scan(opts))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&counting.bucketLists))
+	assert.Empty(t, again.CheckBucketsMissing())
+	saved, _ = ioutil.ReadFile(setFile)
+	assert.Equal(t, 15 * 3 * NumLevels, strings.Count(string(saved), "\n"))
+
+	opts.BucketBloomBits = 1 << 16
+	assert.Error(t, again.ScanBuckets(opts))
+}
+
+func TestIngestListing(t *testing.T) {
+	arch := GetRandomPopulatedArchive()
+	var listing []string
+	for _, dir := range append(arch.Categories(), "bucket") {
+		ch, es := arch.backend.ListFiles(dir)
+		for pth := range ch {
+			listing = append(listing, pth)
+		}
+		assert.Equal(t, uint32(0), drainErrors(es))
+	}
+	has, _ := arch.GetCheckpointHAS(0x7f)
+	gone := MustDecodeHash(has.CurrentBuckets[0].Curr)
+	paths := make(chan string)
+	go func() {
+		paths <- "README"
+		paths <- "bucket/00/00/00/not-a-bucket.xdr.gz"
+		for _, pth := range listing {
+			// Listings may carry the backend's prefix.
+			if strings.HasSuffix(pth, BucketPath(gone)) ||
+				strings.HasSuffix(pth, CategoryCheckpointPath("ledger", 0xff)) {
+				continue
+			}
+			paths <- pth
+		}
+		close(paths)
+	}()
+
+	counting := &bucketListCountingBackend{ArchiveBackend: arch.backend}
+	again := ConnectBackend(counting, nil)
+	assert.Nil(t, again.IngestListing(paths))
+	opts := testOptions()
+	missing := again.CheckCheckpointFilesMissing(opts)
+	assert.Equal(t, []uint32{0xff}, missing["ledger"])
+	assert.Empty(t, missing["history"])
+
+	// Buckets come from the listing; only the HAS files are read.
+	assert.Nil(t, again.ScanBuckets(opts))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&counting.bucketLists))
+	assert.Equal(t, map[Hash]bool{gone:true}, again.CheckBucketsMissing())
+
+	// Until the state is cleared.
+	again.ClearCachedInfo()
+	assert.Nil(t, again.Scan(opts))
+	assert.NotEqual(t, int32(0), atomic.LoadInt32(&counting.bucketLists))
+	assert.Empty(t, again.CheckBucketsMissing())
+}
+
+// Tracks the most bucket reads open at once.
+type bucketReadTrackingBackend struct {
+	ArchiveBackend
+	open int32
+	peak int32
+}
+
+type trackedReader struct {
+	io.ReadCloser
+	b *bucketReadTrackingBackend
+}
+
+func (r trackedReader) Close() error {
+	atomic.AddInt32(&r.b.open, -1)
+	return r.ReadCloser.Close()
+}
+
+func (b *bucketReadTrackingBackend) GetFile(pth string) (io.ReadCloser, error) {
+	rdr, err := b.ArchiveBackend.GetFile(pth)
+	if err != nil || !strings.HasPrefix(pth, "bucket/") {
+		return rdr, err
+	}
+	n := atomic.AddInt32(&b.open, 1)
+	for {
+		peak := atomic.LoadInt32(&b.peak)
+		if n <= peak || atomic.CompareAndSwapInt32(&b.peak, peak, n) {
+			break
+		}
+	}
+	time.Sleep(time.Millisecond)
+	return trackedReader{rdr, b}, nil
+}
+
+func TestScanVerifyConcurrency(t *testing.T) {
+	src := GetRandomPopulatedArchive()
+	tracking := &bucketReadTrackingBackend{ArchiveBackend: src.backend}
+	arch := ConnectBackend(tracking, nil)
+	opts := testOptions()
+	opts.Verify = true
+	opts.VerifyConcurrency = 2
+	// The random buckets aren't gzipped, so every one fails to verify.
+	assert.Error(t, arch.Scan(opts))
+	assert.True(t, atomic.LoadInt32(&tracking.peak) > 0)
+	assert.True(t, atomic.LoadInt32(&tracking.peak) <= 2)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&tracking.open))
+}
+
+func TestScanDeadline(t *testing.T) {
+	defer cleanup()
+	src := GetRandomPopulatedArchive()
+
+	opts := testOptions()
+	opts.Deadline = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	assert.Equal(t, ErrScanIncomplete, src.Scan(opts))
+	assert.NotEqual(t, 0, countMissing(src, opts))
+
+	// The deadline is taken afresh by each scan.
+	src.ClearCachedInfo()
+	opts.Deadline = time.Hour
+	assert.Nil(t, src.Scan(opts))
+	assert.Equal(t, 0, countMissing(src, opts))
+	src.ClearCachedInfo()
+	assert.Nil(t, src.ScanCheckpoints(opts))
+}
+
+// A backend whose listings produce a file every 5ms.
+type slowListingBackend struct {
+	ArchiveBackend
+}
+
+func (b *slowListingBackend) ListFiles(pth string) (chan string, chan error) {
+	return b.ListFilesUntil(pth, nil)
+}
+
+func (b *slowListingBackend) ListFilesUntil(pth string, done <-chan struct{}) (chan string, chan error) {
+	sch, errs := listFilesUntil(b.ArchiveBackend, pth, done)
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		for s := range sch {
+			time.Sleep(5 * time.Millisecond)
+			select {
+			case ch <- s:
+			case <-done:
+				drainStrings(sch)
+				return
+			}
+		}
+	}()
+	return ch, errs
+}
+
+func TestScanDeadlineStopsListing(t *testing.T) {
+	defer cleanup()
+	src := GetRandomPopulatedArchive()
+	slow := ConnectBackend(&slowListingBackend{src.backend}, nil)
+	opts := testOptions()
+	opts.Deadline = 100 * time.Millisecond
+	start := time.Now()
+	// Listing all the buckets alone would take seconds.
+	assert.Equal(t, ErrScanIncomplete, slow.Scan(opts))
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+// A backend taking 200ms to serve each checkpoint's HAS.
+type slowHASBackend struct {
+	ArchiveBackend
+}
+
+func (b *slowHASBackend) GetFile(pth string) (io.ReadCloser, error) {
+	if strings.HasPrefix(pth, "history/") {
+		time.Sleep(200 * time.Millisecond)
+	}
+	return b.ArchiveBackend.GetFile(pth)
+}
+
+func TestScanDeadlineStopsHASPrefetch(t *testing.T) {
+	defer cleanup()
+	src := GetRandomPopulatedArchive()
+	slow := ConnectBackend(&slowHASBackend{src.backend}, nil)
+	opts := testOptions()
+	opts.Concurrency = 2
+	opts.HASPrefetch = 4
+	opts.Deadline = 100 * time.Millisecond
+	start := time.Now()
+	// Fetching every HAS would take over a second.
+	assert.Equal(t, ErrScanIncomplete, slow.Scan(opts))
+	assert.True(t, time.Since(start) < 800 * time.Millisecond)
+}
+
+func TestVerifyStreaming(t *testing.T) {
+	arch := GetTestMockArchive()
+	opts := &CommandOptions{Force:true}
+
+	buf := make([]byte, 1024)
+	rand.Read(buf)
+	good := Hash(sha256.Sum256(buf))
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(buf)
+	w.Close()
+	arch.backend.PutFile(BucketPath(good), ioutil.NopCloser(&gz))
+	bad, _ := arch.AddRandomBucket()
+
+	has := NewHAS()
+	has.CurrentBuckets[0].Curr = good.String()
+	for _, chk := range []uint32{0x3f, 0x7f, 0xbf} {
+		has.CurrentLedger = chk
+		has.CurrentBuckets[1].Snap = ""
+		if chk == 0x7f {
+			has.CurrentBuckets[1].Snap = bad.String()
+		}
+		arch.PutCheckpointHAS(chk, has, opts)
+	}
+	arch.PutRootHAS(has, opts)
+
+	ch, err := arch.VerifyStreaming(MakeRange(0, 0xffffffff))
+	assert.NoError(t, err)
+	results := make(map[Hash]error)
+	n := 0
+	for r := range ch {
+		results[r.Bucket] = r.Err
+		n++
+	}
+	assert.Equal(t, 2, n)
+	assert.NoError(t, results[good])
+	assert.Error(t, results[bad])
+
+	_, err = GetTestMockArchive().VerifyStreaming(testRange())
+	assert.Error(t, err)
+}
+
+func TestLatestPresentCheckpoint(t *testing.T) {
+	defer cleanup()
+	arch := GetRandomPopulatedArchive()
+	chk, e := arch.LatestPresentCheckpoint()
+	assert.NoError(t, e)
+	assert.Equal(t, uint32(0x3bf), chk)
+
+	// Files beyond the root HAS, under other top-level prefixes, are found.
+	assert.Nil(t, arch.AddRandomCheckpointFile("history", 0x0100043f))
+	assert.Nil(t, arch.AddRandomCheckpointFile("history", 0x010004bf))
+	assert.Nil(t, arch.AddRandomCheckpointFile("ledger", 0x020004bf))
+	chk, e = arch.LatestPresentCheckpoint()
+	assert.NoError(t, e)
+	assert.Equal(t, uint32(0x010004bf), chk)
+
+	_, e = GetTestMockArchive().LatestPresentCheckpoint()
+	assert.Error(t, e)
+}
+
+func TestCheckRootConsistency(t *testing.T) {
+	defer cleanup()
+	arch := GetRandomPopulatedArchive()
+	assert.Nil(t, arch.CheckRootConsistency())
+
+	assert.Nil(t, arch.backend.DeleteFile(CategoryCheckpointPath("history", 0x3bf)))
+	assert.Error(t, arch.CheckRootConsistency())
+
+	// A checkpoint above the root doesn't make up for the missing one.
+	assert.Nil(t, arch.AddRandomCheckpointFile("history", 0x3ff))
+	assert.Error(t, arch.CheckRootConsistency())
+}
+
 func countMissing(arch *Archive, opts *CommandOptions) int {
 	n := 0
 	arch.Scan(opts)
@@ -166,6 +896,276 @@ func TestMirror(t *testing.T) {
 	assert.Equal(t, 0, countMissing(dst, opts))
 }
 
+func TestMirrorCategoryConcurrency(t *testing.T) {
+	defer cleanup()
+	opts := testOptions()
+	opts.CategoryConcurrency = 4
+	src := GetRandomPopulatedArchive()
+	dst := GetTestArchive()
+	assert.Nil(t, Mirror(src, dst, opts))
+	assert.Equal(t, 0, countMissing(dst, opts))
+
+	// Failures are counted from every category copied together.
+	for _, cat := range []string{"ledger", "transactions"} {
+		assert.Nil(t, src.backend.DeleteFile(src.CategoryCheckpointPath(cat, 0x7f)))
+	}
+	opts = testOptions()
+	opts.CategoryConcurrency = 4
+	err := Mirror(src, GetTestArchive(), opts)
+	assert.EqualError(t, err, "2 errors while mirroring")
+}
+
+func TestMirrorBucketSizeFilter(t *testing.T) {
+	defer cleanup()
+	opts := testOptions()
+	src := GetRandomPopulatedArchive()
+	dst := GetTestArchive()
+	opts.MaxBucketBytes = 512
+	Mirror(src, dst, opts)
+	dst.Scan(opts)
+	for _, missing := range dst.CheckCheckpointFilesMissing(opts) {
+		assert.Equal(t, 0, len(missing))
+	}
+	assert.NotEqual(t, 0, len(dst.CheckBucketsMissing()))
+	opts = testOptions()
+	opts.MinBucketBytes = 512
+	Mirror(src, dst, opts)
+	assert.Equal(t, 0, countMissing(dst, opts))
+}
+
+func TestMirrorHASInterval(t *testing.T) {
+	defer cleanup()
+	opts := testOptions()
+	src := GetRandomPopulatedArchive()
+	dst := GetTestArchive()
+	opts.HASInterval = 2
+	Mirror(src, dst, opts)
+	dst.ScanCheckpoints(opts)
+	missing := dst.CheckCheckpointFilesMissing(opts)
+	skipped := 0
+	for chk := range opts.Range.Checkpoints() {
+		if !hasSelected(chk, opts) {
+			skipped++
+		}
+	}
+	assert.NotEqual(t, 0, skipped)
+	assert.Equal(t, skipped, len(missing["history"]))
+	assert.Equal(t, 0, len(missing["ledger"]))
+	for _, chk := range missing["history"] {
+		assert.Equal(t, uint32(1), ((chk + 1) / CheckpointFreq) % 2)
+	}
+}
+
+func TestMirrorProgress(t *testing.T) {
+	p := &mirrorProgress{checkpoints: 10}
+	assert.Equal(t, 0.0, p.fraction())
+	p.checkpointsStarted = 2
+	p.checkpointsDone = 1
+	p.bucketsFound = 20
+	p.bucketsDone = 10
+	// 20 buckets from 2 of 10 checkpoints extrapolates to 100 in all.
+	assert.InDelta(t, 11.0 / 110.0, p.fraction(), 1e-9)
+	p.checkpointsStarted = 10
+	p.checkpointsDone = 10
+	p.bucketsDone = 20
+	assert.InDelta(t, 1.0, p.fraction(), 1e-9)
+}
+
+func TestMirrorStrictRange(t *testing.T) {
+	defer cleanup()
+	src := GetRandomPopulatedArchive()
+	opts := testOptions()
+	opts.StrictRange = true
+	assert.Nil(t, Mirror(src, GetTestMockArchive(), opts))
+
+	dst := GetTestMockArchive()
+	opts.Range = MakeRange(0, 0x1000)
+	assert.NotNil(t, Mirror(src, dst, opts))
+	assert.False(t, dst.CategoryCheckpointExists("history", 0x3f))
+	opts.StrictRange = false
+	assert.Nil(t, Mirror(src, dst, opts))
+	assert.Equal(t, testRange(), opts.Range)
+}
+
+func TestMirrorRootHASPolicy(t *testing.T) {
+	defer cleanup()
+	src := GetRandomPopulatedArchive()
+	srcRoot, _ := src.GetRootHAS()
+
+	dst := GetTestMockArchive()
+	opts := testOptions()
+	opts.RootHASPolicy = RootHASNever
+	assert.Nil(t, Mirror(src, dst, opts))
+	_, e := dst.GetRootHAS()
+	assert.Error(t, e)
+
+	dst = GetTestMockArchive()
+	opts = testOptions()
+	opts.RootHASPolicy = RootHASIncremental
+	assert.Nil(t, Mirror(src, dst, opts))
+	root, e := dst.GetRootHAS()
+	assert.NoError(t, e)
+	assert.Equal(t, srcRoot.CurrentLedger, root.CurrentLedger)
+}
+
+func TestRootAdvancerOutOfOrder(t *testing.T) {
+	dst := GetTestMockArchive()
+	r := &rootAdvancer{
+		dst: dst,
+		opts: &CommandOptions{},
+		next: 0x3f,
+		finished: make(map[uint32]HistoryArchiveState),
+	}
+	finish := func(chk uint32) {
+		var has HistoryArchiveState
+		has.CurrentLedger = chk
+		assert.Nil(t, r.finish(chk, has))
+	}
+	finish(0x7f)
+	_, e := dst.GetRootHAS()
+	assert.Error(t, e)
+	finish(0x3f)
+	root, _ := dst.GetRootHAS()
+	assert.Equal(t, uint32(0x7f), root.CurrentLedger)
+	finish(0x13f)
+	finish(0xbf)
+	root, _ = dst.GetRootHAS()
+	assert.Equal(t, uint32(0xbf), root.CurrentLedger)
+}
+
+// A backend whose bucket writes always fail.
+type failingPutBackend struct {
+	ArchiveBackend
+	puts int32
+}
+
+func (b *failingPutBackend) PutFile(pth string, in io.ReadCloser) error {
+	if strings.HasPrefix(pth, "bucket/") {
+		atomic.AddInt32(&b.puts, 1)
+		in.Close()
+		return errors.New("backend down")
+	}
+	return b.ArchiveBackend.PutFile(pth, in)
+}
+
+func TestMirrorRetryBudget(t *testing.T) {
+	defer cleanup()
+	src := GetRandomPopulatedArchive()
+	failing := &failingPutBackend{ArchiveBackend: MakeMockBackend(nil)}
+	dst := ConnectBackend(failing, nil)
+	opts := testOptions()
+	opts.CopyRetries = 3
+	opts.RetryBudget = 10
+	e := Mirror(src, dst, opts)
+	assert.Error(t, e)
+	assert.True(t, errors.Is(e, ErrRetryBudgetExhausted))
+	// Each worker may make one attempt past the budget before it notices.
+	assert.True(t, atomic.LoadInt32(&failing.puts) <= int32(10 + 2 * opts.Concurrency))
+	_, e = dst.GetRootHAS()
+	assert.Error(t, e)
+}
+
+func TestMirrorMaxInFlightBytes(t *testing.T) {
+	defer cleanup()
+	src := GetRandomPopulatedArchive()
+	largest := int64(0)
+	for _, dir := range append(src.Categories(), "bucket") {
+		ch, es := src.backend.ListFiles(dir)
+		for pth := range ch {
+			// Listings may carry the backend's prefix.
+			pth = pth[strings.Index(pth, dir + "/"):]
+			if n, _ := src.backend.GetFileSize(pth); n > largest {
+				largest = n
+			}
+		}
+		drainErrors(es)
+	}
+	// With a budget smaller than every file, each is copied alone.
+	for _, limit := range []int64{3 * largest, 100} {
+		dst := GetTestArchive()
+		opts := testOptions()
+		opts.MaxInFlightBytes = limit
+		assert.Nil(t, Mirror(src, dst, opts))
+		assert.Equal(t, 0, countMissing(dst, opts))
+		assert.True(t, opts.inFlight.peak > 0)
+		assert.True(t, opts.inFlight.peak <= limit || opts.inFlight.peak <= largest)
+		assert.Equal(t, int64(0), opts.inFlight.used)
+	}
+}
+
+func TestByteBudget(t *testing.T) {
+	b := newByteBudget(100)
+	b.acquire(60)
+	admitted := make(chan bool)
+	go func() {
+		b.acquire(200)
+		admitted <- true
+	}()
+	select {
+	case <-admitted:
+		t.Error("admitted past the budget")
+	case <-time.After(10 * time.Millisecond):
+	}
+	b.release(60)
+	<-admitted
+	assert.Equal(t, int64(200), b.peak)
+	b.release(200)
+	var none *byteBudget
+	none.acquire(1 << 40)
+	none.release(1 << 40)
+}
+
+func TestMirrorHASTransform(t *testing.T) {
+	defer cleanup()
+	opts := testOptions()
+	src := GetRandomPopulatedArchive()
+	dst := GetTestArchive()
+	opts.HASTransform = func(has HistoryArchiveState) HistoryArchiveState {
+		has.Server = "mirrored"
+		return has
+	}
+	assert.False(t, copyVerbatim(CategoryCheckpointPath("history", 0x3f), opts))
+	assert.True(t, copyVerbatim(CategoryCheckpointPath("ledger", 0x3f), opts))
+	assert.Nil(t, Mirror(src, dst, opts))
+	root, err := dst.GetRootHAS()
+	assert.Nil(t, err)
+	assert.Equal(t, "mirrored", root.Server)
+	has, err := dst.GetCheckpointHAS(0x7f)
+	assert.Nil(t, err)
+	assert.Equal(t, "mirrored", has.Server)
+	orig, _ := src.GetCheckpointHAS(0x7f)
+	assert.Equal(t, orig.Buckets(), has.Buckets())
+}
+
+type countingTransform struct {
+	applied uint32
+}
+
+func (c *countingTransform) Wants(pth string) bool {
+	return strings.HasSuffix(pth, ".json")
+}
+
+func (c *countingTransform) Apply(pth string, in io.ReadCloser) (io.ReadCloser, error) {
+	atomic.AddUint32(&c.applied, 1)
+	return in, nil
+}
+
+func TestMirrorTransformOnlyWantedFiles(t *testing.T) {
+	defer cleanup()
+	opts := testOptions()
+	src := GetRandomPopulatedArchive()
+	dst := GetTestArchive()
+	tr := &countingTransform{}
+	opts.Transform = tr
+	Mirror(src, dst, opts)
+	assert.Equal(t, uint32(opts.Range.Size()), tr.applied)
+	assert.True(t, copyVerbatim(BucketPath(Hash{}), opts))
+	assert.True(t, copyVerbatim(CategoryCheckpointPath("ledger", 63), opts))
+	assert.False(t, copyVerbatim(CategoryCheckpointPath("history", 63), opts))
+	assert.True(t, copyVerbatim(CategoryCheckpointPath("history", 63), testOptions()))
+	assert.Equal(t, 0, countMissing(dst, opts))
+}
+
 func copyFile(category string, checkpoint uint32, src *Archive, dst *Archive) {
 	pth := CategoryCheckpointPath(category, checkpoint)
 	rdr, err := src.backend.GetFile(pth)
@@ -192,6 +1192,376 @@ func TestMirrorThenRepair(t *testing.T) {
 	assert.Equal(t, 0, countMissing(dst, opts))
 }
 
+func TestRepairManyCategories(t *testing.T) {
+	defer cleanup()
+	src := GetRandomPopulatedArchive()
+	dst := GetTestArchive()
+	assert.Nil(t, Mirror(src, dst, testOptions()))
+	for _, chk := range []uint32{0x7f, 0xbf, 0x1ff, 0x3bf} {
+		for _, cat := range Categories() {
+			if chk == 0x3bf && cat == "history" {
+				continue
+			}
+			assert.Nil(t, dst.backend.DeleteFile(CategoryCheckpointPath(cat, chk)))
+		}
+	}
+	opts := testOptions()
+	assert.NotEqual(t, 0, countMissing(dst, opts))
+	dst.ClearCachedInfo()
+	assert.Nil(t, Repair(src, dst, opts))
+	dst.ClearCachedInfo()
+	assert.Equal(t, 0, countMissing(dst, opts))
+}
+
+func TestRepairScope(t *testing.T) {
+	defer cleanup()
+	src := GetRandomPopulatedArchive()
+	dst := GetTestArchive()
+	assert.Nil(t, Mirror(src, dst, testOptions()))
+	ledger := CategoryCheckpointPath("ledger", 0x7f)
+	bucket := BucketPath(firstBucket(src))
+	assert.Nil(t, dst.backend.DeleteFile(ledger))
+	assert.Nil(t, dst.backend.DeleteFile(bucket))
+
+	opts := testOptions()
+	opts.SkipBuckets = true
+	assert.Nil(t, Repair(src, dst, opts))
+	assert.True(t, dst.backend.Exists(ledger))
+	assert.False(t, dst.backend.Exists(bucket))
+
+	assert.Nil(t, dst.backend.DeleteFile(ledger))
+	dst.ClearCachedInfo()
+	opts = testOptions()
+	opts.BucketsOnly = true
+	assert.Nil(t, Repair(src, dst, opts))
+	assert.False(t, dst.backend.Exists(ledger))
+	assert.True(t, dst.backend.Exists(bucket))
+
+	opts.SkipBuckets = true
+	assert.Error(t, Repair(src, dst, opts))
+}
+
+// Adds a checkpoint that passes verification, unlike AddRandomCheckpoint's:
+// gzipped buckets named by their content's hash, and empty XDR files.
+func (arch *Archive) AddVerifiableCheckpoint(chk uint32) error {
+	opts := &CommandOptions{Force:true}
+	has := NewHAS()
+	has.CurrentLedger = chk
+	for i := range has.CurrentBuckets {
+		buf := make([]byte, 1024)
+		if _, e := rand.Read(buf); e != nil {
+			return e
+		}
+		h := Hash(sha256.Sum256(buf))
+		e := arch.backend.PutFile(BucketPath(h),
+			ioutil.NopCloser(bytes.NewReader(gzipped(buf))))
+		if e != nil {
+			return e
+		}
+		has.CurrentBuckets[i].Curr = h.String()
+	}
+	for _, cat := range arch.Categories() {
+		if cat == "history" {
+			continue
+		}
+		e := arch.backend.PutFile(arch.CategoryCheckpointPath(cat, chk),
+			ioutil.NopCloser(bytes.NewReader(gzipped(nil))))
+		if e != nil {
+			return e
+		}
+	}
+	if e := arch.PutCheckpointHAS(chk, has, opts); e != nil {
+		return e
+	}
+	return arch.PutRootHAS(has, opts)
+}
+
+func TestRepairCorrupt(t *testing.T) {
+	defer cleanup()
+	rng := Range{Low:63, High:0xbf}
+	src := GetTestArchive()
+	for chk := range rng.Checkpoints() {
+		assert.Nil(t, src.AddVerifiableCheckpoint(chk))
+	}
+	dst := GetTestArchive()
+	assert.Nil(t, Mirror(src, dst, &CommandOptions{Range:rng, Concurrency:4}))
+
+	corruptBucket := BucketPath(firstBucket(src))
+	corruptLedger := CategoryCheckpointPath("ledger", 0x7f)
+	for _, pth := range []string{corruptBucket, corruptLedger} {
+		assert.Nil(t, dst.backend.PutFile(pth,
+			ioutil.NopCloser(strings.NewReader("junk"))))
+	}
+	missingLedger := CategoryCheckpointPath("ledger", 0xbf)
+	assert.Nil(t, dst.backend.DeleteFile(missingLedger))
+
+	// A plain repair restores the missing file but can't tell the
+	// corrupt ones from good.
+	opts := &CommandOptions{Range:rng, Concurrency:4}
+	assert.Nil(t, Repair(src, dst, opts))
+	assert.True(t, dst.backend.Exists(missingLedger))
+	dst.ClearCachedInfo()
+	assert.Error(t, dst.Scan(&CommandOptions{Range:rng, Concurrency:4, Verify:true}))
+	assert.Len(t, dst.CheckBucketsCorrupt(), 1)
+	assert.Equal(t, []uint32{0x7f},
+		dst.CheckCheckpointFilesCorrupt(&CommandOptions{Range:rng})["ledger"])
+
+	assert.Nil(t, dst.backend.DeleteFile(missingLedger))
+	dst.ClearCachedInfo()
+	opts = &CommandOptions{Range:rng, Concurrency:4, RepairCorrupt:true}
+	assert.Nil(t, Repair(src, dst, opts))
+	assert.True(t, dst.backend.Exists(missingLedger))
+	dst.ClearCachedInfo()
+	assert.Nil(t, dst.Scan(&CommandOptions{Range:rng, Concurrency:4, Verify:true}))
+	assert.Len(t, dst.CheckBucketsCorrupt(), 0)
+
+	// A source as corrupt as the destination is no repair.
+	for _, a := range []*Archive{src, dst} {
+		assert.Nil(t, a.backend.PutFile(corruptLedger,
+			ioutil.NopCloser(strings.NewReader("junk"))))
+	}
+	dst.ClearCachedInfo()
+	assert.Error(t, Repair(src, dst, opts))
+
+	// Nor is one that couldn't see the destination.
+	blind := ConnectBackend(&failingListBackend{dst.backend}, nil)
+	assert.Error(t, Repair(src, blind, opts))
+}
+
+// A backend whose listings all fail.
+type failingListBackend struct {
+	ArchiveBackend
+}
+
+func (b *failingListBackend) ListFiles(pth string) (chan string, chan error) {
+	ch := make(chan string)
+	errs := make(chan error, 1)
+	close(ch)
+	errs <- errors.New("listing failed")
+	close(errs)
+	return ch, errs
+}
+
+func TestRepairCheckpoint(t *testing.T) {
+	defer cleanup()
+	rng := Range{Low:63, High:0xbf}
+	src := GetTestArchive()
+	for chk := range rng.Checkpoints() {
+		assert.Nil(t, src.AddVerifiableCheckpoint(chk))
+	}
+	dst := GetTestArchive()
+	assert.Nil(t, Mirror(src, dst, &CommandOptions{Range:rng, Concurrency:4}))
+
+	has, err := src.GetCheckpointHAS(0x7f)
+	assert.Nil(t, err)
+	bucket := BucketPath(has.Buckets()[0])
+	ledger := CategoryCheckpointPath("ledger", 0x7f)
+	for _, pth := range []string{bucket, ledger} {
+		assert.Nil(t, dst.backend.DeleteFile(pth))
+	}
+	assert.Nil(t, RepairCheckpoint(src, dst, 0x7f, &CommandOptions{}))
+	assert.True(t, dst.backend.Exists(bucket))
+	assert.True(t, dst.backend.Exists(ledger))
+	assert.Equal(t, 0, countFilesUnder(dst.backend, RepairStagingDir))
+	assert.Nil(t, dst.Scan(&CommandOptions{Range:rng, Concurrency:4, Verify:true}))
+
+	// One bad file in the source and nothing is committed.
+	for _, pth := range []string{bucket, ledger} {
+		assert.Nil(t, dst.backend.DeleteFile(pth))
+	}
+	assert.Nil(t, src.backend.PutFile(ledger, ioutil.NopCloser(strings.NewReader("junk"))))
+	assert.Error(t, RepairCheckpoint(src, dst, 0x7f, &CommandOptions{}))
+	assert.False(t, dst.backend.Exists(bucket))
+	assert.False(t, dst.backend.Exists(ledger))
+	assert.Equal(t, 0, countFilesUnder(dst.backend, RepairStagingDir))
+}
+
+func TestReconcileThenApply(t *testing.T) {
+	defer cleanup()
+	opts := testOptions()
+	src := GetRandomPopulatedArchive()
+	dst := GetTestArchive()
+	Mirror(src, dst, opts)
+	bad := opts.Range.Low + uint32(opts.Range.Size() / 2)
+	src.AddRandomCheckpoint(bad)
+	copyFile("history", bad, src, dst)
+	plan, err := ReconcileWithOptions(src, dst, testOptions())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(plan.CheckpointFiles))
+	assert.Equal(t, 3 * NumLevels, len(plan.Buckets))
+	assert.Equal(t, int64(3 * NumLevels * 1024), plan.EstimatedBytes)
+
+	opts = testOptions()
+	empty := GetTestArchive()
+	plan, err = ReconcileWithOptions(src, empty, opts)
+	assert.Nil(t, err)
+	assert.Equal(t, len(Categories()) * plan.Range.Size(),
+		len(plan.CheckpointFiles))
+	assert.Nil(t, ApplyCopyPlan(src, empty, plan, opts))
+	plan, err = ReconcileWithOptions(src, empty, testOptions())
+	assert.Nil(t, err)
+	assert.True(t, plan.Empty())
+}
+
+func TestReconcileCorrupt(t *testing.T) {
+	defer cleanup()
+	rng := Range{Low:63, High:0xbf}
+	src := GetTestArchive()
+	for chk := range rng.Checkpoints() {
+		assert.Nil(t, src.AddVerifiableCheckpoint(chk))
+	}
+	dst := GetTestArchive()
+	assert.Nil(t, Mirror(src, dst, &CommandOptions{Range:rng, Concurrency:4}))
+	plan, err := Reconcile(src, dst, rng)
+	assert.Nil(t, err)
+	assert.True(t, plan.Empty())
+
+	ledger := dst.CategoryCheckpointPath("ledger", 0x7f)
+	bucket := firstBucket(src)
+	// An XDR frame of 8 bytes, cut short.
+	junk := gzipped([]byte{0x80, 0, 0, 8, 1, 2})
+	assert.Nil(t, dst.backend.PutFile(ledger, ioutil.NopCloser(bytes.NewReader(junk))))
+	assert.Nil(t, dst.backend.PutFile(BucketPath(bucket), ioutil.NopCloser(bytes.NewReader(junk))))
+
+	// Without verification, they're as good as any.
+	plan, err = ReconcileWithOptions(src, dst, &CommandOptions{Range:rng, Concurrency:4})
+	assert.Nil(t, err)
+	assert.True(t, plan.Empty())
+
+	plan, err = Reconcile(src, dst, rng)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{ledger}, plan.CheckpointFiles)
+	assert.Equal(t, []Hash{bucket}, plan.Buckets)
+	assert.Nil(t, ApplyCopyPlan(src, dst, plan, &CommandOptions{}))
+	plan, err = Reconcile(src, dst, rng)
+	assert.Nil(t, err)
+	assert.True(t, plan.Empty())
+}
+
+func TestCheckpointsMissingIn(t *testing.T) {
+	defer cleanup()
+	opts := testOptions()
+	src := GetRandomPopulatedArchive()
+	dst := GetTestArchive()
+	assert.Nil(t, Mirror(src, dst, opts))
+	dst.backend.DeleteFile(CategoryCheckpointPath("ledger", 0x7f))
+	dst.backend.DeleteFile(CategoryCheckpointPath("ledger", 0x13f))
+	dst.backend.DeleteFile(CategoryCheckpointPath("scp", 0xff))
+	// Missing from both, so nothing a mirror could fill in.
+	src.backend.DeleteFile(CategoryCheckpointPath("results", 0xbf))
+	dst.backend.DeleteFile(CategoryCheckpointPath("results", 0xbf))
+
+	missing, err := src.CheckpointsMissingIn(dst, testRange())
+	assert.Nil(t, err)
+	assert.Equal(t, []uint32{0x7f, 0x13f}, missing["ledger"])
+	assert.Equal(t, []uint32{0xff}, missing["scp"])
+	assert.Equal(t, []uint32{}, missing["results"])
+	assert.Equal(t, []uint32{}, missing["history"])
+
+	missing, err = src.CheckpointsMissingIn(GetTestArchive(), testRange())
+	assert.Nil(t, err)
+	assert.Equal(t, testRange().Size(), len(missing["history"]))
+	assert.Equal(t, testRange().Size() - 1, len(missing["results"]))
+}
+
+func TestGenesisCheckpoint(t *testing.T) {
+	defer cleanup()
+	arch := GetTestArchive()
+	opts := testOptions()
+	opts.Range = MakeRange(0, 0)
+	arch.Scan(opts)
+	for _, cat := range Categories() {
+		assert.Equal(t, []uint32{0x3f}, arch.CheckCheckpointFilesMissing(opts)[cat])
+	}
+
+	arch.AddRandomCheckpoint(0x3f)
+	arch.ClearCachedInfo()
+	assert.Equal(t, 0, countMissing(arch, opts))
+	assert.Nil(t, arch.ScanCheckpointsSlow(opts))
+	for _, cat := range Categories() {
+		assert.Empty(t, arch.CheckCheckpointFilesMissing(opts)[cat])
+	}
+
+	dst := GetTestMockArchive()
+	assert.Nil(t, Mirror(arch, dst, testOptions()))
+	assert.True(t, dst.CategoryCheckpointExists("history", 0x3f))
+	assert.Equal(t, 0, countMissing(dst, opts))
+}
+
+func TestDumpCheckpoint(t *testing.T) {
+	defer cleanup()
+	src := GetRandomPopulatedArchive()
+	src.backend.DeleteFile(CategoryCheckpointPath("scp", 0x7f))
+	d, e := ioutil.TempDir("/tmp", "archivist-dump")
+	assert.NoError(t, e)
+	tmpdirs = append(tmpdirs, d)
+	assert.Nil(t, src.DumpCheckpoint(0x7f, d))
+
+	dump := MustConnect("file://" + d, nil)
+	has, e := dump.GetCheckpointHAS(0x7f)
+	assert.NoError(t, e)
+	for _, bucket := range has.Buckets() {
+		assert.True(t, dump.BucketExists(bucket))
+	}
+	assert.True(t, dump.CategoryCheckpointExists("ledger", 0x7f))
+	assert.False(t, dump.CategoryCheckpointExists("scp", 0x7f))
+
+	src.backend.DeleteFile(CategoryCheckpointPath("ledger", 0xbf))
+	assert.Error(t, src.DumpCheckpoint(0xbf, d))
+}
+
+func TestCheckpointsMissingCategory(t *testing.T) {
+	defer cleanup()
+	arch := GetRandomPopulatedArchive()
+	arch.backend.DeleteFile(CategoryCheckpointPath("ledger", 0xbf))
+	arch.backend.DeleteFile(CategoryCheckpointPath("ledger", 0x2ff))
+	for _, cat := range Categories() {
+		arch.backend.DeleteFile(CategoryCheckpointPath(cat, 0x1ff))
+	}
+	opts := testOptions()
+	assert.Nil(t, arch.ScanCheckpoints(opts))
+	assert.Equal(t, []uint32{0xbf, 0x2ff},
+		arch.CheckpointsMissingCategory("ledger", testRange()))
+	assert.Equal(t, []uint32{0xbf},
+		arch.CheckpointsMissingCategory("ledger", MakeRange(0, 0x1ff)))
+	assert.Empty(t, arch.CheckpointsMissingCategory("results", testRange()))
+}
+
+func TestMissingRanges(t *testing.T) {
+	defer cleanup()
+	opts := testOptions()
+	arch := GetTestArchive()
+	arch.PopulateRandomRange(Range{Low:63, High:0x1bf})
+	arch.PopulateRandomRange(Range{Low:0x27f, High:0x3bf})
+	arch.Scan(opts)
+	ranges, err := arch.MissingRanges(opts.Range)
+	assert.Nil(t, err)
+	for _, cat := range Categories() {
+		assert.Equal(t, []Range{{Low:0x1ff, High:0x23f}}, ranges[cat])
+	}
+}
+
+func TestMissingReportJSON(t *testing.T) {
+	defer cleanup()
+	opts := testOptions()
+	arch := GetTestArchive()
+	arch.PopulateRandomRange(Range{Low:63, High:0x1bf})
+	arch.PopulateRandomRange(Range{Low:0x27f, High:0x3bf})
+	has, _ := arch.GetCheckpointHAS(0x7f)
+	missing := MustDecodeHash(has.CurrentBuckets[0].Curr)
+	arch.backend.DeleteFile(BucketPath(missing))
+	arch.Scan(opts)
+	report, err := arch.MissingReport(opts.Range)
+	assert.Nil(t, err)
+	assert.Equal(t, []Hash{missing}, report.Buckets)
+	buf, err := json.Marshal(report)
+	assert.Nil(t, err)
+	var decoded MissingReport
+	assert.Nil(t, json.Unmarshal(buf, &decoded))
+	assert.Equal(t, report, decoded)
+	assert.Equal(t, []Range{{Low:0x1ff, High:0x23f}}, decoded.Checkpoints["ledger"])
+}
+
 func TestDryRunNoRepair(t *testing.T) {
 	defer cleanup()
 	opts := testOptions()
@@ -285,3 +1655,296 @@ func TestXdrDecode(t *testing.T) {
 	assert.Equal(t, out.Len(), n)
 	assert.Equal(t, out.Bytes(), xdrbytes)
 }
+
+func TestMirrorController(t *testing.T) {
+	defer cleanup()
+	src := GetRandomPopulatedArchive()
+	dst := GetTestArchive()
+	opts := testOptions()
+	ctl := NewMirrorController()
+	opts.Controller = ctl
+	ctl.Pause()
+	assert.True(t, ctl.Paused())
+	done := make(chan error)
+	go func() {
+		done <- Mirror(src, dst, opts)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Mirror finished while paused")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Equal(t, 0, countFilesUnder(dst.backend, "bucket"))
+	ctl.Resume()
+	assert.False(t, ctl.Paused())
+	assert.Nil(t, <-done)
+	assert.Equal(t, 0, countMissing(dst, opts))
+}
+
+func TestMirrorControllerStop(t *testing.T) {
+	defer cleanup()
+	src := GetRandomPopulatedArchive()
+	dst := GetTestArchive()
+	opts := testOptions()
+	ctl := NewMirrorController()
+	opts.Controller = ctl
+	ctl.Pause()
+	done := make(chan error)
+	go func() {
+		done <- Mirror(src, dst, opts)
+	}()
+	ctl.Stop()
+	assert.Equal(t, ErrMirrorStopped, <-done)
+	_, e := dst.GetRootHAS()
+	assert.Error(t, e)
+}
+
+// Lets another writer update the root HAS just before the first
+// conditional write.
+type racingRootBackend struct {
+	ArchiveBackend
+	raced bool
+	rival []byte
+}
+
+func (b *racingRootBackend) FileVersion(pth string) (string, error) {
+	return b.ArchiveBackend.(ConditionalPutter).FileVersion(pth)
+}
+
+func (b *racingRootBackend) PutFileIfVersion(pth string, version string, in io.ReadCloser) error {
+	if !b.raced {
+		b.raced = true
+		b.ArchiveBackend.PutFile(pth, ioutil.NopCloser(bytes.NewReader(b.rival)))
+	}
+	return b.ArchiveBackend.(ConditionalPutter).PutFileIfVersion(pth, version, in)
+}
+
+func TestOptimisticRootHAS(t *testing.T) {
+	defer cleanup()
+	src := GetRandomPopulatedArchive()
+	dst := GetTestArchive()
+	opts := testOptions()
+	opts.OptimisticRootHAS = true
+	assert.Nil(t, Mirror(src, dst, opts))
+	root, _ := dst.GetRootHAS()
+	assert.Equal(t, uint32(0x3bf), root.CurrentLedger)
+
+	// An older root HAS leaves the newer one alone.
+	has := NewHAS()
+	has.CurrentLedger = 0x1ff
+	assert.Nil(t, dst.PutRootHAS(has, opts))
+	root, _ = dst.GetRootHAS()
+	assert.Equal(t, uint32(0x3bf), root.CurrentLedger)
+	// Without the option, the last writer wins.
+	opts.OptimisticRootHAS = false
+	assert.Nil(t, dst.PutRootHAS(has, opts))
+	root, _ = dst.GetRootHAS()
+	assert.Equal(t, uint32(0x1ff), root.CurrentLedger)
+
+	// Losing a race to a newer root HAS, the write re-reads and yields.
+	rival := NewHAS()
+	rival.CurrentLedger = 0x3bf
+	var buf bytes.Buffer
+	rival.Encode(&buf)
+	racing := &racingRootBackend{ArchiveBackend: dst.backend, rival: buf.Bytes()}
+	has.CurrentLedger = 0x2ff
+	opts.OptimisticRootHAS = true
+	assert.Nil(t, ConnectBackend(racing, nil).PutRootHAS(has, opts))
+	assert.True(t, racing.raced)
+	root, _ = dst.GetRootHAS()
+	assert.Equal(t, uint32(0x3bf), root.CurrentLedger)
+
+	// Losing to an older one, it retries and wins.
+	rival.CurrentLedger = 0x37f
+	buf.Reset()
+	rival.Encode(&buf)
+	racing = &racingRootBackend{ArchiveBackend: dst.backend, rival: buf.Bytes()}
+	has.CurrentLedger = 0x3ff
+	assert.Nil(t, ConnectBackend(racing, nil).PutRootHAS(has, opts))
+	root, _ = dst.GetRootHAS()
+	assert.Equal(t, uint32(0x3ff), root.CurrentLedger)
+
+	unconditional := struct{ ArchiveBackend }{dst.backend}
+	assert.Error(t, ConnectBackend(unconditional, nil).PutRootHAS(has, opts))
+}
+
+func TestCheckpointHASPath(t *testing.T) {
+	arch := GetTestMockArchive()
+	pth := arch.CheckpointHASPath(0x7f)
+	assert.Equal(t, "history/00/00/00/history-0000007f.json", pth)
+	has := NewHAS()
+	has.CurrentLedger = 0x7f
+	assert.Nil(t, arch.PutCheckpointHAS(0x7f, has, &CommandOptions{}))
+	assert.True(t, arch.backend.Exists(pth))
+}
+
+func TestRootHASPath(t *testing.T) {
+	defer cleanup()
+	src := GetRandomPopulatedArchive()
+	assert.Equal(t, DefaultRootHASPath, src.RootHASPath())
+	pth := ".well-known/payshares-history.json"
+	backend := MakeMockBackend(nil)
+	dst := ConnectBackend(backend, &ConnectOptions{RootHASPath: pth})
+	assert.Equal(t, pth, dst.RootHASPath())
+	assert.Nil(t, Mirror(src, dst, testOptions()))
+	assert.True(t, backend.Exists(pth))
+	assert.False(t, backend.Exists(DefaultRootHASPath))
+	root, e := dst.GetRootHAS()
+	assert.Nil(t, e)
+	assert.Equal(t, uint32(0x3bf), root.CurrentLedger)
+
+	// Read through the default path, the copy has no root HAS.
+	_, e = ConnectBackend(backend, nil).GetRootHAS()
+	assert.Error(t, e)
+}
+
+func TestDefaultConnectOptions(t *testing.T) {
+	SetDefaultConnectOptions(&ConnectOptions{
+		RootHASPath: ".well-known/payshares-history.json",
+		ListBufferSize: 5,
+		S3Region: "eu-west-1",
+	})
+	defer SetDefaultConnectOptions(nil)
+
+	arch := ConnectBackend(nil, &ConnectOptions{ListBufferSize: 7})
+	assert.Equal(t, ".well-known/payshares-history.json", arch.RootHASPath())
+	assert.Equal(t, 7, arch.listBufferSize)
+
+	arch, e := Connect("mock://test", nil)
+	assert.Nil(t, e)
+	assert.Equal(t, ".well-known/payshares-history.json", arch.RootHASPath())
+	assert.Equal(t, 5, arch.listBufferSize)
+
+	arch, e = Connect("s3://bucket/archive", &ConnectOptions{RootHASPath: "root.json"})
+	assert.Nil(t, e)
+	assert.Equal(t, "root.json", arch.RootHASPath())
+
+	SetDefaultConnectOptions(nil)
+	assert.Equal(t, DefaultRootHASPath, ConnectBackend(nil, nil).RootHASPath())
+}
+
+func TestRenameFile(t *testing.T) {
+	defer cleanup()
+	backends := []ArchiveBackend{
+		GetTestArchive().backend,
+		ContentAddressedBackend(MakeMockBackend(nil), "test"),
+	}
+	for _, b := range backends {
+		from := "ledger/00/00/00/ledger-0000003f.xdr.gz"
+		to := "staging/ledger/00/00/00/ledger-0000003f.xdr.gz"
+		assert.Nil(t, b.PutFile(from, ioutil.NopCloser(strings.NewReader("hello"))))
+		assert.Nil(t, b.RenameFile(from, to))
+		assert.False(t, b.Exists(from))
+		rdr, e := b.GetFile(to)
+		assert.Nil(t, e)
+		content, _ := ioutil.ReadAll(rdr)
+		rdr.Close()
+		assert.Equal(t, "hello", string(content))
+		assert.Error(t, b.RenameFile(from, to))
+	}
+}
+
+func gzipped(buf []byte) []byte {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(buf)
+	w.Close()
+	return gz.Bytes()
+}
+
+func TestMirrorVerifyExisting(t *testing.T) {
+	src := GetTestMockArchive()
+	buf := make([]byte, 1024)
+	rand.Read(buf)
+	good := Hash(sha256.Sum256(buf))
+	bpth := BucketPath(good)
+	src.backend.PutFile(bpth, ioutil.NopCloser(bytes.NewReader(gzipped(buf))))
+	lpth := CategoryCheckpointPath("ledger", 0x3f)
+	src.backend.PutFile(lpth, ioutil.NopCloser(bytes.NewReader(gzipped(nil))))
+
+	inner := MakeMockBackend(nil)
+	failing := &failingPutBackend{ArchiveBackend: inner}
+	dst := ConnectBackend(failing, nil)
+	inner.PutFile(bpth, ioutil.NopCloser(bytes.NewReader(gzipped(buf))))
+	inner.PutFile(lpth, ioutil.NopCloser(strings.NewReader("truncated")))
+	opts := &CommandOptions{VerifyExisting:true}
+
+	// A sound bucket is skipped; a corrupt one is copied again.
+	assert.Nil(t, copyPath(src, dst, bpth, opts))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&failing.puts))
+	inner.PutFile(bpth, ioutil.NopCloser(bytes.NewReader(gzipped(buf[1:]))))
+	assert.Error(t, copyPath(src, dst, bpth, opts))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&failing.puts))
+
+	assert.Nil(t, copyPath(src, dst, lpth, &CommandOptions{}))
+	assert.Error(t, verifyExistingFile(dst, lpth))
+	assert.Nil(t, copyPath(src, dst, lpth, opts))
+	assert.Nil(t, verifyExistingFile(dst, lpth))
+}
+
+func TestReadyForIngestion(t *testing.T) {
+	defer cleanup()
+	arch := GetRandomPopulatedArchive()
+	ok, blockers, e := arch.ReadyForIngestion(0x200)
+	assert.NoError(t, e)
+	assert.True(t, ok)
+	assert.Empty(t, blockers)
+
+	// Optional categories aren't needed.
+	arch.backend.DeleteFile(CategoryCheckpointPath("scp", 0x7f))
+	ok, _, _ = arch.ReadyForIngestion(0x200)
+	assert.True(t, ok)
+
+	ok, blockers, _ = arch.ReadyForIngestion(0x1000)
+	assert.False(t, ok)
+	assert.Equal(t, 1, len(blockers), strings.Join(blockers, "; "))
+
+	has, _ := arch.GetCheckpointHAS(0xbf)
+	arch.backend.DeleteFile(BucketPath(MustDecodeHash(has.CurrentBuckets[0].Snap)))
+	arch.backend.DeleteFile(CategoryCheckpointPath("results", 0x7f))
+	ok, blockers, e = arch.ReadyForIngestion(0x200)
+	assert.NoError(t, e)
+	assert.False(t, ok)
+	assert.Equal(t, []string{
+		"Missing 1 results files: 0x0000007f",
+		"Missing 1 referenced buckets",
+	}, blockers)
+
+	// Beyond the damage, it's still ready.
+	ok, _, _ = arch.ReadyForIngestion(0x3f)
+	assert.True(t, ok)
+
+	// The random ledger files hold no headers to check hashes against.
+	ok, blockers, e = arch.ReadyForIngestionWithHashes(0x3f)
+	assert.NoError(t, e)
+	assert.False(t, ok)
+	assert.Equal(t, 1, len(blockers), strings.Join(blockers, "; "))
+}
+
+func TestMirrorBucketFilters(t *testing.T) {
+	defer cleanup()
+	src := GetRandomPopulatedArchive()
+	has, _ := src.GetCheckpointHAS(0x7f)
+	b := MustDecodeHash(has.CurrentBuckets[2].Curr)
+
+	dst := GetTestArchive()
+	opts := testOptions()
+	opts.ExcludeBuckets = map[Hash]bool{b: true}
+	assert.Nil(t, Mirror(src, dst, opts))
+	assert.False(t, dst.backend.Exists(BucketPath(b)))
+	assert.Equal(t, 15 * 3 * NumLevels - 1, countFilesUnder(dst.backend, "bucket"))
+
+	dst = GetTestArchive()
+	opts = testOptions()
+	opts.IncludeBuckets = map[Hash]bool{b: true}
+	assert.Nil(t, Mirror(src, dst, opts))
+	assert.True(t, dst.backend.Exists(BucketPath(b)))
+	assert.Equal(t, 1, countFilesUnder(dst.backend, "bucket"))
+
+	dst = GetTestArchive()
+	opts = testOptions()
+	opts.ExcludeBuckets = map[Hash]bool{b: true}
+	opts.FailOnExcludedBucket = true
+	assert.Error(t, Mirror(src, dst, opts))
+	assert.False(t, dst.backend.Exists(BucketPath(b)))
+}
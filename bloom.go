@@ -0,0 +1,60 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"encoding/binary"
+)
+
+const bloomHashes = 7
+
+// A fixed-size bloom filter over bucket hashes. Since the keys are already
+// uniformly-distributed SHA-256 values, the probe positions are derived
+// directly from their bytes (by double hashing) rather than rehashing.
+// With about 10 bits per element, false positives run near 1%.
+type bucketBloom struct {
+	bits []uint64
+	nbits uint64
+	count int
+}
+
+func newBucketBloom(nbits uint64) *bucketBloom {
+	if nbits < 64 {
+		nbits = 64
+	}
+	return &bucketBloom{
+		bits: make([]uint64, (nbits + 63) / 64),
+		nbits: nbits,
+	}
+}
+
+func (b *bucketBloom) probe(h Hash, i uint64) (uint64, uint64) {
+	h1 := binary.BigEndian.Uint64(h[0:8])
+	h2 := binary.BigEndian.Uint64(h[8:16]) | 1
+	bit := (h1 + i * h2) % b.nbits
+	return bit / 64, uint64(1) << (bit % 64)
+}
+
+func (b *bucketBloom) Add(h Hash) {
+	if b.Has(h) {
+		return
+	}
+	for i := uint64(0); i < bloomHashes; i++ {
+		word, mask := b.probe(h, i)
+		b.bits[word] |= mask
+	}
+	b.count++
+}
+
+// Reports whether h may have been added. A false result is certain.
+func (b *bucketBloom) Has(h Hash) bool {
+	for i := uint64(0); i < bloomHashes; i++ {
+		word, mask := b.probe(h, i)
+		if b.bits[word] & mask == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,37 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func testHash(i int) Hash {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(i))
+	return Hash(sha256.Sum256(buf[:]))
+}
+
+func TestBucketBloom(t *testing.T) {
+	n := 10000
+	b := newBucketBloom(uint64(10 * n))
+	for i := 0; i < n; i++ {
+		b.Add(testHash(i))
+	}
+	for i := 0; i < n; i++ {
+		assert.True(t, b.Has(testHash(i)))
+	}
+	fp := 0
+	for i := n; i < 2 * n; i++ {
+		if b.Has(testHash(i)) {
+			fp++
+		}
+	}
+	assert.True(t, fp < n / 50)
+	assert.True(t, b.count > n - n / 50)
+}
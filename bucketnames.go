@@ -0,0 +1,98 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A bucket file whose name isn't the canonical BucketPath of the hash it
+// names: the hex is (partly) uppercase, or the file sits under directories
+// that don't match the hash's prefix. Uppercase names are invisible to the
+// ordinary listings, whose patterns are lowercase, so the bucket is reported
+// missing; misplaced ones are listed but can't be fetched by hash.
+type BucketNameAnomaly struct {
+	Path string
+	Bucket Hash
+	Canonical string
+	// Whether the listing also held a file at exactly Canonical. Note that
+	// Exists isn't a reliable way to tell on a case-insensitive filesystem,
+	// where it finds the anomalous file itself.
+	CanonicalPresent bool
+}
+
+// Lists every bucket file case-insensitively and returns those whose names
+// aren't canonical.
+func (a *Archive) FindBucketNameAnomalies() ([]BucketNameAnomaly, error) {
+	rx := regexp.MustCompile("(?i)bucket/[0-9a-f]{2}/[0-9a-f]{2}/[0-9a-f]{2}/" +
+		"bucket-([0-9a-f]{64})\\.xdr\\.gz$")
+	sch, errs := a.backend.ListFiles("bucket")
+	errs = makeErrorPump(errs)
+	listed := make(map[string]bool)
+	anomalies := []BucketNameAnomaly{}
+	for s := range sch {
+		m := rx.FindStringSubmatch(s)
+		if m == nil {
+			continue
+		}
+		listed[m[0]] = true
+		bucket := MustDecodeHash(strings.ToLower(m[1]))
+		canonical := BucketPath(bucket)
+		if m[0] != canonical {
+			anomalies = append(anomalies, BucketNameAnomaly{
+				Path: m[0],
+				Bucket: bucket,
+				Canonical: canonical,
+			})
+		}
+	}
+	if n := drainErrors(errs); n != 0 {
+		return anomalies, fmt.Errorf("%d errors while listing buckets", n)
+	}
+	for i := range anomalies {
+		anomalies[i].CanonicalPresent = listed[anomalies[i].Canonical]
+	}
+	return anomalies, nil
+}
+
+func (a *Archive) movePath(from string, to string) error {
+	return a.backend.RenameFile(from, to)
+}
+
+// Renames every anomalous bucket file to its canonical path, or, if a file
+// is already at the canonical path, deletes the anomalous one. A rename goes
+// through a temporary name, since on a case-insensitive filesystem the
+// anomalous and canonical names are the same file. Honours opts.DryRun.
+func (a *Archive) RepairBucketNameAnomalies(opts *CommandOptions) error {
+	anomalies, err := a.FindBucketNameAnomalies()
+	if err != nil {
+		return err
+	}
+	logf("Found %d misnamed buckets", len(anomalies))
+	var errs uint32
+	for _, an := range anomalies {
+		if an.CanonicalPresent {
+			errs += noteError(a.deletePath(an.Path, opts))
+			continue
+		}
+		if opts.DryRun {
+			logf("dryrun skipping rename of %s to %s", an.Path, an.Canonical)
+			continue
+		}
+		logf("Renaming %s to %s", an.Path, an.Canonical)
+		tmp := an.Canonical + ".tmp"
+		err = a.movePath(an.Path, tmp)
+		if err == nil {
+			err = a.movePath(tmp, an.Canonical)
+		}
+		errs += noteError(err)
+	}
+	if errs != 0 {
+		return fmt.Errorf("%d errors while repairing bucket names", errs)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"strings"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucketNameAnomalies(t *testing.T) {
+	defer cleanup()
+	arch := GetRandomPopulatedArchive()
+	has, _ := arch.GetCheckpointHAS(0x7f)
+	upper := MustDecodeHash(has.CurrentBuckets[0].Curr)
+	moved := MustDecodeHash(has.CurrentBuckets[0].Snap)
+	dup := MustDecodeHash(has.CurrentBuckets[1].Curr)
+
+	upcased := func(h Hash) string {
+		return strings.Replace(BucketPath(h), h.String(),
+			strings.ToUpper(h.String()), 1)
+	}
+	upperPath := upcased(upper)
+	assert.Nil(t, arch.movePath(BucketPath(upper), upperPath))
+	movedPath := "bucket/00/00/00/bucket-" + moved.String() + ".xdr.gz"
+	assert.Nil(t, arch.movePath(BucketPath(moved), movedPath))
+	rdr, _ := arch.backend.GetFile(BucketPath(dup))
+	assert.Nil(t, arch.backend.PutFile(upcased(dup), rdr))
+
+	opts := testOptions()
+	arch.Scan(opts)
+	assert.Equal(t, map[Hash]bool{upper:true}, arch.CheckBucketsMissing())
+	assert.False(t, arch.BucketExists(moved))
+
+	anomalies, err := arch.FindBucketNameAnomalies()
+	assert.NoError(t, err)
+	assert.Len(t, anomalies, 3)
+	byBucket := make(map[Hash]BucketNameAnomaly)
+	for _, an := range anomalies {
+		byBucket[an.Bucket] = an
+	}
+	assert.Equal(t, upperPath, byBucket[upper].Path)
+	assert.False(t, byBucket[upper].CanonicalPresent)
+	assert.Equal(t, movedPath, byBucket[moved].Path)
+	assert.True(t, byBucket[dup].CanonicalPresent)
+
+	assert.Nil(t, arch.RepairBucketNameAnomalies(opts))
+	anomalies, err = arch.FindBucketNameAnomalies()
+	assert.NoError(t, err)
+	assert.Empty(t, anomalies)
+	arch.ClearCachedInfo()
+	assert.Equal(t, 0, countMissing(arch, opts))
+}
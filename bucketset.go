@@ -0,0 +1,81 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+var errBucketSetBloom = errors.New("A bucket set can't be saved from a bloom filter")
+
+// Notes every bucket listed in the file at pth, as written by
+// SaveBucketSet, as existing. Reports false, without error, if there is no
+// such file.
+func (arch *Archive) LoadBucketSet(pth string) (bool, error) {
+	f, err := os.Open(pth)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		h, err := DecodeHash(line)
+		if err != nil {
+			return false, fmt.Errorf("Bad bucket hash in %s: %s", pth, err)
+		}
+		arch.NoteExistingBucket(h)
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+	logf("Loaded %d known buckets from %s", n, pth)
+	return true, nil
+}
+
+// Writes the hashes of the buckets noted as existing to pth, one per line
+// in sorted order, replacing the file in one rename.
+func (arch *Archive) SaveBucketSet(pth string) error {
+	arch.mutex.Lock()
+	if arch.allBucketsBloom != nil {
+		arch.mutex.Unlock()
+		return errBucketSetBloom
+	}
+	hashes := make([]Hash, 0, len(arch.allBuckets))
+	for h, present := range arch.allBuckets {
+		if present {
+			hashes = append(hashes, h)
+		}
+	}
+	arch.mutex.Unlock()
+	sort.Sort(byHashString(hashes))
+
+	var buf bytes.Buffer
+	for _, h := range hashes {
+		fmt.Fprintln(&buf, h)
+	}
+	return writeFileAtomic(pth, buf.Bytes())
+}
+
+// Reports whether bucket has been noted as existing.
+func (arch *Archive) bucketNoted(bucket Hash) bool {
+	arch.mutex.Lock()
+	defer arch.mutex.Unlock()
+	return arch.bucketExistsLocked(bucket)
+}
@@ -0,0 +1,95 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"errors"
+)
+
+// Returned by a wrapping backend's optional method when the backend it
+// wraps hasn't got that capability.
+var ErrCapabilityUnsupported = errors.New("Wrapped backend doesn't support this")
+
+// Backends that wrap another, forwarding its optional capabilities. They
+// have the methods of each capability they forward whether or not the
+// backend they wrap has it, so a type assertion on the wrapper can't tell
+// whether it's really there; the asX functions below look down the chain.
+type wrappingBackend interface {
+	wrappedBackend() ArchiveBackend
+}
+
+// Whether b, and every backend it wraps, passes has.
+func allBackendsHave(b ArchiveBackend, has func(ArchiveBackend) bool) bool {
+	for {
+		if !has(b) {
+			return false
+		}
+		w, ok := b.(wrappingBackend)
+		if !ok {
+			return true
+		}
+		b = w.wrappedBackend()
+	}
+}
+
+func asConditionalPutter(b ArchiveBackend) (ConditionalPutter, bool) {
+	if !allBackendsHave(b, func(b ArchiveBackend) bool {
+		_, ok := b.(ConditionalPutter)
+		return ok
+	}) {
+		return nil, false
+	}
+	return b.(ConditionalPutter), true
+}
+
+func asRangeGetter(b ArchiveBackend) (RangeGetter, bool) {
+	if !allBackendsHave(b, func(b ArchiveBackend) bool {
+		_, ok := b.(RangeGetter)
+		return ok
+	}) {
+		return nil, false
+	}
+	return b.(RangeGetter), true
+}
+
+func asModTimeGetter(b ArchiveBackend) (ModTimeGetter, bool) {
+	if !allBackendsHave(b, func(b ArchiveBackend) bool {
+		_, ok := b.(ModTimeGetter)
+		return ok
+	}) {
+		return nil, false
+	}
+	return b.(ModTimeGetter), true
+}
+
+func asModTimeSetter(b ArchiveBackend) (ModTimeSetter, bool) {
+	if !allBackendsHave(b, func(b ArchiveBackend) bool {
+		_, ok := b.(ModTimeSetter)
+		return ok
+	}) {
+		return nil, false
+	}
+	return b.(ModTimeSetter), true
+}
+
+func asDirectCopier(b ArchiveBackend) (DirectCopier, bool) {
+	if !allBackendsHave(b, func(b ArchiveBackend) bool {
+		_, ok := b.(DirectCopier)
+		return ok
+	}) {
+		return nil, false
+	}
+	return b.(DirectCopier), true
+}
+
+func asPartialUploader(b ArchiveBackend) (PartialUploader, bool) {
+	if !allBackendsHave(b, func(b ArchiveBackend) bool {
+		_, ok := b.(PartialUploader)
+		return ok
+	}) {
+		return nil, false
+	}
+	return b.(PartialUploader), true
+}
@@ -0,0 +1,303 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// One backend response in a cassette, which is a sequence of these as
+// JSON, one per line. Which fields are used depends on Op.
+type CassetteEntry struct {
+	Op string                    `json:"op"`
+	Path string                  `json:"path,omitempty"`
+	Exists bool                  `json:"exists,omitempty"`
+	Size int64                   `json:"size,omitempty"`
+	Data []byte                  `json:"data,omitempty"`
+	Files []string               `json:"files,omitempty"`
+	Err string                   `json:"err,omitempty"`
+	ListErrs []string            `json:"listErrs,omitempty"`
+}
+
+var ErrReplayReadOnly = errors.New("Replayed backend can't be written")
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// Turns a recorded error back into an error; ErrListingUnsupported is
+// restored as itself, for callers to recognise.
+func stringError(s string) error {
+	if s == "" {
+		return nil
+	}
+	if s == ErrListingUnsupported.Error() {
+		return ErrListingUnsupported
+	}
+	return errors.New(s)
+}
+
+// A backend that passes every call to another and records the response to
+// each read (Exists, GetFileSize, GetFile and ListFiles, with any errors)
+// in a cassette, for ReplayBackend to serve later: a failure seen against
+// a real archive can then be reproduced in a test. Connect installs it
+// when ConnectOptions.Cassette is set. Writes pass through unrecorded, as
+// do the inner backend's optional capabilities that write; those that read
+// are hidden, so every read goes through a call the replay can answer.
+// GetFile reads each file whole, to record it, before returning it.
+type RecordingArchiveBackend struct {
+	inner ArchiveBackend
+	mutex sync.Mutex
+	enc *json.Encoder
+}
+
+func (b *RecordingArchiveBackend) record(e CassetteEntry) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.enc.Encode(&e); err != nil {
+		logf("Error: recording %s %s: %s", e.Op, e.Path, err)
+	}
+}
+
+func (b *RecordingArchiveBackend) Exists(pth string) bool {
+	ok := b.inner.Exists(pth)
+	b.record(CassetteEntry{Op: "Exists", Path: pth, Exists: ok})
+	return ok
+}
+
+func (b *RecordingArchiveBackend) GetFile(pth string) (io.ReadCloser, error) {
+	rdr, err := b.inner.GetFile(pth)
+	var buf []byte
+	if err == nil {
+		buf, err = ioutil.ReadAll(rdr)
+		rdr.Close()
+	}
+	b.record(CassetteEntry{Op: "GetFile", Path: pth, Data: buf, Err: errorString(err)})
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(buf)), nil
+}
+
+func (b *RecordingArchiveBackend) GetFileSize(pth string) (int64, error) {
+	sz, err := b.inner.GetFileSize(pth)
+	b.record(CassetteEntry{Op: "GetFileSize", Path: pth, Size: sz, Err: errorString(err)})
+	return sz, err
+}
+
+func (b *RecordingArchiveBackend) PutFile(pth string, in io.ReadCloser) error {
+	return b.inner.PutFile(pth, in)
+}
+
+func (b *RecordingArchiveBackend) DeleteFile(pth string) error {
+	return b.inner.DeleteFile(pth)
+}
+
+func (b *RecordingArchiveBackend) RenameFile(from string, to string) error {
+	return b.inner.RenameFile(from, to)
+}
+
+func (b *RecordingArchiveBackend) ListFiles(pth string) (chan string, chan error) {
+	sch, serrs := b.inner.ListFiles(pth)
+	ch := make(chan string)
+	errs := make(chan error)
+	e := CassetteEntry{Op: "ListFiles", Path: pth, Files: []string{}}
+	errsDone := make(chan bool)
+	go func() {
+		defer close(errs)
+		for err := range serrs {
+			e.ListErrs = append(e.ListErrs, errorString(err))
+			errs <- err
+		}
+		close(errsDone)
+	}()
+	// Recorded before ch closes, so that the cassette is complete once
+	// the caller has read the listing.
+	go func() {
+		defer close(ch)
+		for s := range sch {
+			e.Files = append(e.Files, s)
+			ch <- s
+		}
+		<-errsDone
+		b.record(e)
+	}()
+	return ch, makeErrorPump(errs)
+}
+
+func (b *RecordingArchiveBackend) CanListFiles() bool {
+	return b.inner.CanListFiles()
+}
+
+func (b *RecordingArchiveBackend) wrappedBackend() ArchiveBackend {
+	return b.inner
+}
+
+func (b *RecordingArchiveBackend) FileVersion(pth string) (string, error) {
+	cond, ok := b.inner.(ConditionalPutter)
+	if !ok {
+		return "", ErrCapabilityUnsupported
+	}
+	return cond.FileVersion(pth)
+}
+
+func (b *RecordingArchiveBackend) PutFileIfVersion(pth string, version string, in io.ReadCloser) error {
+	cond, ok := b.inner.(ConditionalPutter)
+	if !ok {
+		in.Close()
+		return ErrCapabilityUnsupported
+	}
+	return cond.PutFileIfVersion(pth, version, in)
+}
+
+func (b *RecordingArchiveBackend) SetFileModTime(pth string, t time.Time) error {
+	s, ok := b.inner.(ModTimeSetter)
+	if !ok {
+		return ErrCapabilityUnsupported
+	}
+	return s.SetFileModTime(pth, t)
+}
+
+func (b *RecordingArchiveBackend) CopyFileFrom(src ArchiveBackend, pth string) (int64, error) {
+	copier, ok := b.inner.(DirectCopier)
+	if !ok {
+		return 0, ErrDirectCopyUnsupported
+	}
+	return copier.CopyFileFrom(src, pth)
+}
+
+// Wraps inner to record its responses to cassette. Whether inner can list
+// is recorded first, for the replay to answer the same.
+func RecordingBackend(inner ArchiveBackend, cassette io.Writer) ArchiveBackend {
+	b := &RecordingArchiveBackend{
+		inner: inner,
+		enc: json.NewEncoder(cassette),
+	}
+	b.record(CassetteEntry{Op: "CanListFiles", Exists: inner.CanListFiles()})
+	return b
+}
+
+// A backend serving the responses a RecordingArchiveBackend recorded. A
+// call is answered with the responses recorded for the same call on the
+// same path, in recorded order; once they run out the last is repeated.
+// A call that was never recorded is an error (or, for Exists, false), and
+// every write fails with ErrReplayReadOnly.
+type ReplayArchiveBackend struct {
+	mutex sync.Mutex
+	canList bool
+	entries map[string][]CassetteEntry
+}
+
+func (b *ReplayArchiveBackend) next(op string, pth string) (CassetteEntry, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	key := op + " " + pth
+	q := b.entries[key]
+	if len(q) == 0 {
+		return CassetteEntry{}, false
+	}
+	if len(q) > 1 {
+		b.entries[key] = q[1:]
+	}
+	return q[0], true
+}
+
+func notRecorded(op string, pth string) error {
+	return fmt.Errorf("No recorded response to %s %s", op, pth)
+}
+
+func (b *ReplayArchiveBackend) Exists(pth string) bool {
+	e, _ := b.next("Exists", pth)
+	return e.Exists
+}
+
+func (b *ReplayArchiveBackend) GetFile(pth string) (io.ReadCloser, error) {
+	e, ok := b.next("GetFile", pth)
+	if !ok {
+		return nil, notRecorded("GetFile", pth)
+	}
+	if e.Err != "" {
+		return nil, stringError(e.Err)
+	}
+	return ioutil.NopCloser(bytes.NewReader(e.Data)), nil
+}
+
+func (b *ReplayArchiveBackend) GetFileSize(pth string) (int64, error) {
+	e, ok := b.next("GetFileSize", pth)
+	if !ok {
+		return 0, notRecorded("GetFileSize", pth)
+	}
+	return e.Size, stringError(e.Err)
+}
+
+func (b *ReplayArchiveBackend) PutFile(pth string, in io.ReadCloser) error {
+	in.Close()
+	return ErrReplayReadOnly
+}
+
+func (b *ReplayArchiveBackend) DeleteFile(pth string) error {
+	return ErrReplayReadOnly
+}
+
+func (b *ReplayArchiveBackend) RenameFile(from string, to string) error {
+	return ErrReplayReadOnly
+}
+
+func (b *ReplayArchiveBackend) ListFiles(pth string) (chan string, chan error) {
+	ch := make(chan string)
+	errs := make(chan error)
+	e, ok := b.next("ListFiles", pth)
+	go func() {
+		defer close(ch)
+		defer close(errs)
+		if !ok {
+			errs <- notRecorded("ListFiles", pth)
+			return
+		}
+		for _, s := range e.Files {
+			ch <- s
+		}
+		for _, s := range e.ListErrs {
+			errs <- stringError(s)
+		}
+	}()
+	return ch, makeErrorPump(errs)
+}
+
+func (b *ReplayArchiveBackend) CanListFiles() bool {
+	return b.canList
+}
+
+// Reads a cassette written by a RecordingArchiveBackend, to serve it.
+func ReplayBackend(cassette io.Reader) (ArchiveBackend, error) {
+	b := &ReplayArchiveBackend{entries: make(map[string][]CassetteEntry)}
+	dec := json.NewDecoder(cassette)
+	for {
+		var e CassetteEntry
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			return b, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Reading cassette: %s", err)
+		}
+		if e.Op == "CanListFiles" {
+			b.canList = e.Exists
+			continue
+		}
+		key := e.Op + " " + e.Path
+		b.entries[key] = append(b.entries[key], e)
+	}
+}
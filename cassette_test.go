@@ -0,0 +1,43 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordReplay(t *testing.T) {
+	defer cleanup()
+	src := GetRandomPopulatedArchive()
+	var cassette bytes.Buffer
+	recorded := ConnectBackend(RecordingBackend(src.backend, &cassette), nil)
+	opts := testOptions()
+	assert.Nil(t, recorded.Scan(opts))
+	_, err := recorded.backend.GetFile("missing/file")
+	assert.Error(t, err)
+
+	replay, err := ReplayBackend(bytes.NewReader(cassette.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, src.backend.CanListFiles(), replay.CanListFiles())
+	replayed := ConnectBackend(replay, nil)
+	opts = testOptions()
+	assert.Nil(t, replayed.Scan(opts))
+	assert.Equal(t, 0, countMissing(replayed, opts))
+
+	// Recorded errors come back, and unrecorded calls fail.
+	_, err = replay.GetFile("missing/file")
+	assert.Error(t, err)
+	_, err = replay.GetFile("never/asked")
+	assert.Error(t, err)
+	assert.Equal(t, ErrReplayReadOnly,
+		replay.PutFile("x", ioutil.NopCloser(strings.NewReader("x"))))
+
+	_, err = ReplayBackend(strings.NewReader("{"))
+	assert.Error(t, err)
+}
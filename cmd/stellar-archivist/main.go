@@ -9,8 +9,10 @@ import (
 	"github.com/codegangsta/cli"
 	"fmt"
 	"log"
+	"encoding/json"
 	_ "net/http/pprof"
 	"net/http"
+	"net/url"
 	"github.com/stellar/archivist"
 )
 
@@ -36,6 +38,10 @@ type Options struct {
 	High int
 	Last int
 	Profile bool
+	Quiet bool
+	Json bool
+	S3Inventory string
+	CoverageIndex bool
 	CommandOpts archivist.CommandOptions
 	ConnectOpts archivist.ConnectOptions
 }
@@ -64,12 +70,38 @@ func (opts *Options) MaybeProfile() {
 	}
 }
 
+func printMissingJson(arch *archivist.Archive, opts *archivist.CommandOptions) error {
+	report, e := arch.MissingReport(opts.Range)
+	if e != nil {
+		return e
+	}
+	buf, e := json.MarshalIndent(report, "", "    ")
+	if e != nil {
+		return e
+	}
+	fmt.Printf("%s\n", buf)
+	return nil
+}
+
 func scan(a string, opts *Options) {
 	arch := archivist.MustConnect(a, &opts.ConnectOpts)
 	opts.SetRange(arch)
-	e1 := arch.Scan(&opts.CommandOpts)
-	e2 := arch.ReportMissing(&opts.CommandOpts)
+	var e1 error
+	if opts.S3Inventory != "" {
+		e1 = scanS3Inventory(arch, a, opts)
+	} else {
+		e1 = arch.Scan(&opts.CommandOpts)
+	}
+	var e2 error
+	if opts.Json {
+		e2 = printMissingJson(arch, &opts.CommandOpts)
+	} else {
+		e2 = arch.ReportMissing(&opts.CommandOpts)
+	}
 	e3 := arch.ReportInvalid(&opts.CommandOpts)
+	if e1 == nil && opts.CoverageIndex {
+		e1 = arch.WriteCoverageIndex(opts.CommandOpts.Range)
+	}
 	if e1 != nil {
 		log.Fatal(e1)
 	}
@@ -81,6 +113,28 @@ func scan(a string, opts *Options) {
 	}
 }
 
+// Fills in the scan state of arch, at URL a, from the S3 inventory whose
+// manifest is at the s3:// URL in opts, listing nothing.
+func scanS3Inventory(arch *archivist.Archive, a string, opts *Options) error {
+	inv, e := url.Parse(opts.S3Inventory)
+	if e != nil {
+		return e
+	}
+	if inv.Scheme != "s3" {
+		return fmt.Errorf("S3 inventory manifest must be an s3:// URL, not '%s'", opts.S3Inventory)
+	}
+	src, e := url.Parse(a)
+	if e != nil {
+		return e
+	}
+	backend := archivist.MakeS3Backend(inv.Host, "", &opts.ConnectOpts)
+	e = arch.IngestS3Inventory(backend, inv.Path, src.Path)
+	if e != nil {
+		return e
+	}
+	return arch.ScanBuckets(&opts.CommandOpts)
+}
+
 func mirror(src string, dst string, opts *Options) {
 	srcArch := archivist.MustConnect(src, &opts.ConnectOpts)
 	dstArch := archivist.MustConnect(dst, &opts.ConnectOpts)
@@ -103,6 +157,37 @@ func repair(src string, dst string, opts *Options) {
 	}
 }
 
+func purge(a string, opts *Options) {
+	arch := archivist.MustConnect(a, &opts.ConnectOpts)
+	opts.SetRange(nil)
+	e := archivist.PurgeRange(arch, &opts.CommandOpts)
+	if e != nil {
+		log.Fatal(e)
+	}
+}
+
+func plan(src string, dst string, opts *Options) {
+	srcArch := archivist.MustConnect(src, &opts.ConnectOpts)
+	dstArch := archivist.MustConnect(dst, &opts.ConnectOpts)
+	opts.SetRange(srcArch)
+	log.Printf("planning %v -> %v\n", src, dst)
+	p, e := archivist.ReconcileWithOptions(srcArch, dstArch, &opts.CommandOpts)
+	if e != nil {
+		log.Fatal(e)
+	}
+	for _, pth := range p.CheckpointFiles {
+		fmt.Printf("%s\n", pth)
+	}
+	for _, bucket := range p.Buckets {
+		fmt.Printf("%s\n", archivist.BucketPath(bucket))
+	}
+	fmt.Printf("\n")
+	fmt.Printf("         Range: %s\n", p.Range)
+	fmt.Printf("   Checkpoints: %d files\n", len(p.CheckpointFiles))
+	fmt.Printf("       Buckets: %d files\n", len(p.Buckets))
+	fmt.Printf("     Est. size: %d bytes\n", p.EstimatedBytes)
+}
+
 func main() {
 
 	var opts Options
@@ -135,12 +220,60 @@ func main() {
 			Value: 32,
 			Destination: &opts.CommandOpts.Concurrency,
 		},
+		&cli.IntFlag{
+			Name: "verify-concurrency",
+			Usage: "most files to verify concurrently (default: no limit beyond --concurrency)",
+			Value: 0,
+			Destination: &opts.CommandOpts.VerifyConcurrency,
+		},
+		&cli.IntFlag{
+			Name: "category-concurrency",
+			Usage: "most of a checkpoint's category files to mirror concurrently",
+			Value: 1,
+			Destination: &opts.CommandOpts.CategoryConcurrency,
+		},
+		&cli.IntFlag{
+			Name: "prefix-depth",
+			Usage: "number of hex path components in listed prefixes (1-3)",
+			Value: 0,
+			Destination: &opts.CommandOpts.ListPrefixDepth,
+		},
+		&cli.IntFlag{
+			Name: "has-prefetch",
+			Usage: "number of checkpoint HAS files to fetch ahead while scanning buckets",
+			Destination: &opts.CommandOpts.HASPrefetch,
+		},
 		&cli.StringFlag{
 			Name: "s3region",
 			Usage: "S3 region to connect to",
 			Value: "us-east-1",
 			Destination: &opts.ConnectOpts.S3Region,
 		},
+		&cli.StringFlag{
+			Name: "fs-temp-dir",
+			Usage: "directory to stage file:// writes in (same filesystem as the archive)",
+			Destination: &opts.ConnectOpts.FsTempDir,
+		},
+		&cli.StringFlag{
+			Name: "bucket-set",
+			Usage: "file keeping the set of existing buckets between scans",
+			Destination: &opts.CommandOpts.BucketSetFile,
+		},
+		&cli.StringFlag{
+			Name: "s3-inventory",
+			Usage: "scan from the S3 inventory with this s3:// manifest.json, not by listing",
+			Destination: &opts.S3Inventory,
+		},
+		&cli.StringFlag{
+			Name: "metrics-file",
+			Usage: "write Prometheus textfile metrics here after mirror, repair or scan",
+			Destination: &opts.CommandOpts.MetricsFile,
+		},
+		&cli.StringFlag{
+			Name: "root-has-path",
+			Usage: "path of the root HAS, if not " + archivist.DefaultRootHASPath,
+			Destination: &opts.ConnectOpts.RootHASPath,
+		},
 		&cli.BoolFlag{
 			Name: "dryrun, n",
 			Usage: "describe file-writes, but do not perform any",
@@ -161,11 +294,91 @@ func main() {
 			Usage: "decode and re-encode all buckets",
 			Destination: &opts.CommandOpts.Thorough,
 		},
+		&cli.BoolFlag{
+			Name: "strict-range",
+			Usage: "fail if the source doesn't cover the requested range",
+			Destination: &opts.CommandOpts.StrictRange,
+		},
+		&cli.IntFlag{
+			Name: "retries",
+			Usage: "number of times to retry a failed copy",
+			Destination: &opts.CommandOpts.CopyRetries,
+		},
+		&cli.IntFlag{
+			Name: "retry-budget",
+			Usage: "abort after this many retries in total (0 for no limit)",
+			Destination: &opts.CommandOpts.RetryBudget,
+		},
+		&cli.BoolFlag{
+			Name: "preserve-mtime",
+			Usage: "give copied files their source's modification time",
+			Destination: &opts.CommandOpts.PreserveModTime,
+		},
+		&cli.BoolFlag{
+			Name: "verify-existing",
+			Usage: "check files already at the destination, and recopy any that fail",
+			Destination: &opts.CommandOpts.VerifyExisting,
+		},
+		&cli.BoolFlag{
+			Name: "optimistic-root-has",
+			Usage: "never move the destination's root HAS back to an earlier ledger",
+			Destination: &opts.CommandOpts.OptimisticRootHAS,
+		},
+		&cli.BoolFlag{
+			Name: "skip-buckets",
+			Usage: "repair only checkpoint files",
+			Destination: &opts.CommandOpts.SkipBuckets,
+		},
+		&cli.BoolFlag{
+			Name: "buckets-only",
+			Usage: "repair only buckets",
+			Destination: &opts.CommandOpts.BucketsOnly,
+		},
+		&cli.BoolFlag{
+			Name: "repair-corrupt",
+			Usage: "also re-fetch files the repair scan finds corrupt",
+			Destination: &opts.CommandOpts.RepairCorrupt,
+		},
+		&cli.BoolFlag{
+			Name: "strict-has",
+			Usage: "reject HAS files with fields this version doesn't know",
+			Destination: &opts.ConnectOpts.StrictHAS,
+		},
+		&cli.BoolFlag{
+			Name: "read-only",
+			Usage: "refuse to write to any archive, so a command can only inspect",
+			Destination: &opts.ConnectOpts.ReadOnly,
+		},
+		&cli.DurationFlag{
+			Name: "deadline",
+			Usage: "stop scanning after this long, reporting what was found",
+			Destination: &opts.CommandOpts.Deadline,
+		},
+		&cli.BoolFlag{
+			Name: "json",
+			Usage: "print scan report as JSON",
+			Destination: &opts.Json,
+		},
+		&cli.BoolFlag{
+			Name: "coverage-index",
+			Usage: "after a scan, write " + archivist.CoverageIndexPath,
+			Destination: &opts.CoverageIndex,
+		},
 		&cli.BoolFlag{
 			Name: "profile",
 			Usage: "collect and serve profile locally",
 			Destination: &opts.Profile,
 		},
+		&cli.BoolFlag{
+			Name: "quiet, q",
+			Usage: "suppress progress and error logging",
+			Destination: &opts.Quiet,
+		},
+	}
+
+	app.Before = func(c *cli.Context) error {
+		archivist.SetQuiet(opts.Quiet)
+		return nil
 	}
 
 	app.Commands = []cli.Command{
@@ -206,6 +419,23 @@ func main() {
 				repair(src, dst, &opts)
 			},
 		},
+		{
+			Name: "purge",
+			Action: func(c *cli.Context) {
+				purge(c.Args().First(), &opts)
+			},
+		},
+		{
+			Name: "plan",
+			Action: func(c *cli.Context) {
+				src := c.Args()[0]
+				dst := c.Args()[1]
+				if len(c.Args()) != 2 || src == "" || dst == "" {
+					log.Fatal("require exactly 2 arguments")
+				}
+				plan(src, dst, &opts)
+			},
+		},
 		{
 			Name: "dumpxdr",
 			Action: func(c *cli.Context) {
@@ -0,0 +1,319 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"github.com/ulikunitz/xz"
+	"github.com/klauspost/compress/zstd"
+)
+
+// A compression format for XDR checkpoint files. Files compressed with it
+// end in ".xdr." followed by Ext, and begin with Magic, by which readers
+// recognise it whatever the file is called. A codec with no NewWriter can
+// only be read.
+type Codec struct {
+	Name string
+	Ext string
+	Magic []byte
+	NewReader func(io.Reader) (io.ReadCloser, error)
+	NewWriter func(io.Writer) (io.WriteCloser, error)
+}
+
+// The standard codec; the only one stellar-core reads or writes. Buckets
+// are always gzipped, whatever codec the category files use.
+var GzipCodec = Codec{
+	Name: "gzip",
+	Ext: "gz",
+	Magic: []byte{0x1f, 0x8b},
+	NewReader: func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	},
+}
+
+// Read-only codecs for legacy files compressed otherwise than with gzip.
+// Since readers go by magic bytes, a bucket or category file in one of
+// these reads the same as a gzipped one, even if it's named ".xdr.gz";
+// mirroring copies it as it is.
+var Bzip2Codec = Codec{
+	Name: "bzip2",
+	Ext: "bz2",
+	Magic: []byte("BZh"),
+	NewReader: func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	},
+}
+
+var XzCodec = Codec{
+	Name: "xz",
+	Ext: "xz",
+	Magic: []byte{0xfd, '7', 'z', 'X', 'Z', 0x00},
+	NewReader: func(r io.Reader) (io.ReadCloser, error) {
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xr), nil
+	},
+}
+
+// A codec that compresses better and decompresses faster than gzip, for
+// archives only archivist-based tools read.
+var ZstdCodec = Codec{
+	Name: "zstd",
+	Ext: "zst",
+	Magic: []byte{0x28, 0xb5, 0x2f, 0xfd},
+	NewReader: func(r io.Reader) (io.ReadCloser, error) {
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	},
+	NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		return zw, nil
+	},
+}
+
+var codecRegistryMutex sync.Mutex
+var codecRegistry = map[string]Codec{
+	GzipCodec.Name: GzipCodec,
+	Bzip2Codec.Name: Bzip2Codec,
+	XzCodec.Name: XzCodec,
+	ZstdCodec.Name: ZstdCodec,
+}
+
+// Makes a codec available for reading and, through
+// ConnectOptions.CategoryCodec, for writing; e.g. one built on an lz4
+// package, with Ext "lz4". An archive using anything but gzip is
+// non-standard, and only readable by archivist-based tools that have
+// registered the same codec. Like RegisterBackend, this panics if the name
+// is registered twice.
+func RegisterCodec(c Codec) {
+	codecRegistryMutex.Lock()
+	defer codecRegistryMutex.Unlock()
+	if c.NewReader == nil || len(c.Magic) == 0 {
+		panic("archivist: RegisterCodec needs a reader and magic bytes")
+	}
+	if _, dup := codecRegistry[c.Name]; dup {
+		panic("archivist: RegisterCodec called twice for codec " + c.Name)
+	}
+	codecRegistry[c.Name] = c
+}
+
+func lookupCodec(name string) (Codec, bool) {
+	codecRegistryMutex.Lock()
+	defer codecRegistryMutex.Unlock()
+	c, ok := codecRegistry[name]
+	return c, ok
+}
+
+// Returns the codec whose extension pth ends in.
+func codecForPath(pth string) (Codec, bool) {
+	codecRegistryMutex.Lock()
+	defer codecRegistryMutex.Unlock()
+	for _, c := range codecRegistry {
+		if strings.HasSuffix(pth, ".xdr." + c.Ext) {
+			return c, true
+		}
+	}
+	return Codec{}, false
+}
+
+// Returns the codec whose magic bytes begin buf.
+func codecForMagic(buf []byte) (Codec, bool) {
+	codecRegistryMutex.Lock()
+	defer codecRegistryMutex.Unlock()
+	for _, c := range codecRegistry {
+		if bytes.HasPrefix(buf, c.Magic) {
+			return c, true
+		}
+	}
+	return Codec{}, false
+}
+
+var ErrUnknownCodec = errors.New("Stream doesn't start with any known codec's magic bytes")
+
+type decompressingReader struct {
+	io.ReadCloser
+	in io.ReadCloser
+}
+
+func (d *decompressingReader) Close() error {
+	d.ReadCloser.Close()
+	return d.in.Close()
+}
+
+// Decompresses in with whichever registered codec its first bytes identify.
+// Closing the result closes in. Gzip members are concatenated (see
+// GzipConcatenate).
+func NewDecompressingReader(in io.ReadCloser) (io.ReadCloser, error) {
+	return newDecompressingReader(in, GzipConcatenate)
+}
+
+func newDecompressingReader(in io.ReadCloser, gz GzipTrailing) (io.ReadCloser, error) {
+	br := bufio.NewReader(in)
+	// Short files yield a short peek, and are matched on what there is.
+	head, _ := br.Peek(16)
+	c, ok := codecForMagic(head)
+	if !ok {
+		in.Close()
+		return nil, ErrUnknownCodec
+	}
+	var rdr io.ReadCloser
+	var err error
+	if c.Name == GzipCodec.Name {
+		rdr, err = newGzipReader(br, gz)
+	} else {
+		rdr, err = c.NewReader(br)
+	}
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+	return &decompressingReader{ReadCloser: rdr, in: in}, nil
+}
+
+// Returns cs with every gzipped category switched to the named codec.
+func (cs CategorySet) WithCodec(name string) (CategorySet, error) {
+	c, ok := lookupCodec(name)
+	if !ok {
+		return cs, fmt.Errorf("Unknown codec '%s'", name)
+	}
+	if c.NewWriter == nil {
+		return cs, fmt.Errorf("Codec '%s' can only be read", name)
+	}
+	out := make(CategorySet, len(cs))
+	for i, cat := range cs {
+		if cat.Ext == "xdr." + GzipCodec.Ext {
+			cat.Ext = "xdr." + c.Ext
+		}
+		out[i] = cat
+	}
+	return out, nil
+}
+
+var transcodeCategoryRx = regexp.MustCompile("^([^/]+)" + hexPrefixPat + "([^/]+)-([0-9a-f]{8})\\.xdr\\.[^/.]+$")
+
+// Returns where CommandOptions.Transcode writes pth in dst, and the codec
+// it's compressed with there: for a category file, dst's name and codec
+// for it; for a bucket, the same name and gzip, with the hash its content
+// is checked against. Anything else, such as a HAS file, isn't transcoded.
+func (dst *Archive) transcodeTarget(pth string) (to string, c Codec, bucket *Hash, ok bool) {
+	if m := bucketPathRx.FindStringSubmatch(pth); m != nil {
+		h := MustDecodeHash(m[1])
+		return pth, GzipCodec, &h, true
+	}
+	m := transcodeCategoryRx.FindStringSubmatch(pth)
+	if m == nil || m[1] != m[2] {
+		return pth, c, nil, false
+	}
+	if _, known := dst.categories.lookup(m[1]); !known {
+		return pth, c, nil, false
+	}
+	chk, _ := strconv.ParseUint(m[3], 16, 32)
+	to = dst.CategoryCheckpointPath(m[1], uint32(chk))
+	c, ok = codecForPath(to)
+	if !ok || c.NewWriter == nil {
+		return pth, c, nil, false
+	}
+	return to, c, nil, true
+}
+
+// The reading end of a transcodeReader. Closing it stops the transcoding
+// goroutine and waits for it to finish, so that the caller can then close
+// the source without racing it.
+type transcoder struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+func (t *transcoder) Close() error {
+	t.PipeReader.Close()
+	<-t.done
+	return nil
+}
+
+// Returns a reader of in, in whichever codec its magic bytes identify,
+// recompressed with c. If bucket is set, reading the result fails at the
+// end unless the content hashed to it. The result must be closed, even
+// if it wasn't read to the end; in is left for the caller to close, after
+// it.
+func transcodeReader(in io.Reader, gz GzipTrailing, c Codec, bucket *Hash) (io.ReadCloser, error) {
+	zr, err := newDecompressingReader(ioutil.NopCloser(in), gz)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	t := &transcoder{PipeReader: pr, done: make(chan struct{})}
+	go func() {
+		defer close(t.done)
+		defer zr.Close()
+		hsh := sha256.New()
+		var content io.Reader = zr
+		if bucket != nil {
+			content = io.TeeReader(zr, hsh)
+		}
+		w, err := c.NewWriter(pw)
+		if err == nil {
+			_, err = io.Copy(w, content)
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err == nil && bucket != nil {
+			err = checkBucketHash(hsh, *bucket)
+		}
+		pw.CloseWithError(err)
+	}()
+	return t, nil
+}
+
+// Compresses in, which must be uncompressed XDR, with the codec the
+// category's extension names, and stores it as the category's file for
+// checkpoint chk.
+func (a *Archive) PutCategoryCheckpointXdr(cat string, chk uint32, in io.Reader) error {
+	pth := a.CategoryCheckpointPath(cat, chk)
+	c, ok := codecForPath(pth)
+	if !ok || c.NewWriter == nil {
+		return fmt.Errorf("No codec to write %s", pth)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := c.NewWriter(pw)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		_, err = io.Copy(w, in)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		pw.CloseWithError(err)
+	}()
+	err := a.backend.PutFile(pth, pr)
+	// Unblocks the compressor if PutFile gave up early.
+	pr.Close()
+	return err
+}
@@ -0,0 +1,218 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+// A codec registered as a user of the package would.
+var testZlibCodec = Codec{
+	Name: "zlib-test",
+	Ext: "zz",
+	Magic: []byte{0x78, 0x9c},
+	NewReader: func(r io.Reader) (io.ReadCloser, error) {
+		return zlib.NewReader(r)
+	},
+	NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+		return zlib.NewWriter(w), nil
+	},
+}
+
+func init() {
+	RegisterCodec(testZlibCodec)
+}
+
+func TestCategoryCodec(t *testing.T) {
+	_, e := Connect("mock://test", &ConnectOptions{CategoryCodec: "nonesuch"})
+	assert.Error(t, e)
+
+	arch := MustConnect("mock://test", &ConnectOptions{CategoryCodec: "zlib-test"})
+	pth := arch.CategoryCheckpointPath("ledger", 0x7f)
+	assert.Equal(t, "ledger/00/00/00/ledger-0000007f.xdr.zz", pth)
+	assert.Equal(t, "history/00/00/00/history-0000007f.json",
+		arch.CategoryCheckpointPath("history", 0x7f))
+
+	// Two XDR records, of 4 and 8 bytes.
+	var raw bytes.Buffer
+	binary.Write(&raw, binary.BigEndian, uint32(0x80000004))
+	raw.Write([]byte{1, 2, 3, 4})
+	binary.Write(&raw, binary.BigEndian, uint32(0x80000008))
+	raw.Write(make([]byte, 8))
+	assert.Nil(t, arch.PutCategoryCheckpointXdr("ledger", 0x7f, &raw))
+
+	rdr, _ := arch.backend.GetFile(pth)
+	head := make([]byte, 2)
+	io.ReadFull(rdr, head)
+	assert.Equal(t, testZlibCodec.Magic, head)
+
+	ch, errs := arch.ListCategoryCheckpoints("ledger", "00")
+	chks := []uint32{}
+	for chk := range ch {
+		chks = append(chks, chk)
+	}
+	assert.Equal(t, uint32(0), drainErrors(errs))
+	assert.Equal(t, []uint32{0x7f}, chks)
+
+	x, e := arch.GetXdrStream(pth)
+	assert.NoError(t, e)
+	n, e := x.SkipFrames()
+	assert.NoError(t, e)
+	assert.Equal(t, 2, n)
+}
+
+func TestZstdCodec(t *testing.T) {
+	defer cleanup()
+	rng := Range{Low:63, High:0xbf}
+	src := GetTestArchive()
+	for chk := range rng.Checkpoints() {
+		assert.Nil(t, src.AddVerifiableCheckpoint(chk))
+	}
+	zst := ConnectBackend(MakeMockBackend(nil), &ConnectOptions{CategoryCodec: "zstd"})
+	opts := &CommandOptions{Range:rng, Concurrency:4, Transcode:true}
+	assert.Nil(t, Mirror(src, zst, opts))
+	pth := zst.CategoryCheckpointPath("ledger", 0x7f)
+	assert.Equal(t, "ledger/00/00/00/ledger-0000007f.xdr.zst", pth)
+	rdr, err := zst.backend.GetFile(pth)
+	assert.Nil(t, err)
+	head := make([]byte, 4)
+	io.ReadFull(rdr, head)
+	rdr.Close()
+	assert.Equal(t, ZstdCodec.Magic, head)
+	assert.Nil(t, zst.Scan(&CommandOptions{Range:rng, Concurrency:4, Verify:true}))
+
+	// And back, byte for byte once decompressed.
+	gz := GetTestArchive()
+	opts = &CommandOptions{Range:rng, Concurrency:4, Transcode:true}
+	assert.Nil(t, Mirror(zst, gz, opts))
+	for _, cat := range []string{"ledger", "transactions", "results", "scp"} {
+		for chk := range rng.Checkpoints() {
+			want, err := src.backend.GetFile(src.CategoryCheckpointPath(cat, chk))
+			assert.Nil(t, err)
+			got, err := gz.backend.GetFile(gz.CategoryCheckpointPath(cat, chk))
+			assert.Nil(t, err)
+			assert.Equal(t, gunzipAll(t, want), gunzipAll(t, got))
+		}
+	}
+}
+
+func gunzipAll(t *testing.T, rdr io.ReadCloser) []byte {
+	defer rdr.Close()
+	zr, err := gzip.NewReader(rdr)
+	assert.Nil(t, err)
+	buf, err := ioutil.ReadAll(zr)
+	assert.Nil(t, err)
+	return buf
+}
+
+// The two XDR records of TestCategoryCodec, compressed by the xz and bzip2
+// command-line tools.
+var legacyXz = []byte{
+	0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00, 0x00, 0x04, 0xe6, 0xd6, 0xb4, 0x46,
+	0x02, 0x00, 0x21, 0x01, 0x16, 0x00, 0x00, 0x00, 0x74, 0x2f, 0xe5, 0xa3,
+	0xe0, 0x00, 0x13, 0x00, 0x11, 0x5d, 0x00, 0x40, 0x00, 0x2c, 0x08, 0x00,
+	0xf9, 0x2b, 0xaf, 0x87, 0xb5, 0x3b, 0xa2, 0xf8, 0x30, 0xe4, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0xa3, 0x7a, 0x65, 0x62, 0x01, 0x22, 0x99, 0xff,
+	0x00, 0x01, 0x2d, 0x14, 0xb9, 0x3b, 0x76, 0x1a, 0x1f, 0xb6, 0xf3, 0x7d,
+	0x01, 0x00, 0x00, 0x00, 0x00, 0x04, 0x59, 0x5a,
+}
+
+var legacyBzip2 = []byte{
+	0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x02, 0x9a,
+	0x63, 0x29, 0x00, 0x00, 0x07, 0xc0, 0x40, 0x7c, 0x40, 0x40, 0x00, 0x20,
+	0x00, 0x21, 0xa7, 0xa8, 0xc4, 0x21, 0x80, 0x85, 0x03, 0x2b, 0x9c, 0xa8,
+	0xd7, 0x8b, 0xb9, 0x22, 0x9c, 0x28, 0x48, 0x01, 0x4d, 0x31, 0x94, 0x80,
+}
+
+func TestLegacyCodecs(t *testing.T) {
+	var raw bytes.Buffer
+	binary.Write(&raw, binary.BigEndian, uint32(0x80000004))
+	raw.Write([]byte{1, 2, 3, 4})
+	binary.Write(&raw, binary.BigEndian, uint32(0x80000008))
+	raw.Write(make([]byte, 8))
+	bucket := Hash(sha256.Sum256(raw.Bytes()))
+
+	for _, compressed := range [][]byte{legacyXz, legacyBzip2} {
+		arch := GetTestMockArchive()
+		// Named as gzipped files, as in the archives that have them.
+		pth := arch.CategoryCheckpointPath("ledger", 0x7f)
+		assert.Nil(t, arch.backend.PutFile(pth,
+			ioutil.NopCloser(bytes.NewReader(compressed))))
+		x, e := arch.GetXdrStream(pth)
+		assert.NoError(t, e)
+		n, e := x.SkipFrames()
+		assert.NoError(t, e)
+		assert.Equal(t, 2, n)
+
+		assert.Nil(t, arch.backend.PutFile(BucketPath(bucket),
+			ioutil.NopCloser(bytes.NewReader(compressed))))
+		assert.NoError(t, arch.VerifyBucketHash(bucket))
+	}
+
+	// They can't be written.
+	_, e := Connect("mock://test", &ConnectOptions{CategoryCodec: "xz"})
+	assert.Error(t, e)
+	_, e = DefaultCategorySet().WithCodec("bzip2")
+	assert.Error(t, e)
+}
+
+func TestTranscode(t *testing.T) {
+	defer cleanup()
+	rng := Range{Low:63, High:0xbf}
+	src := GetTestArchive()
+	for chk := range rng.Checkpoints() {
+		assert.Nil(t, src.AddVerifiableCheckpoint(chk))
+	}
+	zz := ConnectBackend(MakeMockBackend(nil), &ConnectOptions{CategoryCodec: "zlib-test"})
+	opts := &CommandOptions{Range:rng, Concurrency:4, Transcode:true}
+	assert.Nil(t, Mirror(src, zz, opts))
+	assert.Nil(t, zz.Scan(&CommandOptions{Range:rng, Concurrency:4, Verify:true}))
+	assert.Equal(t, 0, countMissing(zz, &CommandOptions{Range:rng, Concurrency:4}))
+	rdr, err := zz.backend.GetFile(zz.CategoryCheckpointPath("ledger", 0x7f))
+	assert.Nil(t, err)
+	head := make([]byte, 2)
+	io.ReadFull(rdr, head)
+	assert.Equal(t, testZlibCodec.Magic, head)
+
+	// And back, to files named and compressed as the source's were.
+	gz := GetTestArchive()
+	opts = &CommandOptions{Range:rng, Concurrency:4, Transcode:true}
+	assert.Nil(t, Mirror(zz, gz, opts))
+	assert.Equal(t, 0, countMissing(gz, &CommandOptions{Range:rng, Concurrency:4}))
+	assert.Nil(t, VerifyCategoryFile(gz, "ledger", 0x7f))
+
+	// A bucket whose content doesn't match its hash isn't written.
+	bucket := BucketPath(firstBucket(src))
+	assert.Nil(t, src.backend.PutFile(bucket, ioutil.NopCloser(bytes.NewReader(gzipped([]byte("junk"))))))
+	dst := GetTestArchive()
+	opts = &CommandOptions{Range:rng, Concurrency:4, Transcode:true}
+	assert.Error(t, Mirror(src, dst, opts))
+	assert.False(t, dst.backend.Exists(bucket))
+
+	// Closing a transcoder nobody reads, as when PutFile fails, stops it
+	// rather than leaving it blocked on the pipe.
+	big := make([]byte, 1 << 20)
+	tr, err := transcodeReader(bytes.NewReader(gzipped(big)), GzipConcatenate, testZlibCodec, nil)
+	assert.Nil(t, err)
+	closed := make(chan struct{})
+	go func() {
+		tr.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("transcoder didn't stop when closed")
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+var ErrFileChanged = errors.New("File changed since it was read")
+
+// How many times an optimistic root HAS write re-reads the root HAS and
+// tries again after losing a race with another writer.
+const rootHASWriteAttempts = 5
+
+// Backends that can replace a file only if nobody else has since it was
+// read, for optimistic concurrency between writers.
+type ConditionalPutter interface {
+	// Returns a token standing for the file's current content, or "" if
+	// there is no file.
+	FileVersion(path string) (string, error)
+	// As PutFile, but fails with ErrFileChanged unless the file is still
+	// at version ("" meaning there is still no file).
+	PutFileIfVersion(path string, version string, in io.ReadCloser) error
+}
+
+// Returns the hex SHA-256 of pth's content, or "" if there is no such
+// file: a version for backends with no cheaper one.
+func contentVersion(b ArchiveBackend, pth string) (string, error) {
+	if !b.Exists(pth) {
+		return "", nil
+	}
+	rdr, err := b.GetFile(pth)
+	if err != nil {
+		return "", err
+	}
+	defer rdr.Close()
+	hsh := sha256.New()
+	if _, err = io.Copy(hsh, rdr); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hsh.Sum(nil)), nil
+}
+
+// Writes has as the root HAS unless another writer's root HAS is already
+// at or past it, reading the current one first and writing only if it's
+// unchanged since, so that a slow mirror can't regress the root HAS a
+// faster one wrote. Losing a race, it reads again and retries.
+func (a *Archive) putRootHASOptimistic(has HistoryArchiveState) error {
+	cond, ok := asConditionalPutter(a.backend)
+	if !ok {
+		return fmt.Errorf("Optimistic root HAS writes need a backend with conditional writes")
+	}
+	var buf bytes.Buffer
+	if err := has.Encode(&buf); err != nil {
+		return err
+	}
+	for attempt := 0; attempt < rootHASWriteAttempts; attempt++ {
+		// The version is read first, so a HAS written in between makes
+		// the write fail rather than be overwritten.
+		version, err := cond.FileVersion(a.rootHASPath)
+		if err != nil {
+			return err
+		}
+		if version != "" {
+			current, err := a.GetRootHAS()
+			if err != nil {
+				return err
+			}
+			if current.CurrentLedger >= has.CurrentLedger {
+				logf("Leaving root HAS at ledger 0x%8.8x, not moving it back to 0x%8.8x",
+					current.CurrentLedger, has.CurrentLedger)
+				return nil
+			}
+		}
+		err = cond.PutFileIfVersion(a.rootHASPath, version,
+			ioutil.NopCloser(bytes.NewReader(buf.Bytes())))
+		if err != ErrFileChanged {
+			return err
+		}
+		logf("Root HAS changed while writing it, retrying")
+	}
+	return fmt.Errorf("Writing root HAS: %s %d times", ErrFileChanged, rootHASWriteAttempts)
+}
@@ -0,0 +1,254 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+)
+
+// A backend that stores every file other than a bucket by the SHA-256 of
+// its content, under content/, and records where each one went in a small
+// index object under index/<name>/ holding the hex hash. Buckets are named
+// by hash already and are stored as usual. Several archives (say, one per
+// network) can then share a single store, each with its own index name,
+// and any category file that's identical across them is only stored once.
+//
+// Paths given to the backend are the ordinary archive paths, so an Archive
+// wrapping it reads and writes the layout transparently. Deleting a file
+// only removes its index entry, as other indexes may share the content.
+// The inner backend's optional capabilities are forwarded, acting on the
+// index entry (or, for ranged reads, the content) for a file other than a
+// bucket, but for direct copies of such files, which are left to be
+// streamed, and incomplete uploads, whose paths aren't archive paths.
+type ContentAddressedArchiveBackend struct {
+	inner ArchiveBackend
+	index string
+}
+
+func ContentPath(h Hash) string {
+	return path.Join("content", HashPrefix(h).Path(), h.String())
+}
+
+func isBucketPath(pth string) bool {
+	return strings.HasPrefix(pth, "bucket/") || pth == "bucket"
+}
+
+func (b *ContentAddressedArchiveBackend) indexPath(pth string) string {
+	return path.Join("index", b.index, pth)
+}
+
+// Returns the path of the content the index entry for pth names.
+func (b *ContentAddressedArchiveBackend) resolve(pth string) (string, error) {
+	rdr, err := b.inner.GetFile(b.indexPath(pth))
+	if err != nil {
+		return "", err
+	}
+	defer rdr.Close()
+	buf, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return "", err
+	}
+	h, err := DecodeHash(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return "", fmt.Errorf("Bad index entry for %s: %s", pth, err)
+	}
+	return ContentPath(h), nil
+}
+
+func (b *ContentAddressedArchiveBackend) Exists(pth string) bool {
+	if isBucketPath(pth) {
+		return b.inner.Exists(pth)
+	}
+	return b.inner.Exists(b.indexPath(pth))
+}
+
+func (b *ContentAddressedArchiveBackend) GetFile(pth string) (io.ReadCloser, error) {
+	if isBucketPath(pth) {
+		return b.inner.GetFile(pth)
+	}
+	cpth, err := b.resolve(pth)
+	if err != nil {
+		return nil, err
+	}
+	return b.inner.GetFile(cpth)
+}
+
+func (b *ContentAddressedArchiveBackend) GetFileSize(pth string) (int64, error) {
+	if isBucketPath(pth) {
+		return b.inner.GetFileSize(pth)
+	}
+	cpth, err := b.resolve(pth)
+	if err != nil {
+		return 0, err
+	}
+	return b.inner.GetFileSize(cpth)
+}
+
+// Stores in's content, if the store doesn't already hold it, and returns
+// the index entry naming it.
+func (b *ContentAddressedArchiveBackend) storeContent(in io.ReadCloser) (io.ReadCloser, error) {
+	buf, err := ioutil.ReadAll(in)
+	in.Close()
+	if err != nil {
+		return nil, err
+	}
+	h := Hash(sha256.Sum256(buf))
+	cpth := ContentPath(h)
+	if !b.inner.Exists(cpth) {
+		err = b.inner.PutFile(cpth, ioutil.NopCloser(bytes.NewReader(buf)))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ioutil.NopCloser(strings.NewReader(h.String())), nil
+}
+
+// Stores the content first, if the store doesn't already hold it, and only
+// then the index entry, so an entry never names missing content.
+func (b *ContentAddressedArchiveBackend) PutFile(pth string, in io.ReadCloser) error {
+	if isBucketPath(pth) {
+		return b.inner.PutFile(pth, in)
+	}
+	entry, err := b.storeContent(in)
+	if err != nil {
+		return err
+	}
+	return b.inner.PutFile(b.indexPath(pth), entry)
+}
+
+func (b *ContentAddressedArchiveBackend) DeleteFile(pth string) error {
+	if isBucketPath(pth) {
+		return b.inner.DeleteFile(pth)
+	}
+	return b.inner.DeleteFile(b.indexPath(pth))
+}
+
+// Moves only the index entry; the content stays where it is.
+func (b *ContentAddressedArchiveBackend) RenameFile(from string, to string) error {
+	if isBucketPath(from) && isBucketPath(to) {
+		return b.inner.RenameFile(from, to)
+	}
+	if isBucketPath(from) || isBucketPath(to) {
+		return fmt.Errorf("Can't rename between bucket and non-bucket paths: %s, %s",
+			from, to)
+	}
+	return b.inner.RenameFile(b.indexPath(from), b.indexPath(to))
+}
+
+// Lists buckets as usual, and anything else by listing the index and
+// mapping its entries back to the paths they stand for.
+func (b *ContentAddressedArchiveBackend) ListFiles(pth string) (chan string, chan error) {
+	if isBucketPath(pth) {
+		return b.inner.ListFiles(pth)
+	}
+	marker := path.Join("index", b.index) + "/"
+	ich, errs := b.inner.ListFiles(b.indexPath(pth))
+	ch := make(chan string)
+	go func() {
+		for f := range ich {
+			if i := strings.Index(f, marker); i >= 0 {
+				f = f[:i] + f[i+len(marker):]
+			}
+			ch <- f
+		}
+		close(ch)
+	}()
+	return ch, errs
+}
+
+func (b *ContentAddressedArchiveBackend) CanListFiles() bool {
+	return b.inner.CanListFiles()
+}
+
+func (b *ContentAddressedArchiveBackend) wrappedBackend() ArchiveBackend {
+	return b.inner
+}
+
+// The path in the inner backend of the file, or index entry, for pth.
+func (b *ContentAddressedArchiveBackend) entryPath(pth string) string {
+	if isBucketPath(pth) {
+		return pth
+	}
+	return b.indexPath(pth)
+}
+
+func (b *ContentAddressedArchiveBackend) FileVersion(pth string) (string, error) {
+	cond, ok := b.inner.(ConditionalPutter)
+	if !ok {
+		return "", ErrCapabilityUnsupported
+	}
+	return cond.FileVersion(b.entryPath(pth))
+}
+
+// The content is stored before the index entry is conditionally written,
+// so losing the race leaves, at worst, content no entry names.
+func (b *ContentAddressedArchiveBackend) PutFileIfVersion(pth string, version string, in io.ReadCloser) error {
+	cond, ok := b.inner.(ConditionalPutter)
+	if !ok {
+		in.Close()
+		return ErrCapabilityUnsupported
+	}
+	if isBucketPath(pth) {
+		return cond.PutFileIfVersion(pth, version, in)
+	}
+	entry, err := b.storeContent(in)
+	if err != nil {
+		return err
+	}
+	return cond.PutFileIfVersion(b.indexPath(pth), version, entry)
+}
+
+func (b *ContentAddressedArchiveBackend) GetFileRange(pth string, offset int64, length int64) (io.ReadCloser, error) {
+	g, ok := b.inner.(RangeGetter)
+	if !ok {
+		return nil, ErrCapabilityUnsupported
+	}
+	if isBucketPath(pth) {
+		return g.GetFileRange(pth, offset, length)
+	}
+	cpth, err := b.resolve(pth)
+	if err != nil {
+		return nil, err
+	}
+	return g.GetFileRange(cpth, offset, length)
+}
+
+func (b *ContentAddressedArchiveBackend) GetFileModTime(pth string) (time.Time, error) {
+	g, ok := b.inner.(ModTimeGetter)
+	if !ok {
+		return time.Time{}, ErrCapabilityUnsupported
+	}
+	return g.GetFileModTime(b.entryPath(pth))
+}
+
+func (b *ContentAddressedArchiveBackend) SetFileModTime(pth string, t time.Time) error {
+	s, ok := b.inner.(ModTimeSetter)
+	if !ok {
+		return ErrCapabilityUnsupported
+	}
+	return s.SetFileModTime(b.entryPath(pth), t)
+}
+
+func (b *ContentAddressedArchiveBackend) CopyFileFrom(src ArchiveBackend, pth string) (int64, error) {
+	copier, ok := b.inner.(DirectCopier)
+	if !ok || !isBucketPath(pth) {
+		return 0, ErrDirectCopyUnsupported
+	}
+	return copier.CopyFileFrom(src, pth)
+}
+
+func ContentAddressedBackend(inner ArchiveBackend, index string) ArchiveBackend {
+	return &ContentAddressedArchiveBackend{
+		inner: inner,
+		index: index,
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrMirrorStopped = errors.New("Mirror stopped")
+
+// Lets another goroutine pause, resume or stop a running Mirror given it in
+// CommandOptions.Controller. Workers check it between files, so a pause or
+// stop takes effect once the copies in flight finish; paused workers sleep
+// rather than poll. A stopped Mirror doesn't write the root HAS, and
+// returns ErrMirrorStopped.
+type MirrorController struct {
+	mutex sync.Mutex
+	cond *sync.Cond
+	paused bool
+	stopped bool
+}
+
+func NewMirrorController() *MirrorController {
+	c := &MirrorController{}
+	c.cond = sync.NewCond(&c.mutex)
+	return c
+}
+
+func (c *MirrorController) Pause() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.paused = true
+}
+
+func (c *MirrorController) Resume() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.paused = false
+	c.cond.Broadcast()
+}
+
+// Stops the Mirror for good, waking any paused workers.
+func (c *MirrorController) Stop() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.stopped = true
+	c.cond.Broadcast()
+}
+
+func (c *MirrorController) Paused() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.paused
+}
+
+// Blocks while paused, then reports whether work may go on. A nil
+// controller never pauses or stops.
+func (c *MirrorController) proceed() bool {
+	if c == nil {
+		return true
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for c.paused && !c.stopped {
+		c.cond.Wait()
+	}
+	return !c.stopped
+}
+
+func (c *MirrorController) isStopped() bool {
+	if c == nil {
+		return false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.stopped
+}
@@ -0,0 +1,81 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sync"
+	"sync/atomic"
+)
+
+// Number of prefixes CountObjects lists at once.
+const countConcurrency = 16
+
+type countObjectsReq struct {
+	pth string
+	rx *regexp.Regexp
+	count *int64
+}
+
+// Counts the bucket files and the checkpoint files (of every category) in
+// the archive by listing it, keeping only the tallies, so memory use is
+// fixed however large the archive. The listing is split by first hex path
+// component, and those prefixes are listed concurrently.
+func (a *Archive) CountObjects() (buckets, checkpoints int, err error) {
+	if !a.backend.CanListFiles() {
+		return 0, 0, fmt.Errorf("Counting objects needs a backend that can list")
+	}
+	var nBuckets, nCheckpoints int64
+	rxs := map[string]*regexp.Regexp{
+		"bucket": bucketFileRx,
+	}
+	for _, cat := range a.Categories() {
+		rxs[cat] = a.categoryFileRx(cat)
+	}
+
+	req := make(chan countObjectsReq)
+	go func() {
+		for dir, rx := range rxs {
+			count := &nCheckpoints
+			if dir == "bucket" {
+				count = &nBuckets
+			}
+			for i := 0; i < 0x100; i++ {
+				pth := path.Join(dir, fmt.Sprintf("%02x", i))
+				req <- countObjectsReq{pth: pth, rx: rx, count: count}
+			}
+		}
+		close(req)
+	}()
+
+	var errs uint32
+	var wg sync.WaitGroup
+	wg.Add(countConcurrency)
+	for i := 0; i < countConcurrency; i++ {
+		go func() {
+			for r := range req {
+				ch, es := a.backend.ListFiles(r.pth)
+				es = makeErrorPump(es)
+				n := int64(0)
+				for s := range ch {
+					if r.rx.MatchString(s) {
+						n++
+					}
+				}
+				atomic.AddInt64(r.count, n)
+				atomic.AddUint32(&errs, drainErrors(es))
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+
+	if errs != 0 {
+		err = fmt.Errorf("%d errors while counting objects", errs)
+	}
+	return int(nBuckets), int(nCheckpoints), err
+}
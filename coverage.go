@@ -0,0 +1,292 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Where WriteCoverageIndex puts the coverage index.
+const CoverageIndexPath = ".well-known/archive-coverage.json"
+
+// The version of the coverage index schema written. It changes only if a
+// field's meaning does; fields may be added without a change, and readers
+// ignore fields they don't know.
+const CoverageIndexVersion = 1
+
+// An index of which checkpoints an archive holds, written next to the root
+// HAS so that clients of a sparse or partially mirrored archive can learn
+// what it covers without probing it. Ranges run from first checkpoint to
+// last, as coalesced ranges do elsewhere.
+type CoverageIndex struct {
+	Version int `json:"version"`
+	// The range the scan the index was made from covered; nothing is
+	// claimed about checkpoints outside it.
+	Range Range `json:"range"`
+	// Checkpoints with every required category's file. Their buckets
+	// weren't checked, so may still be missing.
+	Present []Range `json:"present"`
+	// For each category, the checkpoints with its file.
+	Categories map[string][]Range `json:"categories"`
+}
+
+// Which checkpoints of a category are present in every archive, in some but
+// not all, and in none.
+type CheckpointCoverage struct {
+	All []Range `json:"all"`
+	Some []Range `json:"some"`
+	None []Range `json:"none"`
+}
+
+// The combined coverage of several archives over a range, as produced by
+// AggregateCoverage. Buckets are those referenced by any archive's
+// checkpoints in the range; archives are identified by their index in the
+// slice AggregateCoverage was given.
+type CoverageReport struct {
+	Range Range `json:"range"`
+	Checkpoints map[string]CheckpointCoverage `json:"checkpoints"`
+	BucketsInAll int `json:"bucketsInAll"`
+	// Buckets held by some archives but not all, with the indices of the
+	// archives that hold them.
+	BucketsInSome map[Hash][]int `json:"bucketsInSome"`
+	BucketsInNone []Hash `json:"bucketsInNone"`
+}
+
+// Scans every archive over opts.Range, concurrently, and merges the results
+// into a single report. The archives all use the same categories as the
+// first. An archive whose scan fails still contributes whatever it scanned;
+// the error is returned alongside the report.
+func AggregateCoverage(archives []*Archive, opts *CommandOptions) (CoverageReport, error) {
+	report := CoverageReport{
+		Range: opts.Range,
+		Checkpoints: make(map[string]CheckpointCoverage),
+		BucketsInSome: make(map[Hash][]int),
+		BucketsInNone: []Hash{},
+	}
+	if len(archives) == 0 {
+		return report, fmt.Errorf("No archives to aggregate")
+	}
+
+	var errs uint32
+	var wg sync.WaitGroup
+	wg.Add(len(archives))
+	for _, arch := range archives {
+		go func(arch *Archive) {
+			// Each archive is scanned over the requested range rather than
+			// its own, as their root HAS files may well differ.
+			archOpts := *opts
+			e := arch.scanCheckpointsInRange(&archOpts)
+			if e == nil {
+				e = arch.ScanBuckets(&archOpts)
+			}
+			atomic.AddUint32(&errs, noteError(e))
+			wg.Done()
+		}(arch)
+	}
+	wg.Wait()
+	logf("Scanned %d archives, merging coverage", len(archives))
+
+	// Snapshot each archive's state in turn, never holding two locks.
+	present := make([]map[string]map[uint32]bool, len(archives))
+	referenced := make(map[Hash]bool)
+	for i, arch := range archives {
+		present[i] = make(map[string]map[uint32]bool)
+		arch.mutex.Lock()
+		for cat, chks := range arch.checkpointFiles {
+			present[i][cat] = make(map[uint32]bool, len(chks))
+			for chk, ok := range chks {
+				present[i][cat][chk] = ok
+			}
+		}
+		for bucket := range arch.referencedBuckets {
+			referenced[bucket] = true
+		}
+		arch.mutex.Unlock()
+	}
+
+	cats := archives[0].Categories()
+	for _, cat := range cats {
+		var all, some, none []uint32
+		for chk := range opts.Range.Checkpoints() {
+			n := 0
+			for i := range archives {
+				if present[i][cat][chk] {
+					n++
+				}
+			}
+			switch n {
+			case len(archives):
+				all = append(all, chk)
+			case 0:
+				none = append(none, chk)
+			default:
+				some = append(some, chk)
+			}
+		}
+		report.Checkpoints[cat] = CheckpointCoverage{
+			All: coalesceCheckpoints(all),
+			Some: coalesceCheckpoints(some),
+			None: coalesceCheckpoints(none),
+		}
+	}
+
+	holders := make(map[Hash][]int, len(referenced))
+	for i, arch := range archives {
+		// An archive that can't list only knows about the buckets it
+		// references itself; probe it for the rest.
+		probe := []Hash{}
+		arch.mutex.Lock()
+		for bucket := range referenced {
+			if arch.bucketExistsLocked(bucket) {
+				holders[bucket] = append(holders[bucket], i)
+			} else if !arch.backend.CanListFiles() && !arch.referencedBuckets[bucket] {
+				probe = append(probe, bucket)
+			}
+		}
+		arch.mutex.Unlock()
+		for _, bucket := range probe {
+			if arch.BucketExists(bucket) {
+				holders[bucket] = append(holders[bucket], i)
+			}
+		}
+	}
+	for bucket := range referenced {
+		switch len(holders[bucket]) {
+		case len(archives):
+			report.BucketsInAll++
+		case 0:
+			report.BucketsInNone = append(report.BucketsInNone, bucket)
+		default:
+			sort.Ints(holders[bucket])
+			report.BucketsInSome[bucket] = holders[bucket]
+		}
+	}
+	sort.Sort(byHashString(report.BucketsInNone))
+
+	if errs != 0 {
+		return report, fmt.Errorf("%d errors while scanning archives", errs)
+	}
+	return report, nil
+}
+
+// Builds a CoverageIndex for rng from the scan state. Requires a prior
+// scan of rng.
+func (a *Archive) CoverageIndex(rng Range) CoverageIndex {
+	index := CoverageIndex{
+		Version: CoverageIndexVersion,
+		Range: rng,
+		Present: []Range{},
+		Categories: make(map[string][]Range),
+	}
+	cats := a.Categories()
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	complete := []uint32{}
+	present := make(map[string][]uint32)
+	rng.EachCheckpoint(func(chk uint32) error {
+		all := true
+		for _, cat := range cats {
+			if a.checkpointFiles[cat][chk] {
+				present[cat] = append(present[cat], chk)
+			} else if a.categoryRequired(cat) {
+				all = false
+			}
+		}
+		if all {
+			complete = append(complete, chk)
+		}
+		return nil
+	})
+	index.Present = coalesceCheckpoints(complete)
+	for _, cat := range cats {
+		index.Categories[cat] = coalesceCheckpoints(present[cat])
+	}
+	return index
+}
+
+// Number of requests the scan UncoveredRanges makes keeps in flight.
+const uncoveredScanConcurrency = 16
+
+// Scans the checkpoint files in rng and returns, coalesced, the checkpoints
+// with no file in any required category: the stretches of ledgers the
+// archive doesn't have at all, as opposed to the per-category gaps that
+// MissingRanges reports. Checkpoints past the root HAS are uncovered too.
+func (a *Archive) UncoveredRanges(rng Range) ([]Range, error) {
+	opts := &CommandOptions{Range: rng, Concurrency: uncoveredScanConcurrency}
+	if err := a.ScanCheckpoints(opts); err != nil {
+		return nil, err
+	}
+	missing, err := a.MissingRanges(opts.Range)
+	if err != nil {
+		return nil, err
+	}
+	var uncovered []Range
+	first := true
+	for _, cat := range a.Categories() {
+		if !a.categoryRequired(cat) {
+			continue
+		}
+		if first {
+			uncovered = missing[cat]
+			first = false
+		} else {
+			uncovered = intersectRanges(uncovered, missing[cat])
+		}
+	}
+	if uncovered == nil {
+		uncovered = []Range{}
+	}
+	if rng.High > opts.Range.High {
+		beyond := Range{Low: opts.Range.High + CheckpointFreq, High: rng.High}
+		n := len(uncovered)
+		if n > 0 && uncovered[n-1].High == opts.Range.High {
+			uncovered[n-1].High = beyond.High
+		} else {
+			uncovered = append(uncovered, beyond)
+		}
+	}
+	return uncovered, nil
+}
+
+// Writes the CoverageIndex for rng to CoverageIndexPath, replacing any
+// there. Requires a prior scan of rng.
+func (a *Archive) WriteCoverageIndex(rng Range) error {
+	buf, err := json.MarshalIndent(a.CoverageIndex(rng), "", "    ")
+	if err != nil {
+		return err
+	}
+	logf("Writing coverage index for %s", rng)
+	return a.backend.PutFile(CoverageIndexPath,
+		ioutil.NopCloser(bytes.NewReader(buf)))
+}
+
+// Reads the archive's coverage index. Reports false, without error, if it
+// has none, as archives written before the index existed don't, and an
+// error if it's of a later, incompatible version.
+func (a *Archive) ReadCoverageIndex() (CoverageIndex, bool, error) {
+	var index CoverageIndex
+	if !a.backend.Exists(CoverageIndexPath) {
+		return index, false, nil
+	}
+	rdr, err := a.backend.GetFile(CoverageIndexPath)
+	if err != nil {
+		return index, false, err
+	}
+	defer rdr.Close()
+	if err = json.NewDecoder(rdr).Decode(&index); err != nil {
+		return index, false, fmt.Errorf("Reading coverage index: %s", err)
+	}
+	if index.Version > CoverageIndexVersion {
+		return index, false, fmt.Errorf("Coverage index version %d is newer than %d",
+			index.Version, CoverageIndexVersion)
+	}
+	return index, true, nil
+}
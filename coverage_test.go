@@ -0,0 +1,108 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregateCoverage(t *testing.T) {
+	defer cleanup()
+	a := GetRandomPopulatedArchive()
+	b := GetTestArchive()
+	assert.Nil(t, Mirror(a, b, testOptions()))
+
+	has, _ := a.GetCheckpointHAS(0xbf)
+	onlyA := MustDecodeHash(has.CurrentBuckets[0].Curr)
+	onlyB := MustDecodeHash(has.CurrentBuckets[0].Snap)
+	neither := MustDecodeHash(has.CurrentBuckets[1].Curr)
+	b.backend.DeleteFile(BucketPath(onlyA))
+	a.backend.DeleteFile(BucketPath(onlyB))
+	a.backend.DeleteFile(BucketPath(neither))
+	b.backend.DeleteFile(BucketPath(neither))
+	b.backend.DeleteFile(CategoryCheckpointPath("ledger", 0x7f))
+
+	opts := testOptions()
+	opts.Range = MakeRange(0x3f, 0x37f)
+	report, err := AggregateCoverage([]*Archive{a, b}, opts)
+	assert.NoError(t, err)
+
+	ledger := report.Checkpoints["ledger"]
+	assert.Equal(t, []Range{{Low:0x7f, High:0x7f}}, ledger.Some)
+	assert.Empty(t, ledger.None)
+	assert.Equal(t, uint32(0x3f), ledger.All[0].Low)
+	assert.Empty(t, report.Checkpoints["history"].Some)
+	assert.Empty(t, report.Checkpoints["history"].None)
+
+	assert.Equal(t, map[Hash][]int{onlyA:{0}, onlyB:{1}}, report.BucketsInSome)
+	assert.Equal(t, []Hash{neither}, report.BucketsInNone)
+	assert.Equal(t, len(a.referencedBuckets) - 3, report.BucketsInAll)
+}
+
+func TestCoverageIndex(t *testing.T) {
+	defer cleanup()
+	arch := GetRandomPopulatedArchive()
+	_, ok, err := arch.ReadCoverageIndex()
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	arch.backend.DeleteFile(CategoryCheckpointPath("ledger", 0x7f))
+	arch.backend.DeleteFile(CategoryCheckpointPath("scp", 0xbf))
+	opts := testOptions()
+	assert.Nil(t, arch.ScanCheckpoints(opts))
+	assert.Nil(t, arch.WriteCoverageIndex(opts.Range))
+
+	index, ok, err := arch.ReadCoverageIndex()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, CoverageIndexVersion, index.Version)
+	assert.Equal(t, testRange(), index.Range)
+	// scp is optional, so its gap leaves the checkpoint present.
+	gapped := []Range{Range{Low:0x3f, High:0x3f}, Range{Low:0xbf, High:0x3bf}}
+	assert.Equal(t, gapped, index.Present)
+	assert.Equal(t, gapped, index.Categories["ledger"])
+	assert.Equal(t, []Range{Range{Low:0x3f, High:0x7f}, Range{Low:0xff, High:0x3bf}},
+		index.Categories["scp"])
+	assert.Equal(t, []Range{testRange()}, index.Categories["history"])
+
+	// Fields a later writer adds are ignored; a later version isn't.
+	arch.backend.PutFile(CoverageIndexPath, ioutil.NopCloser(strings.NewReader(
+		`{"version": 1, "range": {"low": 63, "high": 127}, "extra": true}`)))
+	index, ok, err = arch.ReadCoverageIndex()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(127), index.Range.High)
+	arch.backend.PutFile(CoverageIndexPath, ioutil.NopCloser(strings.NewReader(
+		`{"version": 2}`)))
+	_, _, err = arch.ReadCoverageIndex()
+	assert.Error(t, err)
+}
+
+func TestUncoveredRanges(t *testing.T) {
+	defer cleanup()
+	arch := GetRandomPopulatedArchive()
+	for _, chk := range []uint32{0x7f, 0xbf} {
+		for _, cat := range Categories() {
+			assert.Nil(t, arch.backend.DeleteFile(CategoryCheckpointPath(cat, chk)))
+		}
+	}
+	// A checkpoint left with only its optional category is uncovered; one
+	// missing only some required categories isn't.
+	for _, cat := range []string{"history", "ledger", "transactions", "results"} {
+		assert.Nil(t, arch.backend.DeleteFile(CategoryCheckpointPath(cat, 0x13f)))
+	}
+	assert.Nil(t, arch.backend.DeleteFile(CategoryCheckpointPath("ledger", 0x1bf)))
+
+	uncovered, err := arch.UncoveredRanges(Range{Low:0x3f, High:0x47f})
+	assert.Nil(t, err)
+	assert.Equal(t, []Range{
+		{Low:0x7f, High:0xbf},
+		{Low:0x13f, High:0x13f},
+		{Low:0x3ff, High:0x47f},
+	}, uncovered)
+}
@@ -0,0 +1,204 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Number of size lookups VerifyAgainstSource keeps in flight.
+const diffConcurrency = 32
+
+// A file present in both archives, with different sizes.
+type FileDiff struct {
+	Path string `json:"path"`
+	LocalSize int64 `json:"localSize"`
+	SourceSize int64 `json:"sourceSize"`
+}
+
+// The differences VerifyAgainstSource found between a copy and its source,
+// as sorted lists of archive paths. A report with no entries means the
+// copy matches.
+type DiffReport struct {
+	Range Range `json:"range"`
+	MissingLocally []string `json:"missingLocally"`
+	MissingInSource []string `json:"missingInSource"`
+	SizeMismatches []FileDiff `json:"sizeMismatches"`
+}
+
+type byDiffPath []FileDiff
+func (a byDiffPath) Len() int           { return len(a) }
+func (a byDiffPath) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byDiffPath) Less(i, j int) bool { return a[i].Path < a[j].Path }
+
+func (d *DiffReport) Empty() bool {
+	return len(d.MissingLocally) == 0 && len(d.MissingInSource) == 0 &&
+		len(d.SizeMismatches) == 0
+}
+
+type sizePair struct {
+	local int64
+	source int64
+}
+
+// Looks up the size of each path in both archives, concurrently; -1 stands
+// for a file that couldn't be sized, which is taken to be absent.
+func sizePairs(local *Archive, source *Archive, pths []string) map[string]sizePair {
+	sizes := make(map[string]sizePair, len(pths))
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	wg.Add(diffConcurrency)
+	req := make(chan string)
+	go func() {
+		for _, pth := range pths {
+			req <- pth
+		}
+		close(req)
+	}()
+	sizeOf := func(arch *Archive, pth string) int64 {
+		sz, e := arch.backend.GetFileSize(pth)
+		if e != nil {
+			return -1
+		}
+		return sz
+	}
+	for i := 0; i < diffConcurrency; i++ {
+		go func() {
+			for pth := range req {
+				p := sizePair{local: sizeOf(local, pth), source: sizeOf(source, pth)}
+				mutex.Lock()
+				sizes[pth] = p
+				mutex.Unlock()
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	return sizes
+}
+
+// Compares local, a copy, with source over rng (clamped to the source's
+// root HAS): every checkpoint file, and every bucket referenced by either
+// side's HAS files in the range, must be present on both sides with the
+// same size. Buckets are named by their hash, so a bucket of the right name
+// and size is taken to be the right one; category files are compared only
+// by size, so VerifyCategoryFile or a scan with Verify is still needed to
+// catch corruption that preserves size.
+func VerifyAgainstSource(local *Archive, source *Archive, rng Range) (DiffReport, error) {
+	report := DiffReport{
+		MissingLocally: []string{},
+		MissingInSource: []string{},
+		SizeMismatches: []FileDiff{},
+	}
+	root, err := source.GetRootHAS()
+	if err != nil {
+		return report, err
+	}
+	rng = rng.Clamp(root.Range())
+	report.Range = rng
+
+	pths := []string{}
+	for chk := range rng.Checkpoints() {
+		for _, cat := range source.Categories() {
+			pths = append(pths, source.CategoryCheckpointPath(cat, chk))
+		}
+	}
+	logf("Comparing %d checkpoint files", len(pths))
+	sizes := sizePairs(local, source, pths)
+
+	var localChks, sourceChks []uint32
+	for chk := range rng.Checkpoints() {
+		p := sizes[source.CheckpointHASPath(chk)]
+		if p.local >= 0 {
+			localChks = append(localChks, chk)
+		}
+		if p.source >= 0 {
+			sourceChks = append(sourceChks, chk)
+		}
+	}
+	refs, e1 := source.collectReferencedBuckets(sourceChks, diffConcurrency)
+	localRefs, e2 := local.collectReferencedBuckets(localChks, diffConcurrency)
+	for bucket := range localRefs {
+		refs[bucket] = true
+	}
+	bpths := make([]string, 0, len(refs))
+	for bucket := range refs {
+		bpths = append(bpths, BucketPath(bucket))
+	}
+	logf("Comparing %d referenced buckets", len(bpths))
+	for pth, p := range sizePairs(local, source, bpths) {
+		sizes[pth] = p
+	}
+
+	for pth, p := range sizes {
+		switch {
+		case p.local < 0 && p.source >= 0:
+			report.MissingLocally = append(report.MissingLocally, pth)
+		case p.source < 0 && p.local >= 0:
+			report.MissingInSource = append(report.MissingInSource, pth)
+		case p.local != p.source:
+			report.SizeMismatches = append(report.SizeMismatches, FileDiff{
+				Path: pth,
+				LocalSize: p.local,
+				SourceSize: p.source,
+			})
+		}
+	}
+	sort.Strings(report.MissingLocally)
+	sort.Strings(report.MissingInSource)
+	sort.Sort(byDiffPath(report.SizeMismatches))
+	logf("%d files missing locally, %d missing in source, %d differ in size",
+		len(report.MissingLocally), len(report.MissingInSource),
+		len(report.SizeMismatches))
+
+	if e1 != nil {
+		return report, e1
+	}
+	return report, e2
+}
+
+// Bytes of each bucket BucketsEqual compares at a time.
+const bucketCompareChunk = 64 * 1024
+
+// Reports whether bucket h has the same content in archives a and b. Both
+// are read through together a chunk at a time, so neither is ever held in
+// memory whole. What's compared is the gunzipped content, which h names:
+// files compressed differently still match. A bucket either archive can't
+// read, or can't gunzip, is an error.
+func BucketsEqual(a, b *Archive, h Hash) (bool, error) {
+	ra, err := a.openBucketContent(h)
+	if err != nil {
+		return false, err
+	}
+	defer ra.Close()
+	rb, err := b.openBucketContent(h)
+	if err != nil {
+		return false, err
+	}
+	defer rb.Close()
+	bufa := make([]byte, bucketCompareChunk)
+	bufb := make([]byte, bucketCompareChunk)
+	for {
+		na, ea := io.ReadFull(ra, bufa)
+		nb, eb := io.ReadFull(rb, bufb)
+		if ea != nil && ea != io.EOF && ea != io.ErrUnexpectedEOF {
+			return false, fmt.Errorf("Bucket %s: %s", h, ea)
+		}
+		if eb != nil && eb != io.EOF && eb != io.ErrUnexpectedEOF {
+			return false, fmt.Errorf("Bucket %s: %s", h, eb)
+		}
+		if na != nb || !bytes.Equal(bufa[:na], bufb[:nb]) {
+			return false, nil
+		}
+		// A short chunk is the last from both, as they're the same length.
+		if na < bucketCompareChunk {
+			return true, nil
+		}
+	}
+}
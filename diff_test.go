@@ -0,0 +1,83 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyAgainstSource(t *testing.T) {
+	defer cleanup()
+	src := GetRandomPopulatedArchive()
+	dst := GetTestArchive()
+	assert.Nil(t, Mirror(src, dst, testOptions()))
+	report, e := VerifyAgainstSource(dst, src, testRange())
+	assert.NoError(t, e)
+	assert.True(t, report.Empty())
+
+	bucket := BucketPath(firstBucket(src))
+	ledger := CategoryCheckpointPath("ledger", 0xbf)
+	results := CategoryCheckpointPath("results", 0xff)
+	assert.Nil(t, dst.backend.DeleteFile(bucket))
+	assert.Nil(t, dst.backend.DeleteFile(ledger))
+	assert.Nil(t, dst.backend.PutFile(results,
+		ioutil.NopCloser(strings.NewReader("short"))))
+	report, e = VerifyAgainstSource(dst, src, testRange())
+	assert.NoError(t, e)
+	assert.Equal(t, []string{bucket, ledger}, report.MissingLocally)
+	assert.Empty(t, report.MissingInSource)
+	assert.Equal(t, 1, len(report.SizeMismatches))
+	assert.Equal(t, results, report.SizeMismatches[0].Path)
+	assert.Equal(t, int64(5), report.SizeMismatches[0].LocalSize)
+}
+
+func putBucketContent(arch *Archive, h Hash, content []byte, level int) {
+	var buf bytes.Buffer
+	w, _ := gzip.NewWriterLevel(&buf, level)
+	w.Write(content)
+	w.Close()
+	arch.backend.PutFile(BucketPath(h), ioutil.NopCloser(&buf))
+}
+
+func TestBucketsEqual(t *testing.T) {
+	content := make([]byte, 3 * bucketCompareChunk + 100)
+	rand.Read(content)
+	h := EmptyXdrArrayHash()
+	a := GetTestMockArchive()
+	b := GetTestMockArchive()
+
+	// Compressed differently, the same content matches.
+	putBucketContent(a, h, content, gzip.BestSpeed)
+	putBucketContent(b, h, content, gzip.BestCompression)
+	eq, err := BucketsEqual(a, b, h)
+	assert.NoError(t, err)
+	assert.True(t, eq)
+
+	other := append([]byte{}, content...)
+	other[len(other) - 1] ^= 1
+	putBucketContent(b, h, other, gzip.DefaultCompression)
+	eq, err = BucketsEqual(a, b, h)
+	assert.NoError(t, err)
+	assert.False(t, eq)
+
+	for _, n := range []int{len(content) - 1, bucketCompareChunk, 2 * len(content)} {
+		putBucketContent(b, h, append(content, content...)[:n], gzip.DefaultCompression)
+		eq, err = BucketsEqual(a, b, h)
+		assert.NoError(t, err)
+		assert.False(t, eq)
+	}
+
+	b.backend.PutFile(BucketPath(h), ioutil.NopCloser(strings.NewReader("not gzip")))
+	_, err = BucketsEqual(a, b, h)
+	assert.Error(t, err)
+	_, err = BucketsEqual(a, GetTestMockArchive(), h)
+	assert.Error(t, err)
+}
@@ -39,9 +39,18 @@ func HashPrefix(h Hash) DirPrefix {
 }
 
 // Returns an array of path prefixes to walk to enumerate all the
-// objects in the provided range.
+// objects in the provided range. diff is the first component in which the
+// range's ends' checkpoint prefixes differ, and there is one prefix,
+// PathPrefix(diff), for each value of that component from the low end's
+// to the high end's, with the components before it they share. Ends that
+// share every component give their whole prefix, alone. So none is
+// repeated or contains another, and they come out sorted. Every
+// checkpoint in the range falls under exactly one of them.
 func RangePaths(r Range) []string {
 	res := []string{}
+	if r.High < r.Low {
+		return res
+	}
 	lowpre := CheckpointPrefix(r.Low)
 	highpre := CheckpointPrefix(r.High)
 	diff := 0
@@ -60,3 +69,22 @@ func RangePaths(r Range) []string {
 	}
 	return res
 }
+
+// Returns the path prefixes, each of exactly depth hex components (1 to 3),
+// that together cover the provided range. Shallower prefixes mean fewer,
+// broader listings; deeper prefixes mean more, narrower ones.
+func RangePathsAtDepth(r Range, depth int) []string {
+	if depth < 1 {
+		depth = 1
+	}
+	if depth > len(DirPrefix{}) {
+		depth = len(DirPrefix{})
+	}
+	shift := uint(8 * (4 - depth))
+	res := []string{}
+	for k := uint64(r.Low >> shift); k <= uint64(r.High >> shift); k++ {
+		pre := CheckpointPrefix(uint32(k << shift))
+		res = append(res, pre.PathPrefix(depth - 1))
+	}
+	return res
+}
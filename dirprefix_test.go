@@ -5,6 +5,7 @@
 package archivist
 
 import (
+	"strings"
 	"testing"
 	"github.com/stretchr/testify/assert"
 )
@@ -31,3 +32,51 @@ func TestRangePaths(t *testing.T) {
 	assert.Equal(t, rps[0], "00/10/00")
 	assert.Equal(t, rps[255], "00/10/ff")
 }
+
+func TestRangePathsAtDepth(t *testing.T) {
+	r := Range{ Low:0x0010001f, High:0x0014001b, }
+	assert.Equal(t, []string{"00"}, RangePathsAtDepth(r, 1))
+	assert.Equal(t, RangePaths(r), RangePathsAtDepth(r, 2))
+	rps := RangePathsAtDepth(r, 3)
+	assert.Equal(t, 0x401, len(rps))
+	assert.Equal(t, "00/10/00", rps[0])
+	assert.Equal(t, "00/14/00", rps[len(rps) - 1])
+	r = Range{ Low:0x00fffff0, High:0x010000ff, }
+	assert.Equal(t, []string{"00", "01"}, RangePathsAtDepth(r, 1))
+	assert.Equal(t, []string{"00/ff/ff", "01/00/00"}, RangePathsAtDepth(r, 3))
+}
+
+func TestRangePathsMinimal(t *testing.T) {
+	ranges := []Range{
+		Range{ Low:0x3f, High:0x3f, },
+		Range{ Low:0x3f, High:0xff, },
+		Range{ Low:0xff, High:0x13f, },
+		Range{ Low:0xffff, High:0x1003f, },
+		Range{ Low:0x00fffff0, High:0x010000ff, },
+		Range{ Low:0x0010001f, High:0x0014001b, },
+		Range{ Low:0x3f, High:0xffffffff, },
+	}
+	for _, r := range ranges {
+		rps := RangePaths(r)
+		assert.NotEmpty(t, rps)
+		for i := 1; i < len(rps); i++ {
+			assert.True(t, rps[i - 1] < rps[i], rps[i - 1] + " before " + rps[i])
+			assert.Equal(t, len(rps[0]), len(rps[i]))
+		}
+		for _, chk := range []uint32{r.Low, r.High, r.Low + (r.High - r.Low) / 2} {
+			covering := 0
+			for _, pre := range rps {
+				if strings.HasPrefix(CheckpointPrefix(chk).Path(), pre) {
+					covering++
+				}
+			}
+			assert.Equal(t, 1, covering)
+		}
+	}
+	assert.Equal(t, []string{"00/00/00"}, RangePaths(Range{ Low:0x3f, High:0xff, }))
+	assert.Equal(t, []string{"00/00/00", "00/00/01"},
+		RangePaths(Range{ Low:0xff, High:0x13f, }))
+	assert.Equal(t, []string{"00/00", "00/01"},
+		RangePaths(Range{ Low:0xffff, High:0x1003f, }))
+	assert.Empty(t, RangePaths(Range{ Low:0x7f, High:0x3f, }))
+}
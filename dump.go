@@ -0,0 +1,43 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"fmt"
+)
+
+// Downloads everything belonging to checkpoint chk (its HAS, its other
+// category files and every bucket the HAS references) into destDir, at
+// their archive paths, so that destDir holds a self-contained copy of the
+// checkpoint. A missing optional category file is skipped with a warning;
+// anything else missing is an error, though the rest is still downloaded.
+func (a *Archive) DumpCheckpoint(chk uint32, destDir string) error {
+	dst := ConnectBackend(MakeFsBackend(destDir, nil),
+		&ConnectOptions{Categories: a.categories})
+	opts := &CommandOptions{Force: true}
+
+	has, err := a.GetCheckpointHAS(chk)
+	if err != nil {
+		return err
+	}
+	var errs uint32
+	for _, cat := range a.Categories() {
+		pth := a.CategoryCheckpointPath(cat, chk)
+		if !a.categoryRequired(cat) && !a.backend.Exists(pth) {
+			logf("Warning: skipping missing optional file %s", pth)
+			continue
+		}
+		errs += noteError(copyPath(a, dst, pth, opts))
+	}
+	buckets := has.Buckets()
+	logf("Downloading %d buckets of checkpoint 0x%8.8x", len(buckets), chk)
+	for _, bucket := range buckets {
+		errs += noteError(copyPath(a, dst, BucketPath(bucket), opts))
+	}
+	if errs != 0 {
+		return fmt.Errorf("%d errors while dumping checkpoint 0x%8.8x", errs, chk)
+	}
+	return nil
+}
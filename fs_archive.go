@@ -6,19 +6,41 @@ package archivist
 
 import (
 	"io"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
-	"path/filepath"
+	"time"
 )
 
 type FsArchiveBackend struct {
 	prefix string
+	tempDir string
 }
 
 func (b *FsArchiveBackend) GetFile(pth string) (io.ReadCloser, error) {
 	return os.Open(path.Join(b.prefix, pth))
 }
 
+func (b *FsArchiveBackend) GetFileRange(pth string, offset int64, length int64) (io.ReadCloser, error) {
+	f, e := os.Open(path.Join(b.prefix, pth))
+	if e != nil {
+		return nil, e
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(f, offset, length), f}, nil
+}
+
+func (b *FsArchiveBackend) GetFileSize(pth string) (int64, error) {
+	info, err := os.Stat(path.Join(b.prefix, pth))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
 func (b *FsArchiveBackend) Exists(pth string) bool {
 	pth = path.Join(b.prefix, pth)
     _, err := os.Stat(pth)
@@ -26,42 +48,239 @@ func (b *FsArchiveBackend) Exists(pth string) bool {
     return true
 }
 
+// Writes to a temporary file, then renames it into place, so that readers
+// never see a partial file. The temporary file is made in tempDir if set,
+// which must be on the same filesystem as the archive for the rename to
+// work, and otherwise next to the target.
 func (b *FsArchiveBackend) PutFile(pth string, in io.ReadCloser) error {
+	defer in.Close()
 	dir := path.Join(b.prefix, path.Dir(pth))
-	if !b.Exists(dir) {
-		if e := os.MkdirAll(dir, 0755); e != nil {
+	if e := os.MkdirAll(dir, 0755); e != nil {
+		return e
+	}
+	tmpDir := dir
+	if b.tempDir != "" {
+		tmpDir = b.tempDir
+		if e := os.MkdirAll(tmpDir, 0755); e != nil {
 			return e
 		}
 	}
 
-	pth = path.Join(b.prefix, pth)
-	out, e := os.Create(pth)
+	out, e := ioutil.TempFile(tmpDir, "." + path.Base(pth) + ".tmp")
 	if e != nil {
 		return e
 	}
-	defer in.Close()
-	defer out.Close()
+	tmp := out.Name()
 	_, e = io.Copy(out, in)
+	if e == nil {
+		e = out.Sync()
+	}
+	if ce := out.Close(); e == nil {
+		e = ce
+	}
+	if e == nil {
+		e = os.Chmod(tmp, 0644)
+	}
+	if e == nil {
+		e = os.Rename(tmp, path.Join(b.prefix, pth))
+	}
+	if e != nil {
+		os.Remove(tmp)
+	}
 	return e
 }
 
+// How long a conditional write waits for another's lock, and how old a
+// lock must be to be taken for one a crashed writer left behind.
+const fsLockWait = 10 * time.Second
+const fsLockStale = time.Minute
+
+// Takes the lock for writing pth, a directory beside it, as making one
+// either succeeds or finds it exists, on every platform. Returns the
+// function that releases it.
+func (b *FsArchiveBackend) lock(pth string) (func(), error) {
+	lock := path.Join(b.prefix, pth) + ".lock"
+	if e := os.MkdirAll(path.Dir(lock), 0755); e != nil {
+		return nil, e
+	}
+	deadline := time.Now().Add(fsLockWait)
+	for {
+		e := os.Mkdir(lock, 0755)
+		if e == nil {
+			return func() { os.Remove(lock) }, nil
+		}
+		if !os.IsExist(e) {
+			return nil, e
+		}
+		if info, e := os.Stat(lock); e == nil && time.Since(info.ModTime()) > fsLockStale {
+			logf("Removing stale lock %s", lock)
+			os.Remove(lock)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Timed out waiting for lock %s", lock)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (b *FsArchiveBackend) FileVersion(pth string) (string, error) {
+	return contentVersion(b, pth)
+}
+
+// Holds pth's lock from checking its version until the new file has been
+// renamed into place, so only writers that also lock are excluded.
+func (b *FsArchiveBackend) PutFileIfVersion(pth string, version string, in io.ReadCloser) error {
+	unlock, e := b.lock(pth)
+	if e != nil {
+		in.Close()
+		return e
+	}
+	defer unlock()
+	current, e := contentVersion(b, pth)
+	if e == nil && current != version {
+		e = ErrFileChanged
+	}
+	if e != nil {
+		in.Close()
+		return e
+	}
+	return b.PutFile(pth, in)
+}
+
+func (b *FsArchiveBackend) GetFileModTime(pth string) (time.Time, error) {
+	info, err := os.Stat(path.Join(b.prefix, pth))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+func (b *FsArchiveBackend) SetFileModTime(pth string, t time.Time) error {
+	return os.Chtimes(path.Join(b.prefix, pth), t, t)
+}
+
+func (b *FsArchiveBackend) DeleteFile(pth string) error {
+	return os.Remove(path.Join(b.prefix, pth))
+}
+
+func (b *FsArchiveBackend) RenameFile(from string, to string) error {
+	dst := path.Join(b.prefix, to)
+	if e := os.MkdirAll(path.Dir(dst), 0755); e != nil {
+		return e
+	}
+	return os.Rename(path.Join(b.prefix, from), dst)
+}
+
+// Copies the file from another fs backend as PutFile writes any file, but
+// file to file, which the kernel does without the bytes passing through
+// this process (and, on filesystems that support it, by sharing blocks).
+func (b *FsArchiveBackend) CopyFileFrom(src ArchiveBackend, pth string) (int64, error) {
+	fsrc, ok := src.(*FsArchiveBackend)
+	if !ok {
+		return 0, ErrDirectCopyUnsupported
+	}
+	in, e := os.Open(path.Join(fsrc.prefix, pth))
+	if e != nil {
+		return 0, e
+	}
+	info, e := in.Stat()
+	if e != nil {
+		in.Close()
+		return 0, e
+	}
+	return info.Size(), b.PutFile(pth, in)
+}
+
 func (b *FsArchiveBackend) ListFiles(pth string) (chan string, chan error) {
+	return b.ListFilesUntil(pth, nil)
+}
+
+// Number of names the fs listing reads from a directory at a time, so a
+// directory of millions of buckets is never held in memory whole.
+const fsListChunk = 1024
+
+type fsLister struct {
+	ch chan string
+	errs chan error
+	done <-chan struct{}
+}
+
+// Each of these returns false once the listing has been abandoned.
+func (l *fsLister) send(p string) bool {
+	select {
+	case l.ch <- p:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+func (l *fsLister) fail(err error) bool {
+	select {
+	case l.errs <- err:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+// Sends the files under dir, reading its names a chunk at a time and
+// descending into each subdirectory as it's met, so memory is bounded by
+// the tree's depth rather than by any directory's size. Names come in
+// directory order, not sorted.
+func (l *fsLister) walk(dir string) bool {
+	f, err := os.Open(dir)
+	if err != nil {
+		return l.fail(err)
+	}
+	defer f.Close()
+	for {
+		names, err := f.Readdirnames(fsListChunk)
+		for _, name := range names {
+			p := path.Join(dir, name)
+			info, e := os.Lstat(p)
+			if e != nil {
+				if !l.fail(e) {
+					return false
+				}
+			} else if info.IsDir() {
+				if !l.walk(p) {
+					return false
+				}
+			} else if !l.send(p) {
+				return false
+			}
+		}
+		if err == io.EOF {
+			return true
+		} else if err != nil {
+			return l.fail(err)
+		}
+	}
+}
+
+func (b *FsArchiveBackend) ListFilesUntil(pth string, done <-chan struct{}) (chan string, chan error) {
 	ch := make(chan string)
 	errs := make(chan error)
+	root := path.Join(b.prefix, pth)
 	go func() {
-		filepath.Walk(path.Join(b.prefix, pth),
-			func(p string, info os.FileInfo, err error) error {
-				if err != nil {
-					errs <- err
-					return nil
-				}
-				if info != nil && ! info.IsDir() {
-					ch <- p
-				}
-				return nil
-			})
-		close(ch)
-		close(errs)
+		defer close(errs)
+		defer close(ch)
+		l := &fsLister{ch: ch, errs: errs, done: done}
+		info, err := os.Lstat(root)
+		// A directory that doesn't exist holds no files, as in the other
+		// backends' listings.
+		if os.IsNotExist(err) {
+			return
+		}
+		if err != nil {
+			l.fail(err)
+		} else if info.IsDir() {
+			l.walk(root)
+		} else {
+			l.send(root)
+		}
 	}()
 	return ch, errs
 }
@@ -71,7 +290,11 @@ func (b *FsArchiveBackend) CanListFiles() bool {
 }
 
 func MakeFsBackend(pth string, opts *ConnectOptions) ArchiveBackend {
-	return &FsArchiveBackend{
+	b := &FsArchiveBackend{
 		prefix: pth,
 	}
+	if opts != nil {
+		b.tempDir = opts.FsTempDir
+	}
+	return b
 }
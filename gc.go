@@ -0,0 +1,102 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Number of HAS reads and size lookups GCPreview keeps in flight.
+const gcConcurrency = 32
+
+// The buckets a garbage collection would delete, and the space it would
+// free, as computed by GCPreview.
+type GCReport struct {
+	Range Range `json:"range"`
+	Buckets []Hash `json:"buckets"`
+	Count int `json:"count"`
+	ReclaimableBytes int64 `json:"reclaimableBytes"`
+}
+
+// Returns the history checkpoints present in rng, by listing.
+func (a *Archive) listHistoryCheckpoints(rng Range) ([]uint32, error) {
+	chks := []uint32{}
+	var errs uint32
+	for _, pth := range RangePaths(rng) {
+		ch, ech := a.ListCategoryCheckpoints("history", pth)
+		for chk := range ch {
+			if chk >= rng.Low && chk <= rng.High {
+				chks = append(chks, chk)
+			}
+		}
+		errs += drainErrors(ech)
+	}
+	if errs != 0 {
+		return chks, fmt.Errorf("%d errors while listing checkpoints", errs)
+	}
+	return chks, nil
+}
+
+// Finds the buckets in the archive that no checkpoint in rng, nor the root
+// HAS, references, and sums their sizes, without deleting anything; pass
+// the report to CollectGarbage to do that. Buckets used only by checkpoints
+// outside rng count as garbage, so rng should normally cover the whole
+// archive. Needs a backend that can list.
+func (a *Archive) GCPreview(rng Range) (GCReport, error) {
+	report := GCReport{Range: rng, Buckets: []Hash{}}
+	if !a.backend.CanListFiles() {
+		return report, fmt.Errorf("Garbage collection needs a backend that can list")
+	}
+	root, err := a.GetRootHAS()
+	if err != nil {
+		return report, err
+	}
+	chks, err := a.listHistoryCheckpoints(rng)
+	if err != nil {
+		return report, err
+	}
+	logf("Reading bucket references of %d checkpoints", len(chks))
+	refs, err := a.collectReferencedBuckets(chks, gcConcurrency)
+	if err != nil {
+		return report, err
+	}
+	for _, bucket := range root.Buckets() {
+		refs[bucket] = true
+	}
+
+	ch, errs := a.ListAllBucketHashes()
+	for bucket := range ch {
+		if !refs[bucket] {
+			report.Buckets = append(report.Buckets, bucket)
+		}
+	}
+	if n := drainErrors(errs); n != 0 {
+		return report, fmt.Errorf("%d errors while listing buckets", n)
+	}
+	sort.Sort(byHashString(report.Buckets))
+	report.Count = len(report.Buckets)
+
+	pths := make([]string, len(report.Buckets))
+	for i, bucket := range report.Buckets {
+		pths[i] = BucketPath(bucket)
+	}
+	report.ReclaimableBytes, err = sumSizes(a, pths, gcConcurrency)
+	logf("%d unreferenced buckets, %d bytes reclaimable",
+		report.Count, report.ReclaimableBytes)
+	return report, err
+}
+
+// Deletes the buckets listed in a GCPreview report. Honours opts.DryRun.
+func (a *Archive) CollectGarbage(report GCReport, opts *CommandOptions) error {
+	var errs uint32
+	for _, bucket := range report.Buckets {
+		errs += noteError(a.deletePath(BucketPath(bucket), opts))
+	}
+	if errs != 0 {
+		return fmt.Errorf("%d errors while collecting garbage", errs)
+	}
+	return nil
+}
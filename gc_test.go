@@ -0,0 +1,51 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGCPreview(t *testing.T) {
+	defer cleanup()
+	arch := GetRandomPopulatedArchive()
+	orphans := map[Hash]bool{}
+	for i := 0; i < 3; i++ {
+		h, e := arch.AddRandomBucket()
+		assert.NoError(t, e)
+		orphans[h] = true
+	}
+
+	report, err := arch.GCPreview(MakeRange(0, 0xffffffff))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, report.Count)
+	assert.Equal(t, int64(3 * 1024), report.ReclaimableBytes)
+	for _, h := range report.Buckets {
+		assert.True(t, orphans[h])
+	}
+
+	// The root HAS's buckets are kept even if its checkpoint is out of range.
+	report, err = arch.GCPreview(MakeRange(0, 0x37f))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, report.Count)
+
+	opts := testOptions()
+	opts.DryRun = true
+	assert.Nil(t, arch.CollectGarbage(report, opts))
+	for h := range orphans {
+		assert.True(t, arch.BucketExists(h))
+	}
+	opts.DryRun = false
+	assert.Nil(t, arch.CollectGarbage(report, opts))
+	for h := range orphans {
+		assert.False(t, arch.BucketExists(h))
+	}
+
+	report, err = arch.GCPreview(MakeRange(0, 0xffffffff))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, report.Count)
+	assert.Equal(t, 0, countMissing(arch, testOptions()))
+}
@@ -0,0 +1,436 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/url"
+	"sort"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// The gRPC transport for the ArchiveStore service in archive_store.proto,
+// used by Connect for "grpc://host:port/prefix" URLs in plaintext and
+// "grpcs://" ones over TLS. Its messages are few and flat enough to encode
+// by hand, so nothing is generated from the .proto; they go on the wire as
+// protobuf, so either end can be generated code instead.
+
+const grpcServiceName = "archivist.ArchiveStore"
+
+// Size of the chunks files travel in, either way.
+const grpcChunkSize = 64 * 1024
+
+// An ArchiveStore message, as the fields it has set, by number. Which are
+// strings or bytes and which are varints is archive_store.proto's business;
+// nothing here is nested.
+type grpcMessage struct {
+	bytes map[uint64][]byte
+	varints map[uint64]uint64
+}
+
+func newGrpcMessage() *grpcMessage {
+	return &grpcMessage{
+		bytes: make(map[uint64][]byte),
+		varints: make(map[uint64]uint64),
+	}
+}
+
+func grpcPathMessage(pth string) *grpcMessage {
+	m := newGrpcMessage()
+	m.bytes[1] = []byte(pth)
+	return m
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], x)]...)
+}
+
+func (m *grpcMessage) marshal() []byte {
+	var nums []int
+	for num := range m.bytes {
+		nums = append(nums, int(num))
+	}
+	for num := range m.varints {
+		nums = append(nums, int(num))
+	}
+	sort.Ints(nums)
+	var buf []byte
+	for _, num := range nums {
+		if b, ok := m.bytes[uint64(num)]; ok {
+			buf = appendUvarint(buf, uint64(num) << 3 | 2)
+			buf = appendUvarint(buf, uint64(len(b)))
+			buf = append(buf, b...)
+		} else {
+			buf = appendUvarint(buf, uint64(num) << 3)
+			buf = appendUvarint(buf, m.varints[uint64(num)])
+		}
+	}
+	return buf
+}
+
+var errGrpcMalformed = errors.New("Malformed ArchiveStore message")
+
+// Fields of wire types the service doesn't use are skipped, as protobuf
+// decoders do with fields they don't know.
+func (m *grpcMessage) unmarshal(buf []byte) error {
+	for len(buf) > 0 {
+		tag, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return errGrpcMalformed
+		}
+		buf = buf[n:]
+		num := tag >> 3
+		switch tag & 7 {
+		case 0:
+			x, n := binary.Uvarint(buf)
+			if n <= 0 {
+				return errGrpcMalformed
+			}
+			m.varints[num] = x
+			buf = buf[n:]
+		case 1:
+			if len(buf) < 8 {
+				return errGrpcMalformed
+			}
+			buf = buf[8:]
+		case 2:
+			sz, n := binary.Uvarint(buf)
+			if n <= 0 || sz > uint64(len(buf) - n) {
+				return errGrpcMalformed
+			}
+			m.bytes[num] = buf[n:n + int(sz)]
+			buf = buf[n + int(sz):]
+		case 5:
+			if len(buf) < 4 {
+				return errGrpcMalformed
+			}
+			buf = buf[4:]
+		default:
+			return errGrpcMalformed
+		}
+	}
+	return nil
+}
+
+// Named "proto", as the messages are protobuf, whatever encodes them.
+type grpcCodec struct{}
+
+func (grpcCodec) Marshal(v interface{}) ([]byte, error) {
+	return v.(*grpcMessage).marshal(), nil
+}
+
+func (grpcCodec) Unmarshal(data []byte, v interface{}) error {
+	return v.(*grpcMessage).unmarshal(data)
+}
+
+func (grpcCodec) Name() string {
+	return "proto"
+}
+
+type grpcArchiveStore struct {
+	conn *grpc.ClientConn
+}
+
+// Returns an ArchiveStoreClient for the service at host, over TLS with the
+// system's roots if useTLS. Connections are made as calls need them.
+func DialGRPCArchiveStore(host string, useTLS bool) (ArchiveStoreClient, error) {
+	creds := insecure.NewCredentials()
+	if useTLS {
+		creds = credentials.NewTLS(&tls.Config{})
+	}
+	conn, err := grpc.Dial(host,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(grpcCodec{})))
+	if err != nil {
+		return nil, err
+	}
+	return &grpcArchiveStore{conn: conn}, nil
+}
+
+func MakeGRPCBackend(u *url.URL, opts *ConnectOptions) (ArchiveBackend, error) {
+	client, err := DialGRPCArchiveStore(u.Host, u.Scheme == "grpcs")
+	if err != nil {
+		return nil, err
+	}
+	return RPCBackend(client, u.Path), nil
+}
+
+func grpcMethod(name string) string {
+	return "/" + grpcServiceName + "/" + name
+}
+
+func (c *grpcArchiveStore) call(name string, req *grpcMessage) (*grpcMessage, error) {
+	reply := newGrpcMessage()
+	err := c.conn.Invoke(context.Background(), grpcMethod(name), req, reply)
+	return reply, err
+}
+
+func (c *grpcArchiveStore) Exists(pth string) (bool, error) {
+	reply, err := c.call("Exists", grpcPathMessage(pth))
+	return reply.varints[1] != 0, err
+}
+
+func (c *grpcArchiveStore) Size(pth string) (int64, error) {
+	reply, err := c.call("Size", grpcPathMessage(pth))
+	return int64(reply.varints[1]), err
+}
+
+func (c *grpcArchiveStore) Delete(pth string) error {
+	_, err := c.call("Delete", grpcPathMessage(pth))
+	return err
+}
+
+func (c *grpcArchiveStore) Rename(from string, to string) error {
+	req := newGrpcMessage()
+	req.bytes[1] = []byte(from)
+	req.bytes[2] = []byte(to)
+	_, err := c.call("Rename", req)
+	return err
+}
+
+// Opens a stream of replies to a request for pth; cancel ends it.
+func (c *grpcArchiveStore) serverStream(name string, pth string) (grpc.ClientStream, context.CancelFunc, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	desc := &grpc.StreamDesc{StreamName: name, ServerStreams: true}
+	stream, err := c.conn.NewStream(ctx, desc, grpcMethod(name))
+	if err == nil {
+		err = stream.SendMsg(grpcPathMessage(pth))
+	}
+	if err == nil {
+		err = stream.CloseSend()
+	}
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return stream, cancel, nil
+}
+
+type grpcChunkReader struct {
+	stream grpc.ClientStream
+	cancel context.CancelFunc
+	cur []byte
+	err error
+}
+
+func (r *grpcChunkReader) next() {
+	m := newGrpcMessage()
+	r.err = r.stream.RecvMsg(m)
+	r.cur = m.bytes[1]
+}
+
+func (r *grpcChunkReader) Read(p []byte) (int, error) {
+	for len(r.cur) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.next()
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+func (r *grpcChunkReader) Close() error {
+	r.cancel()
+	return nil
+}
+
+// The first chunk is awaited, so a file that can't be read fails here
+// rather than on the first Read, as it would with the other backends.
+func (c *grpcArchiveStore) Get(pth string) (io.ReadCloser, error) {
+	stream, cancel, err := c.serverStream("Get", pth)
+	if err != nil {
+		return nil, err
+	}
+	r := &grpcChunkReader{stream: stream, cancel: cancel}
+	r.next()
+	if r.err != nil && r.err != io.EOF {
+		cancel()
+		return nil, r.err
+	}
+	return r, nil
+}
+
+func (c *grpcArchiveStore) Put(pth string, in io.Reader) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	desc := &grpc.StreamDesc{StreamName: "Put", ClientStreams: true}
+	stream, err := c.conn.NewStream(ctx, desc, grpcMethod("Put"))
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, grpcChunkSize)
+	first := true
+	for {
+		n, rerr := io.ReadFull(in, buf)
+		if rerr != nil && rerr != io.EOF && rerr != io.ErrUnexpectedEOF {
+			return rerr
+		}
+		if n > 0 || first {
+			chunk := newGrpcMessage()
+			if first {
+				chunk.bytes[1] = []byte(pth)
+				first = false
+			}
+			chunk.bytes[2] = buf[:n]
+			// io.EOF means the server has ended the call; RecvMsg
+			// has its status.
+			if err = stream.SendMsg(chunk); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+		if rerr != nil {
+			break
+		}
+	}
+	if err != io.EOF {
+		if err = stream.CloseSend(); err != nil {
+			return err
+		}
+	}
+	return stream.RecvMsg(newGrpcMessage())
+}
+
+type grpcListStream struct {
+	stream grpc.ClientStream
+	cancel context.CancelFunc
+}
+
+func (s *grpcListStream) Recv() (string, error) {
+	m := newGrpcMessage()
+	if err := s.stream.RecvMsg(m); err != nil {
+		s.cancel()
+		return "", err
+	}
+	return string(m.bytes[1]), nil
+}
+
+func (c *grpcArchiveStore) List(prefix string) (ArchiveStoreListStream, error) {
+	stream, cancel, err := c.serverStream("List", prefix)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcListStream{stream: stream, cancel: cancel}, nil
+}
+
+// Returns a gRPC server offering srv as the ArchiveStore service, for
+// Serve to run on a listener of the caller's; with ServeBackend, the
+// reference server for any backend.
+func NewGRPCArchiveStoreServer(srv ArchiveStoreServer, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts,
+		grpc.ForceServerCodec(grpcCodec{}),
+		grpc.UnknownServiceHandler(func(_ interface{}, stream grpc.ServerStream) error {
+			return serveGRPCArchiveStore(srv, stream)
+		}))
+	return grpc.NewServer(opts...)
+}
+
+func serveGRPCArchiveStore(srv ArchiveStoreServer, stream grpc.ServerStream) error {
+	method, _ := grpc.MethodFromServerStream(stream)
+	req := newGrpcMessage()
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+	pth := string(req.bytes[1])
+	reply := newGrpcMessage()
+	var err error
+	switch method {
+	case grpcMethod("Exists"):
+		var ok bool
+		if ok, err = srv.Exists(pth); ok {
+			reply.varints[1] = 1
+		}
+	case grpcMethod("Size"):
+		var sz int64
+		sz, err = srv.Size(pth)
+		reply.varints[1] = uint64(sz)
+	case grpcMethod("Delete"):
+		err = srv.Delete(pth)
+	case grpcMethod("Rename"):
+		err = srv.Rename(pth, string(req.bytes[2]))
+	case grpcMethod("Get"):
+		return serveGRPCGet(srv, stream, pth)
+	case grpcMethod("Put"):
+		err = serveGRPCPut(srv, stream, req)
+	case grpcMethod("List"):
+		return srv.List(pth, func(f string) error {
+			return stream.SendMsg(grpcPathMessage(f))
+		})
+	default:
+		return status.Errorf(codes.Unimplemented, "unknown method %s", method)
+	}
+	if err != nil {
+		return err
+	}
+	return stream.SendMsg(reply)
+}
+
+func serveGRPCGet(srv ArchiveStoreServer, stream grpc.ServerStream, pth string) error {
+	rdr, err := srv.Get(pth)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+	buf := make([]byte, grpcChunkSize)
+	for {
+		n, err := io.ReadFull(rdr, buf)
+		if n > 0 {
+			chunk := newGrpcMessage()
+			chunk.bytes[1] = buf[:n]
+			if serr := stream.SendMsg(chunk); serr != nil {
+				return serr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Feeds the chunks to srv's Put as they arrive, first the one already
+// received, which carries the path.
+func serveGRPCPut(srv ArchiveStoreServer, stream grpc.ServerStream, first *grpcMessage) error {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := srv.Put(string(first.bytes[1]), pr)
+		// Unblocks the writes below, should Put return unread.
+		pr.Close()
+		done <- err
+	}()
+	chunk := first
+	for {
+		if _, err := pw.Write(chunk.bytes[2]); err != nil {
+			break
+		}
+		chunk = newGrpcMessage()
+		err := stream.RecvMsg(chunk)
+		if err == io.EOF {
+			pw.Close()
+			break
+		}
+		if err != nil {
+			pw.CloseWithError(err)
+			<-done
+			return err
+		}
+	}
+	return <-done
+}
@@ -0,0 +1,71 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+)
+
+// How gzipped archive files (buckets, and category files using the gzip
+// codec) are read past the end of their first gzip member. stellar-core
+// writes a single member with nothing after it, which reads the same
+// under every policy; the policies differ only on files other tools have
+// extended, and settle which bytes a bucket's hash is computed over.
+type GzipTrailing int
+
+const (
+	// Read every member and concatenate their contents, as gunzip does.
+	// Bytes after the last member that don't start another member, such
+	// as padding, are an error.
+	GzipConcatenate GzipTrailing = iota
+
+	// Allow exactly one member: any bytes after it, even another member,
+	// are an error.
+	GzipStrict
+
+	// Read the first member only, ignoring whatever follows it.
+	GzipFirstMember
+)
+
+var ErrGzipTrailingData = errors.New("Unexpected data after gzip member")
+
+type gzipReader struct {
+	*gzip.Reader
+	br *bufio.Reader
+	mode GzipTrailing
+}
+
+func (g *gzipReader) Read(p []byte) (int, error) {
+	n, err := g.Reader.Read(p)
+	if err == io.EOF && g.mode == GzipStrict {
+		if _, e := g.br.ReadByte(); e != io.EOF {
+			return n, ErrGzipTrailingData
+		}
+	}
+	return n, err
+}
+
+// Returns a reader of the gzipped stream r, treating whatever follows the
+// first member as mode says. Closing it doesn't close r.
+func newGzipReader(r io.Reader, mode GzipTrailing) (io.ReadCloser, error) {
+	// gzip reads a bufio.Reader byte by byte, so never past the end of a
+	// member, leaving what follows for the strict check.
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	z, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+	if mode == GzipConcatenate {
+		return z, nil
+	}
+	z.Multistream(false)
+	return &gzipReader{Reader: z, br: br, mode: mode}, nil
+}
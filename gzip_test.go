@@ -0,0 +1,51 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"io/ioutil"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGzipTrailing(t *testing.T) {
+	buf := make([]byte, 2048)
+	rand.Read(buf)
+	h := Hash(sha256.Sum256(buf))
+
+	single := gzipped(buf)
+	twoMembers := append(gzipped(buf[:1024]), gzipped(buf[1024:])...)
+	padded := append(gzipped(buf), make([]byte, 512)...)
+
+	type result struct {
+		file []byte
+		ok map[GzipTrailing]bool
+	}
+	for _, r := range []result{
+		{single, map[GzipTrailing]bool{
+			GzipConcatenate: true, GzipStrict: true, GzipFirstMember: true}},
+		{twoMembers, map[GzipTrailing]bool{
+			GzipConcatenate: true, GzipStrict: false, GzipFirstMember: false}},
+		{padded, map[GzipTrailing]bool{
+			GzipConcatenate: false, GzipStrict: false, GzipFirstMember: true}},
+	} {
+		for mode, ok := range r.ok {
+			arch := ConnectBackend(MakeMockBackend(nil),
+				&ConnectOptions{GzipTrailing: mode})
+			arch.backend.PutFile(BucketPath(h), ioutil.NopCloser(bytes.NewReader(r.file)))
+			e := arch.VerifyBucketHash(h)
+			assert.Equal(t, ok, e == nil)
+		}
+	}
+
+	arch := ConnectBackend(MakeMockBackend(nil), &ConnectOptions{GzipTrailing: GzipStrict})
+	arch.backend.PutFile(BucketPath(h), ioutil.NopCloser(bytes.NewReader(padded)))
+	e := arch.VerifyBucketHash(h)
+	assert.Error(t, e)
+	assert.Contains(t, e.Error(), ErrGzipTrailingData.Error())
+}
@@ -33,6 +33,20 @@ func (h Hash) String() string {
 	return hex.EncodeToString(h[:])
 }
 
+// Hashes marshal as hex strings, in JSON and other text encodings.
+func (h Hash) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+func (h *Hash) UnmarshalText(text []byte) error {
+	d, err := DecodeHash(string(text))
+	if err != nil {
+		return err
+	}
+	*h = d
+	return nil
+}
+
 func MustDecodeHash(s string) Hash {
 	h, e := DecodeHash(s)
 	if e != nil {
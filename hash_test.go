@@ -5,6 +5,7 @@
 package archivist
 
 import (
+	"encoding/json"
 	"testing"
 	"github.com/stretchr/testify/assert"
 )
@@ -14,3 +15,13 @@ func TestHashDecode(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, []byte{0xf8, 0xac, 0xbd}, d[:3])
 }
+
+func TestHashJSON(t *testing.T) {
+	h := MustDecodeHash("f8acbd8c9a901e17ed5488d7ebf44781dc82924457f488b75ba577911c4e2656")
+	buf, err := json.Marshal([]Hash{h})
+	assert.Nil(t, err)
+	assert.Equal(t, `["f8acbd8c9a901e17ed5488d7ebf44781dc82924457f488b75ba577911c4e2656"]`, string(buf))
+	var hs []Hash
+	assert.Nil(t, json.Unmarshal(buf, &hs))
+	assert.Equal(t, []Hash{h}, hs)
+}
@@ -0,0 +1,70 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Number of HAS reads DistinctHASVersions keeps in flight.
+const hasVersionConcurrency = 32
+
+// Reads the HAS of every checkpoint in rng and counts how many carry each
+// version number. More than one version suggests an archive written by
+// mixed software, such as one partly re-mirrored. Checkpoints are found by
+// listing where the backend can, and otherwise by checking each exists;
+// absent ones aren't counted.
+func (a *Archive) DistinctHASVersions(rng Range) (map[int]int, error) {
+	versions := make(map[int]int)
+	listed := a.backend.CanListFiles()
+	var chks []uint32
+	if listed {
+		var err error
+		if chks, err = a.listHistoryCheckpoints(rng); err != nil {
+			return versions, err
+		}
+	} else {
+		for chk := range rng.Checkpoints() {
+			chks = append(chks, chk)
+		}
+	}
+
+	var mutex sync.Mutex
+	var errs uint32
+	var wg sync.WaitGroup
+	wg.Add(hasVersionConcurrency)
+	req := make(chan uint32)
+	go func() {
+		for _, chk := range chks {
+			req <- chk
+		}
+		close(req)
+	}()
+	for i := 0; i < hasVersionConcurrency; i++ {
+		go func() {
+			for chk := range req {
+				if !listed && !a.CategoryCheckpointExists("history", chk) {
+					continue
+				}
+				has, e := a.GetCheckpointHAS(chk)
+				if e != nil {
+					atomic.AddUint32(&errs, noteError(e))
+					continue
+				}
+				mutex.Lock()
+				versions[has.Version]++
+				mutex.Unlock()
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	if errs != 0 {
+		return versions, fmt.Errorf("%d errors reading checkpoint HAS files", errs)
+	}
+	return versions, nil
+}
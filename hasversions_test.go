@@ -0,0 +1,33 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDistinctHASVersions(t *testing.T) {
+	defer cleanup()
+	arch := GetRandomPopulatedArchive()
+	versions, err := arch.DistinctHASVersions(testRange())
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]int{0: 15}, versions)
+
+	opts := &CommandOptions{Force:true}
+	for _, chk := range []uint32{0x7f, 0xbf} {
+		has, err := arch.GetCheckpointHAS(chk)
+		assert.NoError(t, err)
+		has.Version = 1
+		assert.NoError(t, arch.PutCheckpointHAS(chk, has, opts))
+	}
+	versions, err = arch.DistinctHASVersions(testRange())
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]int{0: 13, 1: 2}, versions)
+
+	versions, err = arch.DistinctHASVersions(Range{Low:0x7f, High:0xff})
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]int{0: 1, 1: 2}, versions)
+}
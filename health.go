@@ -0,0 +1,92 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"io"
+	"fmt"
+	"time"
+	"github.com/stellar/go-stellar-base/xdr"
+)
+
+// The outcome of a HealthCheck. Healthy is true only if Problems is empty.
+type HealthStatus struct {
+	Healthy bool
+	CurrentLedger uint32
+	LatestCheckpoint uint32
+	CheckpointPresent bool
+	LatestCloseTime time.Time
+	LedgerAge time.Duration
+	Problems []string
+}
+
+func (h *HealthStatus) problem(format string, args ...interface{}) {
+	h.Problems = append(h.Problems, fmt.Sprintf(format, args...))
+}
+
+// Returns the close time of the last ledger header in the given checkpoint's
+// ledger file.
+func (a *Archive) lastCloseTime(chk uint32) (time.Time, error) {
+	var last time.Time
+	rdr, err := a.GetXdrStream(a.CategoryCheckpointPath("ledger", chk))
+	if err != nil {
+		return last, err
+	}
+	defer rdr.Close()
+	n := 0
+	for {
+		var lhe xdr.LedgerHeaderHistoryEntry
+		if err = rdr.ReadOne(&lhe); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return last, err
+		}
+		last = time.Unix(int64(lhe.Header.ScpValue.CloseTime), 0)
+		n++
+	}
+	if n == 0 {
+		return last, fmt.Errorf("No ledger headers in checkpoint 0x%8.8x", chk)
+	}
+	return last, nil
+}
+
+// Probes an archive for liveness with a fixed, small amount of I/O: one GET
+// of the root HAS, one existence check on the latest checkpoint's HAS and
+// one GET of its ledger file, whose last header gives the ledger age. An
+// error is returned only if the root HAS can't be read at all; every other
+// failure is reported in the status.
+func (a *Archive) HealthCheck(maxLedgerAge time.Duration) (HealthStatus, error) {
+	var status HealthStatus
+	root, err := a.GetRootHAS()
+	if err != nil {
+		return status, err
+	}
+	status.CurrentLedger = root.CurrentLedger
+	status.LatestCheckpoint = PrevCheckpoint(root.CurrentLedger + 1)
+
+	status.CheckpointPresent = a.CategoryCheckpointExists("history",
+		status.LatestCheckpoint)
+	if !status.CheckpointPresent {
+		status.problem("Latest checkpoint 0x%8.8x has no history file",
+			status.LatestCheckpoint)
+	}
+
+	closed, err := a.lastCloseTime(status.LatestCheckpoint)
+	if err != nil {
+		status.problem("Reading ledger file for 0x%8.8x: %s",
+			status.LatestCheckpoint, err)
+	} else {
+		status.LatestCloseTime = closed
+		status.LedgerAge = time.Since(closed)
+		if maxLedgerAge != 0 && status.LedgerAge > maxLedgerAge {
+			status.problem("Latest ledger closed %s ago, limit is %s",
+				status.LedgerAge, maxLedgerAge)
+		}
+	}
+
+	status.Healthy = len(status.Problems) == 0
+	return status, nil
+}
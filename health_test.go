@@ -0,0 +1,87 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/stellar/go-stellar-base/xdr"
+)
+
+// Replaces the ledger file of checkpoint chk with one whose last ledger
+// closed at closed.
+func putClosedLedgerFile(t *testing.T, arch *Archive, chk uint32, closed time.Time) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	for seq := chk - 1; seq <= chk; seq++ {
+		var lhe xdr.LedgerHeaderHistoryEntry
+		lhe.Header.LedgerSeq = xdr.Uint32(seq)
+		lhe.Header.ScpValue.CloseTime = xdr.Uint64(closed.Unix() - int64(chk - seq) * 5)
+		assert.Nil(t, WriteFramedXdr(w, &lhe))
+	}
+	w.Close()
+	assert.Nil(t, arch.backend.PutFile(arch.CategoryCheckpointPath("ledger", chk),
+		ioutil.NopCloser(&buf)))
+}
+
+func TestHealthCheckUnreachable(t *testing.T) {
+	_, err := GetTestMockArchive().HealthCheck(time.Hour)
+	assert.NotNil(t, err)
+}
+
+func TestHealthCheckReportsProblems(t *testing.T) {
+	defer cleanup()
+	arch := GetRandomPopulatedArchive()
+	// Random checkpoint files aren't valid gzip'ed XDR, so the ledger
+	// age can't be determined.
+	status, err := arch.HealthCheck(time.Hour)
+	assert.Nil(t, err)
+	assert.True(t, status.CheckpointPresent)
+	assert.False(t, status.Healthy)
+	assert.Equal(t, 1, len(status.Problems))
+	assert.Equal(t, status.CurrentLedger, status.LatestCheckpoint)
+}
+
+func TestHealthCheckHealthy(t *testing.T) {
+	defer cleanup()
+	arch := GetRandomPopulatedArchive()
+	closed := time.Now().Add(-time.Minute)
+	putClosedLedgerFile(t, arch, 0x3bf, closed)
+	status, err := arch.HealthCheck(time.Hour)
+	assert.Nil(t, err)
+	assert.True(t, status.Healthy)
+	assert.Equal(t, 0, len(status.Problems))
+	assert.Equal(t, uint32(0x3bf), status.LatestCheckpoint)
+	assert.True(t, status.CheckpointPresent)
+	assert.Equal(t, closed.Unix(), status.LatestCloseTime.Unix())
+
+	// No limit, no matter how old.
+	putClosedLedgerFile(t, arch, 0x3bf, time.Now().Add(-1000 * time.Hour))
+	status, err = arch.HealthCheck(0)
+	assert.Nil(t, err)
+	assert.True(t, status.Healthy)
+}
+
+func TestHealthCheckLedgerAge(t *testing.T) {
+	defer cleanup()
+	arch := GetRandomPopulatedArchive()
+
+	putClosedLedgerFile(t, arch, 0x3bf, time.Now().Add(-50 * time.Minute))
+	status, err := arch.HealthCheck(time.Hour)
+	assert.Nil(t, err)
+	assert.True(t, status.Healthy)
+	assert.True(t, status.LedgerAge < time.Hour)
+
+	putClosedLedgerFile(t, arch, 0x3bf, time.Now().Add(-70 * time.Minute))
+	status, err = arch.HealthCheck(time.Hour)
+	assert.Nil(t, err)
+	assert.False(t, status.Healthy)
+	assert.Equal(t, 1, len(status.Problems))
+	assert.True(t, status.LedgerAge > time.Hour)
+}
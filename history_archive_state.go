@@ -4,20 +4,49 @@
 
 package archivist
 
+import (
+	"io"
+	"encoding/json"
+	"crypto/sha256"
+)
+
+// The number of bucket list levels in every protocol so far. Code reading
+// a HAS goes by the levels it holds instead, so a protocol that changes
+// the count needs no change here; this is only the number NewHAS makes.
 const NumLevels = 11
 
+type HASBucketLevel struct {
+	Curr string                   `json:"curr"`
+	Snap string                   `json:"snap"`
+	Next struct {
+		State uint32              `json:"state"`
+		Output string             `json:"output,omitempty"`
+	}                             `json:"next"`
+}
+
+// A history archive state, as read from or written to a HAS file.
+//
+// CurrentBuckets was once a [NumLevels]HASBucketLevel array, and is now a
+// slice holding as many levels as the HAS does. That breaks code that
+// built a HAS from the zero value and indexed its levels, which now has
+// none: make one with NewHAS() instead, which holds NumLevels empty
+// levels, and range over CurrentBuckets (or use Levels()) rather than
+// counting to NumLevels.
 type HistoryArchiveState struct {
 	Version int                   `json:"version"`
 	Server string                 `json:"server"`
 	CurrentLedger uint32          `json:"currentLedger"`
-	CurrentBuckets [NumLevels] struct {
-		Curr string               `json:"curr"`
-		Snap string               `json:"snap"`
-		Next struct {
-			State uint32          `json:"state"`
-			Output string         `json:"output,omitempty"`
-		}                         `json:"next"`
-	}                             `json:"currentBuckets"`
+	CurrentBuckets []HASBucketLevel `json:"currentBuckets"`
+}
+
+// Returns a HAS with NumLevels empty levels, ready to fill in.
+func NewHAS() HistoryArchiveState {
+	return HistoryArchiveState{CurrentBuckets: make([]HASBucketLevel, NumLevels)}
+}
+
+// Returns the number of bucket list levels the HAS holds.
+func (h *HistoryArchiveState) Levels() int {
+	return len(h.CurrentBuckets)
 }
 
 func (h *HistoryArchiveState) LevelSummary() (string, int) {
@@ -41,6 +70,9 @@ func (h *HistoryArchiveState) LevelSummary() (string, int) {
 	return summ, nz
 }
 
+// Returns the buckets the HAS references. Early in history most levels are
+// still empty, which the HAS records as all-zero hashes (or omits); those
+// are never returned.
 func (h *HistoryArchiveState) Buckets() []Hash {
 	r := []Hash{}
 	for _, b := range h.CurrentBuckets {
@@ -56,6 +88,67 @@ func (h *HistoryArchiveState) Buckets() []Hash {
 	return r
 }
 
+// Returns the hash of the bucket list the HAS describes, as stellar-core
+// computes it for the ledger header: the hash of the concatenated level
+// hashes, each of which hashes the level's curr and snap. Empty or omitted
+// buckets count as all-zero hashes; pending merges don't count at all.
+func (h *HistoryArchiveState) BucketListHash() (Hash, error) {
+	total := sha256.New()
+	for _, b := range h.CurrentBuckets {
+		level := sha256.New()
+		for _, bs := range []string{b.Curr, b.Snap} {
+			var bh Hash
+			if bs != "" {
+				var err error
+				if bh, err = DecodeHash(bs); err != nil {
+					return Hash{}, err
+				}
+			}
+			level.Write(bh[:])
+		}
+		total.Write(level.Sum(nil))
+	}
+	var r Hash
+	copy(r[:], total.Sum(nil))
+	return r, nil
+}
+
 func (h *HistoryArchiveState) Range() Range {
 	return Range{Low:63, High: h.CurrentLedger,}
 }
+
+// Reads a JSON-encoded HAS from r, ignoring any fields it doesn't know.
+func DecodeHAS(r io.Reader) (HistoryArchiveState, error) {
+	return decodeHAS(r, false)
+}
+
+// As DecodeHAS, but a HAS with fields this package doesn't know, such as
+// one in a newer or forked format, is an error.
+func DecodeHASStrict(r io.Reader) (HistoryArchiveState, error) {
+	return decodeHAS(r, true)
+}
+
+func decodeHAS(r io.Reader, strict bool) (HistoryArchiveState, error) {
+	var has HistoryArchiveState
+	dec := json.NewDecoder(r)
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	err := dec.Decode(&has)
+	return has, err
+}
+
+// Writes has to w in the indented JSON form used in archives. A HAS with no
+// levels at all, such as the zero value, is written with NumLevels empty
+// ones, as stellar-core expects a bucket list.
+func (h HistoryArchiveState) Encode(w io.Writer) error {
+	if h.CurrentBuckets == nil {
+		h.CurrentBuckets = make([]HASBucketLevel, NumLevels)
+	}
+	buf, err := json.MarshalIndent(h, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
@@ -5,8 +5,14 @@
 package archivist
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
 	"testing"
 	"encoding/json"
+	"crypto/sha256"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestUnmarshalState(t *testing.T) {
@@ -42,3 +48,179 @@ func TestUnmarshalState(t *testing.T) {
 		t.Error(state)
 	}
 }
+
+func TestHASEncodeDecode(t *testing.T) {
+	has := NewHAS()
+	has.Version = 1
+	has.Server = "test"
+	has.CurrentLedger = 0x7f
+	has.CurrentBuckets[0].Curr = "f8acbd8c9a901e17ed5488d7ebf44781dc82924457f488b75ba577911c4e2656"
+	has.CurrentBuckets[1].Next.State = 1
+
+	var buf bytes.Buffer
+	assert.Nil(t, has.Encode(&buf))
+	decoded, err := DecodeHAS(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, has, decoded)
+
+	_, err = DecodeHAS(bytes.NewReader([]byte("{")))
+	assert.NotNil(t, err)
+}
+
+func TestDecodeHASStrict(t *testing.T) {
+	blob := `{"version": 1, "currentLedger": 63, "networkPassphrase": "x",
+		"currentBuckets": [{"curr": "", "snap": "", "next": {"state": 0}}]}`
+	has, err := DecodeHAS(strings.NewReader(blob))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(63), has.CurrentLedger)
+	_, err = DecodeHASStrict(strings.NewReader(blob))
+	assert.Error(t, err)
+
+	// Unknown fields in a level count too.
+	blob = `{"version": 1, "currentLedger": 63,
+		"currentBuckets": [{"curr": "", "snap": "", "shadow": [], "next": {"state": 0}}]}`
+	_, err = DecodeHASStrict(strings.NewReader(blob))
+	assert.Error(t, err)
+
+	var buf bytes.Buffer
+	assert.Nil(t, NewHAS().Encode(&buf))
+	_, err = DecodeHASStrict(&buf)
+	assert.Nil(t, err)
+
+	backend := MakeMockBackend(nil)
+	backend.PutFile("has.json", ioutil.NopCloser(strings.NewReader(
+		`{"version": 1, "extra": true}`)))
+	_, err = ConnectBackend(backend, nil).GetPathHAS("has.json")
+	assert.Nil(t, err)
+	_, err = ConnectBackend(backend, &ConnectOptions{StrictHAS: true}).GetPathHAS("has.json")
+	assert.Error(t, err)
+}
+
+func TestRootHASVerifier(t *testing.T) {
+	backend := MakeMockBackend(nil)
+	has := NewHAS()
+	has.CurrentLedger = 0x7f
+	var buf bytes.Buffer
+	assert.Nil(t, has.Encode(&buf))
+	raw := buf.Bytes()
+	backend.PutFile(DefaultRootHASPath, ioutil.NopCloser(bytes.NewReader(raw)))
+
+	var seen []byte
+	accept := func(h HistoryArchiveState, b []byte) error {
+		assert.Equal(t, uint32(0x7f), h.CurrentLedger)
+		seen = b
+		return nil
+	}
+	got, err := ConnectBackend(backend, &ConnectOptions{RootHASVerifier: accept}).GetRootHAS()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0x7f), got.CurrentLedger)
+	assert.Equal(t, raw, seen)
+
+	reject := func(h HistoryArchiveState, b []byte) error {
+		return fmt.Errorf("bad signature")
+	}
+	arch := ConnectBackend(backend, &ConnectOptions{RootHASVerifier: reject})
+	got, err = arch.GetRootHAS()
+	assert.Error(t, err)
+	assert.Equal(t, HistoryArchiveState{}, got)
+	// Only GetRootHAS consults it.
+	_, err = arch.GetPathHAS(DefaultRootHASPath)
+	assert.Nil(t, err)
+}
+
+func TestEarlyHistoryBuckets(t *testing.T) {
+	var jsonBlob = []byte(`{
+		"version": 1,
+		"server": "v0.4.0-34-g2f015f6",
+		"currentLedger": 63,
+		"currentBuckets": [
+			{
+				"curr": "f8acbd8c9a901e17ed5488d7ebf44781dc82924457f488b75ba577911c4e2656",
+				"next": {
+					"state": 0
+				},
+				"snap": "0000000000000000000000000000000000000000000000000000000000000000"
+			},
+			{
+				"curr": "0000000000000000000000000000000000000000000000000000000000000000",
+				"next": {
+					"state": 1,
+					"output": "0000000000000000000000000000000000000000000000000000000000000000"
+				},
+				"snap": "0000000000000000000000000000000000000000000000000000000000000000"
+			}
+		 ]
+	}`)
+
+	has, err := DecodeHAS(bytes.NewReader(jsonBlob))
+	assert.Nil(t, err)
+	buckets := has.Buckets()
+	assert.Len(t, buckets, 1)
+	assert.Equal(t, "f8acbd8c9a901e17ed5488d7ebf44781dc82924457f488b75ba577911c4e2656",
+		buckets[0].String())
+	// The summary covers the levels the HAS holds, not NumLevels.
+	summ, nz := has.LevelSummary()
+	assert.Equal(t, "#_", summ)
+	assert.Equal(t, 1, nz)
+}
+
+func TestHASLevelCount(t *testing.T) {
+	level := `{"curr": "%s", "next": {"state": 0}, "snap": "%s"}`
+	zero := Hash{}.String()
+	for _, n := range []int{1, NumLevels, NumLevels + 2} {
+		levels := []string{}
+		var last Hash
+		for i := 0; i < n; i++ {
+			last = Hash(sha256.Sum256([]byte{byte(i)}))
+			levels = append(levels, fmt.Sprintf(level, last, zero))
+		}
+		blob := fmt.Sprintf(`{"version": 1, "currentLedger": 127, "currentBuckets": [%s]}`,
+			strings.Join(levels, ","))
+		has, err := DecodeHAS(strings.NewReader(blob))
+		assert.Nil(t, err)
+		assert.Equal(t, n, has.Levels())
+		buckets := has.Buckets()
+		assert.Equal(t, n, len(buckets))
+		// The deepest level's bucket isn't lost, however many levels.
+		assert.Equal(t, last, buckets[n - 1])
+		summ, _ := has.LevelSummary()
+		assert.Equal(t, n, len(summ))
+
+		var buf bytes.Buffer
+		assert.Nil(t, has.Encode(&buf))
+		again, err := DecodeHAS(&buf)
+		assert.Nil(t, err)
+		assert.Equal(t, n, again.Levels())
+	}
+
+	// The zero HAS is written with the usual number of empty levels.
+	var buf bytes.Buffer
+	assert.Nil(t, HistoryArchiveState{}.Encode(&buf))
+	has, _ := DecodeHAS(&buf)
+	assert.Equal(t, NumLevels, has.Levels())
+}
+
+func TestBucketListHash(t *testing.T) {
+	has := NewHAS()
+	zeroLevel := sha256.Sum256(make([]byte, 64))
+	var empty []byte
+	for i := 0; i < NumLevels; i++ {
+		empty = append(empty, zeroLevel[:]...)
+	}
+	h, e := has.BucketListHash()
+	assert.NoError(t, e)
+	assert.Equal(t, Hash(sha256.Sum256(empty)), h)
+
+	// An explicit all-zero hash is the same as an omitted one.
+	has.CurrentBuckets[0].Curr = Hash{}.String()
+	h2, _ := has.BucketListHash()
+	assert.Equal(t, h, h2)
+
+	has.CurrentBuckets[0].Curr = EmptyXdrArrayHash().String()
+	h2, _ = has.BucketListHash()
+	assert.NotEqual(t, h, h2)
+
+	has.CurrentBuckets[1].Snap = "nonsense"
+	_, e = has.BucketListHash()
+	assert.Error(t, e)
+}
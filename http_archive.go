@@ -47,6 +47,39 @@ func (b *HttpArchiveBackend) GetFile(pth string) (io.ReadCloser, error) {
 	return resp.Body, nil
 }
 
+// Returned by GetFileRange when the server sent the whole file, ignoring
+// the Range header, so the caller can read the file plainly instead.
+var ErrRangeIgnored = errors.New("Server ignored the Range header")
+
+// Servers that ignore the Range header send the whole file, which is an
+// error (ErrRangeIgnored) rather than read through to the range.
+func (b *HttpArchiveBackend) GetFileRange(pth string, offset int64, length int64) (io.ReadCloser, error) {
+	var derived url.URL = b.base
+	derived.Path = path.Join(derived.Path, pth)
+	req, err := http.NewRequest("GET", derived.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset + length - 1))
+	resp, err := b.client.Do(req)
+	if err != nil {
+		if resp != nil && resp.Body != nil {
+			resp.Body.Close()
+		}
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		resp.Body.Close()
+		return nil, ErrRangeIgnored
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Bad HTTP response '%s' for ranged GET '%s'",
+			resp.Status, derived.String())
+	}
+	return resp.Body, nil
+}
+
 func (b *HttpArchiveBackend) Exists(pth string) bool {
 	var derived url.URL = b.base
 	derived.Path = path.Join(derived.Path, pth)
@@ -57,18 +90,40 @@ func (b *HttpArchiveBackend) Exists(pth string) bool {
 	return err == nil && resp != nil && checkResp(resp) == nil
 }
 
+func (b *HttpArchiveBackend) GetFileSize(pth string) (int64, error) {
+	var derived url.URL = b.base
+	derived.Path = path.Join(derived.Path, pth)
+	resp, err := b.client.Head(derived.String())
+	if resp != nil && resp.Body != nil {
+		resp.Body.Close()
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err = checkResp(resp); err != nil {
+		return 0, err
+	}
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("No Content-Length for HEAD '%s'", derived.String())
+	}
+	return resp.ContentLength, nil
+}
+
 func (b *HttpArchiveBackend) PutFile(pth string, in io.ReadCloser) error {
 	in.Close()
 	return errors.New("PutFile not available over HTTP")
 }
 
+func (b *HttpArchiveBackend) DeleteFile(pth string) error {
+	return errors.New("DeleteFile not available over HTTP")
+}
+
+func (b *HttpArchiveBackend) RenameFile(from string, to string) error {
+	return errors.New("RenameFile not available over HTTP")
+}
+
 func (b *HttpArchiveBackend) ListFiles(pth string) (chan string, chan error) {
-	ch := make(chan string)
-	er := make(chan error)
-	close(ch)
-	er <- errors.New("ListFiles not available over HTTP")
-	close(er)
-	return ch, er
+	return unlistable()
 }
 
 func (b *HttpArchiveBackend) CanListFiles() bool {
@@ -76,7 +131,13 @@ func (b *HttpArchiveBackend) CanListFiles() bool {
 }
 
 func MakeHttpBackend(base *url.URL, opts *ConnectOptions) ArchiveBackend {
+	// Archive files may be served with Content-Encoding: gzip, and must
+	// be read as stored rather than transparently unzipped. Otherwise the
+	// transport is the default's, timeouts and connection pooling alike.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableCompression = true
 	return &HttpArchiveBackend{
+		client: http.Client{Transport: transport},
 		base: *base,
 	}
 }
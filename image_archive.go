@@ -0,0 +1,203 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+)
+
+var ErrImageReadOnly = errors.New("Image backend can't be written")
+
+// A backend serving an archive from a read-only filesystem image, such as
+// a squashfs image of a history range packaged for distribution. The image
+// is anything presenting an fs.FS: a mounted image's mount point (through
+// os.DirFS), or an image file read in-process by a reader registered with
+// RegisterImageFormat. Files are read from the image's root, and every
+// write fails with ErrImageReadOnly.
+type ImageArchiveBackend struct {
+	fsys fs.FS
+}
+
+// Turns an archive path into an fs.FS one, which is unrooted and has no
+// "." or ".." components; the image's root is ".".
+func imagePath(pth string) string {
+	p := path.Clean("/" + pth)[1:]
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+func (b *ImageArchiveBackend) Exists(pth string) bool {
+	_, err := fs.Stat(b.fsys, imagePath(pth))
+	return err == nil
+}
+
+func (b *ImageArchiveBackend) GetFile(pth string) (io.ReadCloser, error) {
+	return b.fsys.Open(imagePath(pth))
+}
+
+func (b *ImageArchiveBackend) GetFileSize(pth string) (int64, error) {
+	info, err := fs.Stat(b.fsys, imagePath(pth))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (b *ImageArchiveBackend) PutFile(pth string, in io.ReadCloser) error {
+	in.Close()
+	return ErrImageReadOnly
+}
+
+func (b *ImageArchiveBackend) DeleteFile(pth string) error {
+	return ErrImageReadOnly
+}
+
+func (b *ImageArchiveBackend) RenameFile(from string, to string) error {
+	return ErrImageReadOnly
+}
+
+var errStopWalk = errors.New("listing stopped")
+
+func (b *ImageArchiveBackend) ListFiles(pth string) (chan string, chan error) {
+	return b.ListFilesUntil(pth, nil)
+}
+
+// Walks the image's directory tree under pth, sending the path of every
+// regular file in it, as the fs backend does its directories.
+func (b *ImageArchiveBackend) ListFilesUntil(pth string, done <-chan struct{}) (chan string, chan error) {
+	ch := make(chan string)
+	errs := make(chan error)
+	root := imagePath(pth)
+	go func() {
+		fs.WalkDir(b.fsys, root,
+			func(p string, d fs.DirEntry, err error) error {
+				if p == root && errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				if err != nil {
+					select {
+					case errs <- err:
+						return nil
+					case <-done:
+						return errStopWalk
+					}
+				}
+				if d.Type().IsRegular() {
+					select {
+					case ch <- p:
+					case <-done:
+						return errStopWalk
+					}
+				}
+				return nil
+			})
+		close(ch)
+		close(errs)
+	}()
+	return ch, errs
+}
+
+func (b *ImageArchiveBackend) CanListFiles() bool {
+	return true
+}
+
+func ImageBackend(fsys fs.FS) ArchiveBackend {
+	return &ImageArchiveBackend{fsys: fsys}
+}
+
+// A filesystem image format that image:// URLs naming an image file can
+// be read in: one whose files begin with Magic, read by Open from the
+// whole file. No format is registered by default, squashfs included: this
+// package has no squashfs reader of its own, so an image:// URL naming a
+// squashfs file fails unless one built on a squashfs package is registered
+// (with Magic squashfsMagic), or the image is mounted and its mount point
+// used instead.
+type ImageFormat struct {
+	Name string
+	Magic []byte
+	Open func(r io.ReaderAt, size int64) (fs.FS, error)
+}
+
+// The bytes a squashfs image begins with.
+var squashfsMagic = []byte("hsqs")
+
+var imageFormatMutex sync.Mutex
+var imageFormats []ImageFormat
+
+// Makes an image format readable through image:// URLs. Like
+// RegisterCodec, this panics if the name is registered twice. Squashfs
+// image files can only be read once a format for them is registered.
+func RegisterImageFormat(f ImageFormat) {
+	imageFormatMutex.Lock()
+	defer imageFormatMutex.Unlock()
+	if f.Open == nil || len(f.Magic) == 0 {
+		panic("archivist: RegisterImageFormat needs an opener and magic bytes")
+	}
+	for _, g := range imageFormats {
+		if g.Name == f.Name {
+			panic("archivist: RegisterImageFormat called twice for format " + f.Name)
+		}
+	}
+	imageFormats = append(imageFormats, f)
+}
+
+func imageFormatForMagic(buf []byte) (ImageFormat, bool) {
+	imageFormatMutex.Lock()
+	defer imageFormatMutex.Unlock()
+	for _, f := range imageFormats {
+		if bytes.HasPrefix(buf, f.Magic) {
+			return f, true
+		}
+	}
+	return ImageFormat{}, false
+}
+
+// Makes a backend for the image at pth: if it's a directory, the mount
+// point of a mounted image, it's served as it is; otherwise it's an image
+// file, opened in the registered format its magic bytes identify. The file
+// stays open for as long as the backend is used.
+func MakeImageBackend(pth string) (ArchiveBackend, error) {
+	info, err := os.Stat(pth)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return ImageBackend(os.DirFS(pth)), nil
+	}
+	file, err := os.Open(pth)
+	if err != nil {
+		return nil, err
+	}
+	magic := make([]byte, 16)
+	n, err := file.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		file.Close()
+		return nil, err
+	}
+	f, ok := imageFormatForMagic(magic[:n])
+	if !ok {
+		file.Close()
+		if bytes.HasPrefix(magic[:n], squashfsMagic) {
+			return nil, fmt.Errorf("Image %s is squashfs, which needs a reader registered " +
+				"with RegisterImageFormat; mount it and use its mount point instead", pth)
+		}
+		return nil, fmt.Errorf("Image %s isn't in any registered format; mount it and use its mount point", pth)
+	}
+	fsys, err := f.Open(file, info.Size())
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Opening %s image %s: %s", f.Name, pth, err)
+	}
+	return ImageBackend(fsys), nil
+}
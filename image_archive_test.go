@@ -0,0 +1,88 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"github.com/stretchr/testify/assert"
+)
+
+// Copies every file of arch into an in-memory image.
+func imageOf(t *testing.T, arch *Archive) fstest.MapFS {
+	img := fstest.MapFS{}
+	ch, errs := arch.backend.ListFiles("")
+	for pth := range ch {
+		rdr, err := arch.backend.GetFile(pth)
+		assert.Nil(t, err)
+		buf, err := ioutil.ReadAll(rdr)
+		assert.Nil(t, err)
+		rdr.Close()
+		img[pth] = &fstest.MapFile{Data: buf}
+	}
+	assert.Equal(t, 0, countErrors(errs))
+	return img
+}
+
+func TestImageBackend(t *testing.T) {
+	src := GetTestMockArchive()
+	src.PopulateRandomRange(testRange())
+	img := imageOf(t, src)
+
+	arch := ConnectBackend(ImageBackend(img), nil)
+	opts := testOptions()
+	assert.Nil(t, arch.Scan(opts))
+	assert.Equal(t, 0, countMissing(arch, opts))
+	assert.True(t, arch.backend.Exists("/" + DefaultRootHASPath))
+	assert.False(t, arch.backend.Exists("no/such/file"))
+	ch, errs := arch.backend.ListFiles("no/such/dir")
+	for range ch {
+		t.Error("listed a file of a missing directory")
+	}
+	assert.Equal(t, 0, countErrors(errs))
+	assert.Equal(t, ErrImageReadOnly, arch.backend.PutFile("x",
+		ioutil.NopCloser(strings.NewReader("x"))))
+	assert.Equal(t, ErrImageReadOnly, arch.backend.DeleteFile(DefaultRootHASPath))
+}
+
+func TestImageFormat(t *testing.T) {
+	defer cleanup()
+	src := GetTestMockArchive()
+	src.PopulateRandomRange(testRange())
+	img := imageOf(t, src)
+	RegisterImageFormat(ImageFormat{
+		Name: "test",
+		Magic: []byte("TESTIMG"),
+		Open: func(r io.ReaderAt, size int64) (fs.FS, error) {
+			return img, nil
+		},
+	})
+
+	dir := GetTestFileArchive().backend.(*FsArchiveBackend).prefix
+	file := path.Join(dir, "history.img")
+	assert.Nil(t, ioutil.WriteFile(file, []byte("TESTIMG"), 0644))
+	arch, err := Connect("image://" + file, nil)
+	assert.Nil(t, err)
+	opts := testOptions()
+	assert.Nil(t, arch.Scan(opts))
+	assert.Equal(t, 0, countMissing(arch, opts))
+
+	assert.Nil(t, ioutil.WriteFile(file, []byte("hsqs"), 0644))
+	_, err = Connect("image://" + file, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "RegisterImageFormat")
+	assert.Nil(t, ioutil.WriteFile(file, []byte("unknown"), 0644))
+	_, err = Connect("image://" + file, nil)
+	assert.Error(t, err)
+
+	// A directory is a mounted image.
+	_, err = Connect("image://" + dir, nil)
+	assert.Nil(t, err)
+}
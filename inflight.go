@@ -0,0 +1,57 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"sync"
+)
+
+// Bounds the total size of the files an operation's workers copy at once.
+// A file larger than the whole budget is admitted once nothing else is in
+// flight, so it waits rather than blocking forever. A nil budget bounds
+// nothing.
+type byteBudget struct {
+	mutex sync.Mutex
+	cond *sync.Cond
+	limit int64
+	used int64
+	// The most ever in flight at once, for tests.
+	peak int64
+}
+
+func newByteBudget(limit int64) *byteBudget {
+	if limit <= 0 {
+		return nil
+	}
+	b := &byteBudget{limit: limit}
+	b.cond = sync.NewCond(&b.mutex)
+	return b
+}
+
+// Waits until n more bytes fit in the budget, then claims them.
+func (b *byteBudget) acquire(n int64) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for b.used != 0 && b.used + n > b.limit {
+		b.cond.Wait()
+	}
+	b.used += n
+	if b.used > b.peak {
+		b.peak = b.used
+	}
+}
+
+func (b *byteBudget) release(n int64) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.used -= n
+	b.cond.Broadcast()
+}
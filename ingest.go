@@ -0,0 +1,136 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"fmt"
+	"io"
+	"github.com/stellar/go-stellar-base/xdr"
+)
+
+// Number of files ReadyForIngestion works on at once.
+const ingestionConcurrency = 32
+
+// Checks that an ingester such as horizon can read the archive from
+// genesis through ledger upTo: the root HAS is present, consistent and at
+// or past upTo, every required category file is present through the
+// checkpoint containing upTo, and so is every bucket those checkpoints
+// reference. Whatever stands in the way is described in the returned
+// list; the error is for failures to check at all, such as a failed
+// listing. Any scan state arch already held is discarded.
+func (a *Archive) ReadyForIngestion(upTo uint32) (bool, []string, error) {
+	return a.readyForIngestion(upTo, false)
+}
+
+// As ReadyForIngestion, also checking that each checkpoint's HAS matches
+// the bucket list hash in its last ledger header, which means reading
+// every ledger file in the range.
+func (a *Archive) ReadyForIngestionWithHashes(upTo uint32) (bool, []string, error) {
+	return a.readyForIngestion(upTo, true)
+}
+
+func (a *Archive) readyForIngestion(upTo uint32, hashes bool) (bool, []string, error) {
+	blockers := []string{}
+	root, err := a.GetRootHAS()
+	if err != nil {
+		blockers = append(blockers, "Can't read root HAS: " + err.Error())
+		return false, blockers, nil
+	}
+	if err = a.CheckRootConsistency(); err != nil {
+		blockers = append(blockers, err.Error())
+	}
+	if root.CurrentLedger < upTo {
+		blockers = append(blockers, fmt.Sprintf("Root HAS is at ledger 0x%8.8x, " +
+			"short of 0x%8.8x", root.CurrentLedger, upTo))
+	}
+
+	a.ClearCachedInfo()
+	opts := &CommandOptions{
+		Range: MakeRange(0, upTo).Clamp(root.Range()),
+		Concurrency: ingestionConcurrency,
+	}
+	if err = a.Scan(opts); err != nil {
+		return false, blockers, err
+	}
+	missing := a.CheckCheckpointFilesMissing(opts)
+	for _, cat := range a.Categories() {
+		if len(missing[cat]) != 0 && a.categoryRequired(cat) {
+			blockers = append(blockers, fmt.Sprintf("Missing %d %s files: %s",
+				len(missing[cat]), cat, fmtRangeList(missing[cat])))
+		}
+	}
+	// The scan reads every HAS under the listed prefixes, which can reach
+	// past upTo, so only buckets the range's checkpoints reference count.
+	absent := make(map[uint32]bool)
+	for _, chk := range missing["history"] {
+		absent[chk] = true
+	}
+	chks := []uint32{}
+	for chk := range opts.Range.Checkpoints() {
+		if !absent[chk] {
+			chks = append(chks, chk)
+		}
+	}
+	refs, err := a.collectReferencedBuckets(chks, ingestionConcurrency)
+	if err != nil {
+		return false, blockers, err
+	}
+	n := 0
+	for bucket := range a.CheckBucketsMissing() {
+		if refs[bucket] {
+			n++
+		}
+	}
+	if n != 0 {
+		blockers = append(blockers, fmt.Sprintf("Missing %d referenced buckets", n))
+	}
+
+	if hashes {
+		for chk := range opts.Range.Checkpoints() {
+			if err = a.checkBucketListHash(chk); err != nil {
+				blockers = append(blockers, err.Error())
+			}
+		}
+	}
+	return len(blockers) == 0, blockers, nil
+}
+
+// Compares the bucket list hash of checkpoint chk's HAS with the one in
+// its ledger file's last header.
+func (a *Archive) checkBucketListHash(chk uint32) error {
+	has, err := a.GetCheckpointHAS(chk)
+	if err != nil {
+		return err
+	}
+	expect, err := has.BucketListHash()
+	if err != nil {
+		return err
+	}
+	rdr, err := a.GetXdrStream(a.CategoryCheckpointPath("ledger", chk))
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+	var last *xdr.LedgerHeaderHistoryEntry
+	for {
+		var lhe xdr.LedgerHeaderHistoryEntry
+		if err = rdr.ReadOne(&lhe); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Reading ledger file of checkpoint 0x%8.8x: %s", chk, err)
+		}
+		last = &lhe
+	}
+	if last == nil || uint32(last.Header.LedgerSeq) != chk {
+		return fmt.Errorf("Ledger file of checkpoint 0x%8.8x doesn't end with " +
+			"its checkpoint ledger", chk)
+	}
+	actual := Hash(last.Header.BucketListHash)
+	if actual != expect {
+		return fmt.Errorf("Checkpoint 0x%8.8x: HAS has bucket list hash %s, " +
+			"ledger header %s", chk, expect, actual)
+	}
+	return nil
+}
@@ -11,7 +11,6 @@ import (
 	"path"
 	"strings"
 	"encoding/json"
-	"compress/gzip"
 	"github.com/stellar/go-stellar-base/xdr"
 )
 
@@ -31,8 +30,8 @@ func DumpXdrAsJson(args []string) error {
 			return err
 		}
 
-		if strings.HasSuffix(arg, ".gz") {
-			rdr, err = gzip.NewReader(rdr)
+		if _, ok := codecForPath(arg); ok || strings.HasSuffix(arg, ".gz") {
+			rdr, err = NewDecompressingReader(rdr)
 			if err != nil {
 				return err
 			}
@@ -0,0 +1,179 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"io"
+	"strings"
+	"time"
+)
+
+// Maps archive paths to the keys a store with key constraints holds them
+// under, and back. Decode must undo Encode, including on the keys a
+// listing returns, which may carry a prefix before the encoded path.
+type KeyTransform interface {
+	Encode(pth string) string
+	Decode(key string) string
+}
+
+// A KeyTransform for stores that fold keys to upper case or won't take
+// "/" in them. Archive paths are all lower case (unless categories or the
+// root HAS path are configured otherwise), so upper-cased keys decode by
+// lower-casing them. Separator, if set, replaces "/" between path
+// components, and must not occur in archive paths itself; it suits flat
+// object stores, which list by key prefix, not the fs backend, which lists
+// directories.
+type KeyFormat struct {
+	Uppercase bool
+	Separator string
+}
+
+func (f KeyFormat) Encode(pth string) string {
+	if f.Separator != "" {
+		pth = strings.Replace(pth, "/", f.Separator, -1)
+	}
+	if f.Uppercase {
+		pth = strings.ToUpper(pth)
+	}
+	return pth
+}
+
+func (f KeyFormat) Decode(key string) string {
+	if f.Uppercase {
+		key = strings.ToLower(key)
+	}
+	if f.Separator != "" {
+		sep := f.Separator
+		if f.Uppercase {
+			sep = strings.ToLower(sep)
+		}
+		key = strings.Replace(key, sep, "/", -1)
+	}
+	return key
+}
+
+// A backend that stores every file of another under the key a KeyTransform
+// gives its path, and decodes the keys it lists, so the archive above, and
+// the patterns it classifies listed paths by, only see archive paths.
+// Connect installs it when ConnectOptions.KeyTransform is set. The inner
+// backend's optional capabilities are forwarded, with paths encoded, but
+// for direct copies, which would read the source at the encoded key too.
+type KeyTransformArchiveBackend struct {
+	inner ArchiveBackend
+	transform KeyTransform
+}
+
+func (b *KeyTransformArchiveBackend) Exists(pth string) bool {
+	return b.inner.Exists(b.transform.Encode(pth))
+}
+
+func (b *KeyTransformArchiveBackend) GetFile(pth string) (io.ReadCloser, error) {
+	return b.inner.GetFile(b.transform.Encode(pth))
+}
+
+func (b *KeyTransformArchiveBackend) GetFileSize(pth string) (int64, error) {
+	return b.inner.GetFileSize(b.transform.Encode(pth))
+}
+
+func (b *KeyTransformArchiveBackend) PutFile(pth string, in io.ReadCloser) error {
+	return b.inner.PutFile(b.transform.Encode(pth), in)
+}
+
+func (b *KeyTransformArchiveBackend) DeleteFile(pth string) error {
+	return b.inner.DeleteFile(b.transform.Encode(pth))
+}
+
+func (b *KeyTransformArchiveBackend) RenameFile(from string, to string) error {
+	return b.inner.RenameFile(b.transform.Encode(from), b.transform.Encode(to))
+}
+
+func (b *KeyTransformArchiveBackend) ListFiles(pth string) (chan string, chan error) {
+	sch, errs := b.inner.ListFiles(b.transform.Encode(pth))
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		for s := range sch {
+			ch <- b.transform.Decode(s)
+		}
+	}()
+	return ch, errs
+}
+
+func (b *KeyTransformArchiveBackend) CanListFiles() bool {
+	return b.inner.CanListFiles()
+}
+
+func (b *KeyTransformArchiveBackend) wrappedBackend() ArchiveBackend {
+	return b.inner
+}
+
+func (b *KeyTransformArchiveBackend) FileVersion(pth string) (string, error) {
+	cond, ok := b.inner.(ConditionalPutter)
+	if !ok {
+		return "", ErrCapabilityUnsupported
+	}
+	return cond.FileVersion(b.transform.Encode(pth))
+}
+
+func (b *KeyTransformArchiveBackend) PutFileIfVersion(pth string, version string, in io.ReadCloser) error {
+	cond, ok := b.inner.(ConditionalPutter)
+	if !ok {
+		in.Close()
+		return ErrCapabilityUnsupported
+	}
+	return cond.PutFileIfVersion(b.transform.Encode(pth), version, in)
+}
+
+func (b *KeyTransformArchiveBackend) GetFileRange(pth string, offset int64, length int64) (io.ReadCloser, error) {
+	g, ok := b.inner.(RangeGetter)
+	if !ok {
+		return nil, ErrCapabilityUnsupported
+	}
+	return g.GetFileRange(b.transform.Encode(pth), offset, length)
+}
+
+func (b *KeyTransformArchiveBackend) GetFileModTime(pth string) (time.Time, error) {
+	g, ok := b.inner.(ModTimeGetter)
+	if !ok {
+		return time.Time{}, ErrCapabilityUnsupported
+	}
+	return g.GetFileModTime(b.transform.Encode(pth))
+}
+
+func (b *KeyTransformArchiveBackend) SetFileModTime(pth string, t time.Time) error {
+	s, ok := b.inner.(ModTimeSetter)
+	if !ok {
+		return ErrCapabilityUnsupported
+	}
+	return s.SetFileModTime(b.transform.Encode(pth), t)
+}
+
+func (b *KeyTransformArchiveBackend) ListPartialUploads() ([]string, error) {
+	p, ok := b.inner.(PartialUploader)
+	if !ok {
+		return nil, ErrCapabilityUnsupported
+	}
+	keys, err := p.ListPartialUploads()
+	uploads := make([]string, len(keys))
+	for i, key := range keys {
+		uploads[i] = b.transform.Decode(key)
+	}
+	return uploads, err
+}
+
+func (b *KeyTransformArchiveBackend) AbortPartialUploads(pth string) error {
+	p, ok := b.inner.(PartialUploader)
+	if !ok {
+		return ErrCapabilityUnsupported
+	}
+	return p.AbortPartialUploads(b.transform.Encode(pth))
+}
+
+func KeyTransformBackend(inner ArchiveBackend, transform KeyTransform) ArchiveBackend {
+	return &KeyTransformArchiveBackend{
+		inner: inner,
+		transform: transform,
+	}
+}
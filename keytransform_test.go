@@ -0,0 +1,41 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"strings"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyFormat(t *testing.T) {
+	f := KeyFormat{Uppercase: true, Separator: ":"}
+	pth := "bucket/ab/cd/ef/bucket-abcdef.xdr.gz"
+	assert.Equal(t, "BUCKET:AB:CD:EF:BUCKET-ABCDEF.XDR.GZ", f.Encode(pth))
+	assert.Equal(t, pth, f.Decode(f.Encode(pth)))
+	assert.Equal(t, pth, KeyFormat{}.Encode(pth))
+}
+
+func TestKeyTransformBackend(t *testing.T) {
+	src := GetRandomPopulatedArchive()
+	inner := MakeMockBackend(nil)
+	dst := ConnectBackend(KeyTransformBackend(inner,
+		KeyFormat{Uppercase: true, Separator: ":"}), nil)
+	opts := testOptions()
+	assert.Nil(t, Mirror(src, dst, opts))
+
+	ch, errs := inner.ListFiles("")
+	n := 0
+	for key := range ch {
+		assert.False(t, strings.ContainsAny(key, "/abcdef"), key)
+		n++
+	}
+	assert.Equal(t, uint32(0), drainErrors(errs))
+	assert.NotEqual(t, 0, n)
+
+	// Listings come back as archive paths, so a fast scan finds it all.
+	assert.True(t, dst.backend.CanListFiles())
+	assert.Equal(t, 0, countMissing(dst, opts))
+}
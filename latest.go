@@ -0,0 +1,120 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"fmt"
+	"path"
+)
+
+// Reports whether anything of category cat is listed under the given
+// prefix, stopping at the first hit.
+func (a *Archive) categoryPrefixNonEmpty(cat string, pth string) (bool, error) {
+	done := make(chan struct{})
+	ch, errs := a.ListCategoryCheckpointsUntil(cat, pth, done)
+	for range ch {
+		close(done)
+		go drainErrors(errs)
+		return true, nil
+	}
+	if n := drainErrors(errs); n != 0 {
+		return false, fmt.Errorf("%d errors while listing %s", n, path.Join(cat, pth))
+	}
+	return false, nil
+}
+
+// Returns the highest checkpoint that has a history file, without scanning
+// the archive. On a backend that can list, the hex directory prefixes are
+// searched from the top down: at each of the two upper levels, the highest
+// non-empty prefix is found (stopping each listing at its first entry), and
+// then the highest non-empty leaf directory, of at most 4 checkpoints, is
+// listed in full. This costs at most a few hundred small LISTs however
+// large the archive is.
+//
+// A backend that can't list is probed downwards from the root HAS instead,
+// so any checkpoints present beyond the root HAS are not seen.
+func (a *Archive) LatestPresentCheckpoint() (uint32, error) {
+	if !a.backend.CanListFiles() {
+		return a.latestPresentCheckpointByProbing()
+	}
+	var pre DirPrefix
+	for depth := 0; depth < len(pre) - 1; depth++ {
+		found := false
+		for i := 0xff; i >= 0 && !found; i-- {
+			pre[depth] = uint8(i)
+			ok, err := a.categoryPrefixNonEmpty("history", pre.PathPrefix(depth))
+			if err != nil {
+				return 0, err
+			}
+			found = ok
+		}
+		if !found {
+			return 0, fmt.Errorf("No history checkpoints in archive")
+		}
+	}
+	leaf := len(pre) - 1
+	for i := 0xff; i >= 0; i-- {
+		pre[leaf] = uint8(i)
+		ch, errs := a.ListCategoryCheckpoints("history", pre.Path())
+		found := false
+		var latest uint32
+		for chk := range ch {
+			if !found || chk > latest {
+				latest = chk
+			}
+			found = true
+		}
+		if n := drainErrors(errs); n != 0 {
+			return 0, fmt.Errorf("%d errors while listing %s", n,
+				path.Join("history", pre.Path()))
+		}
+		if found {
+			return latest, nil
+		}
+	}
+	return 0, fmt.Errorf("No history checkpoints under %s",
+		path.Join("history", pre.PathPrefix(leaf - 1)))
+}
+
+func (a *Archive) latestPresentCheckpointByProbing() (uint32, error) {
+	root, err := a.GetRootHAS()
+	if err != nil {
+		return 0, err
+	}
+	for chk := root.CurrentLedger; ; chk -= CheckpointFreq {
+		if a.CategoryCheckpointExists("history", chk) {
+			return chk, nil
+		}
+		if chk < 2 * CheckpointFreq {
+			break
+		}
+	}
+	return 0, fmt.Errorf("No history checkpoints at or below 0x%8.8x",
+		root.CurrentLedger)
+}
+
+// Checks that the root HAS doesn't advertise ledgers the archive doesn't
+// have: that the checkpoint it names has a history file, and that no lower
+// checkpoint than it is the highest present. This catches a root HAS that
+// was written although some of the last checkpoints before it weren't.
+func (a *Archive) CheckRootConsistency() error {
+	root, err := a.GetRootHAS()
+	if err != nil {
+		return err
+	}
+	latest, err := a.LatestPresentCheckpoint()
+	if err != nil {
+		return err
+	}
+	if root.CurrentLedger > latest {
+		return fmt.Errorf("Root HAS advertises ledger 0x%8.8x, beyond the highest " +
+			"present checkpoint 0x%8.8x", root.CurrentLedger, latest)
+	}
+	if !a.CategoryCheckpointExists("history", root.CurrentLedger) {
+		return fmt.Errorf("Root HAS advertises ledger 0x%8.8x, whose checkpoint " +
+			"is missing", root.CurrentLedger)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"fmt"
+	"io"
+	"github.com/stellar/go-stellar-base/xdr"
+)
+
+// Number of ledger files StreamLedgerHeaders fetches ahead of the one it
+// is sending from.
+const ledgerStreamReadAhead = 8
+
+// A ledger header as StreamLedgerHeaders sends it, with the checkpoint
+// whose ledger file held it.
+type LedgerHeader struct {
+	Checkpoint uint32
+	Entry xdr.LedgerHeaderHistoryEntry
+}
+
+type fetchedLedgers struct {
+	checkpoint uint32
+	entries []xdr.LedgerHeaderHistoryEntry
+	err error
+}
+
+// Reads and decodes the whole ledger file of chk.
+func (a *Archive) readLedgerFile(chk uint32) ([]xdr.LedgerHeaderHistoryEntry, error) {
+	rdr, err := a.GetXdrStream(a.CategoryCheckpointPath("ledger", chk))
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	entries := []xdr.LedgerHeaderHistoryEntry{}
+	for {
+		var lhe xdr.LedgerHeaderHistoryEntry
+		if err = rdr.ReadOne(&lhe); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return entries, err
+		}
+		entries = append(entries, lhe)
+	}
+}
+
+// Sends the header of every ledger in the checkpoints of rng (clamped to
+// the root HAS), strictly in ledger order, read from their ledger files.
+// Up to ledgerStreamReadAhead files are fetched and decoded at once, each
+// into its own slot, and the slots are emptied in checkpoint order, so
+// fetches finishing out of order can't reorder the stream. Each file is
+// read and checked whole before any of its headers are sent, so a
+// checkpoint whose file can't be read, or whose headers go backwards, is
+// reported on the error channel and none of its headers are sent. Both
+// channels are closed at the end, and the caller must drain both: the
+// stream stops until each header is read, and errors left unread keep
+// the goroutine buffering them alive.
+func (a *Archive) StreamLedgerHeaders(rng Range) (<-chan LedgerHeader, <-chan error) {
+	ch := make(chan LedgerHeader)
+	errs := make(chan error)
+	go func() {
+		defer close(ch)
+		defer close(errs)
+		root, err := a.GetRootHAS()
+		if err != nil {
+			errs <- err
+			return
+		}
+		rng = rng.Clamp(root.Range())
+
+		// Slots are queued in checkpoint order; the queue's capacity
+		// bounds the read-ahead.
+		slots := make(chan chan fetchedLedgers, ledgerStreamReadAhead)
+		go func() {
+			defer close(slots)
+			for chk := range rng.Checkpoints() {
+				slot := make(chan fetchedLedgers, 1)
+				slots <- slot
+				go func(chk uint32) {
+					entries, err := a.readLedgerFile(chk)
+					slot <- fetchedLedgers{checkpoint: chk, entries: entries, err: err}
+				}(chk)
+			}
+		}()
+
+		var last uint32
+		for slot := range slots {
+			f := <-slot
+			chk := f.checkpoint
+			if f.err != nil {
+				errs <- fmt.Errorf("Reading ledger file of checkpoint 0x%8.8x: %s", chk, f.err)
+				continue
+			}
+			prev := last
+			ordered := true
+			for _, lhe := range f.entries {
+				seq := uint32(lhe.Header.LedgerSeq)
+				if seq <= prev {
+					errs <- fmt.Errorf("Ledger %d follows ledger %d in checkpoint 0x%8.8x",
+						seq, prev, chk)
+					ordered = false
+					break
+				}
+				prev = seq
+			}
+			if !ordered {
+				continue
+			}
+			for _, lhe := range f.entries {
+				ch <- LedgerHeader{Checkpoint: chk, Entry: lhe}
+			}
+			last = prev
+		}
+	}()
+	return ch, makeErrorPump(errs)
+}
@@ -0,0 +1,89 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stellar/go-stellar-base/xdr"
+)
+
+func putLedgerFile(t *testing.T, arch *Archive, chk uint32, seqs []uint32) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	for _, seq := range seqs {
+		var lhe xdr.LedgerHeaderHistoryEntry
+		lhe.Header.LedgerSeq = xdr.Uint32(seq)
+		assert.Nil(t, WriteFramedXdr(w, &lhe))
+	}
+	w.Close()
+	assert.Nil(t, arch.backend.PutFile(arch.CategoryCheckpointPath("ledger", chk),
+		ioutil.NopCloser(&buf)))
+}
+
+func countErrors(errs <-chan error) int {
+	n := 0
+	for range errs {
+		n++
+	}
+	return n
+}
+
+func TestStreamLedgerHeaders(t *testing.T) {
+	arch := GetTestMockArchive()
+	high := uint32(0x23f)
+	for chk := uint32(0x3f); chk <= high; chk += 64 {
+		seqs := []uint32{}
+		for seq := chk - 63; seq <= chk; seq++ {
+			if seq != 0 {
+				seqs = append(seqs, seq)
+			}
+		}
+		putLedgerFile(t, arch, chk, seqs)
+	}
+	has := NewHAS()
+	has.CurrentLedger = high
+	assert.Nil(t, arch.PutRootHAS(has, &CommandOptions{Force:true}))
+
+	// Headers come in order across checkpoints, from the first ledger of
+	// the range's first checkpoint to the last of its last.
+	ch, errs := arch.StreamLedgerHeaders(MakeRange(0, 0x1bf))
+	expect := uint32(1)
+	for lh := range ch {
+		assert.Equal(t, expect, uint32(lh.Entry.Header.LedgerSeq))
+		assert.Equal(t, expect | 0x3f, lh.Checkpoint)
+		expect++
+	}
+	assert.Equal(t, 0, countErrors(errs))
+	assert.Equal(t, uint32(0x1c0), expect)
+
+	// A missing file, one going backwards, or one cut short is reported,
+	// and none of its headers sent.
+	assert.Nil(t, arch.backend.DeleteFile(arch.CategoryCheckpointPath("ledger", 0x7f)))
+	putLedgerFile(t, arch, 0xbf, []uint32{0x80, 0x60})
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	for seq := uint32(0xc0); seq < 0xd0; seq++ {
+		var lhe xdr.LedgerHeaderHistoryEntry
+		lhe.Header.LedgerSeq = xdr.Uint32(seq)
+		assert.Nil(t, WriteFramedXdr(w, &lhe))
+	}
+	w.Write([]byte{0x80, 0, 0, 100, 1, 2, 3})
+	w.Close()
+	assert.Nil(t, arch.backend.PutFile(arch.CategoryCheckpointPath("ledger", 0xff),
+		ioutil.NopCloser(&buf)))
+	ch, errs = arch.StreamLedgerHeaders(MakeRange(0, high))
+	n := 0
+	for lh := range ch {
+		assert.NotEqual(t, uint32(0xbf), lh.Checkpoint)
+		assert.NotEqual(t, uint32(0xff), lh.Checkpoint)
+		n++
+	}
+	assert.Equal(t, 3, countErrors(errs))
+	assert.Equal(t, 63 + 64 * 5, n)
+}
@@ -0,0 +1,59 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Receives everything the package logs: progress, skipped files and errors.
+// Printf is called from many goroutines at once; a *log.Logger will do.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Writes to the standard logger, as the package always has.
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) {
+	log.Output(3, fmt.Sprintf(format, v...))
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Printf(string, ...interface{}) {}
+
+var loggerMutex sync.RWMutex
+var logger Logger = stdLogger{}
+
+// Sends the package's log output to l instead of the standard logger; nil
+// discards it.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = discardLogger{}
+	}
+	loggerMutex.Lock()
+	defer loggerMutex.Unlock()
+	logger = l
+}
+
+// Silences the package entirely, for embedders that report progress and
+// errors themselves; SetQuiet(false) goes back to the standard logger.
+func SetQuiet(quiet bool) {
+	if quiet {
+		SetLogger(nil)
+	} else {
+		SetLogger(stdLogger{})
+	}
+}
+
+func logf(format string, v ...interface{}) {
+	loggerMutex.RLock()
+	l := logger
+	loggerMutex.RUnlock()
+	l.Printf(format, v...)
+}
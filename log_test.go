@@ -0,0 +1,51 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+type capturingLogger struct {
+	mutex sync.Mutex
+	lines []string
+}
+
+func (l *capturingLogger) Printf(format string, v ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func TestSetLogger(t *testing.T) {
+	defer cleanup()
+	var std bytes.Buffer
+	log.SetOutput(&std)
+	defer log.SetOutput(os.Stderr)
+	defer SetQuiet(false)
+
+	l := &capturingLogger{}
+	SetLogger(l)
+	assert.Nil(t, Mirror(GetRandomPopulatedArchive(), GetTestArchive(), testOptions()))
+	assert.NotEmpty(t, l.lines)
+	assert.Equal(t, "", std.String())
+
+	SetQuiet(true)
+	opts := testOptions()
+	dst := GetTestArchive()
+	assert.Nil(t, Mirror(GetRandomPopulatedArchive(), dst, opts))
+	assert.Equal(t, 0, countMissing(dst, opts))
+	assert.Equal(t, "", std.String())
+
+	SetQuiet(false)
+	logf("back to %s", "standard")
+	assert.Contains(t, std.String(), "back to standard")
+}
@@ -0,0 +1,105 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A file named like a bucket or checkpoint file that the archive can't
+// find as one, and why.
+type MalformedFile struct {
+	Path string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+type byMalformedPath []MalformedFile
+
+func (m byMalformedPath) Len() int { return len(m) }
+func (m byMalformedPath) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m byMalformedPath) Less(i, j int) bool { return m[i].Path < m[j].Path }
+
+var lowerHexRx = regexp.MustCompile("^[0-9a-f]*$")
+
+// Returns why rel, a path within the archive under dir, which is "bucket"
+// or a category, is named as one of dir's files but isn't where the
+// archive would look for it; or "" if it is, or isn't named as one at all.
+func (a *Archive) malformedReason(dir string, rel string) string {
+	base := path.Base(rel)
+	if !strings.HasPrefix(base, dir + "-") {
+		return ""
+	}
+	id, ext := strings.TrimPrefix(base, dir + "-"), ""
+	if i := strings.Index(id, "."); i >= 0 {
+		id, ext = id[:i], id[i + 1:]
+	}
+	idLen, wantExt := 8, a.categories.Ext(dir)
+	if dir == "bucket" {
+		idLen, wantExt = 64, "xdr.gz"
+	}
+	if len(id) != idLen {
+		return fmt.Sprintf("'%s' is %d characters long, not %d", id, len(id), idLen)
+	}
+	if !lowerHexRx.MatchString(id) {
+		return fmt.Sprintf("'%s' isn't lowercase hex", id)
+	}
+	if ext != wantExt {
+		return fmt.Sprintf("Extension is '.%s', not '.%s'", ext, wantExt)
+	}
+	var want string
+	if dir == "bucket" {
+		want = BucketPath(MustDecodeHash(id))
+	} else {
+		chk, _ := strconv.ParseUint(id, 16, 32)
+		want = a.CategoryCheckpointPath(dir, uint32(chk))
+	}
+	if rel != want {
+		return "Belongs at " + want
+	}
+	return ""
+}
+
+// Lists the bucket and category trees whole and returns, sorted by path,
+// the files named as buckets or checkpoint files that the archive can't
+// find as such: those whose hash or checkpoint number is truncated or
+// isn't lowercase hex, which the patterns listings are matched against
+// skip silently, and those under the wrong hex directories, which a scan
+// counts but a lookup by name never reaches. Either way the file's
+// contents are invisible, so it stands for data lost. This only reads, and
+// CleanOrphans leaves such files alone. Needs a backend that can list.
+func (a *Archive) ListMalformedFiles() ([]MalformedFile, error) {
+	found := []MalformedFile{}
+	if !a.backend.CanListFiles() {
+		return found, fmt.Errorf("Finding malformed files needs a backend that can list")
+	}
+	var errs uint32
+	for _, dir := range append([]string{"bucket"}, a.Categories()...) {
+		// Listings may carry the backend's prefix; this finds the path
+		// within the archive.
+		within := regexp.MustCompile("(?:^|/)(" + regexp.QuoteMeta(dir) + "/.*)$")
+		ch, es := a.backend.ListFiles(dir)
+		es = makeErrorPump(es)
+		for s := range ch {
+			m := within.FindStringSubmatch(s)
+			if m == nil {
+				continue
+			}
+			if reason := a.malformedReason(dir, m[1]); reason != "" {
+				found = append(found, MalformedFile{Path: m[1], Reason: reason})
+			}
+		}
+		errs += drainErrors(es)
+	}
+	sort.Sort(byMalformedPath(found))
+	if errs != 0 {
+		return found, fmt.Errorf("%d errors while listing for malformed files", errs)
+	}
+	return found, nil
+}
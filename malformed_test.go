@@ -0,0 +1,41 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListMalformedFiles(t *testing.T) {
+	defer cleanup()
+	arch := GetRandomPopulatedArchive()
+	found, err := arch.ListMalformedFiles()
+	assert.Nil(t, err)
+	assert.Empty(t, found)
+
+	hash := strings.Repeat("ab", 32)
+	malformed := []string{
+		"bucket/ab/ab/ab/bucket-" + hash[:63] + ".xdr.gz",
+		"bucket/ab/ab/ab/bucket-" + strings.ToUpper(hash) + ".xdr.gz",
+		"bucket/00/00/00/bucket-" + hash + ".xdr.gz",
+		"ledger/00/00/00/ledger-7f.xdr.gz",
+		"ledger/00/00/00/ledger-0000007f.xdr",
+	}
+	for _, pth := range append(malformed, "bucket/ab/ab/ab/.bucket-x.tmp123") {
+		assert.Nil(t, arch.backend.PutFile(pth, ioutil.NopCloser(strings.NewReader("x"))))
+	}
+	found, err = arch.ListMalformedFiles()
+	assert.Nil(t, err)
+	paths := []string{}
+	for _, m := range found {
+		assert.NotEqual(t, "", m.Reason)
+		paths = append(paths, m.Path)
+	}
+	assert.Equal(t, []string{malformed[2], malformed[1], malformed[0], malformed[4], malformed[3]}, paths)
+	assert.Equal(t, "Belongs at " + BucketPath(MustDecodeHash(hash)), found[0].Reason)
+}
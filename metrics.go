@@ -0,0 +1,126 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// What an operation has copied, counted for its MetricsFile. A nil
+// *opStats counts nothing.
+type opStats struct {
+	filesCopied uint32
+	bucketsCopied uint32
+	bytesCopied int64
+	// Of filesCopied, those a DirectCopier copied without reading them.
+	filesCopiedDirect uint32
+}
+
+func (s *opStats) noteCopy(pth string, n int64) {
+	if s == nil {
+		return
+	}
+	atomic.AddUint32(&s.filesCopied, 1)
+	if isBucketPath(pth) {
+		atomic.AddUint32(&s.bucketsCopied, 1)
+	}
+	atomic.AddInt64(&s.bytesCopied, n)
+}
+
+func (s *opStats) noteDirectCopy(pth string, n int64) {
+	if s == nil {
+		return
+	}
+	s.noteCopy(pth, n)
+	atomic.AddUint32(&s.filesCopiedDirect, 1)
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type metric struct {
+	name string
+	help string
+	value float64
+}
+
+// Starts counting for op if opts.MetricsFile is set. The returned function
+// writes the file once op ends with err; arch, if given, is the archive op
+// scanned, whose missing and corrupt files are reported too.
+func startMetrics(opts *CommandOptions, op string) func(arch *Archive, err error) {
+	if opts.MetricsFile == "" {
+		return func(*Archive, error) {}
+	}
+	start := time.Now()
+	stats := &opStats{}
+	opts.stats = stats
+	return func(arch *Archive, err error) {
+		opts.stats = nil
+		end := time.Now()
+		success := 1.0
+		if err != nil {
+			success = 0
+		}
+		metrics := []metric{
+			{"last_run_success", "Whether the last run succeeded.", success},
+			{"last_run_timestamp_seconds", "When the last run ended.",
+				float64(end.UnixNano()) / 1e9},
+			{"duration_seconds", "How long the last run took.",
+				end.Sub(start).Seconds()},
+			{"files_copied", "Files the last run copied.",
+				float64(atomic.LoadUint32(&stats.filesCopied))},
+			{"buckets_copied", "Buckets the last run copied.",
+				float64(atomic.LoadUint32(&stats.bucketsCopied))},
+			{"bytes_copied", "Bytes the last run copied.",
+				float64(atomic.LoadInt64(&stats.bytesCopied))},
+			{"files_copied_direct", "Files the last run copied without reading them.",
+				float64(atomic.LoadUint32(&stats.filesCopiedDirect))},
+		}
+		if arch != nil {
+			missing := len(arch.CheckBucketsMissing())
+			for _, chks := range arch.CheckCheckpointFilesMissing(opts) {
+				missing += len(chks)
+			}
+			arch.mutex.Lock()
+			corrupt := arch.invalidBuckets + arch.invalidLedgers +
+				arch.invalidTxSets + arch.invalidTxResultSets
+			arch.mutex.Unlock()
+			metrics = append(metrics,
+				metric{"missing_files", "Files the last run found missing.",
+					float64(missing)},
+				metric{"corrupt_files", "Files the last run found corrupt.",
+					float64(corrupt)})
+		}
+		noteError(writeMetricsFile(opts.MetricsFile, op, metrics))
+	}
+}
+
+// Writes metrics in the Prometheus text format, as node_exporter's
+// textfile collector reads it, replacing the file in one rename so the
+// collector never sees half of it.
+func writeMetricsFile(pth string, op string, metrics []metric) error {
+	var buf bytes.Buffer
+	label := strings.Replace(op, "\"", "\\\"", -1)
+	for _, m := range metrics {
+		name := "archivist_" + m.name
+		fmt.Fprintf(&buf, "# HELP %s %s\n", name, m.help)
+		fmt.Fprintf(&buf, "# TYPE %s gauge\n", name)
+		fmt.Fprintf(&buf, "%s{operation=\"%s\"} %g\n", name, label, m.value)
+	}
+	return writeFileAtomic(pth, buf.Bytes())
+}
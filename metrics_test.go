@@ -0,0 +1,65 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func readMetrics(t *testing.T, pth string) map[string]string {
+	buf, e := ioutil.ReadFile(pth)
+	assert.NoError(t, e)
+	values := make(map[string]string)
+	for _, line := range strings.Split(string(buf), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		values[fields[0]] = fields[1]
+	}
+	return values
+}
+
+func TestMetricsFile(t *testing.T) {
+	defer cleanup()
+	dir, e := ioutil.TempDir("/tmp", "archivist")
+	assert.NoError(t, e)
+	tmpdirs = append(tmpdirs, dir)
+	pth := dir + "/archivist.prom"
+
+	src := GetRandomPopulatedArchive()
+	dst := GetTestArchive()
+	opts := testOptions()
+	opts.MetricsFile = pth
+	assert.Nil(t, Mirror(src, dst, opts))
+	m := readMetrics(t, pth)
+	assert.Equal(t, "1", m[`archivist_last_run_success{operation="mirror"}`])
+	// Readable by a collector running as another user.
+	fi, e := os.Stat(pth)
+	assert.NoError(t, e)
+	assert.Equal(t, os.FileMode(0644), fi.Mode().Perm())
+	nBuckets := 15 * 3 * NumLevels
+	nFiles := nBuckets + 15 * len(Categories())
+	assert.Equal(t, strconv.Itoa(nBuckets), m[`archivist_buckets_copied{operation="mirror"}`])
+	assert.Equal(t, strconv.Itoa(nFiles), m[`archivist_files_copied{operation="mirror"}`])
+	assert.NotEqual(t, "0", m[`archivist_bytes_copied{operation="mirror"}`])
+	_, ok := m[`archivist_missing_files{operation="mirror"}`]
+	assert.False(t, ok)
+
+	has, _ := dst.GetCheckpointHAS(0x7f)
+	dst.backend.DeleteFile(BucketPath(MustDecodeHash(has.CurrentBuckets[0].Curr)))
+	opts = testOptions()
+	opts.MetricsFile = pth
+	assert.Nil(t, dst.Scan(opts))
+	m = readMetrics(t, pth)
+	assert.Equal(t, "1", m[`archivist_missing_files{operation="scan"}`])
+	assert.Equal(t, "0", m[`archivist_files_copied{operation="scan"}`])
+	assert.Nil(t, opts.stats)
+}
@@ -5,39 +5,231 @@
 package archivist
 
 import (
-	"log"
 	"fmt"
 	"sync"
 	"sync/atomic"
 )
 
+// Reports whether a bucket falls inside the size window configured by
+// MinBucketBytes / MaxBucketBytes. With neither set, no size lookup is done.
+func bucketSizeSelected(src *Archive, bucket Hash, opts *CommandOptions) (bool, error) {
+	if opts.MinBucketBytes == 0 && opts.MaxBucketBytes == 0 {
+		return true, nil
+	}
+	sz, err := src.BucketSize(bucket)
+	if err != nil {
+		return false, err
+	}
+	if opts.MinBucketBytes != 0 && sz < opts.MinBucketBytes {
+		return false, nil
+	}
+	if opts.MaxBucketBytes != 0 && sz > opts.MaxBucketBytes {
+		return false, nil
+	}
+	return true, nil
+}
+
+// Reports whether a bucket passes the IncludeBuckets / ExcludeBuckets
+// filters.
+func bucketHashSelected(bucket Hash, opts *CommandOptions) bool {
+	if opts.IncludeBuckets != nil && !opts.IncludeBuckets[bucket] {
+		return false
+	}
+	return !opts.ExcludeBuckets[bucket]
+}
+
+// Reports whether Mirror should copy the history file for checkpoint chk,
+// given opts.HASInterval.
+func hasSelected(chk uint32, opts *CommandOptions) bool {
+	if opts.HASInterval <= 1 {
+		return true
+	}
+	n := (chk + 1) / CheckpointFreq
+	return n % uint32(opts.HASInterval) == 0
+}
+
+// Tracks which checkpoints Mirror has finished copying and, under
+// RootHASIncremental, advances dst's root HAS to the highest one below
+// which every checkpoint is finished.
+type rootAdvancer struct {
+	mutex sync.Mutex
+	dst *Archive
+	opts *CommandOptions
+	next uint32
+	finished map[uint32]HistoryArchiveState
+}
+
+func (r *rootAdvancer) finish(chk uint32, has HistoryArchiveState) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.finished[chk] = has
+	var latest *HistoryArchiveState
+	for {
+		h, ok := r.finished[r.next]
+		if !ok {
+			break
+		}
+		delete(r.finished, r.next)
+		latest = &h
+		r.next += CheckpointFreq
+	}
+	if latest == nil {
+		return nil
+	}
+	root := *latest
+	if r.opts.HASTransform != nil {
+		root = r.opts.HASTransform(root)
+	}
+	return r.dst.PutRootHAS(root, r.opts)
+}
+
+type bucketFetchState struct {
+	// Closed once the bucket's copy has been attempted; failed is set
+	// before then.
+	done chan struct{}
+	failed bool
+}
+
+func mirrorBucket(src *Archive, dst *Archive, bucket Hash, opts *CommandOptions) error {
+	pth := BucketPath(bucket)
+	if !bucketHashSelected(bucket, opts) {
+		if opts.FailOnExcludedBucket {
+			return fmt.Errorf("Excluded bucket %s is referenced by a mirrored checkpoint", bucket)
+		}
+		logf("skipping excluded bucket " + pth)
+		return nil
+	}
+	selected, e := bucketSizeSelected(src, bucket, opts)
+	if e != nil {
+		return e
+	}
+	if !selected {
+		logf("skipping out-of-size-range " + pth)
+		return nil
+	}
+	return copyPath(src, dst, pth, opts)
+}
+
+// Copies checkpoint ix's category files, up to opts.CategoryConcurrency at
+// once, and returns the number of failures among them all. A missing
+// optional category isn't one.
+func mirrorCategories(src *Archive, dst *Archive, ix uint32, opts *CommandOptions) uint32 {
+	width := opts.CategoryConcurrency
+	if width < 1 {
+		width = 1
+	}
+	slots := make(chan struct{}, width)
+	var errs uint32
+	var wg sync.WaitGroup
+	for _, cat := range src.Categories() {
+		if cat == "history" && !hasSelected(ix, opts) {
+			continue
+		}
+		if !opts.Controller.proceed() {
+			atomic.AddUint32(&errs, 1)
+			break
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(cat string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			e := copyPath(src, dst, src.CategoryCheckpointPath(cat, ix), opts)
+			if e != nil && !src.categoryRequired(cat) {
+				return
+			}
+			atomic.AddUint32(&errs, noteError(e))
+		}(cat)
+	}
+	wg.Wait()
+	return errs
+}
+
+// Mirror's progress counters, updated atomically by its workers. Buckets
+// usually dominate the work, but are only discovered as each checkpoint's
+// HAS is read, so the bucket total is extrapolated from the checkpoints
+// started so far.
+type mirrorProgress struct {
+	checkpoints uint32
+	checkpointsStarted uint32
+	checkpointsDone uint32
+	bucketsFound uint32
+	bucketsDone uint32
+}
+
+func (p *mirrorProgress) fraction() float64 {
+	started := atomic.LoadUint32(&p.checkpointsStarted)
+	if started == 0 || p.checkpoints == 0 {
+		return 0
+	}
+	found := float64(atomic.LoadUint32(&p.bucketsFound))
+	estBuckets := found * float64(p.checkpoints) / float64(started)
+	done := float64(atomic.LoadUint32(&p.checkpointsDone)) +
+		float64(atomic.LoadUint32(&p.bucketsDone))
+	return done / (float64(p.checkpoints) + estBuckets)
+}
+
+func (p *mirrorProgress) String() string {
+	return fmt.Sprintf("Copied %d/%d checkpoints, %d/%d buckets found so far (%f%%)",
+		atomic.LoadUint32(&p.checkpointsDone), p.checkpoints,
+		atomic.LoadUint32(&p.bucketsDone), atomic.LoadUint32(&p.bucketsFound),
+		100.0 * p.fraction())
+}
+
 func Mirror(src *Archive, dst *Archive, opts *CommandOptions) error {
+	span := startRangeSpan(opts, "archivist.Mirror")
+	finish := startMetrics(opts, "mirror")
+	err := mirror(src, dst, opts)
+	finish(nil, err)
+	span.End(err)
+	return err
+}
+
+func mirror(src *Archive, dst *Archive, opts *CommandOptions) error {
 	rootHAS, e := src.GetRootHAS()
 	if e != nil {
 		return e
 	}
 
-	opts.Range = opts.Range.Clamp(rootHAS.Range())
+	avail := rootHAS.Range()
+	if opts.StrictRange && (opts.Range.Low < avail.Low || opts.Range.High > avail.High) {
+		return fmt.Errorf("Requested range %s is not contained in source range %s",
+			opts.Range, avail)
+	}
+	opts.Range = opts.Range.Clamp(avail)
+	opts.retries = newRetryBudget(opts.RetryBudget)
+	opts.verifySlots = newVerifyLimiter(opts.VerifyConcurrency)
+	opts.inFlight = newByteBudget(opts.MaxInFlightBytes)
 
-	log.Printf("copying range %s\n", opts.Range)
+	logf("copying range %s\n", opts.Range)
 
 	// Make a bucket-fetch map that shows which buckets are
 	// already-being-fetched
-	bucketFetch := make(map[Hash]bool)
+	bucketFetch := make(map[Hash]*bucketFetchState)
 	var bucketFetchMutex sync.Mutex
 
 	var errs uint32
-	tick := makeTicker(func(ticks uint) {
-		bucketFetchMutex.Lock()
-		sz := opts.Range.Size()
-		log.Printf("Copied %d/%d checkpoints (%f%%), %d buckets",
-			ticks, sz,
-			100.0 * float64(ticks)/float64(sz),
-			len(bucketFetch))
-		bucketFetchMutex.Unlock()
+	progress := &mirrorProgress{checkpoints: uint32(opts.Range.Size())}
+	// Ticks for copied buckets as well as checkpoints, so progress is still
+	// reported while a few checkpoints' worth of big buckets copy.
+	tick := makeTicker(func(_ uint) {
+		logf("%s", progress)
 	})
 
 
+	var advancer *rootAdvancer
+	if opts.RootHASPolicy == RootHASIncremental {
+		// PutRootHAS briefly sets Force on the options it's given, so
+		// mustn't be handed the ones the workers are reading.
+		rootOpts := *opts
+		advancer = &rootAdvancer{
+			dst: dst,
+			opts: &rootOpts,
+			next: opts.Range.Low,
+			finished: make(map[uint32]HistoryArchiveState),
+		}
+	}
+
 	var wg sync.WaitGroup
 	checkpoints := opts.Range.Checkpoints()
 	wg.Add(opts.Concurrency)
@@ -48,34 +240,56 @@ func Mirror(src *Archive, dst *Archive, opts *CommandOptions) error {
 				if !ok {
 					break
 				}
+				if opts.retries.exhausted() || !opts.Controller.proceed() {
+					continue
+				}
 				has, e := src.GetCheckpointHAS(ix)
 				if e != nil {
 					atomic.AddUint32(&errs, noteError(e))
 					continue
 				}
+				atomic.AddUint32(&progress.checkpointsStarted, 1)
+				chkErrs := uint32(0)
+				complete := true
 				for _, bucket := range has.Buckets() {
-					alreadyFetching := false
 					bucketFetchMutex.Lock()
-					_, alreadyFetching = bucketFetch[bucket]
+					fetch, alreadyFetching := bucketFetch[bucket]
 					if !alreadyFetching {
-						bucketFetch[bucket] = true
+						fetch = &bucketFetchState{done: make(chan struct{})}
+						bucketFetch[bucket] = fetch
+						atomic.AddUint32(&progress.bucketsFound, 1)
 					}
 					bucketFetchMutex.Unlock()
 					if !alreadyFetching {
-						pth := BucketPath(bucket)
-						e = copyPath(src, dst, pth, opts)
-						atomic.AddUint32(&errs, noteError(e))
+						// A stopped Mirror leaves the bucket uncopied, and
+						// counts it failed without logging it.
+						e := ErrMirrorStopped
+						if opts.Controller.proceed() {
+							e = mirrorBucket(src, dst, bucket, opts)
+							chkErrs += noteError(e)
+						} else {
+							chkErrs++
+						}
+						fetch.failed = e != nil
+						close(fetch.done)
+						atomic.AddUint32(&progress.bucketsDone, 1)
+						tick <- true
+					} else if advancer != nil {
+						// The root HAS mustn't advance past this checkpoint
+						// while a bucket it shares is still being copied.
+						<-fetch.done
+						if fetch.failed {
+							complete = false
+						}
 					}
 				}
 
-				for _, cat := range Categories() {
-					pth := CategoryCheckpointPath(cat, ix)
-					e = copyPath(src, dst, pth, opts)
-					if e != nil && !categoryRequired(cat) {
-						continue
-					}
-					atomic.AddUint32(&errs, noteError(e))
+				chkErrs += mirrorCategories(src, dst, ix, opts)
+				if chkErrs == 0 && complete && advancer != nil {
+					chkErrs += noteError(advancer.finish(ix, has))
 				}
+				atomic.AddUint32(&errs, chkErrs)
+				atomic.AddUint32(&progress.checkpointsDone, 1)
 				tick <- true
 			}
 			wg.Done()
@@ -83,11 +297,22 @@ func Mirror(src *Archive, dst *Archive, opts *CommandOptions) error {
 	}
 
 	wg.Wait()
-	log.Printf("Copied %d checkpoints, %d buckets",
-		opts.Range.Size(), len(bucketFetch))
 	close(tick)
-	e = dst.PutRootHAS(rootHAS, opts)
-	errs += noteError(e)
+	logf("Copied %d checkpoints, %d buckets",
+		progress.checkpointsDone, progress.bucketsDone)
+	if opts.retries.exhausted() {
+		return opts.retries.abortError("mirroring")
+	}
+	if opts.Controller.isStopped() {
+		return ErrMirrorStopped
+	}
+	if opts.RootHASPolicy != RootHASNever {
+		if opts.HASTransform != nil {
+			rootHAS = opts.HASTransform(rootHAS)
+		}
+		e = dst.PutRootHAS(rootHAS, opts)
+		errs += noteError(e)
+	}
 	if errs != 0 {
 		return fmt.Errorf("%d errors while mirroring", errs)
 	}
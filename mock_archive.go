@@ -11,6 +11,9 @@ import (
 	"io/ioutil"
 	"errors"
 	"sync"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 )
 
 type MockArchiveBackend struct {
@@ -25,6 +28,44 @@ func (b *MockArchiveBackend) Exists(pth string) bool {
 	return ok
 }
 
+var errMockFileClosed = errors.New("read from closed mock file")
+
+// A reader over a file's contents as they were when it was opened. Besides
+// reading it can Seek and ReadAt, as an *os.File can. Closing it more than
+// once is harmless.
+type mockFile struct {
+	rdr *bytes.Reader
+	closed bool
+}
+
+func (f *mockFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, errMockFileClosed
+	}
+	return f.rdr.Read(p)
+}
+
+func (f *mockFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, errMockFileClosed
+	}
+	return f.rdr.ReadAt(p, off)
+}
+
+func (f *mockFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, errMockFileClosed
+	}
+	return f.rdr.Seek(offset, whence)
+}
+
+func (f *mockFile) Close() error {
+	f.closed = true
+	return nil
+}
+
+// Each call returns an independent reader. Files are never modified in
+// place, only replaced, so a reader is unaffected by later writes.
 func (b *MockArchiveBackend) GetFile(pth string) (io.ReadCloser, error) {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
@@ -33,21 +74,99 @@ func (b *MockArchiveBackend) GetFile(pth string) (io.ReadCloser, error) {
 	if !ok {
 		return nil, errors.New("no such file: " + pth)
 	}
-	return ioutil.NopCloser(bytes.NewReader(buf)), nil
+	return &mockFile{rdr: bytes.NewReader(buf)}, nil
+}
+
+func (b *MockArchiveBackend) GetFileRange(pth string, offset int64, length int64) (io.ReadCloser, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	buf, ok := b.files[pth]
+	if !ok {
+		return nil, errors.New("no such file: " + pth)
+	}
+	if offset < 0 || offset > int64(len(buf)) {
+		return nil, fmt.Errorf("offset %d outside %s", offset, pth)
+	}
+	end := offset + length
+	if end > int64(len(buf)) {
+		end = int64(len(buf))
+	}
+	return &mockFile{rdr: bytes.NewReader(buf[offset:end])}, nil
+}
+
+func (b *MockArchiveBackend) GetFileSize(pth string) (int64, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	buf, ok := b.files[pth]
+	if !ok {
+		return 0, errors.New("no such file: " + pth)
+	}
+	return int64(len(buf)), nil
 }
 
 func (b *MockArchiveBackend) PutFile(pth string, in io.ReadCloser) error {
+	defer in.Close()
+	buf, e := ioutil.ReadAll(in)
+	if e != nil {
+		return e
+	}
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
+	b.files[pth] = buf
+	return nil
+}
+
+func (b *MockArchiveBackend) FileVersion(pth string) (string, error) {
+	return contentVersion(b, pth)
+}
+
+func (b *MockArchiveBackend) PutFileIfVersion(pth string, version string, in io.ReadCloser) error {
+	defer in.Close()
 	buf, e := ioutil.ReadAll(in)
 	if e != nil {
 		return e
 	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	current := ""
+	if old, ok := b.files[pth]; ok {
+		h := sha256.Sum256(old)
+		current = hex.EncodeToString(h[:])
+	}
+	if current != version {
+		return ErrFileChanged
+	}
 	b.files[pth] = buf
 	return nil
 }
 
+func (b *MockArchiveBackend) DeleteFile(pth string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, ok := b.files[pth]; !ok {
+		return errors.New("no such file: " + pth)
+	}
+	delete(b.files, pth)
+	return nil
+}
+
+func (b *MockArchiveBackend) RenameFile(from string, to string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	buf, ok := b.files[from]
+	if !ok {
+		return errors.New("no such file: " + from)
+	}
+	delete(b.files, from)
+	b.files[to] = buf
+	return nil
+}
+
 func (b *MockArchiveBackend) ListFiles(pth string) (chan string, chan error) {
+	return b.ListFilesUntil(pth, nil)
+}
+
+func (b *MockArchiveBackend) ListFilesUntil(pth string, done <-chan struct{}) (chan string, chan error) {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 	ch := make(chan string)
@@ -57,13 +176,17 @@ func (b *MockArchiveBackend) ListFiles(pth string) (chan string, chan error) {
 		files = append(files, k)
 	}
 	go func() {
+		defer close(errs)
+		defer close(ch)
 		for _, f := range files {
 			if strings.HasPrefix(f, pth) {
-				ch <- f
+				select {
+				case ch <- f:
+				case <-done:
+					return
+				}
 			}
 		}
-		close(ch)
-		close(errs)
 	}()
 	return ch, errs
 }
@@ -0,0 +1,45 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMockFileSeekable(t *testing.T) {
+	b := MakeMockBackend(nil)
+	assert.Nil(t, b.PutFile("a", ioutil.NopCloser(strings.NewReader("0123456789"))))
+
+	r1, e := b.GetFile("a")
+	assert.NoError(t, e)
+	r2, _ := b.GetFile("a")
+	buf := make([]byte, 4)
+	io.ReadFull(r1, buf)
+	assert.Equal(t, "0123", string(buf))
+
+	seeker, ok := r1.(io.ReadSeeker)
+	assert.True(t, ok)
+	_, e = seeker.Seek(6, io.SeekStart)
+	assert.NoError(t, e)
+	rest, _ := ioutil.ReadAll(r1)
+	assert.Equal(t, "6789", string(rest))
+
+	// Readers are independent, and unaffected by a later write.
+	assert.Nil(t, b.PutFile("a", ioutil.NopCloser(strings.NewReader("new"))))
+	all, _ := ioutil.ReadAll(r2)
+	assert.Equal(t, "0123456789", string(all))
+
+	assert.Nil(t, r1.Close())
+	assert.Nil(t, r1.Close())
+	_, e = r1.Read(buf)
+	assert.Error(t, e)
+	r3, _ := b.GetFile("a")
+	all, _ = ioutil.ReadAll(r3)
+	assert.Equal(t, "new", string(all))
+}
@@ -0,0 +1,120 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The temporary files the fs backend and writeFileAtomic write through: a
+// dot, the final name, ".tmp" and a random suffix.
+var tempFileRx = regexp.MustCompile("(?:^|/)\\.[^/]+\\.tmp[^/]*$")
+
+// Finds, relative to the archive root, the temporary files of writes that
+// crashed before renaming them into place under the archive's bucket and
+// category directories, the files left under RepairStagingDir, and, on
+// backends that have them, the paths of incomplete uploads. Any other file
+// there that isn't named as a bucket or checkpoint file is only logged:
+// one named as such in the wrong case or place is data that
+// ListMalformedFiles and FindBucketNameAnomalies can recover, and anything
+// else isn't known to be a leftover. Needs a backend that can list.
+func (a *Archive) listOrphans() (files []string, uploads []string, err error) {
+	if !a.backend.CanListFiles() {
+		return nil, nil, fmt.Errorf("Finding orphans needs a backend that can list")
+	}
+	rxs := map[string]*regexp.Regexp{"bucket": bucketFileRx}
+	for _, cat := range a.Categories() {
+		rxs[cat] = a.categoryFileRx(cat)
+	}
+	var errs uint32
+	for dir, rx := range rxs {
+		// Listings may carry the backend's prefix; this finds the path
+		// within the archive.
+		within := regexp.MustCompile("(?:^|/)(" + regexp.QuoteMeta(dir) +
+			"/(?:[0-9a-f]{2}/){0,3}[^/]+)$")
+		ch, es := a.backend.ListFiles(dir)
+		es = makeErrorPump(es)
+		for s := range ch {
+			if rx.MatchString(s) {
+				continue
+			}
+			m := within.FindStringSubmatch(s)
+			if m != nil && tempFileRx.MatchString(s) {
+				files = append(files, m[1])
+			} else if strings.HasPrefix(strings.ToLower(path.Base(s)), dir + "-") {
+				logf("Leaving %s, named as a %s file; see ListMalformedFiles", s, dir)
+			} else {
+				logf("Leaving unexpected file %s", s)
+			}
+		}
+		errs += drainErrors(es)
+	}
+	// Nothing but an interrupted repair leaves files here.
+	staged := regexp.MustCompile("(?:^|/)(" + regexp.QuoteMeta(RepairStagingDir) + "/.+)$")
+	ch, es := a.backend.ListFiles(RepairStagingDir)
+	es = makeErrorPump(es)
+	for s := range ch {
+		if m := staged.FindStringSubmatch(s); m != nil {
+			files = append(files, m[1])
+		}
+	}
+	errs += drainErrors(es)
+	if errs != 0 {
+		return files, uploads, fmt.Errorf("%d errors while listing orphans", errs)
+	}
+	if p, ok := asPartialUploader(a.backend); ok {
+		uploads, err = p.ListPartialUploads()
+	}
+	return files, uploads, err
+}
+
+// Returns, sorted, the leftover temporary, staged or partial files in the
+// archive that CleanOrphans would remove.
+func (a *Archive) ListOrphans() ([]string, error) {
+	files, uploads, err := a.listOrphans()
+	seen := make(map[string]bool)
+	r := []string{}
+	for _, pth := range append(files, uploads...) {
+		if !seen[pth] {
+			seen[pth] = true
+			r = append(r, pth)
+		}
+	}
+	sort.Strings(r)
+	return r, err
+}
+
+// Deletes the files ListOrphans finds, and aborts any incomplete uploads.
+// A write in progress looks just like one that crashed, so this must not
+// run while anything else writes to the archive. Honours opts.DryRun.
+func (a *Archive) CleanOrphans(opts *CommandOptions) error {
+	files, uploads, err := a.listOrphans()
+	if err != nil {
+		return err
+	}
+	logf("Found %d orphaned files and %d incomplete uploads", len(files), len(uploads))
+	var errs uint32
+	for _, pth := range files {
+		errs += noteError(a.deletePath(pth, opts))
+	}
+	if p, ok := asPartialUploader(a.backend); ok {
+		for _, pth := range uploads {
+			if opts.DryRun {
+				logf("dryrun skipping abort of upload to %s", pth)
+				continue
+			}
+			logf("Aborting incomplete upload to %s", pth)
+			errs += noteError(p.AbortPartialUploads(pth))
+		}
+	}
+	if errs != 0 {
+		return fmt.Errorf("%d errors while cleaning orphans", errs)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+// A backend with incomplete uploads, as S3 has.
+type partialUploadBackend struct {
+	ArchiveBackend
+	uploads map[string]bool
+}
+
+func (b *partialUploadBackend) ListPartialUploads() ([]string, error) {
+	r := []string{}
+	for pth := range b.uploads {
+		r = append(r, pth)
+	}
+	return r, nil
+}
+
+func (b *partialUploadBackend) AbortPartialUploads(pth string) error {
+	delete(b.uploads, pth)
+	return nil
+}
+
+func TestOrphans(t *testing.T) {
+	defer cleanup()
+	src := GetRandomPopulatedArchive()
+	junk := []string{
+		"bucket/aa/bb/cc/.bucket-aabbcc.xdr.gz.tmp123",
+		"ledger/00/00/00/.ledger-0000003f.xdr.gz.tmp9",
+		RepairStagingDir + "/0123abcd/ledger/00/00/00/ledger-0000003f.xdr.gz",
+	}
+	for _, pth := range junk {
+		src.backend.PutFile(pth, ioutil.NopCloser(bytes.NewReader([]byte("partial"))))
+	}
+	// Buckets named in the wrong case or filed in the wrong place, which
+	// FindBucketNameAnomalies can recover, and a file of unknown purpose.
+	kept := []string{
+		"bucket/aa/bb/cc/bucket-" + strings.Repeat("AB", 32) + ".xdr.gz",
+		"bucket/00/00/00/bucket-" + strings.Repeat("ab", 32) + ".xdr.gz",
+		"bucket/README",
+	}
+	for _, pth := range kept {
+		src.backend.PutFile(pth, ioutil.NopCloser(bytes.NewReader([]byte("data"))))
+	}
+	has, _ := src.GetCheckpointHAS(0x7f)
+	uploading := BucketPath(MustDecodeHash(has.CurrentBuckets[0].Curr))
+	backend := &partialUploadBackend{
+		ArchiveBackend: src.backend,
+		uploads: map[string]bool{uploading: true},
+	}
+	arch := ConnectBackend(backend, nil)
+
+	orphans, err := arch.ListOrphans()
+	assert.NoError(t, err)
+	expect := append([]string{uploading}, junk...)
+	sort.Strings(expect)
+	assert.Equal(t, expect, orphans)
+
+	opts := testOptions()
+	opts.DryRun = true
+	assert.NoError(t, arch.CleanOrphans(opts))
+	again, _ := arch.ListOrphans()
+	assert.Equal(t, orphans, again)
+
+	opts.DryRun = false
+	assert.NoError(t, arch.CleanOrphans(opts))
+	again, err = arch.ListOrphans()
+	assert.NoError(t, err)
+	assert.Empty(t, again)
+	// Aborting the upload left the complete file alone.
+	assert.True(t, arch.backend.Exists(uploading))
+	for _, pth := range kept {
+		assert.True(t, arch.backend.Exists(pth), pth)
+	}
+	assert.Equal(t, 0, countMissing(arch, opts))
+}
@@ -0,0 +1,150 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Reads the HAS of every listed checkpoint and returns the union of the
+// buckets they reference.
+func (arch *Archive) collectReferencedBuckets(chks []uint32, concurrency int) (map[Hash]bool, error) {
+	refs := make(map[Hash]bool)
+	var refsMutex sync.Mutex
+	var errs uint32
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	req := make(chan uint32)
+	go func() {
+		for _, chk := range chks {
+			req <- chk
+		}
+		close(req)
+	}()
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			for chk := range req {
+				has, e := arch.GetCheckpointHAS(chk)
+				if e != nil {
+					atomic.AddUint32(&errs, noteError(e))
+					continue
+				}
+				refsMutex.Lock()
+				for _, bucket := range has.Buckets() {
+					refs[bucket] = true
+				}
+				refsMutex.Unlock()
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	if errs != 0 {
+		return refs, fmt.Errorf("%d errors reading checkpoint HAS files", errs)
+	}
+	return refs, nil
+}
+
+func (arch *Archive) deletePath(pth string, opts *CommandOptions) error {
+	if opts.DryRun {
+		logf("dryrun skipping delete of " + pth)
+		return nil
+	}
+	logf("Deleting " + pth)
+	return arch.backend.DeleteFile(pth)
+}
+
+// Deletes every checkpoint file in opts.Range from dst, along with every
+// bucket referenced from inside the range that no checkpoint outside it
+// still references. The whole archive is scanned first to establish which
+// buckets are still in use; if any retained HAS can't be read, nothing is
+// deleted. The range may not include the checkpoint named by the root HAS.
+// Honours opts.DryRun.
+func PurgeRange(dst *Archive, opts *CommandOptions) error {
+	if opts.Concurrency == 0 {
+		return fmt.Errorf("Zero concurrency")
+	}
+	state, e := dst.GetRootHAS()
+	if e != nil {
+		return e
+	}
+	full := state.Range()
+	purge := opts.Range.Clamp(full)
+	if purge.High >= state.CurrentLedger {
+		return fmt.Errorf("Refusing to purge range %s, which includes the " +
+			"root HAS checkpoint 0x%8.8x", purge, state.CurrentLedger)
+	}
+
+	logf("Scanning full archive before purging %s", purge)
+	scanOpts := *opts
+	scanOpts.Range = full
+	if e = dst.ScanCheckpoints(&scanOpts); e != nil {
+		return e
+	}
+
+	inPurge := func(chk uint32) bool {
+		return chk >= purge.Low && chk <= purge.High
+	}
+
+	purged := []uint32{}
+	retained := []uint32{}
+	dst.mutex.Lock()
+	for chk, present := range dst.checkpointFiles["history"] {
+		if !present {
+			continue
+		}
+		if inPurge(chk) {
+			purged = append(purged, chk)
+		} else {
+			retained = append(retained, chk)
+		}
+	}
+	dst.mutex.Unlock()
+
+	logf("Reading bucket references of %d retained checkpoints", len(retained))
+	keep, e := dst.collectReferencedBuckets(retained, opts.Concurrency)
+	if e != nil {
+		return e
+	}
+	logf("Reading bucket references of %d purged checkpoints", len(purged))
+	drop, e := dst.collectReferencedBuckets(purged, opts.Concurrency)
+	if e != nil {
+		return e
+	}
+
+	var errs uint32
+	for _, cat := range dst.Categories() {
+		dst.mutex.Lock()
+		chks := []uint32{}
+		for chk, present := range dst.checkpointFiles[cat] {
+			if present && inPurge(chk) {
+				chks = append(chks, chk)
+			}
+		}
+		dst.mutex.Unlock()
+		for _, chk := range chks {
+			errs += noteError(dst.deletePath(dst.CategoryCheckpointPath(cat, chk), opts))
+		}
+	}
+
+	nbuckets := 0
+	for bucket := range drop {
+		if keep[bucket] {
+			continue
+		}
+		nbuckets++
+		errs += noteError(dst.deletePath(BucketPath(bucket), opts))
+	}
+	logf("Purged %d checkpoints and %d buckets in range %s",
+		len(purged), nbuckets, purge)
+
+	dst.ClearCachedInfo()
+	if errs != 0 {
+		return fmt.Errorf("%d errors while purging", errs)
+	}
+	return nil
+}
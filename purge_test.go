@@ -0,0 +1,50 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPurgeRange(t *testing.T) {
+	defer cleanup()
+	arch := GetRandomPopulatedArchive()
+	opts := testOptions()
+
+	// Make a retained checkpoint share a bucket with a purged one.
+	first, err := arch.GetCheckpointHAS(0x3f)
+	assert.Nil(t, err)
+	later, err := arch.GetCheckpointHAS(0x1bf)
+	assert.Nil(t, err)
+	later.CurrentBuckets[0].Curr = first.CurrentBuckets[0].Curr
+	assert.Nil(t, arch.PutCheckpointHAS(0x1bf, later, &CommandOptions{Force:true}))
+	shared := MustDecodeHash(first.CurrentBuckets[0].Curr)
+	unshared := MustDecodeHash(first.CurrentBuckets[0].Snap)
+
+	opts.Range = MakeRange(0, 0x17f)
+	opts.DryRun = true
+	assert.Nil(t, PurgeRange(arch, opts))
+	assert.True(t, arch.CategoryCheckpointExists("ledger", 0x3f))
+	assert.True(t, arch.BucketExists(unshared))
+
+	opts.DryRun = false
+	assert.Nil(t, PurgeRange(arch, opts))
+	for _, cat := range Categories() {
+		assert.False(t, arch.CategoryCheckpointExists(cat, 0x3f))
+		assert.False(t, arch.CategoryCheckpointExists(cat, 0x17f))
+		assert.True(t, arch.CategoryCheckpointExists(cat, 0x1bf))
+	}
+	assert.True(t, arch.BucketExists(shared))
+	assert.False(t, arch.BucketExists(unshared))
+}
+
+func TestPurgeRangeRefusesRootCheckpoint(t *testing.T) {
+	defer cleanup()
+	arch := GetRandomPopulatedArchive()
+	opts := testOptions()
+	assert.NotNil(t, PurgeRange(arch, opts))
+	assert.True(t, arch.CategoryCheckpointExists("history", 0x3f))
+}
@@ -13,8 +13,8 @@ import (
 const CheckpointFreq = uint32(64)
 
 type Range struct {
-	Low uint32
-	High uint32
+	Low uint32   `json:"low"`
+	High uint32  `json:"high"`
 }
 
 func PrevCheckpoint(i uint32) uint32 {
@@ -25,17 +25,17 @@ func PrevCheckpoint(i uint32) uint32 {
     return ((i / freq) * freq) - 1;
 }
 
+// Returns the checkpoint ledger at or after ledger i: the last ledger of the
+// checkpoint containing i.
 func NextCheckpoint(i uint32) uint32 {
-	if i == 0 {
-		return CheckpointFreq - 1
-	}
-	freq := uint64(CheckpointFreq)
-	v := uint64(i)
-	n := (((v + freq - 1) / freq) * freq) - 1
-	if n >= 0xffffffff {
-		return 0xffffffff
-	}
-	return uint32(n)
+	return checkpointLedger(checkpointNumber(i))
+}
+
+// Returns the checkpoint (named, like all checkpoints, by its last ledger)
+// whose files hold ledger: 0x3f for ledgers 0 through 0x3f, 0x7f for 0x40
+// through 0x7f, and so on.
+func CheckpointContaining(ledger uint32) uint32 {
+	return NextCheckpoint(ledger)
 }
 
 func MakeRange(low uint32, high uint32) Range {
@@ -48,6 +48,40 @@ func MakeRange(low uint32, high uint32) Range {
 	}
 }
 
+// Returns the last ledger of checkpoint number n, where checkpoint 0 is
+// ledgers 0 through CheckpointFreq-1.
+func checkpointLedger(n uint32) uint32 {
+	v := (uint64(n) + 1) * uint64(CheckpointFreq) - 1
+	if v >= 0xffffffff {
+		return 0xffffffff
+	}
+	return uint32(v)
+}
+
+// Returns the number of the checkpoint containing ledger i.
+func checkpointNumber(i uint32) uint32 {
+	return i / CheckpointFreq
+}
+
+// Makes a Range from checkpoint numbers rather than ledgers: checkpoint 0
+// covers ledgers 0 through 63 and ends at ledger 63, checkpoint 1 ends at
+// ledger 127, and so on.
+func RangeFromCheckpoints(lowChk uint32, highChk uint32) Range {
+	if highChk < lowChk {
+		highChk = lowChk
+	}
+	return Range{
+		Low:checkpointLedger(lowChk),
+		High:checkpointLedger(highChk),
+	}
+}
+
+// Returns the numbers of the checkpoints containing the range's endpoints;
+// the inverse of RangeFromCheckpoints.
+func (r Range) CheckpointRange() (uint32, uint32) {
+	return checkpointNumber(r.Low), checkpointNumber(r.High)
+}
+
 func (r Range) Clamp(other Range) Range {
 	low := r.Low
 	high := r.High
@@ -64,10 +98,12 @@ func (r Range) String() string {
 	return fmt.Sprintf("[0x%8.8x, 0x%8.8x]", r.Low, r.High)
 }
 
+// Returns a channel of every checkpoint in the range, Low and High both
+// included; so the genesis range [0x3f, 0x3f] yields 0x3f alone.
 func (r Range) Checkpoints() chan uint32 {
 	ch := make(chan uint32)
 	go func() {
-		for i := uint64(r.Low); i < uint64(r.High); i += uint64(CheckpointFreq) {
+		for i := uint64(r.Low); i <= uint64(r.High); i += uint64(CheckpointFreq) {
 			ch <- uint32(i)
 		}
 		close(ch)
@@ -75,8 +111,44 @@ func (r Range) Checkpoints() chan uint32 {
 	return ch
 }
 
+// Returns a channel of every checkpoint in the range, as Checkpoints does,
+// but newest first. Equivalent to CheckpointsDescUntil(nil).
+func (r Range) CheckpointsDesc() chan uint32 {
+	return r.CheckpointsDescUntil(nil)
+}
+
+// As CheckpointsDesc, but if the consumer wants to stop early it should
+// close done, upon which the producer stops and closes the channel.
+func (r Range) CheckpointsDescUntil(done <-chan struct{}) chan uint32 {
+	ch := make(chan uint32)
+	go func() {
+		defer close(ch)
+		for i := int64(r.High); i >= int64(r.Low); i -= int64(CheckpointFreq) {
+			select {
+			case ch <- uint32(i):
+			case <-done:
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// Calls f with every checkpoint in the range, in order, as Checkpoints
+// yields them, stopping at and returning the first error f returns. Unlike
+// Checkpoints, it leaves nothing running if the caller stops early.
+func (r Range) EachCheckpoint(f func(chk uint32) error) error {
+	for i := uint64(r.Low); i <= uint64(r.High); i += uint64(CheckpointFreq) {
+		if err := f(uint32(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the number of checkpoints Checkpoints yields.
 func (r Range) Size() int {
-	return int(r.High - r.Low) / int(CheckpointFreq)
+	return int(r.High - r.Low) / int(CheckpointFreq) + 1
 }
 
 func (r Range) CollapsedString() string {
@@ -93,11 +165,14 @@ func (a ByUint32) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByUint32) Less(i, j int) bool { return a[i] < a[j] }
 
 
-func fmtRangeList(vs []uint32) string {
+// Coalesces a set of checkpoints into the fewest Ranges covering runs of
+// consecutive checkpoints. Each Range runs from its first checkpoint to its
+// last; a lone checkpoint gives a Range with Low == High.
+func coalesceCheckpoints(vs []uint32) []Range {
 
 	sort.Sort(ByUint32(vs))
 
-	s := make([]string, 0, 10)
+	rs := make([]Range, 0, 10)
 	var curr *Range
 
 	for _, t := range vs {
@@ -106,15 +181,90 @@ func fmtRangeList(vs []uint32) string {
 				curr.High = t
 				continue
 			} else {
-				s = append(s, curr.CollapsedString())
+				rs = append(rs, *curr)
 				curr = nil
 			}
 		}
 		curr = &Range{Low:t, High:t}
 	}
 	if curr != nil {
-		s = append(s, curr.CollapsedString())
+		rs = append(rs, *curr)
+	}
+
+	return rs
+}
+
+// Returns the checkpoints in both a and b, coalesced ranges as
+// coalesceCheckpoints returns, as coalesced ranges again.
+func intersectRanges(a []Range, b []Range) []Range {
+	rs := make([]Range, 0, 10)
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		low, high := a[i].Low, a[i].High
+		if b[j].Low > low {
+			low = b[j].Low
+		}
+		if b[j].High < high {
+			high = b[j].High
+		}
+		if low <= high {
+			rs = append(rs, Range{Low:low, High:high})
+		}
+		if a[i].High < b[j].High {
+			i++
+		} else {
+			j++
+		}
 	}
+	return rs
+}
 
+func fmtRanges(rs []Range) string {
+	s := make([]string, 0, len(rs))
+	for _, r := range rs {
+		s = append(s, r.CollapsedString())
+	}
 	return strings.Join(s, ", ")
 }
+
+func fmtRangeList(vs []uint32) string {
+	return fmtRanges(coalesceCheckpoints(vs))
+}
+
+// The error ValidateRange returns for a range the archive doesn't cover.
+// Partial is set if the range overlaps the archive's, in which case
+// clamping it still leaves something to act on; callers may choose to
+// treat that as a warning.
+type RangeError struct {
+	Requested Range
+	Available Range
+	Partial bool
+}
+
+func (e *RangeError) Error() string {
+	if e.Partial {
+		return fmt.Sprintf("Requested range %s extends beyond archive range %s",
+			e.Requested, e.Available)
+	}
+	return fmt.Sprintf("Requested range %s lies entirely outside archive range %s",
+		e.Requested, e.Available)
+}
+
+// Checks rng against the range the root HAS advertises, returning a
+// *RangeError if any checkpoint rng touches is outside it.
+func (a *Archive) ValidateRange(rng Range) error {
+	root, err := a.GetRootHAS()
+	if err != nil {
+		return err
+	}
+	avail := root.Range()
+	low := NextCheckpoint(rng.Low)
+	high := NextCheckpoint(rng.High)
+	if low >= avail.Low && high <= avail.High {
+		return nil
+	}
+	return &RangeError{
+		Requested: rng,
+		Available: avail,
+		Partial: high >= avail.Low && low <= avail.High,
+	}
+}
@@ -5,6 +5,7 @@
 package archivist
 
 import (
+	"errors"
 	"testing"
 	"github.com/stretchr/testify/assert"
 )
@@ -40,3 +41,166 @@ func TestFmtRangeList(t *testing.T) {
 		fmtRangeList([]uint32{0x3f, 0x7f, 0xff, 0x17f, 0x1bf}))
 }
 
+
+func TestCoalesceCheckpoints(t *testing.T) {
+
+	assert.Equal(t,
+		[]Range{},
+		coalesceCheckpoints([]uint32{}))
+
+	assert.Equal(t,
+		[]Range{{Low:0x3f, High:0xbf}, {Low:0x13f, High:0x13f}},
+		coalesceCheckpoints([]uint32{0x13f, 0x7f, 0x3f, 0xbf}))
+}
+
+func TestIntersectRanges(t *testing.T) {
+	a := []Range{{Low:0x3f, High:0xff}, {Low:0x17f, High:0x1bf}, {Low:0x2bf, High:0x2bf}}
+	b := []Range{{Low:0x7f, High:0x1ff}, {Low:0x2bf, High:0x2ff}}
+	assert.Equal(t,
+		[]Range{{Low:0x7f, High:0xff}, {Low:0x17f, High:0x1bf}, {Low:0x2bf, High:0x2bf}},
+		intersectRanges(a, b))
+	assert.Equal(t, []Range{}, intersectRanges(a, []Range{}))
+}
+
+func TestRangeFromCheckpoints(t *testing.T) {
+	assert.Equal(t, Range{Low:0x3f, High:0x3f}, RangeFromCheckpoints(0, 0))
+	assert.Equal(t, Range{Low:0x3f, High:0x7f}, RangeFromCheckpoints(0, 1))
+	assert.Equal(t, Range{Low:0xbf, High:0xbf}, RangeFromCheckpoints(2, 1))
+	assert.Equal(t, Range{Low:0x3f, High:0xffffffff},
+		RangeFromCheckpoints(0, 0xffffffff))
+
+	low, high := Range{Low:0, High:63}.CheckpointRange()
+	assert.Equal(t, uint32(0), low)
+	assert.Equal(t, uint32(0), high)
+	low, high = Range{Low:63, High:64}.CheckpointRange()
+	assert.Equal(t, uint32(0), low)
+	assert.Equal(t, uint32(1), high)
+	low, high = MakeRange(0, 0x3bf).CheckpointRange()
+	assert.Equal(t, uint32(0), low)
+	assert.Equal(t, uint32(14), high)
+	low, high = RangeFromCheckpoints(5, 9).CheckpointRange()
+	assert.Equal(t, uint32(5), low)
+	assert.Equal(t, uint32(9), high)
+	_, high = Range{Low:0, High:0xffffffff}.CheckpointRange()
+	assert.Equal(t, uint32(0x3ffffff), high)
+}
+
+func TestGenesisRange(t *testing.T) {
+	assert.Equal(t, uint32(0x3f), NextCheckpoint(0))
+	assert.Equal(t, uint32(0x3f), NextCheckpoint(0x3f))
+	assert.Equal(t, uint32(0x7f), NextCheckpoint(0x40))
+	assert.Equal(t, uint32(0x7f), NextCheckpoint(0x7f))
+	assert.Equal(t, uint32(0xffffffff), NextCheckpoint(0xffffffff))
+
+	r := MakeRange(0, 0)
+	assert.Equal(t, Range{Low:0x3f, High:0x3f}, r)
+	assert.Equal(t, r, MakeRange(0, 0x3f))
+	assert.Equal(t, r, MakeRange(0, 0x100000).Clamp(Range{Low:0, High:0x3f}))
+	assert.Equal(t, 1, r.Size())
+	chks := []uint32{}
+	for chk := range r.Checkpoints() {
+		chks = append(chks, chk)
+	}
+	assert.Equal(t, []uint32{0x3f}, chks)
+	assert.Equal(t, []string{"00/00/00"}, RangePaths(r))
+
+	chks = []uint32{}
+	for chk := range MakeRange(0, 0x80).Checkpoints() {
+		chks = append(chks, chk)
+	}
+	assert.Equal(t, []uint32{0x3f, 0x7f, 0xbf}, chks)
+	assert.Equal(t, 3, MakeRange(0, 0x80).Size())
+}
+
+func TestCheckpointContaining(t *testing.T) {
+	defer cleanup()
+	assert.Equal(t, uint32(0x3f), CheckpointContaining(0))
+	assert.Equal(t, uint32(0x3f), CheckpointContaining(1))
+	assert.Equal(t, uint32(0x3f), CheckpointContaining(0x3f))
+	assert.Equal(t, uint32(0x7f), CheckpointContaining(0x40))
+	assert.Equal(t, uint32(0xffffffff), CheckpointContaining(0xffffffff))
+
+	assert.Equal(t, "ledger/00/00/00/ledger-0000003f.xdr.gz",
+		CategoryPathForLedger("ledger", 1))
+	assert.Equal(t, "ledger/00/00/00/ledger-0000003f.xdr.gz",
+		CategoryPathForLedger("ledger", 0x3f))
+	assert.Equal(t, "history/00/00/00/history-0000007f.json",
+		CategoryPathForLedger("history", 0x40))
+	arch := GetTestArchive()
+	assert.Equal(t, arch.CategoryCheckpointPath("results", 0x7f),
+		arch.CategoryPathForLedger("results", 0x41))
+}
+
+func TestEachCheckpoint(t *testing.T) {
+	for _, r := range []Range{
+		MakeRange(0, 0),
+		MakeRange(100, 1000),
+		Range{Low:0xffffffbf, High:0xffffffff},
+	} {
+		var want, got []uint32
+		for chk := range r.Checkpoints() {
+			want = append(want, chk)
+		}
+		assert.Nil(t, r.EachCheckpoint(func(chk uint32) error {
+			got = append(got, chk)
+			return nil
+		}))
+		assert.Equal(t, want, got)
+	}
+
+	stop := errors.New("stop")
+	got := []uint32{}
+	err := MakeRange(0, 1000).EachCheckpoint(func(chk uint32) error {
+		got = append(got, chk)
+		if chk == 0xbf {
+			return stop
+		}
+		return nil
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, []uint32{0x3f, 0x7f, 0xbf}, got)
+}
+
+func TestCheckpointsDesc(t *testing.T) {
+	for _, r := range []Range{
+		MakeRange(0, 0),
+		MakeRange(100, 1000),
+		Range{Low:0xffffffbf, High:0xffffffff},
+	} {
+		var asc, desc []uint32
+		for chk := range r.Checkpoints() {
+			asc = append([]uint32{chk}, asc...)
+		}
+		for chk := range r.CheckpointsDesc() {
+			desc = append(desc, chk)
+		}
+		assert.Equal(t, asc, desc)
+	}
+
+	// Stopping early ends the producer, closing the channel.
+	done := make(chan struct{})
+	ch := MakeRange(0, 0xffffffff).CheckpointsDescUntil(done)
+	assert.Equal(t, uint32(0xffffffff), <-ch)
+	assert.Equal(t, uint32(0xffffffbf), <-ch)
+	close(done)
+	for range ch {
+	}
+}
+
+func TestValidateRange(t *testing.T) {
+	defer cleanup()
+	arch := GetRandomPopulatedArchive()
+	assert.Nil(t, arch.ValidateRange(testRange()))
+	assert.Nil(t, arch.ValidateRange(MakeRange(0, 0x100)))
+
+	e := arch.ValidateRange(MakeRange(0x200, 0x1000))
+	re, ok := e.(*RangeError)
+	assert.True(t, ok)
+	assert.True(t, re.Partial)
+	assert.Equal(t, uint32(0x3bf), re.Available.High)
+
+	e = arch.ValidateRange(MakeRange(0x1000, 0x2000))
+	re, ok = e.(*RangeError)
+	assert.True(t, ok)
+	assert.False(t, re.Partial)
+}
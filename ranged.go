@@ -0,0 +1,106 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Number of ranges a rangedReader fetches ahead of the one being read.
+const rangedReadAhead = 4
+
+type fetchedRange struct {
+	buf []byte
+	err error
+}
+
+// Reads a file of known size as a sequence of ranges of chunk bytes, each
+// fetched whole by its own goroutine, up to rangedReadAhead of them ahead
+// of the one being read, so a slow download of a large file overlaps with
+// whatever is consuming it. The file's first bytes, if already fetched,
+// are read before the rest.
+type rangedReader struct {
+	slots chan chan fetchedRange
+	done chan struct{}
+	cur []byte
+	err error
+}
+
+func newRangedReader(g RangeGetter, pth string, size int64, chunk int64, first []byte) *rangedReader {
+	r := &rangedReader{
+		// Slots are queued in file order; the queue's capacity bounds
+		// the read-ahead.
+		slots: make(chan chan fetchedRange, rangedReadAhead),
+		done: make(chan struct{}),
+		cur: first,
+	}
+	go func() {
+		defer close(r.slots)
+		for off := int64(len(first)); off < size; off += chunk {
+			length := chunk
+			if off + length > size {
+				length = size - off
+			}
+			slot := make(chan fetchedRange, 1)
+			select {
+			case r.slots <- slot:
+			case <-r.done:
+				return
+			}
+			go func(off int64, length int64) {
+				slot <- fetchRange(g, pth, off, length)
+			}(off, length)
+		}
+	}()
+	return r
+}
+
+func fetchRange(g RangeGetter, pth string, off int64, length int64) fetchedRange {
+	rdr, err := g.GetFileRange(pth, off, length)
+	if err != nil {
+		return fetchedRange{err: err}
+	}
+	defer rdr.Close()
+	buf, err := ioutil.ReadAll(io.LimitReader(rdr, length))
+	if err != nil {
+		return fetchedRange{err: err}
+	}
+	if int64(len(buf)) != length {
+		return fetchedRange{err: fmt.Errorf("Range %d+%d of %s came back %d bytes long",
+			off, length, pth, len(buf))}
+	}
+	return fetchedRange{buf: buf}
+}
+
+func (r *rangedReader) Read(p []byte) (int, error) {
+	for len(r.cur) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		slot, ok := <-r.slots
+		if !ok {
+			r.err = io.EOF
+			continue
+		}
+		f := <-slot
+		r.cur, r.err = f.buf, f.err
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// Stops fetching further ranges; those already fetching finish into
+// slots no one reads.
+func (r *rangedReader) Close() error {
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+type countingRangeBackend struct {
+	*MockArchiveBackend
+	ranges uint32
+}
+
+func (b *countingRangeBackend) GetFileRange(pth string, offset int64, length int64) (io.ReadCloser, error) {
+	atomic.AddUint32(&b.ranges, 1)
+	return b.MockArchiveBackend.GetFileRange(pth, offset, length)
+}
+
+func TestVerifyBucketRanged(t *testing.T) {
+	buf := make([]byte, 8192)
+	rand.Read(buf)
+	h := Hash(sha256.Sum256(buf))
+	file := gzipped(buf)
+
+	backend := &countingRangeBackend{MockArchiveBackend: MakeMockBackend(nil).(*MockArchiveBackend)}
+	arch := ConnectBackend(backend, &ConnectOptions{VerifyChunkBytes: 100})
+	backend.PutFile(BucketPath(h), ioutil.NopCloser(bytes.NewReader(file)))
+	assert.NoError(t, arch.VerifyBucketHash(h))
+	assert.Equal(t, uint32((len(file) + 99) / 100), backend.ranges)
+
+	// A flipped byte in the middle range is caught.
+	bad := append([]byte{}, file...)
+	bad[len(bad) / 2] ^= 0xff
+	backend.PutFile(BucketPath(h), ioutil.NopCloser(bytes.NewReader(bad)))
+	assert.Error(t, arch.VerifyBucketHash(h))
+
+	// A bucket no bigger than one range is read plainly.
+	small := []byte("small")
+	hs := Hash(sha256.Sum256(small))
+	backend.PutFile(BucketPath(hs), ioutil.NopCloser(bytes.NewReader(gzipped(small))))
+	backend.ranges = 0
+	arch.verifyChunkBytes = 4096
+	assert.NoError(t, arch.VerifyBucketHash(hs))
+	assert.Equal(t, uint32(0), backend.ranges)
+}
+
+func TestFsGetFileRange(t *testing.T) {
+	defer cleanup()
+	arch := GetTestFileArchive()
+	buf := make([]byte, 1000)
+	rand.Read(buf)
+	arch.backend.PutFile("some/file", ioutil.NopCloser(bytes.NewReader(buf)))
+	rdr, err := arch.backend.(RangeGetter).GetFileRange("some/file", 900, 200)
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(rdr)
+	rdr.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, buf[900:], got)
+}
+
+func TestVerifyBucketRangeIgnored(t *testing.T) {
+	buf := make([]byte, 8192)
+	rand.Read(buf)
+	h := Hash(sha256.Sum256(buf))
+	file := gzipped(buf)
+	var ranged, plain uint32
+	// Answers every GET with the whole file, whatever Range asks for.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" + BucketPath(h) {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == "GET" {
+			if r.Header.Get("Range") != "" {
+				atomic.AddUint32(&ranged, 1)
+			} else {
+				atomic.AddUint32(&plain, 1)
+			}
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(file)))
+		w.Write(file)
+	}))
+	defer srv.Close()
+
+	arch := MustConnect(srv.URL, &ConnectOptions{VerifyChunkBytes: 100})
+	assert.NoError(t, arch.VerifyBucketHash(h))
+	assert.Equal(t, uint32(1), ranged)
+	assert.Equal(t, uint32(1), plain)
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+var ErrReadOnly = errors.New("Archive was connected read-only")
+
+// A backend that reads from another but refuses every write, returning
+// ErrReadOnly before the inner backend sees it, so a repair, mirror or
+// garbage collection pointed at it by mistake can't change anything.
+// Connect installs it, outermost, when ConnectOptions.ReadOnly is set.
+// Listings can still be abandoned part-way, and the inner backend's ranged
+// reads and modification times forwarded; its capabilities that write are
+// hidden.
+type ReadOnlyArchiveBackend struct {
+	inner ArchiveBackend
+}
+
+func (b *ReadOnlyArchiveBackend) Exists(pth string) bool {
+	return b.inner.Exists(pth)
+}
+
+func (b *ReadOnlyArchiveBackend) GetFile(pth string) (io.ReadCloser, error) {
+	return b.inner.GetFile(pth)
+}
+
+func (b *ReadOnlyArchiveBackend) GetFileSize(pth string) (int64, error) {
+	return b.inner.GetFileSize(pth)
+}
+
+func (b *ReadOnlyArchiveBackend) PutFile(pth string, in io.ReadCloser) error {
+	in.Close()
+	return ErrReadOnly
+}
+
+func (b *ReadOnlyArchiveBackend) DeleteFile(pth string) error {
+	return ErrReadOnly
+}
+
+func (b *ReadOnlyArchiveBackend) RenameFile(from string, to string) error {
+	return ErrReadOnly
+}
+
+func (b *ReadOnlyArchiveBackend) ListFiles(pth string) (chan string, chan error) {
+	return b.inner.ListFiles(pth)
+}
+
+func (b *ReadOnlyArchiveBackend) ListFilesUntil(pth string, done <-chan struct{}) (chan string, chan error) {
+	return listFilesUntil(b.inner, pth, done)
+}
+
+func (b *ReadOnlyArchiveBackend) CanListFiles() bool {
+	return b.inner.CanListFiles()
+}
+
+func (b *ReadOnlyArchiveBackend) wrappedBackend() ArchiveBackend {
+	return b.inner
+}
+
+func (b *ReadOnlyArchiveBackend) GetFileRange(pth string, offset int64, length int64) (io.ReadCloser, error) {
+	g, ok := b.inner.(RangeGetter)
+	if !ok {
+		return nil, ErrCapabilityUnsupported
+	}
+	return g.GetFileRange(pth, offset, length)
+}
+
+func (b *ReadOnlyArchiveBackend) GetFileModTime(pth string) (time.Time, error) {
+	g, ok := b.inner.(ModTimeGetter)
+	if !ok {
+		return time.Time{}, ErrCapabilityUnsupported
+	}
+	return g.GetFileModTime(pth)
+}
+
+func ReadOnlyBackend(inner ArchiveBackend) ArchiveBackend {
+	return &ReadOnlyArchiveBackend{inner: inner}
+}
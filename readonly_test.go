@@ -0,0 +1,62 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadOnly(t *testing.T) {
+	defer cleanup()
+	writable := GetTestFileArchive()
+	writable.PopulateRandomRange(testRange())
+	arch, err := Connect("file://" + tmpdirs[len(tmpdirs) - 1],
+		&ConnectOptions{ReadOnly: true})
+	assert.NoError(t, err)
+
+	opts := testOptions()
+	assert.NoError(t, arch.Scan(opts))
+	assert.Equal(t, 0, countMissing(arch, opts))
+
+	ledger := CategoryCheckpointPath("ledger", 0x7f)
+	assert.Equal(t, ErrReadOnly, arch.backend.PutFile(ledger,
+		ioutil.NopCloser(strings.NewReader("x"))))
+	assert.Equal(t, ErrReadOnly, arch.backend.DeleteFile(ledger))
+	assert.Equal(t, ErrReadOnly, arch.backend.RenameFile(ledger, ledger + ".moved"))
+	assert.True(t, writable.backend.Exists(ledger))
+	assert.False(t, writable.backend.Exists(ledger + ".moved"))
+
+	// Nothing mirrored lands in it.
+	before, err := writable.GetRootHAS()
+	assert.NoError(t, err)
+	src := GetTestMockArchive()
+	src.PopulateRandomRange(testRange())
+	assert.Error(t, Mirror(src, arch, testOptions()))
+	after, err := writable.GetRootHAS()
+	assert.NoError(t, err)
+	assert.Equal(t, before, after)
+}
+
+func TestReadOnlyConnectBackend(t *testing.T) {
+	ledger := CategoryCheckpointPath("ledger", 0x7f)
+	put := func(arch *Archive) error {
+		return arch.backend.PutFile(ledger, ioutil.NopCloser(strings.NewReader("x")))
+	}
+	store := MakeMockBackend(nil)
+	assert.Equal(t, ErrReadOnly, put(ConnectBackend(store, &ConnectOptions{ReadOnly: true})))
+	assert.False(t, store.Exists(ledger))
+
+	// Or read-only by default.
+	SetDefaultConnectOptions(&ConnectOptions{ReadOnly: true})
+	defer SetDefaultConnectOptions(nil)
+	assert.Equal(t, ErrReadOnly, put(ConnectBackend(store, nil)))
+	arch, err := Connect("mock://test", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrReadOnly, put(arch))
+	assert.False(t, store.Exists(ledger))
+}
@@ -0,0 +1,101 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"io"
+)
+
+// A backend that serves files from local when it has them, and otherwise
+// fetches them from upstream, stores them in local and serves them from
+// there. Writes and deletes only touch local. Wrapped in an Archive (see
+// ConnectBackend), this makes local a mirror of upstream populated lazily,
+// by demand.
+type ReadThroughArchiveBackend struct {
+	local ArchiveBackend
+	upstream ArchiveBackend
+}
+
+func (b *ReadThroughArchiveBackend) Exists(pth string) bool {
+	return b.local.Exists(pth) || b.upstream.Exists(pth)
+}
+
+func (b *ReadThroughArchiveBackend) GetFile(pth string) (io.ReadCloser, error) {
+	if b.local.Exists(pth) {
+		return b.local.GetFile(pth)
+	}
+	rdr, err := b.upstream.GetFile(pth)
+	if err != nil {
+		return nil, err
+	}
+	if err = b.local.PutFile(pth, rdr); err != nil {
+		logf("Error: caching %s locally: %s", pth, err)
+		return b.upstream.GetFile(pth)
+	}
+	return b.local.GetFile(pth)
+}
+
+func (b *ReadThroughArchiveBackend) GetFileSize(pth string) (int64, error) {
+	if b.local.Exists(pth) {
+		return b.local.GetFileSize(pth)
+	}
+	return b.upstream.GetFileSize(pth)
+}
+
+func (b *ReadThroughArchiveBackend) PutFile(pth string, in io.ReadCloser) error {
+	return b.local.PutFile(pth, in)
+}
+
+func (b *ReadThroughArchiveBackend) DeleteFile(pth string) error {
+	return b.local.DeleteFile(pth)
+}
+
+// Upstream is never written, so a file found only there is copied into
+// local under the new name, and stays visible under the old one.
+func (b *ReadThroughArchiveBackend) RenameFile(from string, to string) error {
+	if b.local.Exists(from) {
+		return b.local.RenameFile(from, to)
+	}
+	rdr, err := b.upstream.GetFile(from)
+	if err != nil {
+		return err
+	}
+	return b.local.PutFile(to, rdr)
+}
+
+// Lists the union of local and upstream: everything in local, then
+// whatever upstream has that local doesn't.
+func (b *ReadThroughArchiveBackend) ListFiles(pth string) (chan string, chan error) {
+	ch := make(chan string)
+	lch, lerrs := b.local.ListFiles(pth)
+	uch, uerrs := b.upstream.ListFiles(pth)
+	errs := makeErrorPump(mergeErrors(lerrs, uerrs))
+	go func() {
+		seen := make(map[string]bool)
+		for f := range lch {
+			seen[f] = true
+			ch <- f
+		}
+		for f := range uch {
+			if !seen[f] {
+				ch <- f
+			}
+		}
+		close(ch)
+	}()
+	return ch, errs
+}
+
+// The union listing is only complete if both sides can list.
+func (b *ReadThroughArchiveBackend) CanListFiles() bool {
+	return b.local.CanListFiles() && b.upstream.CanListFiles()
+}
+
+func ReadThroughBackend(local ArchiveBackend, upstream ArchiveBackend) ArchiveBackend {
+	return &ReadThroughArchiveBackend{
+		local: local,
+		upstream: upstream,
+	}
+}
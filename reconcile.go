@@ -0,0 +1,256 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// A CopyPlan is the list of objects that would have to be copied from one
+// archive to another to bring the latter up to date over some range. It is
+// produced by Reconcile without writing anything, and executed by
+// ApplyCopyPlan.
+type CopyPlan struct {
+	Range Range
+	CheckpointFiles []string
+	Buckets []Hash
+	// Sum of the source sizes of every object in the plan.
+	EstimatedBytes int64
+}
+
+func (p *CopyPlan) Empty() bool {
+	return len(p.CheckpointFiles) == 0 && len(p.Buckets) == 0
+}
+
+// Number of workers each of Reconcile's scans runs.
+const reconcileConcurrency = 16
+
+// Scans both archives over rng, verifying dst's files as it goes, and
+// returns a plan for copying everything present in src but missing from or
+// corrupt in dst: checkpoint files, and buckets referenced by src's
+// checkpoints in the range.
+func Reconcile(src *Archive, dst *Archive, rng Range) (CopyPlan, error) {
+	return ReconcileWithOptions(src, dst, &CommandOptions{
+		Range: rng,
+		Concurrency: reconcileConcurrency,
+		Verify: true,
+	})
+}
+
+// As Reconcile, over opts.Range, with opts' concurrency. dst's files are
+// verified, and those that fail planned for copying, only if opts.Verify;
+// src's are never verified.
+func ReconcileWithOptions(src *Archive, dst *Archive, opts *CommandOptions) (CopyPlan, error) {
+	var plan CopyPlan
+
+	srcOpts := *opts
+	srcOpts.Verify = false
+	dstOpts := *opts
+	// Files failing verification are what's to be planned, not errors.
+	dstOpts.tolerateCorrupt = true
+
+	// A plan is of the archives as they are now, not as an earlier scan
+	// found them.
+	src.ClearCachedInfo()
+	dst.ClearCachedInfo()
+
+	logf("Scanning source for reconciliation")
+	if e := src.ScanCheckpoints(&srcOpts); e != nil {
+		return plan, e
+	}
+	if e := src.ScanBuckets(&srcOpts); e != nil {
+		return plan, e
+	}
+	plan.Range = srcOpts.Range
+
+	// The destination may not have a root HAS yet (or may have a stale
+	// one), so scan it over the source's range rather than its own.
+	logf("Scanning destination for reconciliation")
+	dstOpts.Range = plan.Range
+	if e := dst.scanCheckpointsInRange(&dstOpts); e != nil {
+		return plan, e
+	}
+	if e := dst.ScanBuckets(&dstOpts); e != nil {
+		return plan, e
+	}
+
+	srcFiles := src.CheckCheckpointFilesMissing(&srcOpts)
+	dstFiles := []map[string][]uint32{dst.CheckCheckpointFilesMissing(&srcOpts)}
+	if opts.Verify {
+		dstFiles = append(dstFiles, dst.CheckCheckpointFilesCorrupt(&srcOpts))
+	}
+	for _, cat := range src.Categories() {
+		absent := make(map[uint32]bool)
+		for _, chk := range srcFiles[cat] {
+			absent[chk] = true
+		}
+		for _, files := range dstFiles {
+			for _, chk := range files[cat] {
+				if !absent[chk] {
+					plan.CheckpointFiles = append(plan.CheckpointFiles,
+						src.CategoryCheckpointPath(cat, chk))
+				}
+			}
+		}
+	}
+
+	canList := dst.backend.CanListFiles()
+	available := []Hash{}
+	src.mutex.Lock()
+	for bucket := range src.referencedBuckets {
+		if src.bucketExistsLocked(bucket) {
+			available = append(available, bucket)
+		}
+	}
+	src.mutex.Unlock()
+	var corrupt []Hash
+	dst.mutex.Lock()
+	for _, bucket := range available {
+		if dst.corruptBuckets[bucket] {
+			corrupt = append(corrupt, bucket)
+		} else if !dst.bucketExistsLocked(bucket) {
+			plan.Buckets = append(plan.Buckets, bucket)
+		}
+	}
+	dst.mutex.Unlock()
+
+	if !canList {
+		// dst's bucket set only covers buckets dst itself references, so
+		// probe the rest directly.
+		need := plan.Buckets[:0]
+		for _, bucket := range plan.Buckets {
+			if !dst.BucketExists(bucket) {
+				need = append(need, bucket)
+			}
+		}
+		plan.Buckets = need
+	}
+	plan.Buckets = append(plan.Buckets, corrupt...)
+
+	sort.Strings(plan.CheckpointFiles)
+	sort.Sort(byHashString(plan.Buckets))
+
+	sz, e := sumSizes(src, plan.paths(), opts.Concurrency)
+	plan.EstimatedBytes = sz
+	return plan, e
+}
+
+func (p *CopyPlan) paths() []string {
+	pths := make([]string, 0, len(p.CheckpointFiles) + len(p.Buckets))
+	pths = append(pths, p.CheckpointFiles...)
+	for _, bucket := range p.Buckets {
+		pths = append(pths, BucketPath(bucket))
+	}
+	return pths
+}
+
+func sumSizes(arch *Archive, pths []string, concurrency int) (int64, error) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	var total int64
+	var errs uint32
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	req := make(chan string)
+	go func() {
+		for _, pth := range pths {
+			req <- pth
+		}
+		close(req)
+	}()
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			for pth := range req {
+				sz, e := arch.backend.GetFileSize(pth)
+				atomic.AddUint32(&errs, noteError(e))
+				atomic.AddInt64(&total, sz)
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	if errs != 0 {
+		return total, fmt.Errorf("%d errors while sizing files", errs)
+	}
+	return total, nil
+}
+
+// Number of workers each of CheckpointsMissingIn's scans runs.
+const missingInConcurrency = 16
+
+// Scans the checkpoint files of both archives over rng, clamped to src's
+// root HAS, and returns, per category of src, the checkpoints in order
+// whose file src has and dst lacks: the checkpoint files a mirror from src
+// would copy to dst, as data to review first. Buckets aren't compared; see
+// Reconcile for a plan that covers them too.
+func (src *Archive) CheckpointsMissingIn(dst *Archive, rng Range) (map[string][]uint32, error) {
+	missing := make(map[string][]uint32)
+	opts := &CommandOptions{Range: rng, Concurrency: missingInConcurrency}
+	if e := src.ScanCheckpoints(opts); e != nil {
+		return missing, e
+	}
+	// As in Reconcile, dst is scanned over src's range, not its own.
+	dstOpts := *opts
+	if e := dst.scanCheckpointsInRange(&dstOpts); e != nil {
+		return missing, e
+	}
+
+	present := make(map[string][]uint32)
+	src.mutex.Lock()
+	for _, cat := range src.Categories() {
+		present[cat] = []uint32{}
+		opts.Range.EachCheckpoint(func(chk uint32) error {
+			if src.checkpointFiles[cat][chk] {
+				present[cat] = append(present[cat], chk)
+			}
+			return nil
+		})
+	}
+	src.mutex.Unlock()
+	dst.mutex.Lock()
+	defer dst.mutex.Unlock()
+	for cat, chks := range present {
+		missing[cat] = []uint32{}
+		for _, chk := range chks {
+			if !dst.checkpointFiles[cat][chk] {
+				missing[cat] = append(missing[cat], chk)
+			}
+		}
+	}
+	return missing, nil
+}
+
+// Copies every object listed in plan from src to dst, checkpoint files
+// first and then buckets. A listed object dst has is one Reconcile found
+// corrupt (or one written since), so it's verified and copied over if it
+// fails, rather than skipped.
+func ApplyCopyPlan(src *Archive, dst *Archive, plan CopyPlan, opts *CommandOptions) error {
+	verifying := *opts
+	verifying.VerifyExisting = true
+	opts = &verifying
+	var errs uint32
+	for _, pth := range plan.CheckpointFiles {
+		logf("Copying %s", pth)
+		errs += noteError(copyPath(src, dst, pth, opts))
+	}
+	for _, bucket := range plan.Buckets {
+		pth := BucketPath(bucket)
+		logf("Copying %s", pth)
+		errs += noteError(copyPath(src, dst, pth, opts))
+	}
+	if errs != 0 {
+		return fmt.Errorf("%d errors while applying copy plan", errs)
+	}
+	return nil
+}
+
+type byHashString []Hash
+func (a byHashString) Len() int           { return len(a) }
+func (a byHashString) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byHashString) Less(i, j int) bool { return a[i].String() < a[j].String() }
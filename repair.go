@@ -5,56 +5,186 @@
 package archivist
 
 import (
-	"log"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"path"
+	"sync"
+	"sync/atomic"
 )
 
+type repairReq struct {
+	cat string
+	pth string
+	// Set when dst has the file but the scan found it corrupt.
+	corrupt bool
+}
+
+// Copies missing or corrupt checkpoint files from src to dst with
+// opts.Concurrency workers, returning the number of errors.
+func repairCheckpointFiles(src *Archive, dst *Archive, reqs []repairReq, opts *CommandOptions) uint32 {
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var errs uint32
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	req := make(chan repairReq)
+	go func() {
+		for _, r := range reqs {
+			req <- r
+		}
+		close(req)
+	}()
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			for r := range req {
+				if opts.retries.exhausted() {
+					continue
+				}
+				if !dst.categoryRequired(r.cat) && !src.backend.Exists(r.pth) {
+					logf("Skipping nonexistent, optional %s file %s", r.cat, r.pth)
+					continue
+				}
+				if r.corrupt {
+					atomic.AddUint32(&errs, noteError(refetchCorrupt(src, dst, r.pth, opts)))
+					continue
+				}
+				logf("Repairing %s", r.pth)
+				atomic.AddUint32(&errs, noteError(copyPath(src, dst, r.pth, opts)))
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// Copies pth from src over dst's corrupt copy, then verifies the result,
+// so that a source just as corrupt is reported rather than trusted.
+func refetchCorrupt(src *Archive, dst *Archive, pth string, opts *CommandOptions) error {
+	logf("Repairing corrupt %s", pth)
+	force := *opts
+	force.Force = true
+	if err := copyPath(src, dst, pth, &force); err != nil || opts.DryRun {
+		return err
+	}
+	return opts.verifySlots.run(func() error {
+		return verifyExistingFile(dst, pth)
+	})
+}
+
 func Repair(src *Archive, dst *Archive, opts *CommandOptions) error {
+	span := startRangeSpan(opts, "archivist.Repair")
+	finish := startMetrics(opts, "repair")
+	err := repair(src, dst, opts)
+	finish(dst, err)
+	span.End(err)
+	return err
+}
+
+func repair(src *Archive, dst *Archive, opts *CommandOptions) error {
 	state, e := dst.GetRootHAS()
 	if e != nil {
 		return e
 	}
 	opts.Range = opts.Range.Clamp(state.Range())
+	opts.retries = newRetryBudget(opts.RetryBudget)
+	opts.verifySlots = newVerifyLimiter(opts.VerifyConcurrency)
+	opts.inFlight = newByteBudget(opts.MaxInFlightBytes)
+
+	if opts.SkipBuckets && opts.BucketsOnly {
+		return fmt.Errorf("SkipBuckets and BucketsOnly leave nothing to repair")
+	}
 
-	log.Printf("Starting scan for repair")
+	// With RepairCorrupt, verification failures in the scans are what's
+	// to be repaired rather than errors; refetchCorrupt counts any that
+	// remain. Any other scan error, such as a failed listing, still counts.
+	scanOpts := opts
+	if opts.RepairCorrupt {
+		verifying := *opts
+		verifying.Verify = true
+		verifying.tolerateCorrupt = true
+		scanOpts = &verifying
+	}
+	scan := func(f func(*CommandOptions) error) uint32 {
+		return noteError(f(scanOpts))
+	}
+
+	logf("Starting scan for repair")
 	var errs uint32
-	errs += noteError(dst.ScanCheckpoints(opts))
+	errs += scan(dst.ScanCheckpoints)
 
-	log.Printf("Examining checkpoint files for gaps")
-	missingCheckpointFiles := dst.CheckCheckpointFilesMissing(opts)
+	// The checkpoint scan is still needed with BucketsOnly, to find the
+	// history files that reference the buckets.
+	missingCheckpointFiles := make(map[string][]uint32)
+	if !opts.BucketsOnly {
+		logf("Examining checkpoint files for gaps")
+		missingCheckpointFiles = dst.CheckCheckpointFilesMissing(opts)
+	}
+	corruptCheckpointFiles := make(map[string][]uint32)
+	if opts.RepairCorrupt && !opts.BucketsOnly {
+		corruptCheckpointFiles = dst.CheckCheckpointFilesCorrupt(opts)
+	}
 
-	repairedHistory := false
-	for cat, missing := range missingCheckpointFiles {
-		for _, chk := range missing {
-			pth := CategoryCheckpointPath(cat, chk)
-			if !categoryRequired(cat) && !src.backend.Exists(pth) {
-				log.Printf("Skipping nonexistent, optional %s file %s", cat, pth)
-				continue
-			}
-			log.Printf("Repairing %s", pth)
-			errs += noteError(copyPath(src, dst, pth, opts))
-			if cat == "history" {
-				repairedHistory = true
+	// History files are copied first, as the bucket re-scan below depends
+	// on them, then the other categories together.
+	var history, others []repairReq
+	for i, files := range []map[string][]uint32{missingCheckpointFiles, corruptCheckpointFiles} {
+		for cat, chks := range files {
+			for _, chk := range chks {
+				r := repairReq{cat: cat, pth: dst.CategoryCheckpointPath(cat, chk), corrupt: i == 1}
+				if cat == "history" {
+					history = append(history, r)
+				} else {
+					others = append(others, r)
+				}
 			}
 		}
 	}
+	repairedHistory := len(history) != 0
+	errs += repairCheckpointFiles(src, dst, history, opts)
+	errs += repairCheckpointFiles(src, dst, others, opts)
+	if opts.retries.exhausted() {
+		return opts.retries.abortError("repair")
+	}
+
+	if opts.SkipBuckets {
+		logf("Skipping bucket repair")
+		if errs != 0 {
+			return fmt.Errorf("%d errors while repairing", errs)
+		}
+		return nil
+	}
 
 	if repairedHistory {
-		log.Printf("Re-running checkpoing-file scan, for bucket repair")
+		logf("Re-running checkpoing-file scan, for bucket repair")
 		dst.ClearCachedInfo()
-		errs += noteError(dst.ScanCheckpoints(opts))
+		errs += scan(dst.ScanCheckpoints)
 	}
 
-	errs += noteError(dst.ScanBuckets(opts))
+	errs += scan(dst.ScanBuckets)
 
-	log.Printf("Examining buckets referenced by checkpoints")
+	logf("Examining buckets referenced by checkpoints")
 	missingBuckets := dst.CheckBucketsMissing()
 
 	for bkt, _ := range missingBuckets {
+		if opts.retries.exhausted() {
+			return opts.retries.abortError("repair")
+		}
 		pth := BucketPath(bkt)
-		log.Printf("Repairing %s", pth)
+		logf("Repairing %s", pth)
 		errs += noteError(copyPath(src, dst, pth, opts))
 	}
+	if opts.RepairCorrupt {
+		for bkt, _ := range dst.CheckBucketsCorrupt() {
+			if opts.retries.exhausted() {
+				return opts.retries.abortError("repair")
+			}
+			errs += noteError(refetchCorrupt(src, dst, BucketPath(bkt), opts))
+		}
+	}
 
 	if errs != 0 {
 		return fmt.Errorf("%d errors while repairing", errs)
@@ -62,3 +192,101 @@ func Repair(src *Archive, dst *Archive, opts *CommandOptions) error {
 	return nil
 }
 
+
+// Where RepairCheckpoint stages files in the destination, each repair in a
+// directory of its own. Nothing that scans, lists or mirrors an archive
+// looks here.
+const RepairStagingDir = ".archivist-staging"
+
+// Repairs checkpoint chk of dst from src as a unit: every file it needs
+// that dst lacks (or, per opts.Force and opts.VerifyExisting, has but
+// shouldn't keep), its category files and the buckets its HAS references,
+// is copied into a staging directory in dst and verified there, and only
+// once all are good are they renamed into place, buckets first and the
+// checkpoint's HAS last. If anything fails before then, the staged files
+// are deleted and dst is left as it was; a scan never sees the checkpoint
+// half repaired. The renames themselves can still fail part-way, but as
+// the HAS goes last, the checkpoint then still reads as missing.
+func RepairCheckpoint(src *Archive, dst *Archive, chk uint32, opts *CommandOptions) error {
+	has, err := src.GetCheckpointHAS(chk)
+	if err != nil {
+		return err
+	}
+	// Buckets, then the category files with history last, is the order
+	// they're committed in.
+	var pths []string
+	for _, bucket := range has.Buckets() {
+		pths = append(pths, BucketPath(bucket))
+	}
+	for _, cat := range dst.Categories() {
+		if cat == "history" {
+			continue
+		}
+		pth := dst.CategoryCheckpointPath(cat, chk)
+		if !dst.categoryRequired(cat) && !src.backend.Exists(pth) {
+			continue
+		}
+		pths = append(pths, pth)
+	}
+	pths = append(pths, dst.CheckpointHASPath(chk))
+
+	var needed []string
+	for _, pth := range pths {
+		if dst.backend.Exists(pth) && !opts.Force {
+			if !opts.VerifyExisting || verifyExistingFile(dst, pth) == nil {
+				continue
+			}
+		}
+		needed = append(needed, pth)
+	}
+	if len(needed) == 0 {
+		logf("Checkpoint 0x%8.8x needs no repair", chk)
+		return nil
+	}
+	if opts.DryRun {
+		for _, pth := range needed {
+			logf("dryrun skipping repair of " + pth)
+		}
+		return nil
+	}
+
+	token := make([]byte, 8)
+	if _, err = rand.Read(token); err != nil {
+		return err
+	}
+	staging := path.Join(RepairStagingDir, hex.EncodeToString(token))
+	var staged []string
+	abort := func(err error) error {
+		for _, pth := range staged {
+			if e := dst.backend.DeleteFile(path.Join(staging, pth)); e != nil {
+				logf("Error: deleting staged %s: %s", pth, e)
+			}
+		}
+		return fmt.Errorf("Repair of checkpoint 0x%8.8x abandoned: %s", chk, err)
+	}
+
+	logf("Staging %d files of checkpoint 0x%8.8x", len(needed), chk)
+	for _, pth := range needed {
+		rdr, err := src.backend.GetFile(pth)
+		if err != nil {
+			return abort(err)
+		}
+		err = dst.backend.PutFile(path.Join(staging, pth), bufReadCloser(rdr))
+		if err != nil {
+			return abort(err)
+		}
+		staged = append(staged, pth)
+		if err = verifyExistingFile(dst, path.Join(staging, pth)); err != nil {
+			return abort(fmt.Errorf("%s: %s", pth, err))
+		}
+	}
+
+	for i, pth := range staged {
+		logf("Repairing %s", pth)
+		if err = dst.backend.RenameFile(path.Join(staging, pth), pth); err != nil {
+			staged = staged[i:]
+			return abort(err)
+		}
+	}
+	return nil
+}
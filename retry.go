@@ -0,0 +1,44 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// Returned, wrapped, by a Mirror or Repair that gave up for want of
+// retries.
+var ErrRetryBudgetExhausted = errors.New("Retry budget exhausted")
+
+// A count of retries shared by every worker of an operation. A nil budget,
+// or one with a zero limit, is unlimited.
+type retryBudget struct {
+	limit int64
+	used int64
+}
+
+func newRetryBudget(limit int) *retryBudget {
+	return &retryBudget{limit: int64(limit)}
+}
+
+// Claims one retry, reporting whether the budget allowed it.
+func (r *retryBudget) take() bool {
+	if r == nil || r.limit == 0 {
+		return true
+	}
+	return atomic.AddInt64(&r.used, 1) <= r.limit
+}
+
+// Reports whether a retry has been refused, after which the operation
+// should stop.
+func (r *retryBudget) exhausted() bool {
+	return r != nil && r.limit != 0 && atomic.LoadInt64(&r.used) > r.limit
+}
+
+func (r *retryBudget) abortError(op string) error {
+	return fmt.Errorf("Aborted %s after %d retries: %w", op, r.limit, ErrRetryBudgetExhausted)
+}
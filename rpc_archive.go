@@ -0,0 +1,186 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"io"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// The client side of the ArchiveStore service in archive_store.proto.
+// DialGRPCArchiveStore returns one speaking gRPC, which Connect uses for
+// grpc:// URLs; for another RPC framework, or gRPC with dial options of
+// your own, wrap the client generated for it to satisfy this, and register
+// it with RegisterArchiveStore.
+type ArchiveStoreClient interface {
+	Exists(path string) (bool, error)
+	Size(path string) (int64, error)
+	Get(path string) (io.ReadCloser, error)
+	Put(path string, in io.Reader) error
+	Delete(path string) error
+	Rename(from string, to string) error
+	List(prefix string) (ArchiveStoreListStream, error)
+}
+
+// A streamed listing. Recv returns io.EOF once the listing is complete.
+type ArchiveStoreListStream interface {
+	Recv() (string, error)
+}
+
+// The server side of the ArchiveStore service, which
+// NewGRPCArchiveStoreServer serves over gRPC. List calls send once per
+// file, as it's found, so the listing is never held in memory.
+type ArchiveStoreServer interface {
+	Exists(path string) (bool, error)
+	Size(path string) (int64, error)
+	Get(path string) (io.ReadCloser, error)
+	Put(path string, in io.ReadCloser) error
+	Delete(path string) error
+	Rename(from string, to string) error
+	List(prefix string, send func(string) error) error
+}
+
+// An ArchiveBackend over a remote store, with every path under prefix.
+type RPCArchiveBackend struct {
+	client ArchiveStoreClient
+	prefix string
+}
+
+func (b *RPCArchiveBackend) key(pth string) string {
+	return strings.TrimPrefix(path.Join(b.prefix, pth), "/")
+}
+
+func (b *RPCArchiveBackend) Exists(pth string) bool {
+	ok, err := b.client.Exists(b.key(pth))
+	return err == nil && ok
+}
+
+func (b *RPCArchiveBackend) GetFile(pth string) (io.ReadCloser, error) {
+	return b.client.Get(b.key(pth))
+}
+
+func (b *RPCArchiveBackend) GetFileSize(pth string) (int64, error) {
+	return b.client.Size(b.key(pth))
+}
+
+func (b *RPCArchiveBackend) PutFile(pth string, in io.ReadCloser) error {
+	defer in.Close()
+	return b.client.Put(b.key(pth), in)
+}
+
+func (b *RPCArchiveBackend) DeleteFile(pth string) error {
+	return b.client.Delete(b.key(pth))
+}
+
+func (b *RPCArchiveBackend) RenameFile(from string, to string) error {
+	return b.client.Rename(b.key(from), b.key(to))
+}
+
+// Passes listing results on as the stream delivers them.
+func (b *RPCArchiveBackend) ListFiles(pth string) (chan string, chan error) {
+	ch := make(chan string)
+	errs := make(chan error)
+	go func() {
+		defer close(errs)
+		defer close(ch)
+		stream, err := b.client.List(b.key(pth))
+		if err != nil {
+			errs <- err
+			return
+		}
+		for {
+			f, err := stream.Recv()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+			ch <- f
+		}
+	}()
+	return ch, errs
+}
+
+func (b *RPCArchiveBackend) CanListFiles() bool {
+	return true
+}
+
+func RPCBackend(client ArchiveStoreClient, prefix string) ArchiveBackend {
+	return &RPCArchiveBackend{
+		client: client,
+		prefix: strings.Trim(path.Clean("/" + prefix), "/"),
+	}
+}
+
+// Connects to the store at a URL's host. Called once per Connect.
+type ArchiveStoreDialer func(host string, opts *ConnectOptions) (ArchiveStoreClient, error)
+
+// Teaches Connect to reach remote stores for URLs of the given scheme,
+// such as "store://host:port/prefix", through dial. The URL's path is the
+// archive's prefix within the store.
+func RegisterArchiveStore(scheme string, dial ArchiveStoreDialer) {
+	RegisterBackend(scheme, func(u *url.URL, opts *ConnectOptions) (ArchiveBackend, error) {
+		client, err := dial(u.Host, opts)
+		if err != nil {
+			return nil, err
+		}
+		return RPCBackend(client, u.Path), nil
+	})
+}
+
+// Serves an ArchiveBackend as an ArchiveStore: the reference server.
+type BackendArchiveStore struct {
+	backend ArchiveBackend
+}
+
+func (s *BackendArchiveStore) Exists(pth string) (bool, error) {
+	return s.backend.Exists(pth), nil
+}
+
+func (s *BackendArchiveStore) Size(pth string) (int64, error) {
+	return s.backend.GetFileSize(pth)
+}
+
+func (s *BackendArchiveStore) Get(pth string) (io.ReadCloser, error) {
+	return s.backend.GetFile(pth)
+}
+
+func (s *BackendArchiveStore) Put(pth string, in io.ReadCloser) error {
+	return s.backend.PutFile(pth, in)
+}
+
+func (s *BackendArchiveStore) Delete(pth string) error {
+	return s.backend.DeleteFile(pth)
+}
+
+func (s *BackendArchiveStore) Rename(from string, to string) error {
+	return s.backend.RenameFile(from, to)
+}
+
+// Stops the backend's listing if send fails, as it does when the client
+// goes away.
+func (s *BackendArchiveStore) List(prefix string, send func(string) error) error {
+	done := make(chan struct{})
+	defer close(done)
+	ch, errs := listFilesUntil(s.backend, prefix, done)
+	errs = makeErrorPump(errs)
+	for f := range ch {
+		if err := send(f); err != nil {
+			return err
+		}
+	}
+	for err := range errs {
+		return err
+	}
+	return nil
+}
+
+func ServeBackend(backend ArchiveBackend) ArchiveStoreServer {
+	return &BackendArchiveStore{backend: backend}
+}
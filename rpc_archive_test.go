@@ -0,0 +1,138 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+// Connects an ArchiveStoreClient straight to a server, in process, in
+// place of an RPC transport.
+type loopbackStore struct {
+	server ArchiveStoreServer
+}
+
+type loopbackListStream struct {
+	ch chan string
+	err chan error
+}
+
+func (s *loopbackListStream) Recv() (string, error) {
+	if f, ok := <-s.ch; ok {
+		return f, nil
+	}
+	if err := <-s.err; err != nil {
+		return "", err
+	}
+	return "", io.EOF
+}
+
+func (c *loopbackStore) Exists(pth string) (bool, error) {
+	return c.server.Exists(pth)
+}
+
+func (c *loopbackStore) Size(pth string) (int64, error) {
+	return c.server.Size(pth)
+}
+
+func (c *loopbackStore) Get(pth string) (io.ReadCloser, error) {
+	return c.server.Get(pth)
+}
+
+func (c *loopbackStore) Put(pth string, in io.Reader) error {
+	return c.server.Put(pth, ioutil.NopCloser(in))
+}
+
+func (c *loopbackStore) Delete(pth string) error {
+	return c.server.Delete(pth)
+}
+
+func (c *loopbackStore) Rename(from string, to string) error {
+	return c.server.Rename(from, to)
+}
+
+func (c *loopbackStore) List(prefix string) (ArchiveStoreListStream, error) {
+	s := &loopbackListStream{ch: make(chan string), err: make(chan error, 1)}
+	go func() {
+		err := c.server.List(prefix, func(f string) error {
+			s.ch <- f
+			return nil
+		})
+		close(s.ch)
+		s.err <- err
+	}()
+	return s, nil
+}
+
+func TestRPCBackend(t *testing.T) {
+	defer cleanup()
+	store := MakeMockBackend(nil)
+	RegisterArchiveStore("rpctest", func(host string, opts *ConnectOptions) (ArchiveStoreClient, error) {
+		return &loopbackStore{server: ServeBackend(store)}, nil
+	})
+	src := GetRandomPopulatedArchive()
+	dst := MustConnect("rpctest://localhost:1234/archives/test", nil)
+	opts := testOptions()
+	assert.Nil(t, Mirror(src, dst, opts))
+	assert.True(t, store.Exists("archives/test/" + DefaultRootHASPath))
+
+	assert.Nil(t, dst.Scan(opts))
+	assert.Equal(t, 0, countMissing(dst, opts))
+	sz, e := dst.BucketSize(firstBucket(src))
+	assert.NoError(t, e)
+	assert.Equal(t, int64(1024), sz)
+}
+
+func TestGRPCBackend(t *testing.T) {
+	defer cleanup()
+	store := MakeMockBackend(nil)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	srv := NewGRPCArchiveStoreServer(ServeBackend(store))
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	src := GetRandomPopulatedArchive()
+	dst := MustConnect("grpc://" + lis.Addr().String() + "/archives/test", nil)
+	opts := testOptions()
+	assert.Nil(t, Mirror(src, dst, opts))
+	assert.True(t, store.Exists("archives/test/" + DefaultRootHASPath))
+	assert.Nil(t, dst.Scan(opts))
+	assert.Equal(t, 0, countMissing(dst, opts))
+
+	// A file of several chunks, and an empty one.
+	for _, sz := range []int{3 * grpcChunkSize + 5, 0} {
+		buf := make([]byte, sz)
+		for i := range buf {
+			buf[i] = byte(i * 7)
+		}
+		assert.Nil(t, dst.backend.PutFile("big", ioutil.NopCloser(bytes.NewReader(buf))))
+		n, err := dst.backend.GetFileSize("big")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(sz), n)
+		rdr, err := dst.backend.GetFile("big")
+		assert.Nil(t, err)
+		got, err := ioutil.ReadAll(rdr)
+		rdr.Close()
+		assert.Nil(t, err)
+		assert.True(t, bytes.Equal(buf, got))
+	}
+	assert.Nil(t, dst.backend.RenameFile("big", "bigger"))
+	assert.True(t, store.Exists("archives/test/bigger"))
+	assert.Nil(t, dst.backend.DeleteFile("bigger"))
+	assert.False(t, dst.backend.Exists("bigger"))
+	_, err = dst.backend.GetFile("bigger")
+	assert.Error(t, err)
+}
+
+func firstBucket(arch *Archive) Hash {
+	has, _ := arch.GetRootHAS()
+	return has.Buckets()[0]
+}
@@ -7,40 +7,149 @@ package archivist
 import (
 	"io"
 	"path"
+	"strings"
 	"bytes"
+	"net/url"
+	"fmt"
+	"time"
+	"net/http"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
 type S3ArchiveBackend struct {
 	svc *s3.S3
+	region string
 	bucket string
 	prefix string
+	tagging *string
+	metadata map[string]*string
+	contentTypes map[string]string
+	contentEncodings map[string]string
 }
 
-func (b *S3ArchiveBackend) GetFile(pth string) (io.ReadCloser, error) {
-	params := &s3.GetObjectInput{
-		Bucket: aws.String(b.bucket),
-		Key: aws.String(path.Join(b.prefix, pth)),
+// The Content-Type and Content-Encoding set on uploaded files, by suffix, so
+// that an archive served straight from S3 (or a CDN in front of it) is
+// usable by web clients. Buckets and checkpoint files are stored gzipped
+// and marked Content-Encoding: gzip, so a browser receives them unzipped.
+// Clients that decompress transparently must not do so when fetching
+// archive files; neither MakeHttpBackend's client nor this backend's does.
+func DefaultS3ContentHeaders() (types map[string]string, encodings map[string]string) {
+	types = map[string]string{
+		".json": "application/json",
+		".xdr.gz": "application/octet-stream",
 	}
-	resp, err := b.svc.GetObject(params)
-	if err != nil {
+	encodings = map[string]string{
+		".xdr.gz": "gzip",
+	}
+	return
+}
+
+// Returns the value for the longest suffix of pth in m, or nil if there is
+// none or it's empty.
+func headerForPath(m map[string]string, pth string) *string {
+	best := ""
+	found := false
+	for suffix := range m {
+		if strings.HasSuffix(pth, suffix) && len(suffix) >= len(best) {
+			best = suffix
+			found = true
+		}
+	}
+	if !found || m[best] == "" {
+		return nil
+	}
+	return aws.String(m[best])
+}
+
+// Inside s3, all keys start _without_ a leading /, and the prefix is joined
+// to paths with exactly one /, however the prefix was written in the URL.
+func normalizeS3Prefix(prefix string) string {
+	return strings.Trim(path.Clean("/" + prefix), "/")
+}
+
+func (b *S3ArchiveBackend) key(pth string) string {
+	return strings.TrimPrefix(path.Join(b.prefix, pth), "/")
+}
+
+// Fetches an object as it's stored. Objects uploaded with Content-Encoding:
+// gzip would otherwise be unzipped by Go's transport, which asks for gzip
+// and decompresses what comes back unless the request names an encoding
+// itself.
+func (b *S3ArchiveBackend) getObject(params *s3.GetObjectInput) (io.ReadCloser, error) {
+	req, resp := b.svc.GetObjectRequest(params)
+	req.HTTPRequest.Header.Set("Accept-Encoding", "identity")
+	if err := req.Send(); err != nil {
 		return nil, err
 	}
 	return resp.Body, nil
 }
 
+func (b *S3ArchiveBackend) GetFile(pth string) (io.ReadCloser, error) {
+	return b.getObject(&s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key: aws.String(b.key(pth)),
+	})
+}
+
+func (b *S3ArchiveBackend) GetFileRange(pth string, offset int64, length int64) (io.ReadCloser, error) {
+	return b.getObject(&s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key: aws.String(b.key(pth)),
+		Range: aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset + length - 1)),
+	})
+}
+
 func (b *S3ArchiveBackend) Exists(pth string) bool {
 	params := &s3.HeadObjectInput{
 		Bucket: aws.String(b.bucket),
-		Key: aws.String(path.Join(b.prefix, pth)),
+		Key: aws.String(b.key(pth)),
 	}
 	_, err := b.svc.HeadObject(params)
 	return err == nil
 }
 
+func (b *S3ArchiveBackend) GetFileSize(pth string) (int64, error) {
+	params := &s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key: aws.String(b.key(pth)),
+	}
+	resp, err := b.svc.HeadObject(params)
+	if err != nil {
+		return 0, err
+	}
+	if resp.ContentLength == nil {
+		return 0, fmt.Errorf("No Content-Length for %s", pth)
+	}
+	return *resp.ContentLength, nil
+}
+
+func (b *S3ArchiveBackend) GetFileModTime(pth string) (time.Time, error) {
+	params := &s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key: aws.String(b.key(pth)),
+	}
+	resp, err := b.svc.HeadObject(params)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if resp.LastModified == nil {
+		return time.Time{}, fmt.Errorf("No modification time for %s", pth)
+	}
+	return *resp.LastModified, nil
+}
+
 func (b *S3ArchiveBackend) PutFile(pth string, in io.ReadCloser) error {
+	return b.putObject(pth, in, nil)
+}
+
+// Uploads in to pth, first letting condition, if not nil, set the
+// request's preconditions.
+// Condition, if set, adds headers the PutObjectInput has no fields for to
+// the request before it's sent.
+func (b *S3ArchiveBackend) putObject(pth string, in io.ReadCloser, condition func(http.Header)) error {
 	var buf bytes.Buffer
 	_, err := buf.ReadFrom(in)
 	in.Close()
@@ -49,17 +158,133 @@ func (b *S3ArchiveBackend) PutFile(pth string, in io.ReadCloser) error {
 	}
 	params := &s3.PutObjectInput{
 		Bucket: aws.String(b.bucket),
-		Key: aws.String(path.Join(b.prefix, pth)),
+		Key: aws.String(b.key(pth)),
 		ACL: aws.String(s3.ObjectCannedACLPublicRead),
 		Body: bytes.NewReader(buf.Bytes()),
+		Tagging: b.tagging,
+		Metadata: b.metadata,
+		ContentType: headerForPath(b.contentTypes, pth),
+		ContentEncoding: headerForPath(b.contentEncodings, pth),
+	}
+	req, _ := b.svc.PutObjectRequest(params)
+	if condition != nil {
+		condition(req.HTTPRequest.Header)
 	}
-	_, err = b.svc.PutObject(params)
+	err = req.Send()
 	in.Close()
 	return err
 }
 
+func s3StatusCode(err error) int {
+	if rf, ok := err.(awserr.RequestFailure); ok {
+		return rf.StatusCode()
+	}
+	return 0
+}
+
+// The version is the object's ETag.
+func (b *S3ArchiveBackend) FileVersion(pth string) (string, error) {
+	params := &s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key: aws.String(b.key(pth)),
+	}
+	resp, err := b.svc.HeadObject(params)
+	if err != nil {
+		if s3StatusCode(err) == http.StatusNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	if resp.ETag == nil {
+		return "", fmt.Errorf("No ETag for %s", pth)
+	}
+	return *resp.ETag, nil
+}
+
+// Uses S3's conditional writes: If-Match the version, or If-None-Match
+// for a file that mustn't exist yet.
+func (b *S3ArchiveBackend) PutFileIfVersion(pth string, version string, in io.ReadCloser) error {
+	err := b.putObject(pth, in, func(h http.Header) {
+		if version == "" {
+			h.Set("If-None-Match", "*")
+		} else {
+			h.Set("If-Match", version)
+		}
+	})
+	// A concurrent conditional write to the same key fails with 409.
+	switch s3StatusCode(err) {
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		return ErrFileChanged
+	}
+	return err
+}
+
+func (b *S3ArchiveBackend) DeleteFile(pth string) error {
+	params := &s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key: aws.String(b.key(pth)),
+	}
+	_, err := b.svc.DeleteObject(params)
+	return err
+}
+
+// S3 has no rename, so this copies the object server-side, keeping its
+// metadata and tags, then deletes the original. It is not atomic: for a
+// moment the object exists under both names, and if the delete fails it
+// is left under both.
+func (b *S3ArchiveBackend) RenameFile(from string, to string) error {
+	src := url.URL{Path: b.bucket + "/" + b.key(from)}
+	params := &s3.CopyObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key: aws.String(b.key(to)),
+		CopySource: aws.String(src.EscapedPath()),
+		ACL: aws.String(s3.ObjectCannedACLPublicRead),
+	}
+	if _, err := b.svc.CopyObject(params); err != nil {
+		return err
+	}
+	return b.DeleteFile(from)
+}
+
+// Copies the object server-side from another S3 backend in the same
+// region. The copy is given the headers, metadata and tags this backend
+// would upload it with, not the source's. S3 doesn't say how large the
+// object was, so no bytes are reported copied. A source this backend's
+// credentials can't read, as in another account, is left to be streamed.
+func (b *S3ArchiveBackend) CopyFileFrom(src ArchiveBackend, pth string) (int64, error) {
+	s3src, ok := src.(*S3ArchiveBackend)
+	if !ok || s3src.region != b.region {
+		return 0, ErrDirectCopyUnsupported
+	}
+	_, err := b.svc.CopyObject(b.copyFromInput(s3src, pth))
+	if ae, ok := err.(awserr.Error); ok && ae.Code() == "AccessDenied" {
+		return 0, ErrDirectCopyUnsupported
+	}
+	return 0, err
+}
+
+func (b *S3ArchiveBackend) copyFromInput(src *S3ArchiveBackend, pth string) *s3.CopyObjectInput {
+	from := url.URL{Path: src.bucket + "/" + src.key(pth)}
+	return &s3.CopyObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key: aws.String(b.key(pth)),
+		CopySource: aws.String(from.EscapedPath()),
+		ACL: aws.String(s3.ObjectCannedACLPublicRead),
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+		Metadata: b.metadata,
+		ContentType: headerForPath(b.contentTypes, pth),
+		ContentEncoding: headerForPath(b.contentEncodings, pth),
+		TaggingDirective: aws.String(s3.TaggingDirectiveReplace),
+		Tagging: b.tagging,
+	}
+}
+
 func (b *S3ArchiveBackend) ListFiles(pth string) (chan string, chan error) {
-	prefix := path.Join(b.prefix, pth)
+	return b.ListFilesUntil(pth, nil)
+}
+
+func (b *S3ArchiveBackend) ListFilesUntil(pth string, done <-chan struct{}) (chan string, chan error) {
+	prefix := b.key(pth)
 	ch := make(chan string)
 	errs := make(chan error)
 
@@ -68,30 +293,30 @@ func (b *S3ArchiveBackend) ListFiles(pth string) (chan string, chan error) {
 		MaxKeys: aws.Int64(1000),
 		Prefix: aws.String(prefix),
 	}
-	resp, err := b.svc.ListObjects(params)
-	if err != nil {
-		errs <- err
-		close(ch)
-		close(errs)
-		return ch, errs
-	}
 	go func() {
+		defer close(errs)
+		defer close(ch)
 		for {
+			resp, err := b.svc.ListObjects(params)
+			if err != nil {
+				select {
+				case errs <- err:
+				case <-done:
+				}
+				return
+			}
 			for _, c := range resp.Contents {
 				params.Marker = c.Key
-				ch <- *c.Key
-			}
-			if *resp.IsTruncated {
-				resp, err = b.svc.ListObjects(params)
-				if err != nil {
-					errs <- err
+				select {
+				case ch <- *c.Key:
+				case <-done:
+					return
 				}
-			} else {
-				break
+			}
+			if !*resp.IsTruncated {
+				return
 			}
 		}
-		close(ch)
-		close(errs)
 	}()
 	return ch, errs
 }
@@ -100,15 +325,98 @@ func (b *S3ArchiveBackend) CanListFiles() bool {
 	return true
 }
 
+// Visits every incomplete multipart upload under the prefix.
+func (b *S3ArchiveBackend) eachMultipartUpload(pth string, fn func(*s3.MultipartUpload) error) error {
+	params := &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(b.bucket),
+		Prefix: aws.String(b.key(pth)),
+	}
+	for {
+		resp, err := b.svc.ListMultipartUploads(params)
+		if err != nil {
+			return err
+		}
+		for _, u := range resp.Uploads {
+			if err := fn(u); err != nil {
+				return err
+			}
+		}
+		if resp.IsTruncated == nil || !*resp.IsTruncated {
+			return nil
+		}
+		params.KeyMarker = resp.NextKeyMarker
+		params.UploadIdMarker = resp.NextUploadIdMarker
+	}
+}
+
+func (b *S3ArchiveBackend) ListPartialUploads() ([]string, error) {
+	pths := []string{}
+	err := b.eachMultipartUpload("", func(u *s3.MultipartUpload) error {
+		pth := *u.Key
+		if b.prefix != "" {
+			pth = strings.TrimPrefix(pth, b.prefix + "/")
+		}
+		pths = append(pths, pth)
+		return nil
+	})
+	return pths, err
+}
+
+func (b *S3ArchiveBackend) AbortPartialUploads(pth string) error {
+	key := b.key(pth)
+	return b.eachMultipartUpload(pth, func(u *s3.MultipartUpload) error {
+		// The listing is by prefix, so may hold longer keys too.
+		if *u.Key != key {
+			return nil
+		}
+		_, err := b.svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket: aws.String(b.bucket),
+			Key: u.Key,
+			UploadId: u.UploadId,
+		})
+		return err
+	})
+}
+
+// Encodes tags as the URL query string S3 takes for an object's tag set,
+// keys sorted, or returns nil if there are none.
+func encodeS3Tagging(tags map[string]string) *string {
+	if len(tags) == 0 {
+		return nil
+	}
+	vals := url.Values{}
+	for k, v := range tags {
+		vals.Set(k, v)
+	}
+	return aws.String(vals.Encode())
+}
+
 func MakeS3Backend(bucket string, prefix string, opts *ConnectOptions) ArchiveBackend {
 	cfg := aws.Config{}
+	region := ""
 	if opts != nil && opts.S3Region != "" {
-		cfg.Region = aws.String(opts.S3Region)
+		region = opts.S3Region
+		cfg.Region = aws.String(region)
 	}
 	sess := session.New(&cfg)
-	return &S3ArchiveBackend{
+	b := &S3ArchiveBackend{
 		svc: s3.New(sess),
+		region: region,
 		bucket: bucket,
-		prefix: prefix,
+		prefix: normalizeS3Prefix(prefix),
+	}
+	b.contentTypes, b.contentEncodings = DefaultS3ContentHeaders()
+	if opts != nil {
+		for suffix, v := range opts.S3ContentTypes {
+			b.contentTypes[suffix] = v
+		}
+		for suffix, v := range opts.S3ContentEncodings {
+			b.contentEncodings[suffix] = v
+		}
+		b.tagging = encodeS3Tagging(opts.S3ObjectTags)
+		if len(opts.S3Metadata) != 0 {
+			b.metadata = aws.StringMap(opts.S3Metadata)
+		}
 	}
+	return b
 }
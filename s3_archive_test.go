@@ -0,0 +1,202 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+// An S3 endpoint keeping objects in memory, and serving each with the
+// Content-Encoding it was uploaded with, whatever the request accepts, as
+// S3 does. HEAD answers carry no Content-Length, as some S3-compatible
+// stores' don't.
+type fakeS3 struct {
+	mutex sync.Mutex
+	objects map[string][]byte
+	encodings map[string]string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	switch r.Method {
+	case "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		f.objects[r.URL.Path] = body
+		f.encodings[r.URL.Path] = r.Header.Get("Content-Encoding")
+	case "GET":
+		obj, ok := f.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if rng := r.Header.Get("Range"); rng != "" {
+			var lo, hi int
+			fmt.Sscanf(rng, "bytes=%d-%d", &lo, &hi)
+			obj = obj[lo:hi + 1]
+		}
+		if enc := f.encodings[r.URL.Path]; enc != "" {
+			w.Header().Set("Content-Encoding", enc)
+		}
+		w.Write(obj)
+	case "HEAD":
+		if _, ok := f.objects[r.URL.Path]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Returns a backend for bucket "bucket", prefix "archive", of a fakeS3.
+func makeFakeS3Backend(t *testing.T) (*S3ArchiveBackend, *fakeS3) {
+	f := &fakeS3{objects: make(map[string][]byte), encodings: make(map[string]string)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	b := MakeS3Backend("bucket", "archive", nil).(*S3ArchiveBackend)
+	b.svc = s3.New(session.New(&aws.Config{
+		Endpoint: aws.String(srv.URL),
+		Region: aws.String("us-east-1"),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+	return b, f
+}
+
+func TestS3KeyPrefix(t *testing.T) {
+	pth := "history/00/00/00/history-0000003f.json"
+	for prefix, key := range map[string]string{
+		"": pth,
+		"/": pth,
+		"archive": "archive/" + pth,
+		"archive/": "archive/" + pth,
+		"/archive": "archive/" + pth,
+		"/archive/": "archive/" + pth,
+		"archive//sub/": "archive/sub/" + pth,
+	} {
+		b := MakeS3Backend("bucket", prefix, nil).(*S3ArchiveBackend)
+		assert.Equal(t, key, b.key(pth), prefix)
+	}
+}
+
+func TestConnectS3Prefix(t *testing.T) {
+	for u, prefix := range map[string]string{
+		"s3://bucket": "",
+		"s3://bucket/": "",
+		"s3://bucket/archive": "archive",
+		"s3://bucket/archive/": "archive",
+		"s3://bucket//archive/": "archive",
+	} {
+		arch, err := Connect(u, nil)
+		assert.NoError(t, err)
+		b := arch.backend.(*S3ArchiveBackend)
+		assert.Equal(t, "bucket", b.bucket)
+		assert.Equal(t, prefix, b.prefix, u)
+	}
+}
+
+func TestS3ContentHeaders(t *testing.T) {
+	b := MakeS3Backend("bucket", "", &ConnectOptions{
+		S3ContentTypes: map[string]string{".gz": "application/gzip"},
+		S3ContentEncodings: map[string]string{".xdr.gz": ""},
+	}).(*S3ArchiveBackend)
+	has := CategoryCheckpointPath("history", 0x3f)
+	ledger := CategoryCheckpointPath("ledger", 0x3f)
+	assert.Equal(t, "application/json", *headerForPath(b.contentTypes, has))
+	assert.Nil(t, headerForPath(b.contentEncodings, has))
+	assert.Equal(t, "application/octet-stream", *headerForPath(b.contentTypes, ledger))
+	assert.Equal(t, "application/gzip", *headerForPath(b.contentTypes, "foo.gz"))
+	assert.Nil(t, headerForPath(b.contentEncodings, ledger))
+
+	types, encodings := DefaultS3ContentHeaders()
+	assert.Equal(t, "gzip", *headerForPath(encodings, ledger))
+	assert.Nil(t, headerForPath(types, "README"))
+}
+
+func TestEncodeS3Tagging(t *testing.T) {
+	assert.Nil(t, encodeS3Tagging(nil))
+	assert.Nil(t, encodeS3Tagging(map[string]string{}))
+	tags := map[string]string{
+		"network": "test net",
+		"owner": "ops&infra",
+		"a=b": "c/d",
+		"empty": "",
+	}
+	tagging := encodeS3Tagging(tags)
+	assert.Equal(t, "a%3Db=c%2Fd&empty=&network=test+net&owner=ops%26infra", *tagging)
+	vals, err := url.ParseQuery(*tagging)
+	assert.NoError(t, err)
+	assert.Equal(t, len(tags), len(vals))
+	for k, v := range tags {
+		assert.Equal(t, v, vals.Get(k))
+	}
+
+	b := MakeS3Backend("bucket", "", &ConnectOptions{
+		S3ObjectTags: tags,
+		S3Metadata: map[string]string{"origin": "mirror"},
+	}).(*S3ArchiveBackend)
+	assert.Equal(t, *tagging, *b.tagging)
+	assert.Equal(t, "mirror", *b.metadata["origin"])
+	assert.Nil(t, MakeS3Backend("bucket", "", nil).(*S3ArchiveBackend).tagging)
+}
+
+func TestS3CopyFromInput(t *testing.T) {
+	src := MakeS3Backend("src", "a", nil).(*S3ArchiveBackend)
+	dst := MakeS3Backend("dst", "b", &ConnectOptions{
+		S3ContentTypes: map[string]string{".xdr.gz": "application/x-xdr"},
+		S3Metadata: map[string]string{"origin": "mirror"},
+	}).(*S3ArchiveBackend)
+	ledger := CategoryCheckpointPath("ledger", 0x3f)
+	params := dst.copyFromInput(src, ledger)
+	assert.Equal(t, "src/a/" + ledger, *params.CopySource)
+	assert.Equal(t, "b/" + ledger, *params.Key)
+	// The destination's headers replace the source object's.
+	assert.Equal(t, s3.MetadataDirectiveReplace, *params.MetadataDirective)
+	assert.Equal(t, "application/x-xdr", *params.ContentType)
+	assert.Equal(t, "gzip", *params.ContentEncoding)
+	assert.Equal(t, "mirror", *params.Metadata["origin"])
+	assert.Equal(t, s3.TaggingDirectiveReplace, *params.TaggingDirective)
+}
+
+func TestS3GetsEncodedObjectsAsStored(t *testing.T) {
+	b, f := makeFakeS3Backend(t)
+	raw := bytes.Repeat([]byte("bucket entries "), 100)
+	bucket := Hash(sha256.Sum256(raw))
+	pth := BucketPath(bucket)
+	stored := gzipped(raw)
+	assert.Nil(t, b.PutFile(pth, ioutil.NopCloser(bytes.NewReader(stored))))
+	assert.Equal(t, "gzip", f.encodings["/bucket/archive/" + pth])
+
+	arch := ConnectBackend(b, nil)
+	assert.Nil(t, arch.VerifyBucketHash(bucket))
+	rdr, err := b.GetFileRange(pth, 0, 10)
+	assert.Nil(t, err)
+	got, err := ioutil.ReadAll(rdr)
+	rdr.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, stored[:10], got)
+}
+
+func TestS3GetFileSizeWithoutLength(t *testing.T) {
+	b, _ := makeFakeS3Backend(t)
+	assert.Nil(t, b.PutFile("some/file", ioutil.NopCloser(bytes.NewReader([]byte("content")))))
+	_, err := b.GetFileSize("some/file")
+	assert.Error(t, err)
+	_, err = b.GetFileSize("no/file")
+	assert.Error(t, err)
+}
@@ -0,0 +1,135 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// The parts of an S3 Inventory manifest.json that IngestS3Inventory reads.
+type S3InventoryManifest struct {
+	SourceBucket string         `json:"sourceBucket"`
+	FileFormat string           `json:"fileFormat"`
+	FileSchema string           `json:"fileSchema"`
+	Files []struct {
+		Key string              `json:"key"`
+	}                           `json:"files"`
+}
+
+// Reads the S3 Inventory manifest at manifestPath in inv, the backend
+// holding the inventory, and passes the keys in every data file it names
+// to IngestListing, sparing a scan the LIST requests. The manifest names
+// data files by their full keys, so inv must be rooted at the inventory's
+// destination bucket. Only keys under keyPrefix, the archive's prefix in
+// the source bucket, and in its bucket or category directories are
+// ingested, so other archives sharing the source bucket are ignored. Only
+// CSV inventories can be read. The inventory is as stale as its last
+// report: objects written since then count as missing.
+func (a *Archive) IngestS3Inventory(inv ArchiveBackend, manifestPath string, keyPrefix string) error {
+	var manifest S3InventoryManifest
+	rdr, err := inv.GetFile(manifestPath)
+	if err != nil {
+		return err
+	}
+	err = json.NewDecoder(rdr).Decode(&manifest)
+	rdr.Close()
+	if err != nil {
+		return fmt.Errorf("Reading S3 inventory manifest %s: %s", manifestPath, err)
+	}
+	if manifest.FileFormat != "CSV" {
+		return fmt.Errorf("Unsupported S3 inventory format: '%s'", manifest.FileFormat)
+	}
+	cols := make(map[string]int)
+	for i, col := range strings.Split(manifest.FileSchema, ",") {
+		cols[strings.TrimSpace(col)] = i
+	}
+	if _, ok := cols["Key"]; !ok {
+		return fmt.Errorf("S3 inventory schema has no Key: '%s'", manifest.FileSchema)
+	}
+
+	dirs := map[string]bool{"bucket": true}
+	for _, cat := range a.Categories() {
+		dirs[cat] = true
+	}
+	keyPrefix = normalizeS3Prefix(keyPrefix)
+	if keyPrefix != "" {
+		keyPrefix += "/"
+	}
+
+	paths := make(chan string)
+	ingested := make(chan error)
+	go func() {
+		ingested <- a.IngestListing(paths)
+	}()
+	var errs uint32
+	for _, f := range manifest.Files {
+		logf("Reading S3 inventory file %s", f.Key)
+		errs += noteError(readS3InventoryFile(inv, f.Key, cols, func(key string) {
+			if !strings.HasPrefix(key, keyPrefix) {
+				return
+			}
+			pth := strings.TrimPrefix(key, keyPrefix)
+			if dirs[strings.SplitN(pth, "/", 2)[0]] {
+				paths <- pth
+			}
+		}))
+	}
+	close(paths)
+	errs += noteError(<-ingested)
+	if errs != 0 {
+		return fmt.Errorf("%d errors while ingesting S3 inventory", errs)
+	}
+	return nil
+}
+
+// Calls fn with the key of each current object in the gzipped CSV data
+// file pth, whose columns are as cols maps them. On versioned buckets the
+// inventory lists old versions and delete markers too; those are skipped.
+func readS3InventoryFile(inv ArchiveBackend, pth string, cols map[string]int, fn func(string)) error {
+	rdr, err := inv.GetFile(pth)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+	gz, err := gzip.NewReader(rdr)
+	if err != nil {
+		return fmt.Errorf("Reading S3 inventory file %s: %s", pth, err)
+	}
+	defer gz.Close()
+	r := csv.NewReader(gz)
+	r.FieldsPerRecord = -1
+	latest, versioned := cols["IsLatest"]
+	deleted, markers := cols["IsDeleteMarker"]
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Reading S3 inventory file %s: %s", pth, err)
+		}
+		if cols["Key"] >= len(rec) {
+			return fmt.Errorf("Short record in S3 inventory file %s", pth)
+		}
+		if versioned && latest < len(rec) && rec[latest] != "true" {
+			continue
+		}
+		if markers && deleted < len(rec) && rec[deleted] == "true" {
+			continue
+		}
+		// Keys are URL-encoded in the inventory.
+		key, err := url.QueryUnescape(rec[cols["Key"]])
+		if err != nil {
+			return fmt.Errorf("Bad key in S3 inventory file %s: %s", pth, err)
+		}
+		fn(key)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIngestS3Inventory(t *testing.T) {
+	arch := GetTestMockArchive()
+	arch.PopulateRandomRange(testRange())
+	has, _ := arch.GetCheckpointHAS(0x7f)
+	gone := MustDecodeHash(has.CurrentBuckets[0].Curr)
+
+	var rows bytes.Buffer
+	w := csv.NewWriter(&rows)
+	ch, _ := arch.backend.ListFiles("")
+	for pth := range ch {
+		if pth == CategoryCheckpointPath("ledger", 0xff) {
+			continue
+		}
+		if pth == BucketPath(gone) {
+			// Only an old version and a delete marker remain.
+			key := url.QueryEscape("pub/archive/" + pth)
+			w.Write([]string{"src", key, "false", "false"})
+			w.Write([]string{"src", key, "true", "true"})
+			continue
+		}
+		w.Write([]string{"src", url.QueryEscape("pub/archive/" + pth), "true", "false"})
+		// Another archive sharing the source bucket.
+		w.Write([]string{"src", url.QueryEscape("other/" + pth), "true", "false"})
+	}
+	w.Write([]string{"src", url.QueryEscape("pub/archive/README"), "true", "false"})
+	w.Flush()
+
+	inv := MakeMockBackend(nil)
+	inv.PutFile("inv/data/1.csv.gz", ioutil.NopCloser(bytes.NewReader(gzipped(rows.Bytes()))))
+	manifest := `{"sourceBucket": "src", "fileFormat": "CSV",
+		"fileSchema": "Bucket, Key, IsLatest, IsDeleteMarker",
+		"files": [{"key": "inv/data/1.csv.gz"}]}`
+	inv.PutFile("inv/manifest.json", ioutil.NopCloser(strings.NewReader(manifest)))
+
+	again := ConnectBackend(arch.backend, nil)
+	assert.Nil(t, again.IngestS3Inventory(inv, "inv/manifest.json", "/pub/archive/"))
+	opts := testOptions()
+	missing := again.CheckCheckpointFilesMissing(opts)
+	assert.Equal(t, []uint32{0xff}, missing["ledger"])
+	assert.Empty(t, missing["history"])
+	assert.Nil(t, again.ScanBuckets(opts))
+	assert.Equal(t, map[Hash]bool{gone:true}, again.CheckBucketsMissing())
+
+	inv.PutFile("inv/manifest.json", ioutil.NopCloser(strings.NewReader(
+		`{"fileFormat": "ORC", "fileSchema": "", "files": []}`)))
+	assert.Error(t, again.IngestS3Inventory(inv, "inv/manifest.json", ""))
+}
@@ -5,12 +5,15 @@
 package archivist
 
 import (
-	"log"
 	"fmt"
 	"sync"
 	"sync/atomic"
 	"strings"
 	"errors"
+	"sort"
+	"regexp"
+	"strconv"
+	"time"
 )
 
 type scanCheckpointFastReq struct {
@@ -23,14 +26,56 @@ type scanCheckpointSlowReq struct {
 	checkpoint uint32
 }
 
+// Returned by a scan that used up its CommandOptions.Deadline before it
+// finished, and so covered only part of its range.
+var ErrScanIncomplete = errors.New("Scan stopped at its deadline, incomplete")
+
+// The time by which a scan with a Deadline must stop making requests; the
+// zero value never passes.
+type scanDeadline time.Time
+
+func newScanDeadline(d time.Duration) scanDeadline {
+	if d == 0 {
+		return scanDeadline{}
+	}
+	return scanDeadline(time.Now().Add(d))
+}
+
+func (d scanDeadline) passed() bool {
+	t := time.Time(d)
+	return !t.IsZero() && time.Now().After(t)
+}
+
+// Returns a channel closed once the deadline passes, to stop listings
+// already under way, and a function releasing its timer. With no deadline
+// the channel is nil, and never closes.
+func (d scanDeadline) expiry() (<-chan struct{}, func()) {
+	t := time.Time(d)
+	if t.IsZero() {
+		return nil, func() {}
+	}
+	ch := make(chan struct{})
+	timer := time.AfterFunc(time.Until(t), func() { close(ch) })
+	return ch, func() { timer.Stop() }
+}
+
 func (arch *Archive) ScanCheckpoints(opts *CommandOptions) error {
+	opts.scanDeadline = newScanDeadline(opts.Deadline)
+	return arch.scanCheckpoints(opts)
+}
+
+// As ScanCheckpoints, but within the deadline already set in opts.
+func (arch *Archive) scanCheckpoints(opts *CommandOptions) error {
 	state, e := arch.GetRootHAS()
 	if e != nil {
 		return e
 	}
 	opts.Range = opts.Range.Clamp(state.Range())
+	return arch.scanCheckpointsInRange(opts)
+}
 
-	log.Printf("Scanning checkpoint files in range: %s", opts.Range)
+func (arch *Archive) scanCheckpointsInRange(opts *CommandOptions) error {
+	logf("Scanning checkpoint files in range: %s", opts.Range)
 
 	if arch.backend.CanListFiles() {
 		return arch.ScanCheckpointsFast(opts)
@@ -46,6 +91,7 @@ func (arch *Archive) ScanCheckpointsSlow(opts *CommandOptions) error {
 	}
 
 	var errs uint32
+	verify := newVerifyLimiter(opts.VerifyConcurrency)
 	tick := makeTicker(func(_ uint){
 		arch.ReportCheckpointStats()
 	})
@@ -53,16 +99,26 @@ func (arch *Archive) ScanCheckpointsSlow(opts *CommandOptions) error {
 	var wg sync.WaitGroup
 	wg.Add(opts.Concurrency)
 
+	// Unbuffered, so the request generator never runs ahead of the workers.
 	req := make(chan scanCheckpointSlowReq)
 
-	cats := Categories()
+	cats := arch.Categories()
+	var incomplete bool
 	go func() {
+		defer close(req)
 		for _, cat := range cats {
-			for chk := range opts.Range.Checkpoints() {
+			err := opts.Range.EachCheckpoint(func(chk uint32) error {
+				if opts.scanDeadline.passed() {
+					return ErrScanIncomplete
+				}
 				req <- scanCheckpointSlowReq{category:cat, checkpoint:chk}
+				return nil
+			})
+			if err != nil {
+				incomplete = true
+				return
 			}
 		}
-		close(req)
 	}()
 
 	for i := 0; i < opts.Concurrency; i++ {
@@ -76,9 +132,8 @@ func (arch *Archive) ScanCheckpointsSlow(opts *CommandOptions) error {
 				tick <- true
 				arch.NoteCheckpointFile(r.category, r.checkpoint, exists)
 				if exists && opts.Verify {
-					atomic.AddUint32(&errs,
-						noteError(arch.VerifyCategoryCheckpoint(r.category,
-							r.checkpoint)))
+					atomic.AddUint32(&errs, countVerifyFailure(opts,
+						arch.verifyScannedCheckpoint(verify, r.category, r.checkpoint)))
 				}
 			}
 			wg.Done()
@@ -87,39 +142,62 @@ func (arch *Archive) ScanCheckpointsSlow(opts *CommandOptions) error {
 
 	wg.Wait()
 	close(tick)
-	log.Printf("Checkpoint files scanned with %d errors", errs)
+	logf("Checkpoint files scanned with %d errors", errs)
 	arch.ReportCheckpointStats()
 	if errs != 0 {
 		return fmt.Errorf("%d errors scanning checkpoints", errs)
 	}
+	if incomplete {
+		return ErrScanIncomplete
+	}
 	return nil
 }
 
 
+func scanPrefixes(opts *CommandOptions) []string {
+	if opts.ListPrefixDepth == 0 {
+		return RangePaths(opts.Range)
+	}
+	return RangePathsAtDepth(opts.Range, opts.ListPrefixDepth)
+}
+
 func (arch *Archive) ScanCheckpointsFast(opts *CommandOptions) error {
 
 	if opts.Concurrency == 0 {
 		return errors.New("Zero concurrency")
 	}
+	if !arch.backend.CanListFiles() {
+		return ErrListingUnsupported
+	}
 
 	var errs uint32
+	verify := newVerifyLimiter(opts.VerifyConcurrency)
 	tick := makeTicker(func(_ uint){
 		arch.ReportCheckpointStats()
 	})
 
+	expired, stop := opts.scanDeadline.expiry()
+	defer stop()
+
 	var wg sync.WaitGroup
 	wg.Add(opts.Concurrency)
 
+	// Unbuffered, so the request generator never runs ahead of the workers.
 	req := make(chan scanCheckpointFastReq)
 
-	cats := Categories()
+	cats := arch.Categories()
+	var incomplete uint32
 	go func() {
+		defer close(req)
 		for _, cat := range cats {
-			for _, pth := range RangePaths(opts.Range) {
+			for _, pth := range scanPrefixes(opts) {
+				if opts.scanDeadline.passed() {
+					atomic.StoreUint32(&incomplete, 1)
+					return
+				}
 				req <- scanCheckpointFastReq{category:cat, pathprefix:pth}
 			}
 		}
-		close(req)
 	}()
 
 	for i := 0; i < opts.Concurrency; i++ {
@@ -129,16 +207,20 @@ func (arch *Archive) ScanCheckpointsFast(opts *CommandOptions) error {
 				if !ok {
 					break
 				}
-				ch, es := arch.ListCategoryCheckpoints(r.category, r.pathprefix)
+				ch, es := arch.ListCategoryCheckpointsUntil(r.category, r.pathprefix, expired)
 				for n := range ch {
 					tick <- true
 					arch.NoteCheckpointFile(r.category, n, true)
 					if opts.Verify {
-						atomic.AddUint32(&errs,
-							noteError(arch.VerifyCategoryCheckpoint(r.category, n)))
+						atomic.AddUint32(&errs, countVerifyFailure(opts,
+							arch.verifyScannedCheckpoint(verify, r.category, n)))
 					}
 				}
 				atomic.AddUint32(&errs, drainErrors(es))
+				// The listing may have been cut short.
+				if opts.scanDeadline.passed() {
+					atomic.StoreUint32(&incomplete, 1)
+				}
 			}
 			wg.Done()
 		}()
@@ -146,16 +228,30 @@ func (arch *Archive) ScanCheckpointsFast(opts *CommandOptions) error {
 
 	wg.Wait()
 	close(tick)
-	log.Printf("Checkpoint files scanned with %d errors", errs)
+	logf("Checkpoint files scanned with %d errors", errs)
 	arch.ReportCheckpointStats()
 	if errs != 0 {
 		return fmt.Errorf("%d errors scanning checkpoints", errs)
 	}
+	if incomplete != 0 {
+		return ErrScanIncomplete
+	}
 	return nil
 }
 
 func (arch *Archive) Scan(opts *CommandOptions) error {
-	e1 := arch.ScanCheckpoints(opts)
+	span := startRangeSpan(opts, "archivist.Scan")
+	finish := startMetrics(opts, "scan")
+	err := arch.scan(opts)
+	finish(arch, err)
+	span.End(err)
+	return err
+}
+
+func (arch *Archive) scan(opts *CommandOptions) error {
+	// The deadline covers both halves of the scan.
+	opts.scanDeadline = newScanDeadline(opts.Deadline)
+	e1 := arch.scanCheckpoints(opts)
 	e2 := arch.ScanBuckets(opts)
 	if e1 != nil {
 		return e1
@@ -167,13 +263,18 @@ func (arch *Archive) Scan(opts *CommandOptions) error {
 }
 
 func (arch *Archive) ScanAllBuckets() error {
-	log.Printf("Scanning all buckets, and those referenced by range")
+	return arch.scanAllBucketsUntil(nil)
+}
+
+// As ScanAllBuckets, but stops listing once done is closed.
+func (arch *Archive) scanAllBucketsUntil(done <-chan struct{}) error {
+	logf("Scanning all buckets, and those referenced by range")
 
 	tick := makeTicker(func(_ uint){
 		arch.ReportBucketStats()
 	})
 
-	allBuckets, ech := arch.ListAllBucketHashes()
+	allBuckets, ech := arch.ListAllBucketHashesUntil(done)
 
 	for b := range allBuckets {
 		arch.NoteExistingBucket(b)
@@ -193,13 +294,38 @@ func (arch *Archive) ScanBuckets(opts *CommandOptions) error {
 		return errors.New("Zero concurrency")
 	}
 
-	var errs uint32
+	var errs, incomplete uint32
+	verify := newVerifyLimiter(opts.VerifyConcurrency)
+
+	if opts.BucketSetFile != "" && opts.BucketBloomBits != 0 {
+		return errBucketSetBloom
+	}
+
+	if opts.BucketBloomBits != 0 {
+		arch.mutex.Lock()
+		if arch.allBucketsBloom == nil {
+			arch.allBucketsBloom = newBucketBloom(opts.BucketBloomBits)
+		}
+		arch.mutex.Unlock()
+	}
 
 	// First scan _all_ buckets if we can; if not, we'll do an exists-check
-	// on each bucket as we go. But this is faster when we can do it.
+	// on each bucket as we go. But this is faster when we can do it. The
+	// set is loaded before the prefetch starts, as failing to load it
+	// returns.
 	doList := arch.backend.CanListFiles()
-	if doList {
-		errs += noteError(arch.ScanAllBuckets())
+	arch.mutex.Lock()
+	ingested := arch.bucketsIngested
+	arch.mutex.Unlock()
+	loadedSet := false
+	if opts.BucketSetFile != "" {
+		var e error
+		loadedSet, e = arch.LoadBucketSet(opts.BucketSetFile)
+		if e != nil {
+			return e
+		}
+		// Only the referenced buckets not in the set need checking.
+		doList = doList && !loadedSet
 	}
 
 	// Grab the set of checkpoints we have HASs for, to read references.
@@ -213,6 +339,28 @@ func (arch *Archive) ScanBuckets(opts *CommandOptions) error {
 	}
 	arch.mutex.Unlock()
 
+	// Closed at the deadline, to stop the prefetch and the listing.
+	expired, stop := opts.scanDeadline.expiry()
+	defer stop()
+
+	// Prefetching starts now, so the HAS fetches overlap the listing.
+	var fetched chan fetchedHAS
+	if opts.HASPrefetch > 0 {
+		fetched = arch.prefetchHAS(seqs, opts.Concurrency, opts.HASPrefetch, expired, func() {
+			atomic.StoreUint32(&incomplete, 1)
+		})
+	}
+
+	if doList && !ingested {
+		errs += noteError(arch.scanAllBucketsUntil(expired))
+		// The listing may have been cut short.
+		if opts.scanDeadline.passed() {
+			atomic.StoreUint32(&incomplete, 1)
+		}
+	}
+	// An ingested listing is as good as one made now.
+	doList = doList || ingested
+
 	var wg sync.WaitGroup
 	wg.Add(opts.Concurrency)
 
@@ -220,93 +368,227 @@ func (arch *Archive) ScanBuckets(opts *CommandOptions) error {
 		arch.ReportBucketStats()
 	})
 
-	// Make a bunch of goroutines that pull each HAS and enumerate
-	// its buckets into a channel. These are the _referenced_ buckets.
-	req := make(chan uint32)
-	go func() {
-		for _, seq := range seqs {
-			req <- seq
-		}
-		close(req)
-	}()
-	for i := 0; i < opts.Concurrency; i++ {
-		go func() {
-			for {
-				ix, ok := <- req
-				if !ok {
-					break
-				}
-				has, e := arch.GetCheckpointHAS(ix)
-				atomic.AddUint32(&errs, noteError(e))
-				for _, bucket := range has.Buckets() {
-					new := arch.NoteReferencedBucket(bucket)
-					if !new {
-						continue
-					}
+	noteReferences := func(has HistoryArchiveState) {
+		for _, bucket := range has.Buckets() {
+			new := arch.NoteReferencedBucket(bucket)
+			if !new {
+				continue
+			}
 
-					if !doList || opts.Verify {
-						if arch.BucketExists(bucket) {
-							if !doList {
-								arch.NoteExistingBucket(bucket)
-							}
-							if opts.Verify {
-								n := uint32(0)
-								if opts.Thorough {
-									n = noteError(arch.VerifyBucketEntries(bucket))
-								} else {
-									n = noteError(arch.VerifyBucketHash(bucket))
-								}
-								atomic.AddUint32(&errs, n)
-								if n != 0 {
-									arch.mutex.Lock()
-									arch.invalidBuckets++
-									arch.mutex.Unlock()
-								}
+			if !doList || opts.Verify {
+				// Buckets in a loaded set are taken to still be there.
+				known := loadedSet && arch.bucketNoted(bucket)
+				if known || arch.BucketExists(bucket) {
+					if !doList && !known {
+						arch.NoteExistingBucket(bucket)
+					}
+					if opts.Verify {
+						err := verify.run(func() error {
+							if opts.Thorough {
+								return arch.VerifyBucketEntries(bucket)
 							}
+							return arch.VerifyBucketHash(bucket)
+						})
+						atomic.AddUint32(&errs, countVerifyFailure(opts, err))
+						if err != nil {
+							arch.mutex.Lock()
+							arch.invalidBuckets++
+							arch.corruptBuckets[bucket] = true
+							arch.mutex.Unlock()
 						}
 					}
 				}
-				tick <- true
 			}
-			wg.Done()
+		}
+		tick <- true
+	}
+
+	if fetched != nil {
+		for i := 0; i < opts.Concurrency; i++ {
+			go func() {
+				for f := range fetched {
+					// Fetches past the deadline are drained, unread.
+					if opts.scanDeadline.passed() {
+						atomic.StoreUint32(&incomplete, 1)
+						continue
+					}
+					atomic.AddUint32(&errs, noteError(f.err))
+					noteReferences(f.has)
+				}
+				wg.Done()
+			}()
+		}
+	} else {
+		// Make a bunch of goroutines that pull each HAS and enumerate
+		// its buckets into a channel. These are the _referenced_ buckets.
+		req := make(chan uint32)
+		go func() {
+			for _, seq := range seqs {
+				if opts.scanDeadline.passed() {
+					atomic.StoreUint32(&incomplete, 1)
+					break
+				}
+				req <- seq
+			}
+			close(req)
 		}()
+		for i := 0; i < opts.Concurrency; i++ {
+			go func() {
+				for {
+					ix, ok := <- req
+					if !ok {
+						break
+					}
+					has, e := arch.GetCheckpointHAS(ix)
+					atomic.AddUint32(&errs, noteError(e))
+					noteReferences(has)
+				}
+				wg.Done()
+			}()
+		}
 	}
 
 	wg.Wait()
 	arch.ReportBucketStats()
 	close(tick)
+	if opts.BucketSetFile != "" {
+		errs += noteError(arch.SaveBucketSet(opts.BucketSetFile))
+	}
 	if errs != 0 {
 		return fmt.Errorf("%d errors while scanning buckets", errs)
 	}
+	if incomplete != 0 {
+		return ErrScanIncomplete
+	}
+	arch.mutex.Lock()
+	arch.bucketsScanned = true
+	arch.bucketsScannedRange = opts.Range
+	arch.mutex.Unlock()
 	return nil
 }
 
+type fetchedHAS struct {
+	has HistoryArchiveState
+	err error
+}
+
+// Fetches the HAS of each of seqs with concurrency fetchers, delivering
+// them, in no particular order, through a channel that holds up to depth
+// fetched but not yet consumed. Once done is closed no more fetches start,
+// those finishing may be dropped, and stopped is called if any of seqs
+// were left unfetched; the channel closes either way.
+func (arch *Archive) prefetchHAS(seqs []uint32, concurrency int, depth int,
+	done <-chan struct{}, stopped func()) chan fetchedHAS {
+	out := make(chan fetchedHAS, depth)
+	req := make(chan uint32)
+	go func() {
+		defer close(req)
+		for _, seq := range seqs {
+			select {
+			case req <- seq:
+			case <-done:
+				stopped()
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			for ix := range req {
+				has, e := arch.GetCheckpointHAS(ix)
+				select {
+				case out <- fetchedHAS{has: has, err: e}:
+				case <-done:
+				}
+			}
+			wg.Done()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
 func (arch* Archive) ClearCachedInfo() {
 	arch.mutex.Lock()
 	defer arch.mutex.Unlock()
-	for _, cat := range Categories() {
+	for _, cat := range arch.Categories() {
 		arch.checkpointFiles[cat] = make(map[uint32]bool)
 	}
 	arch.allBuckets = make(map[Hash]bool)
+	arch.allBucketsBloom = nil
 	arch.referencedBuckets = make(map[Hash]bool)
+	arch.bucketsIngested = false
+	arch.bucketsScanned = false
+	arch.corruptCheckpointFiles = make(map[string](map[uint32]bool))
+	arch.corruptBuckets = make(map[Hash]bool)
+}
+
+// Notes the files in paths, a complete listing of the archive obtained some
+// other way (an S3 inventory report, say), in the scan state as a fast scan
+// would, classifying them by the same patterns; other paths are ignored.
+// CheckCheckpointFilesMissing then works without listing the archive, as
+// does ScanBuckets, which still reads the checkpoint HAS files for their
+// references but takes the buckets present from the listing. Paths may
+// carry a prefix before the archive root, as backend listings do. Reads
+// paths until it is closed.
+func (arch *Archive) IngestListing(paths <-chan string) error {
+	cats := arch.Categories()
+	rxs := make([]*regexp.Regexp, len(cats))
+	for i, cat := range cats {
+		rxs[i] = arch.categoryFileRx(cat)
+	}
+	var errs uint32
+	for pth := range paths {
+		if m := bucketFileRx.FindStringSubmatch(pth); m != nil {
+			arch.NoteExistingBucket(MustDecodeHash(m[1]))
+			continue
+		}
+		for i, rx := range rxs {
+			m := rx.FindStringSubmatch(pth)
+			if m == nil {
+				continue
+			}
+			n, e := strconv.ParseUint(m[1], 16, 32)
+			if e != nil {
+				errs += noteError(errors.New("decoding checkpoint number in filename " + pth))
+			} else {
+				arch.NoteCheckpointFile(cats[i], uint32(n), true)
+			}
+			break
+		}
+	}
+	arch.mutex.Lock()
+	arch.bucketsIngested = true
+	arch.mutex.Unlock()
+	arch.ReportCheckpointStats()
+	arch.ReportBucketStats()
+	if errs != 0 {
+		return fmt.Errorf("%d errors while ingesting listing", errs)
+	}
+	return nil
 }
 
 func (arch* Archive) ReportCheckpointStats() {
 	arch.mutex.Lock()
 	defer arch.mutex.Unlock()
 	s := make([]string, 0)
-	for _, cat := range Categories() {
+	for _, cat := range arch.Categories() {
 		tab := arch.checkpointFiles[cat]
 		s = append(s, fmt.Sprintf("%d %s", len(tab), cat))
 	}
-	log.Printf("Archive: %s", strings.Join(s, ", "))
+	logf("Archive: %s", strings.Join(s, ", "))
 }
 
 func (arch* Archive) ReportBucketStats() {
 	arch.mutex.Lock()
 	defer arch.mutex.Unlock()
-	log.Printf("Archive: %d buckets total, %d referenced",
-		len(arch.allBuckets), len(arch.referencedBuckets))
+	logf("Archive: %d buckets total, %d referenced",
+		arch.existingBucketCountLocked(), len(arch.referencedBuckets))
 }
 
 func (arch *Archive) NoteCheckpointFile(cat string, chk uint32, present bool) {
@@ -315,10 +597,59 @@ func (arch *Archive) NoteCheckpointFile(cat string, chk uint32, present bool) {
 	arch.checkpointFiles[cat][chk] = present
 }
 
+// Counts a verification failure of the scan opts is for as an error,
+// unless opts.tolerateCorrupt; either way it's logged.
+func countVerifyFailure(opts *CommandOptions, err error) uint32 {
+	if err != nil && opts.tolerateCorrupt {
+		logf("Corrupt: %s", err)
+		return 0
+	}
+	return noteError(err)
+}
+
+// Verifies cat's file for chk once verify has a slot, noting the file
+// corrupt if it fails, for Repair with RepairCorrupt.
+func (arch *Archive) verifyScannedCheckpoint(verify verifyLimiter, cat string, chk uint32) error {
+	err := verify.run(func() error {
+		return arch.VerifyCategoryCheckpoint(cat, chk)
+	})
+	if err != nil {
+		arch.mutex.Lock()
+		if arch.corruptCheckpointFiles[cat] == nil {
+			arch.corruptCheckpointFiles[cat] = make(map[uint32]bool)
+		}
+		arch.corruptCheckpointFiles[cat][chk] = true
+		arch.mutex.Unlock()
+	}
+	return err
+}
+
 func (arch *Archive) NoteExistingBucket(bucket Hash) {
 	arch.mutex.Lock()
 	defer arch.mutex.Unlock()
-	arch.allBuckets[bucket] = true
+	if arch.allBucketsBloom != nil {
+		arch.allBucketsBloom.Add(bucket)
+	} else {
+		arch.allBuckets[bucket] = true
+	}
+}
+
+// Reports whether the scan saw bucket; with a bloom filter in use, a true
+// result may be a false positive. Requires arch.mutex.
+func (arch *Archive) bucketExistsLocked(bucket Hash) bool {
+	if arch.allBucketsBloom != nil && arch.allBucketsBloom.Has(bucket) {
+		return true
+	}
+	return arch.allBuckets[bucket]
+}
+
+// Requires arch.mutex. Approximate when a bloom filter is in use.
+func (arch *Archive) existingBucketCountLocked() int {
+	n := len(arch.allBuckets)
+	if arch.allBucketsBloom != nil {
+		n += arch.allBucketsBloom.count
+	}
+	return n
 }
 
 func (arch *Archive) NoteReferencedBucket(bucket Hash) bool {
@@ -334,64 +665,254 @@ func (arch *Archive) NoteReferencedBucket(bucket Hash) bool {
 
 
 func (arch *Archive) CheckCheckpointFilesMissing(opts *CommandOptions) map[string][]uint32 {
+	// EachCheckpoint runs no goroutine, so is safe under the mutex, as
+	// Checkpoints() would not be.
 	arch.mutex.Lock()
 	defer arch.mutex.Unlock()
 	missing := make(map[string][]uint32)
-	for _, cat := range Categories() {
+	for _, cat := range arch.Categories() {
 		missing[cat] = make([]uint32, 0)
-		for ix := range opts.Range.Checkpoints() {
-			_, ok := arch.checkpointFiles[cat][ix]
-			if !ok {
+		opts.Range.EachCheckpoint(func(ix uint32) error {
+			// The slow scan records absent files as false, so a
+			// false entry is as missing as no entry at all.
+			if !arch.checkpointFiles[cat][ix] {
 				missing[cat] = append(missing[cat], ix)
 			}
-		}
+			return nil
+		})
 	}
 	return missing
 }
 
+// Returns, in order, the checkpoints in rng that the scan found files for
+// in at least one category, but not in cat: the checkpoints whose writing
+// was interrupted part-way, as far as cat is concerned. Checkpoints with no
+// files at all aren't included.
+func (arch *Archive) CheckpointsMissingCategory(cat string, rng Range) []uint32 {
+	arch.mutex.Lock()
+	defer arch.mutex.Unlock()
+	res := []uint32{}
+	rng.EachCheckpoint(func(ix uint32) error {
+		if arch.checkpointFiles[cat][ix] {
+			return nil
+		}
+		for _, other := range arch.Categories() {
+			if arch.checkpointFiles[other][ix] {
+				res = append(res, ix)
+				break
+			}
+		}
+		return nil
+	})
+	return res
+}
 
+// Returns, per category, the missing checkpoints in rng coalesced into
+// ranges of consecutive checkpoints. Requires a prior scan.
+func (arch *Archive) MissingRanges(rng Range) (map[string][]Range, error) {
+	opts := &CommandOptions{Range:rng}
+	ranges := make(map[string][]Range)
+	for cat, missing := range arch.CheckCheckpointFilesMissing(opts) {
+		ranges[cat] = coalesceCheckpoints(missing)
+	}
+	return ranges, nil
+}
+
+// Number of bloom filter hits CheckBucketsMissing confirms at once.
+const bloomConfirmConcurrency = 32
+
+// Returns the referenced buckets the scan didn't find. A referenced bucket
+// found only by a bloom filter, which may be a false positive, is
+// confirmed with an Exists check, and noted exactly once confirmed, so a
+// missing bucket is never hidden and each is checked once.
 func (arch* Archive) CheckBucketsMissing() map[Hash]bool {
 	arch.mutex.Lock()
-	defer arch.mutex.Unlock()
 	missing := make(map[Hash]bool)
+	var hits []Hash
 	for k, _ := range arch.referencedBuckets {
-		_, ok := arch.allBuckets[k]
-		if !ok {
+		if arch.allBuckets[k] {
+			continue
+		}
+		if arch.allBucketsBloom != nil && arch.allBucketsBloom.Has(k) {
+			hits = append(hits, k)
+		} else {
 			missing[k] = true
 		}
 	}
+	arch.mutex.Unlock()
+	if len(hits) == 0 {
+		return missing
+	}
+
+	req := make(chan Hash)
+	go func() {
+		for _, k := range hits {
+			req <- k
+		}
+		close(req)
+	}()
+	var wg sync.WaitGroup
+	wg.Add(bloomConfirmConcurrency)
+	for i := 0; i < bloomConfirmConcurrency; i++ {
+		go func() {
+			for k := range req {
+				exists := arch.backend.Exists(BucketPath(k))
+				arch.mutex.Lock()
+				if exists {
+					arch.allBuckets[k] = true
+				} else {
+					missing[k] = true
+				}
+				arch.mutex.Unlock()
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
 	return missing
 }
 
+// Number of HAS reads UnreferencedBuckets keeps in flight.
+const unreferencedConcurrency = 32
+
+// The complement of CheckBucketsMissing: returns the buckets a prior scan
+// found present that no checkpoint of rng the scan found references. The
+// references are read afresh from those checkpoints' HAS files, so rng may
+// be narrower than the range scanned. Unlike GCPreview this trusts the
+// scan's bucket listing rather than listing again, and doesn't count the
+// root HAS's buckets as referenced. Needs a completed scan that saw every
+// bucket: one that listed, or ingested a listing, and kept no bloom filter.
+// rng must lie within the range that scan covered, as checkpoints outside
+// it aren't known to exist and their references would go unread.
+func (arch *Archive) UnreferencedBuckets(rng Range) (map[Hash]bool, error) {
+	unreferenced := make(map[Hash]bool)
+	arch.mutex.Lock()
+	if !arch.bucketsScanned {
+		arch.mutex.Unlock()
+		return unreferenced, fmt.Errorf("Finding unreferenced buckets needs a completed bucket scan")
+	}
+	scanned := arch.bucketsScannedRange
+	if NextCheckpoint(rng.Low) < scanned.Low || NextCheckpoint(rng.High) > scanned.High {
+		arch.mutex.Unlock()
+		return unreferenced, fmt.Errorf("Range %s isn't within the scanned range %s", rng, scanned)
+	}
+	if arch.allBucketsBloom != nil {
+		arch.mutex.Unlock()
+		return unreferenced, fmt.Errorf("Unreferenced buckets can't be found from a bloom filter")
+	}
+	if !arch.backend.CanListFiles() && !arch.bucketsIngested {
+		arch.mutex.Unlock()
+		return unreferenced, fmt.Errorf("Finding unreferenced buckets needs a scan that listed them")
+	}
+	chks := []uint32{}
+	rng.EachCheckpoint(func(ix uint32) error {
+		if arch.checkpointFiles["history"][ix] {
+			chks = append(chks, ix)
+		}
+		return nil
+	})
+	arch.mutex.Unlock()
+
+	refs, err := arch.collectReferencedBuckets(chks, unreferencedConcurrency)
+	if err != nil {
+		return unreferenced, err
+	}
+	arch.mutex.Lock()
+	defer arch.mutex.Unlock()
+	for bucket, present := range arch.allBuckets {
+		if present && !refs[bucket] {
+			unreferenced[bucket] = true
+		}
+	}
+	return unreferenced, nil
+}
+
+// Returns, per category, the checkpoints in opts.Range whose files a scan
+// with Verify found present but failing verification.
+func (arch *Archive) CheckCheckpointFilesCorrupt(opts *CommandOptions) map[string][]uint32 {
+	arch.mutex.Lock()
+	defer arch.mutex.Unlock()
+	corrupt := make(map[string][]uint32)
+	for _, cat := range arch.Categories() {
+		corrupt[cat] = make([]uint32, 0)
+		opts.Range.EachCheckpoint(func(ix uint32) error {
+			if arch.corruptCheckpointFiles[cat][ix] {
+				corrupt[cat] = append(corrupt[cat], ix)
+			}
+			return nil
+		})
+	}
+	return corrupt
+}
+
+// Returns the referenced buckets that a scan with Verify found present
+// but failing verification.
+func (arch* Archive) CheckBucketsCorrupt() map[Hash]bool {
+	arch.mutex.Lock()
+	defer arch.mutex.Unlock()
+	corrupt := make(map[Hash]bool)
+	for k, _ := range arch.corruptBuckets {
+		corrupt[k] = true
+	}
+	return corrupt
+}
+
+// A serializable summary of what a scan found missing: per category, the
+// missing checkpoints coalesced into ranges, and the referenced buckets
+// that are absent.
+type MissingReport struct {
+	Range Range                    `json:"range"`
+	Checkpoints map[string][]Range `json:"checkpoints"`
+	Buckets []Hash                 `json:"buckets"`
+}
+
+// Builds a MissingReport for rng from the scan state. Requires a prior scan.
+func (arch *Archive) MissingReport(rng Range) (MissingReport, error) {
+	report := MissingReport{Range:rng}
+	logf("Examining checkpoint files for gaps")
+	ranges, err := arch.MissingRanges(rng)
+	if err != nil {
+		return report, err
+	}
+	report.Checkpoints = ranges
+	logf("Examining buckets referenced by checkpoints")
+	report.Buckets = []Hash{}
+	for bucket := range arch.CheckBucketsMissing() {
+		report.Buckets = append(report.Buckets, bucket)
+	}
+	sort.Sort(byHashString(report.Buckets))
+	return report, nil
+}
+
 func (arch *Archive) ReportMissing(opts *CommandOptions) error {
 
-	log.Printf("Examining checkpoint files for gaps")
-	missingCheckpointFiles := arch.CheckCheckpointFilesMissing(opts)
-	log.Printf("Examining buckets referenced by checkpoints")
-	missingBuckets := arch.CheckBucketsMissing()
+	report, err := arch.MissingReport(opts.Range)
+	if err != nil {
+		return err
+	}
 
 	missingCheckpoints := false
-	for cat, missing := range missingCheckpointFiles {
-		if !categoryRequired(cat) {
+	for cat, missing := range report.Checkpoints {
+		if !arch.categoryRequired(cat) {
 			continue
 		}
 		if len(missing) != 0 {
-			s := fmtRangeList(missing)
+			s := fmtRanges(missing)
 			missingCheckpoints = true
-			log.Printf("Missing %s: %s", cat, s)
+			logf("Missing %s: %s", cat, s)
 		}
 	}
 
 	if !missingCheckpoints {
-		log.Printf("No checkpoint files missing in range %s", opts.Range)
+		logf("No checkpoint files missing in range %s", opts.Range)
 	}
 
-	for bucket, _ := range missingBuckets {
-		log.Printf("Missing bucket: %s", bucket)
+	for _, bucket := range report.Buckets {
+		logf("Missing bucket: %s", bucket)
 	}
 
-	if len(missingBuckets) == 0 {
-		log.Printf("No missing buckets referenced in range %s", opts.Range)
+	if len(report.Buckets) == 0 {
+		logf("No missing buckets referenced in range %s", opts.Range)
 	}
 
 	return nil
@@ -0,0 +1,111 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Number of size lookups and HAS reads StorageBreakdown keeps in flight.
+const storageConcurrency = 32
+
+type storageReq struct {
+	pth string
+	total *int64
+}
+
+// Looks up the size of each file sent on req, adding it to the request's
+// total, and returns the number of lookups that failed. A file that isn't
+// there takes no space, so isn't a failure.
+func sumFileSizes(a *Archive, req chan storageReq) uint32 {
+	var errs uint32
+	var wg sync.WaitGroup
+	wg.Add(storageConcurrency)
+	for i := 0; i < storageConcurrency; i++ {
+		go func() {
+			for r := range req {
+				sz, e := a.backend.GetFileSize(r.pth)
+				if e != nil {
+					if a.backend.Exists(r.pth) {
+						atomic.AddUint32(&errs, noteError(e))
+					}
+					continue
+				}
+				atomic.AddInt64(r.total, sz)
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// Sums the sizes of the checkpoint files of rng by category, and of the
+// buckets their HAS files reference under "bucket", each bucket counted
+// once however many checkpoints share it. Sizes are looked up one file at
+// a time (HEAD requests on S3), storageConcurrency at once, so this works
+// on backends that can't list; files that are missing are left out.
+func (a *Archive) StorageBreakdown(rng Range) (map[string]int64, error) {
+	totals := make(map[string]*int64)
+	for _, cat := range append(a.Categories(), "bucket") {
+		totals[cat] = new(int64)
+	}
+
+	var mutex sync.Mutex
+	buckets := make(map[Hash]bool)
+	var errs uint32
+	req := make(chan storageReq)
+	go func() {
+		var wg sync.WaitGroup
+		chks := rng.Checkpoints()
+		wg.Add(storageConcurrency)
+		for i := 0; i < storageConcurrency; i++ {
+			go func() {
+				for chk := range chks {
+					for _, cat := range a.Categories() {
+						req <- storageReq{pth: a.CategoryCheckpointPath(cat, chk), total: totals[cat]}
+					}
+					if !a.CategoryCheckpointExists("history", chk) {
+						continue
+					}
+					has, e := a.GetCheckpointHAS(chk)
+					if e != nil {
+						atomic.AddUint32(&errs, noteError(e))
+						continue
+					}
+					mutex.Lock()
+					for _, bucket := range has.Buckets() {
+						buckets[bucket] = true
+					}
+					mutex.Unlock()
+				}
+				wg.Done()
+			}()
+		}
+		wg.Wait()
+		close(req)
+	}()
+	errs += sumFileSizes(a, req)
+
+	req = make(chan storageReq)
+	go func() {
+		for bucket := range buckets {
+			req <- storageReq{pth: BucketPath(bucket), total: totals["bucket"]}
+		}
+		close(req)
+	}()
+	errs += sumFileSizes(a, req)
+
+	sizes := make(map[string]int64)
+	for k, v := range totals {
+		sizes[k] = *v
+	}
+	if errs != 0 {
+		return sizes, fmt.Errorf("%d errors while summing storage", errs)
+	}
+	return sizes, nil
+}
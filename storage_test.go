@@ -0,0 +1,46 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorageBreakdown(t *testing.T) {
+	defer cleanup()
+	arch := GetRandomPopulatedArchive()
+	expect := make(map[string]int64)
+	buckets := make(map[Hash]bool)
+	for chk := range testRange().Checkpoints() {
+		for _, cat := range arch.Categories() {
+			sz, err := arch.backend.GetFileSize(arch.CategoryCheckpointPath(cat, chk))
+			assert.NoError(t, err)
+			expect[cat] += sz
+		}
+		has, err := arch.GetCheckpointHAS(chk)
+		assert.NoError(t, err)
+		for _, bucket := range has.Buckets() {
+			buckets[bucket] = true
+		}
+	}
+	for bucket := range buckets {
+		sz, err := arch.BucketSize(bucket)
+		assert.NoError(t, err)
+		expect["bucket"] += sz
+	}
+	sizes, err := arch.StorageBreakdown(testRange())
+	assert.NoError(t, err)
+	assert.Equal(t, expect, sizes)
+	assert.NotEqual(t, int64(0), sizes["bucket"])
+
+	// Missing files take no space.
+	ledger := arch.CategoryCheckpointPath("ledger", 0x7f)
+	sz, _ := arch.backend.GetFileSize(ledger)
+	assert.NoError(t, arch.backend.DeleteFile(ledger))
+	sizes, err = arch.StorageBreakdown(testRange())
+	assert.NoError(t, err)
+	assert.Equal(t, expect["ledger"] - sz, sizes["ledger"])
+}
@@ -0,0 +1,219 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"io"
+	"time"
+)
+
+// Receives spans for archivist operations and backend calls, so they can
+// be forwarded to a tracing system such as OpenTelemetry without the
+// archivist depending on it. Attribute keys are "path" for backend calls
+// and "range" for operations.
+type Tracer interface {
+	StartSpan(name string, attrs map[string]string) Span
+}
+
+// Ended exactly once, with the error the traced call returned, if any.
+type Span interface {
+	End(err error)
+}
+
+type nopSpan struct{}
+
+func (nopSpan) End(error) {}
+
+func startRangeSpan(opts *CommandOptions, name string) Span {
+	if opts.Tracer == nil {
+		return nopSpan{}
+	}
+	return opts.Tracer.StartSpan(name, map[string]string{"range": opts.Range.String()})
+}
+
+// A backend that traces every call to another. Connect installs it when
+// ConnectOptions.Tracer is set. It forwards, and traces, each of the inner
+// backend's optional capabilities.
+type TracingArchiveBackend struct {
+	inner ArchiveBackend
+	tracer Tracer
+}
+
+func (b *TracingArchiveBackend) span(name string, pth string) Span {
+	return b.tracer.StartSpan(name, map[string]string{"path": pth})
+}
+
+func (b *TracingArchiveBackend) Exists(pth string) bool {
+	span := b.span("archivist.Exists", pth)
+	ok := b.inner.Exists(pth)
+	span.End(nil)
+	return ok
+}
+
+// The span covers the request, not the reading of the body.
+func (b *TracingArchiveBackend) GetFile(pth string) (io.ReadCloser, error) {
+	span := b.span("archivist.GetFile", pth)
+	rdr, err := b.inner.GetFile(pth)
+	span.End(err)
+	return rdr, err
+}
+
+func (b *TracingArchiveBackend) GetFileSize(pth string) (int64, error) {
+	span := b.span("archivist.GetFileSize", pth)
+	sz, err := b.inner.GetFileSize(pth)
+	span.End(err)
+	return sz, err
+}
+
+func (b *TracingArchiveBackend) PutFile(pth string, in io.ReadCloser) error {
+	span := b.span("archivist.PutFile", pth)
+	err := b.inner.PutFile(pth, in)
+	span.End(err)
+	return err
+}
+
+func (b *TracingArchiveBackend) DeleteFile(pth string) error {
+	span := b.span("archivist.DeleteFile", pth)
+	err := b.inner.DeleteFile(pth)
+	span.End(err)
+	return err
+}
+
+func (b *TracingArchiveBackend) RenameFile(from string, to string) error {
+	span := b.tracer.StartSpan("archivist.RenameFile",
+		map[string]string{"path": from, "to": to})
+	err := b.inner.RenameFile(from, to)
+	span.End(err)
+	return err
+}
+
+func (b *TracingArchiveBackend) ListFiles(pth string) (chan string, chan error) {
+	return b.ListFilesUntil(pth, nil)
+}
+
+// The span lasts until the listing is exhausted or abandoned.
+func (b *TracingArchiveBackend) ListFilesUntil(pth string, done <-chan struct{}) (chan string, chan error) {
+	span := b.span("archivist.ListFiles", pth)
+	sch, errs := listFilesUntil(b.inner, pth, done)
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		defer span.End(nil)
+		for s := range sch {
+			select {
+			case ch <- s:
+			case <-done:
+				drainStrings(sch)
+				return
+			}
+		}
+	}()
+	return ch, errs
+}
+
+func (b *TracingArchiveBackend) CanListFiles() bool {
+	return b.inner.CanListFiles()
+}
+
+func (b *TracingArchiveBackend) wrappedBackend() ArchiveBackend {
+	return b.inner
+}
+
+func (b *TracingArchiveBackend) FileVersion(pth string) (string, error) {
+	cond, ok := b.inner.(ConditionalPutter)
+	if !ok {
+		return "", ErrCapabilityUnsupported
+	}
+	span := b.span("archivist.FileVersion", pth)
+	version, err := cond.FileVersion(pth)
+	span.End(err)
+	return version, err
+}
+
+func (b *TracingArchiveBackend) PutFileIfVersion(pth string, version string, in io.ReadCloser) error {
+	cond, ok := b.inner.(ConditionalPutter)
+	if !ok {
+		in.Close()
+		return ErrCapabilityUnsupported
+	}
+	span := b.span("archivist.PutFileIfVersion", pth)
+	err := cond.PutFileIfVersion(pth, version, in)
+	span.End(err)
+	return err
+}
+
+// The span covers the request, not the reading of the body.
+func (b *TracingArchiveBackend) GetFileRange(pth string, offset int64, length int64) (io.ReadCloser, error) {
+	g, ok := b.inner.(RangeGetter)
+	if !ok {
+		return nil, ErrCapabilityUnsupported
+	}
+	span := b.span("archivist.GetFileRange", pth)
+	rdr, err := g.GetFileRange(pth, offset, length)
+	span.End(err)
+	return rdr, err
+}
+
+func (b *TracingArchiveBackend) GetFileModTime(pth string) (time.Time, error) {
+	g, ok := b.inner.(ModTimeGetter)
+	if !ok {
+		return time.Time{}, ErrCapabilityUnsupported
+	}
+	span := b.span("archivist.GetFileModTime", pth)
+	t, err := g.GetFileModTime(pth)
+	span.End(err)
+	return t, err
+}
+
+func (b *TracingArchiveBackend) SetFileModTime(pth string, t time.Time) error {
+	s, ok := b.inner.(ModTimeSetter)
+	if !ok {
+		return ErrCapabilityUnsupported
+	}
+	span := b.span("archivist.SetFileModTime", pth)
+	err := s.SetFileModTime(pth, t)
+	span.End(err)
+	return err
+}
+
+func (b *TracingArchiveBackend) CopyFileFrom(src ArchiveBackend, pth string) (int64, error) {
+	copier, ok := b.inner.(DirectCopier)
+	if !ok {
+		return 0, ErrDirectCopyUnsupported
+	}
+	span := b.span("archivist.CopyFileFrom", pth)
+	n, err := copier.CopyFileFrom(src, pth)
+	span.End(err)
+	return n, err
+}
+
+func (b *TracingArchiveBackend) ListPartialUploads() ([]string, error) {
+	p, ok := b.inner.(PartialUploader)
+	if !ok {
+		return nil, ErrCapabilityUnsupported
+	}
+	span := b.span("archivist.ListPartialUploads", "")
+	uploads, err := p.ListPartialUploads()
+	span.End(err)
+	return uploads, err
+}
+
+func (b *TracingArchiveBackend) AbortPartialUploads(pth string) error {
+	p, ok := b.inner.(PartialUploader)
+	if !ok {
+		return ErrCapabilityUnsupported
+	}
+	span := b.span("archivist.AbortPartialUploads", pth)
+	err := p.AbortPartialUploads(pth)
+	span.End(err)
+	return err
+}
+
+func TracingBackend(inner ArchiveBackend, tracer Tracer) ArchiveBackend {
+	return &TracingArchiveBackend{
+		inner: inner,
+		tracer: tracer,
+	}
+}
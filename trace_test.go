@@ -0,0 +1,96 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"sync"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingTracer struct {
+	mutex sync.Mutex
+	started map[string]int
+	ended map[string]int
+	failed map[string]int
+}
+
+type recordingSpan struct {
+	t *recordingTracer
+	name string
+}
+
+func newRecordingTracer() *recordingTracer {
+	return &recordingTracer{
+		started: make(map[string]int),
+		ended: make(map[string]int),
+		failed: make(map[string]int),
+	}
+}
+
+func (t *recordingTracer) StartSpan(name string, attrs map[string]string) Span {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.started[name]++
+	return &recordingSpan{t: t, name: name}
+}
+
+func (s *recordingSpan) End(err error) {
+	s.t.mutex.Lock()
+	defer s.t.mutex.Unlock()
+	s.t.ended[s.name]++
+	if err != nil {
+		s.t.failed[s.name]++
+	}
+}
+
+func TestTracing(t *testing.T) {
+	defer cleanup()
+	src := GetRandomPopulatedArchive()
+	tracer := newRecordingTracer()
+	dst := MustConnect("mock://test", &ConnectOptions{Tracer: tracer})
+	opts := testOptions()
+	opts.Tracer = tracer
+	assert.Nil(t, Mirror(src, dst, opts))
+	assert.Nil(t, dst.Scan(opts))
+
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	assert.Equal(t, 1, tracer.started["archivist.Mirror"])
+	assert.Equal(t, 1, tracer.started["archivist.Scan"])
+	assert.Equal(t, 15 * 3 * NumLevels + 15 * len(Categories()) + 1,
+		tracer.started["archivist.PutFile"])
+	assert.NotEqual(t, 0, tracer.started["archivist.ListFiles"])
+	assert.Equal(t, tracer.started, tracer.ended)
+	assert.Equal(t, 0, tracer.failed["archivist.PutFile"])
+}
+
+func TestTracingForwardsCapabilities(t *testing.T) {
+	defer cleanup()
+	tracer := newRecordingTracer()
+	fs := GetTestFileArchive()
+	arch := ConnectBackend(TracingBackend(fs.backend, tracer), nil)
+	opts := testOptions()
+	opts.OptimisticRootHAS = true
+	has := NewHAS()
+	has.CurrentLedger = 0x3f
+	assert.Nil(t, arch.PutRootHAS(has, opts))
+	root, e := fs.GetRootHAS()
+	assert.Nil(t, e)
+	assert.Equal(t, uint32(0x3f), root.CurrentLedger)
+	tracer.mutex.Lock()
+	assert.Equal(t, 1, tracer.started["archivist.PutFileIfVersion"])
+	tracer.mutex.Unlock()
+
+	// A capability the traced backend hasn't got isn't claimed, and one a
+	// read-only wrapper hides stays hidden beneath the tracing.
+	unconditional := struct{ ArchiveBackend }{fs.backend}
+	_, ok := asConditionalPutter(TracingBackend(unconditional, tracer))
+	assert.False(t, ok)
+	_, ok = asConditionalPutter(TracingBackend(ReadOnlyBackend(fs.backend), tracer))
+	assert.False(t, ok)
+	_, ok = asRangeGetter(TracingBackend(ReadOnlyBackend(fs.backend), tracer))
+	assert.True(t, ok)
+}
@@ -6,10 +6,15 @@ package archivist
 
 import (
 	"path"
-	"log"
 	"fmt"
 	"bufio"
+	"bytes"
 	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"os"
+	"path/filepath"
 )
 
 func makeTicker(onTick func(uint)) chan bool {
@@ -33,46 +38,268 @@ func bufReadCloser(in io.ReadCloser) io.ReadCloser {
 	}{bufio.NewReader(in), in}
 }
 
+// A CopyTransform rewrites file contents in flight while copying between
+// archives (recompression, encryption and so on). Files it does not want
+// are streamed verbatim, so a transform must decline anything already in
+// its output format rather than decode and re-encode it.
+type CopyTransform interface {
+	Wants(pth string) bool
+	Apply(pth string, in io.ReadCloser) (io.ReadCloser, error)
+}
+
+func isCheckpointHASPath(pth string) bool {
+	return strings.HasPrefix(pth, "history/") && strings.HasSuffix(pth, ".json")
+}
+
+// Reports whether copyPath should stream pth byte-for-byte, as opposed to
+// rewriting it with opts.HASTransform and/or opts.Transform.
+func copyVerbatim(pth string, opts *CommandOptions) bool {
+	if opts.HASTransform != nil && isCheckpointHASPath(pth) {
+		return false
+	}
+	return opts.Transform == nil || !opts.Transform.Wants(pth)
+}
+
+func rewriteHAS(in io.ReadCloser, f func(HistoryArchiveState) HistoryArchiveState) (io.ReadCloser, error) {
+	defer in.Close()
+	has, err := DecodeHAS(in)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = f(has).Encode(&buf); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
+}
+
+// Copies pth from src to dst, retrying up to opts.CopyRetries times while
+// the operation's retry budget lasts.
 func copyPath(src *Archive, dst *Archive, pth string, opts *CommandOptions) error {
+	for attempt := 0; ; attempt++ {
+		if opts.retries.exhausted() {
+			return ErrRetryBudgetExhausted
+		}
+		err := copyPathOnce(src, dst, pth, opts)
+		if err == nil || attempt >= opts.CopyRetries || !opts.retries.take() {
+			return err
+		}
+		logf("Retrying %s after error: %s", pth, err)
+	}
+}
+
+func copyPathOnce(src *Archive, dst *Archive, pth string, opts *CommandOptions) error {
 	if opts.DryRun {
-		log.Printf("dryrun skipping " + pth)
+		logf("dryrun skipping " + pth)
 		return nil
 	}
-	if dst.backend.Exists(pth) && !opts.Force {
-		log.Printf("skipping existing " + pth)
-		return nil
+	to := pth
+	var codec Codec
+	var bucket *Hash
+	transcode := false
+	if opts.Transcode {
+		to, codec, bucket, transcode = dst.transcodeTarget(pth)
+	}
+	if dst.backend.Exists(to) && !opts.Force {
+		if !opts.VerifyExisting {
+			logf("skipping existing " + to)
+			return nil
+		}
+		err := opts.verifySlots.run(func() error {
+			return verifyExistingFile(dst, to)
+		})
+		if err == nil {
+			logf("skipping existing, verified " + to)
+			return nil
+		}
+		logf("Copying over %s, which failed verification: %s", to, err)
+	}
+	if opts.inFlight != nil {
+		size, err := src.backend.GetFileSize(pth)
+		if err != nil {
+			return err
+		}
+		opts.inFlight.acquire(size)
+		defer opts.inFlight.release(size)
+	}
+	// Only a file copied verbatim can be copied without reading it.
+	if copier, ok := asDirectCopier(dst.backend); ok && !transcode && copyVerbatim(pth, opts) {
+		n, err := copier.CopyFileFrom(src.backend, pth)
+		if err != ErrDirectCopyUnsupported {
+			if err != nil {
+				return err
+			}
+			opts.stats.noteDirectCopy(pth, n)
+			if opts.PreserveModTime {
+				return copyModTime(src, dst, pth, pth)
+			}
+			return nil
+		}
 	}
 	rdr, err := src.backend.GetFile(pth)
 	if err != nil {
 		return err
 	}
 	defer rdr.Close()
-	err = dst.backend.PutFile(pth, bufReadCloser(rdr))
+	in := bufReadCloser(rdr)
+	if transcode {
+		if in, err = transcodeReader(in, src.gzipTrailing, codec, bucket); err != nil {
+			return fmt.Errorf("Transcoding %s: %s", pth, err)
+		}
+		// Unblocks the transcoder if PutFile gave up early, and waits
+		// for it to stop reading rdr before rdr is closed.
+		defer in.Close()
+	}
+	if !copyVerbatim(pth, opts) {
+		if opts.HASTransform != nil && isCheckpointHASPath(pth) {
+			if in, err = rewriteHAS(in, opts.HASTransform); err != nil {
+				return err
+			}
+		}
+		if opts.Transform != nil && opts.Transform.Wants(pth) {
+			if in, err = opts.Transform.Apply(pth, in); err != nil {
+				return err
+			}
+		}
+	}
+	counted := &countingReadCloser{ReadCloser: in}
+	if err = dst.backend.PutFile(to, counted); err != nil {
+		if transcode {
+			return fmt.Errorf("Transcoding %s: %s", pth, err)
+		}
+		return err
+	}
+	opts.stats.noteCopy(to, counted.n)
+	if opts.PreserveModTime {
+		return copyModTime(src, dst, pth, to)
+	}
+	return nil
+}
+
+// The listing of a backend that can't list: no files, and
+// ErrListingUnsupported.
+func unlistable() (chan string, chan error) {
+	ch := make(chan string)
+	errs := make(chan error, 1)
+	close(ch)
+	errs <- ErrListingUnsupported
+	close(errs)
+	return ch, errs
+}
+
+// Writes data to the local file pth through a temporary file beside it, so
+// readers see either the old contents or the new.
+func writeFileAtomic(pth string, data []byte) error {
+	out, err := ioutil.TempFile(filepath.Dir(pth), "." + filepath.Base(pth) + ".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := out.Name()
+	_, err = out.Write(data)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, pth)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
 	return err
 }
 
-func Categories() []string {
-	return []string{ "history", "ledger", "transactions", "results", "scp"}
+// Sets dst's file to, copied from src's from, to from's modification time,
+// if their backends allow.
+func copyModTime(src *Archive, dst *Archive, from string, to string) error {
+	getter, ok := asModTimeGetter(src.backend)
+	if !ok {
+		return nil
+	}
+	setter, ok := asModTimeSetter(dst.backend)
+	if !ok {
+		return nil
+	}
+	t, err := getter.GetFileModTime(from)
+	if err != nil {
+		return err
+	}
+	return setter.SetFileModTime(to, t)
 }
 
-func categoryExt(n string) string {
-	if n == "history" {
-		return "json"
-	} else {
-		return "xdr.gz"
+// A Category is one kind of per-checkpoint file: its name (which is also
+// its top-level directory and filename prefix), its file extension, and
+// whether every checkpoint must have one.
+type Category struct {
+	Name string
+	Ext string
+	Required bool
+}
+
+// The categories of per-checkpoint file an archive holds. Every set must
+// include "history", whose files are the checkpoint HAS JSON.
+type CategorySet []Category
+
+func DefaultCategorySet() CategorySet {
+	return CategorySet{
+		{Name:"history", Ext:"json", Required:true},
+		{Name:"ledger", Ext:"xdr.gz", Required:true},
+		{Name:"transactions", Ext:"xdr.gz", Required:true},
+		{Name:"results", Ext:"xdr.gz", Required:true},
+		{Name:"scp", Ext:"xdr.gz", Required:false},
 	}
 }
 
-func categoryRequired(n string) bool {
-	return n != "scp"
+func (cs CategorySet) Names() []string {
+	names := make([]string, 0, len(cs))
+	for _, c := range cs {
+		names = append(names, c.Name)
+	}
+	return names
 }
 
-func CategoryCheckpointPath(cat string, chk uint32) string {
-	ext := categoryExt(cat)
+func (cs CategorySet) lookup(n string) (Category, bool) {
+	for _, c := range cs {
+		if c.Name == n {
+			return c, true
+		}
+	}
+	return Category{Name:n, Ext:"xdr.gz"}, false
+}
+
+func (cs CategorySet) Ext(n string) string {
+	c, _ := cs.lookup(n)
+	return c.Ext
+}
+
+func (cs CategorySet) Required(n string) bool {
+	c, _ := cs.lookup(n)
+	return c.Required
+}
+
+func (cs CategorySet) CheckpointPath(cat string, chk uint32) string {
+	ext := cs.Ext(cat)
 	pre := CheckpointPrefix(chk).Path()
 	return path.Join(cat, pre, fmt.Sprintf("%s-%8.8x.%s", cat, chk, ext))
 }
 
+func Categories() []string {
+	return DefaultCategorySet().Names()
+}
+
+// Returns the path of a checkpoint file in the default category set.
+func CategoryCheckpointPath(cat string, chk uint32) string {
+	return DefaultCategorySet().CheckpointPath(cat, chk)
+}
+
+// Returns the path of the cat file holding ledger, which needn't be a
+// checkpoint ledger.
+func CategoryPathForLedger(cat string, ledger uint32) string {
+	return CategoryCheckpointPath(cat, CheckpointContaining(ledger))
+}
+
 func BucketPath(bucket Hash) string {
 	pre := HashPrefix(bucket)
 	return path.Join("bucket", pre.Path(), fmt.Sprintf("bucket-%s.xdr.gz", bucket))
@@ -118,9 +345,37 @@ func makeErrorPump(in chan error) chan error {
 	return ret
 }
 
+// Fan two error channels into one, closing the result once both inputs
+// are closed.
+func mergeErrors(a chan error, b chan error) chan error {
+	out := make(chan error)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	fwd := func(in chan error) {
+		for e := range in {
+			out <- e
+		}
+		wg.Done()
+	}
+	go fwd(a)
+	go fwd(b)
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// Discard everything remaining on a listing channel, so that the backend
+// goroutine feeding it can run to completion and exit.
+func drainStrings(ch chan string) {
+	for range ch {
+	}
+}
+
 func noteError(e error) uint32 {
 	if e != nil {
-		log.Printf("Error: " + e.Error())
+		logf("Error: " + e.Error())
 		return 1
 	}
 	return 0
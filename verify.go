@@ -7,12 +7,12 @@ package archivist
 import (
 	"fmt"
 	"io"
-	"log"
 	"bytes"
 	"sort"
 	"crypto/sha256"
-	"compress/gzip"
 	"hash"
+	"regexp"
+	"strings"
 	"github.com/stellar/go-stellar-base/xdr"
 )
 
@@ -83,15 +83,25 @@ func HashEmptyTxSet(previousLedgerHash Hash) Hash {
 	return Hash(sha256.Sum256(previousLedgerHash[:]))
 }
 
-func (arch *Archive) VerifyLedgerHeaderHistoryEntry(entry *xdr.LedgerHeaderHistoryEntry) error {
+// Returns the hash of entry's header, checking it's the hash the entry
+// records.
+func ledgerEntryHash(entry *xdr.LedgerHeaderHistoryEntry) (Hash, error) {
 	h, err := HashXdr(&entry.Header)
 	if err != nil {
-		return err
+		return h, err
 	}
 	if h != Hash(entry.Hash) {
-		return fmt.Errorf("Ledger %d expected hash %s, got %s",
+		return h, fmt.Errorf("Ledger %d expected hash %s, got %s",
 			entry.Header.LedgerSeq, Hash(entry.Hash), Hash(h))
 	}
+	return h, nil
+}
+
+func (arch *Archive) VerifyLedgerHeaderHistoryEntry(entry *xdr.LedgerHeaderHistoryEntry) error {
+	h, err := ledgerEntryHash(entry)
+	if err != nil {
+		return err
+	}
 	arch.mutex.Lock()
 	defer arch.mutex.Unlock()
 	seq := uint32(entry.Header.LedgerSeq)
@@ -132,7 +142,7 @@ func (arch *Archive) VerifyCategoryCheckpoint(cat string, chk uint32) error {
 		return nil
 	}
 
-	rdr, err := arch.GetXdrStream(CategoryCheckpointPath(cat, chk))
+	rdr, err := arch.GetXdrStream(arch.CategoryCheckpointPath(cat, chk))
 	if err != nil {
 		return err
 	}
@@ -174,19 +184,188 @@ func (arch *Archive) VerifyCategoryCheckpoint(cat string, chk uint32) error {
 	default:
 		return nil
 	}
+	return eachXdrEntry(rdr, &tmp, reset, step)
+}
 
+// Reads rdr to the end, a frame at a time into entry, cleared by reset
+// before each, calling step after each.
+func eachXdrEntry(rdr *XdrStream, entry interface{}, reset func(), step func() error) error {
 	for {
 		reset()
-		if err = rdr.ReadOne(&tmp); err != nil {
+		if err := rdr.ReadOne(entry); err != nil {
 			if err == io.EOF {
-				break
-			} else {
+				return nil
+			}
+			return err
+		}
+		if err := step(); err != nil {
+			return err
+		}
+	}
+}
+
+// The hashes one checkpoint's files commit to, keyed by ledger, and those
+// their contents hash to, as a Verify scan collects across its range.
+type checkpointHashes struct {
+	expectLedger map[uint32]Hash
+	actualLedger map[uint32]Hash
+	expectTxSet map[uint32]Hash
+	actualTxSet map[uint32]Hash
+	expectTxResultSet map[uint32]Hash
+	actualTxResultSet map[uint32]Hash
+}
+
+// Reads cat's file for chk, if there is one, into hs, returning whether
+// there was.
+func (arch *Archive) readCheckpointHashes(hs *checkpointHashes, cat string, chk uint32) (bool, error) {
+	pth := arch.CategoryCheckpointPath(cat, chk)
+	if !arch.backend.Exists(pth) {
+		return false, nil
+	}
+	rdr, err := arch.GetXdrStream(pth)
+	if err != nil {
+		return true, err
+	}
+	defer rdr.Close()
+	switch cat {
+	case "ledger":
+		var lhe xdr.LedgerHeaderHistoryEntry
+		return true, eachXdrEntry(rdr, &lhe,
+			func() { lhe = xdr.LedgerHeaderHistoryEntry{} },
+			func() error {
+				h, err := ledgerEntryHash(&lhe)
+				if err != nil {
+					return err
+				}
+				seq := uint32(lhe.Header.LedgerSeq)
+				hs.actualLedger[seq] = h
+				hs.expectLedger[seq - 1] = Hash(lhe.Header.PreviousLedgerHash)
+				hs.expectTxSet[seq] = Hash(lhe.Header.ScpValue.TxSetHash)
+				hs.expectTxResultSet[seq] = Hash(lhe.Header.TxSetResultHash)
+				return nil
+			})
+	case "transactions":
+		var the xdr.TransactionHistoryEntry
+		return true, eachXdrEntry(rdr, &the,
+			func() { the = xdr.TransactionHistoryEntry{} },
+			func() error {
+				h, err := HashTxSet(&the.TxSet)
+				hs.actualTxSet[uint32(the.LedgerSeq)] = h
 				return err
+			})
+	default:
+		var thre xdr.TransactionHistoryResultEntry
+		return true, eachXdrEntry(rdr, &thre,
+			func() { thre = xdr.TransactionHistoryResultEntry{} },
+			func() error {
+				h, err := HashXdr(&thre.TxResultSet)
+				hs.actualTxResultSet[uint32(thre.LedgerSeq)] = h
+				return err
+			})
+	}
+}
+
+// Checks the hashes checkpoint chk's ledger, transactions and results
+// files commit to against one another, as a Verify scan and ReportInvalid
+// do across a range, but within the one checkpoint and without the
+// Archive's shared maps: each header's hash, the chain of previous-ledger
+// hashes, and each ledger's transaction set and result set hashes, which
+// may be missing if empty. Files that are missing are left out. Returns
+// the path of the file at fault along with any error.
+func (arch *Archive) verifyCheckpointHashes(chk uint32) (string, error) {
+	hs := &checkpointHashes{
+		expectLedger: make(map[uint32]Hash),
+		actualLedger: make(map[uint32]Hash),
+		expectTxSet: make(map[uint32]Hash),
+		actualTxSet: make(map[uint32]Hash),
+		expectTxResultSet: make(map[uint32]Hash),
+		actualTxResultSet: make(map[uint32]Hash),
+	}
+	read := make(map[string]bool)
+	for _, cat := range []string{"ledger", "transactions", "results"} {
+		ok, err := arch.readCheckpointHashes(hs, cat, chk)
+		if err != nil {
+			return arch.CategoryCheckpointPath(cat, chk), err
+		}
+		read[cat] = ok
+	}
+	if !read["ledger"] {
+		return "", nil
+	}
+
+	seqs := make([]uint32, 0, len(hs.actualLedger))
+	for seq := range hs.actualLedger {
+		seqs = append(seqs, seq)
+	}
+	sort.Sort(ByUint32(seqs))
+	emptyXdrArrayHash := EmptyXdrArrayHash()
+	for _, seq := range seqs {
+		// The first ledger's predecessor is in the previous checkpoint.
+		if h, ok := hs.actualLedger[seq - 1]; ok && h != hs.expectLedger[seq - 1] {
+			return arch.CategoryCheckpointPath("ledger", chk),
+				fmt.Errorf("Ledger %d follows ledger %s, but ledger %d hashes to %s",
+					seq, hs.expectLedger[seq - 1], seq - 1, h)
+		}
+		if read["transactions"] {
+			h, ok := hs.actualTxSet[seq]
+			expect := hs.expectTxSet[seq]
+			if (ok || expect != HashEmptyTxSet(hs.expectLedger[seq - 1])) && h != expect {
+				return arch.CategoryCheckpointPath("transactions", chk),
+					fmt.Errorf("Transaction set of ledger %d expected hash %s, got %s",
+						seq, expect, h)
 			}
 		}
-		if err = step(); err != nil {
+		if read["results"] {
+			h, ok := hs.actualTxResultSet[seq]
+			expect := hs.expectTxResultSet[seq]
+			if (ok || expect != emptyXdrArrayHash) && h != expect {
+				return arch.CategoryCheckpointPath("results", chk),
+					fmt.Errorf("Transaction result set of ledger %d expected hash %s, got %s",
+						seq, expect, h)
+			}
+		}
+	}
+	return "", nil
+}
+
+// Checks that a category file is a complete sequence of XDR frames: that
+// it gunzips cleanly, that no frame's length runs past the end of the file,
+// and that the file ends on a frame boundary. Frames aren't decoded, so this
+// catches a valid gzip of a file truncated mid-frame, which neither presence
+// nor gzip checks do, without the cost of VerifyCategoryCheckpoint.
+func VerifyCategoryFile(a *Archive, cat string, chk uint32) error {
+	pth := a.CategoryCheckpointPath(cat, chk)
+	rdr, err := a.GetXdrStream(pth)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+	if _, err = rdr.SkipFrames(); err != nil {
+		return fmt.Errorf("%s: %s", pth, err)
+	}
+	return nil
+}
+
+var bucketPathRx = regexp.MustCompile("bucket-([0-9a-f]{64})\\.xdr\\.gz$")
+
+// Checks a file already in arch, by whatever means its kind allows, as
+// CommandOptions.VerifyExisting describes.
+func verifyExistingFile(arch *Archive, pth string) error {
+	if m := bucketPathRx.FindStringSubmatch(pth); m != nil {
+		return arch.verifyBucketFileHash(pth, MustDecodeHash(m[1]))
+	}
+	if strings.Contains(pth, ".xdr.") {
+		rdr, err := arch.GetXdrStream(pth)
+		if err != nil {
 			return err
 		}
+		defer rdr.Close()
+		_, err = rdr.SkipFrames()
+		return err
+	}
+	if strings.HasSuffix(pth, ".json") {
+		_, err := arch.GetPathHAS(pth)
+		return err
 	}
 	return nil
 }
@@ -202,18 +381,69 @@ func checkBucketHash(hasher hash.Hash, expect Hash) error {
 	return nil
 }
 
-func (arch *Archive) VerifyBucketHash(h Hash) error {
+// Returns a reader of bucket h's decompressed content; closing it closes
+// the file too. Buckets are gzipped, but legacy ones in another registered
+// codec are read too, as the magic bytes identify it.
+func (arch *Archive) openBucketContent(h Hash) (io.ReadCloser, error) {
 	rdr, err := arch.backend.GetFile(BucketPath(h))
+	if err != nil {
+		return nil, err
+	}
+	zrdr, err := newDecompressingReader(bufReadCloser(rdr), arch.gzipTrailing)
+	if err != nil {
+		return nil, fmt.Errorf("Bucket %s: %s", h, err)
+	}
+	return zrdr, nil
+}
+
+func (arch *Archive) VerifyBucketHash(h Hash) error {
+	return arch.verifyBucketFileHash(BucketPath(h), h)
+}
+
+// Opens the bucket file at pth to be hashed: through a rangedReader if
+// ConnectOptions.VerifyChunkBytes asks for ranged reads, the backend can
+// do them and the file is bigger than one range, and plainly otherwise,
+// including when the backend turns out to ignore ranges.
+func (arch *Archive) openBucketFile(pth string) (io.ReadCloser, error) {
+	g, ok := asRangeGetter(arch.backend)
+	if !ok || arch.verifyChunkBytes <= 0 {
+		return arch.backend.GetFile(pth)
+	}
+	size, err := arch.backend.GetFileSize(pth)
+	if err != nil {
+		return nil, err
+	}
+	if size <= arch.verifyChunkBytes {
+		return arch.backend.GetFile(pth)
+	}
+	// A server that ignores ranges refuses the first, and the file is read
+	// plainly instead.
+	first := fetchRange(g, pth, 0, arch.verifyChunkBytes)
+	if first.err == ErrRangeIgnored {
+		return arch.backend.GetFile(pth)
+	}
+	if first.err != nil {
+		return nil, first.err
+	}
+	return newRangedReader(g, pth, size, arch.verifyChunkBytes, first.buf), nil
+}
+
+// Checks the file at pth, which needn't be where bucket h belongs, hashes
+// to h.
+func (arch *Archive) verifyBucketFileHash(pth string, h Hash) error {
+	rdr, err := arch.openBucketFile(pth)
 	if err != nil {
 		return err
 	}
-	defer rdr.Close()
 	hsh := sha256.New()
-	rdr, err = gzip.NewReader(bufReadCloser(rdr))
+	zrdr, err := newDecompressingReader(bufReadCloser(rdr), arch.gzipTrailing)
 	if err != nil {
 		return err
 	}
-	io.Copy(hsh, bufReadCloser(rdr))
+	defer zrdr.Close()
+	if _, err = io.Copy(hsh, zrdr); err != nil {
+		return fmt.Errorf("Bucket %s: %s", h, err)
+	}
 	return checkBucketHash(hsh, h)
 }
 
@@ -244,9 +474,9 @@ func (arch *Archive) VerifyBucketEntries(h Hash) error {
 
 func reportValidity(ty string, nbad int, total int) {
 	if nbad == 0 {
-		log.Printf("Verified %d %ss have expected hashes", total, ty)
+		logf("Verified %d %ss have expected hashes", total, ty)
 	} else {
-		log.Printf("Error: %d %ss (of %d checked) have unexpected hashes", nbad, ty, total)
+		logf("Error: %d %ss (of %d checked) have unexpected hashes", nbad, ty, total)
 	}
 }
 
@@ -260,7 +490,7 @@ func compareHashMaps(expect map[uint32]Hash, actual map[uint32]Hash, ty string,
 		}
 		if ahash != ehash {
 			n++
-			log.Printf("Error: mismatched hash on %s 0x%8.8x: expected %s, got %s",
+			logf("Error: mismatched hash on %s 0x%8.8x: expected %s, got %s",
 				ty, eledger, ehash, ahash)
 		}
 	}
@@ -320,3 +550,23 @@ func (arch *Archive) ReportInvalid(opts *CommandOptions) error {
 	}
 	return nil
 }
+
+// Bounds how many verifications run at once, apart from how many workers
+// list or copy. A nil limiter bounds nothing.
+type verifyLimiter chan struct{}
+
+func newVerifyLimiter(n int) verifyLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return make(verifyLimiter, n)
+}
+
+// Runs fn once a slot is free.
+func (l verifyLimiter) run(fn func() error) error {
+	if l != nil {
+		l <- struct{}{}
+		defer func() { <-l }()
+	}
+	return fn()
+}
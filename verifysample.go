@@ -0,0 +1,155 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Number of files VerifySample checks at once.
+const verifySampleConcurrency = 16
+
+// What VerifySample checked and what failed. Seed reproduces the sample
+// through VerifySampleSeeded. Failures maps the path of each file that
+// failed its check (or was missing) to the reason, and FailedCheckpoints
+// lists the sampled checkpoints with any failure; a bad bucket counts
+// against the first sampled checkpoint that references it.
+type VerifyReport struct {
+	Range Range `json:"range"`
+	Seed int64 `json:"seed"`
+	Checkpoints int `json:"checkpoints"`
+	Sampled int `json:"sampled"`
+	Files int `json:"files"`
+	Buckets int `json:"buckets"`
+	Failures map[string]string `json:"failures"`
+	FailedCheckpoints []uint32 `json:"failedCheckpoints"`
+}
+
+// Verifies a random fraction of the checkpoints of rng, as
+// VerifySampleSeeded does, with a seed taken from the clock and recorded
+// in the report.
+func (a *Archive) VerifySample(rng Range, fraction float64) (VerifyReport, error) {
+	return a.VerifySampleSeeded(rng, fraction, time.Now().UnixNano())
+}
+
+// Picks each checkpoint of rng (clamped to the root HAS) with probability
+// fraction, using a generator seeded with seed, so the same seed over the
+// same range picks the same checkpoints. Every category file of a picked
+// checkpoint is checked as VerifyExisting checks files, its ledger headers,
+// transaction sets and result sets are checked against the hashes the
+// checkpoint commits them to as a Verify scan checks them, and every
+// bucket its HAS references has its hash verified, each bucket once
+// however many picked checkpoints share it. A cheap, statistical probe of
+// an archive too large to verify whole routinely. Failures go in the
+// report; an error is returned only if fraction is out of range or the
+// root HAS can't be read.
+func (a *Archive) VerifySampleSeeded(rng Range, fraction float64, seed int64) (VerifyReport, error) {
+	report := VerifyReport{
+		Seed: seed,
+		Failures: make(map[string]string),
+		FailedCheckpoints: []uint32{},
+	}
+	if fraction <= 0 || fraction > 1 {
+		return report, fmt.Errorf("Sample fraction %f is not in (0, 1]", fraction)
+	}
+	root, err := a.GetRootHAS()
+	if err != nil {
+		return report, err
+	}
+	rng = rng.Clamp(root.Range())
+	report.Range = rng
+	report.Checkpoints = rng.Size()
+
+	// Drawn before any checking starts, so the sample doesn't depend on
+	// the order checks finish in.
+	gen := rand.New(rand.NewSource(seed))
+	var sample []uint32
+	for chk := range rng.Checkpoints() {
+		if gen.Float64() < fraction {
+			sample = append(sample, chk)
+		}
+	}
+	report.Sampled = len(sample)
+
+	var mutex sync.Mutex
+	failed := make(map[uint32]bool)
+	fail := func(chk uint32, pth string, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		report.Failures[pth] = err.Error()
+		failed[chk] = true
+	}
+	bucketChecked := make(map[Hash]bool)
+
+	type sampleReq struct {
+		chk uint32
+		cat string
+		pth string
+		bucket *Hash
+		hashes bool
+	}
+	req := make(chan sampleReq)
+	go func() {
+		defer close(req)
+		for _, chk := range sample {
+			for _, cat := range a.Categories() {
+				pth := a.CategoryCheckpointPath(cat, chk)
+				req <- sampleReq{chk: chk, cat: cat, pth: pth}
+			}
+			req <- sampleReq{chk: chk, hashes: true}
+			has, err := a.GetCheckpointHAS(chk)
+			if err != nil {
+				// Reported by the history file's own check.
+				continue
+			}
+			for _, bucket := range has.Buckets() {
+				if !bucketChecked[bucket] {
+					bucketChecked[bucket] = true
+					b := bucket
+					req <- sampleReq{chk: chk, pth: BucketPath(b), bucket: &b}
+				}
+			}
+		}
+	}()
+
+	var files uint32
+	var wg sync.WaitGroup
+	wg.Add(verifySampleConcurrency)
+	for i := 0; i < verifySampleConcurrency; i++ {
+		go func() {
+			for r := range req {
+				var err error
+				if r.hashes {
+					r.pth, err = a.verifyCheckpointHashes(r.chk)
+				} else if r.bucket != nil {
+					err = a.VerifyBucketHash(*r.bucket)
+				} else if a.backend.Exists(r.pth) {
+					atomic.AddUint32(&files, 1)
+					err = verifyExistingFile(a, r.pth)
+				} else if a.categoryRequired(r.cat) {
+					err = fmt.Errorf("Missing %s", r.pth)
+				}
+				if err != nil {
+					fail(r.chk, r.pth, err)
+				}
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+
+	report.Files = int(files)
+	report.Buckets = len(bucketChecked)
+	for chk := range failed {
+		report.FailedCheckpoints = append(report.FailedCheckpoints, chk)
+	}
+	sort.Sort(ByUint32(report.FailedCheckpoints))
+	return report, nil
+}
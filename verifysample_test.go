@@ -0,0 +1,126 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stellar/go-stellar-base/xdr"
+)
+
+// Writes the ledger, transactions and results files of checkpoint chk with
+// headers whose hashes chain on from prev, and which commit to the
+// transaction and result sets written; the set of ledger tampered is
+// swapped for another after it's hashed.
+// Returns the hash of the last header.
+func putHashedCheckpoint(t *testing.T, arch *Archive, chk uint32, prev Hash, tampered uint32) Hash {
+	var ledgers, txs, results bytes.Buffer
+	lw, tw, rw := gzip.NewWriter(&ledgers), gzip.NewWriter(&txs), gzip.NewWriter(&results)
+	for seq := chk - 63; seq <= chk; seq++ {
+		if seq == 0 {
+			continue
+		}
+		the := xdr.TransactionHistoryEntry{LedgerSeq: xdr.Uint32(seq)}
+		the.TxSet.PreviousLedgerHash = xdr.Hash(prev)
+		txHash, err := HashTxSet(&the.TxSet)
+		assert.Nil(t, err)
+		thre := xdr.TransactionHistoryResultEntry{LedgerSeq: xdr.Uint32(seq)}
+		resultHash, err := HashXdr(&thre.TxResultSet)
+		assert.Nil(t, err)
+
+		var lhe xdr.LedgerHeaderHistoryEntry
+		lhe.Header.LedgerSeq = xdr.Uint32(seq)
+		lhe.Header.PreviousLedgerHash = xdr.Hash(prev)
+		lhe.Header.ScpValue.TxSetHash = xdr.Hash(txHash)
+		lhe.Header.TxSetResultHash = xdr.Hash(resultHash)
+		h, err := HashXdr(&lhe.Header)
+		assert.Nil(t, err)
+		lhe.Hash = xdr.Hash(h)
+		prev = h
+
+		if seq == tampered {
+			the.TxSet.PreviousLedgerHash[0] ^= 0xff
+		}
+		assert.Nil(t, WriteFramedXdr(lw, &lhe))
+		assert.Nil(t, WriteFramedXdr(tw, &the))
+		assert.Nil(t, WriteFramedXdr(rw, &thre))
+	}
+	for cat, buf := range map[string]*bytes.Buffer{"ledger": &ledgers, "transactions": &txs, "results": &results} {
+		map[string]*gzip.Writer{"ledger": lw, "transactions": tw, "results": rw}[cat].Close()
+		assert.Nil(t, arch.backend.PutFile(arch.CategoryCheckpointPath(cat, chk),
+			ioutil.NopCloser(buf)))
+	}
+	return prev
+}
+
+func TestVerifySample(t *testing.T) {
+	defer cleanup()
+	arch := GetTestArchive()
+	rng := Range{Low:63, High:0x3bf}
+	for chk := range rng.Checkpoints() {
+		assert.Nil(t, arch.AddVerifiableCheckpoint(chk))
+	}
+	has, err := arch.GetCheckpointHAS(rng.High)
+	assert.Nil(t, err)
+	assert.Nil(t, arch.PutRootHAS(has, &CommandOptions{}))
+
+	report, err := arch.VerifySampleSeeded(rng, 0.5, 7)
+	assert.Nil(t, err)
+	assert.Equal(t, 15, report.Checkpoints)
+	assert.True(t, report.Sampled > 0 && report.Sampled < 15)
+	assert.Equal(t, report.Sampled * len(arch.Categories()), report.Files)
+	assert.NotEqual(t, 0, report.Buckets)
+	assert.Empty(t, report.Failures)
+
+	// The same seed samples the same checkpoints; sampling all of them
+	// finds a corrupt file wherever it is.
+	again, err := arch.VerifySampleSeeded(rng, 0.5, 7)
+	assert.Nil(t, err)
+	assert.Equal(t, report, again)
+	pth := arch.CategoryCheckpointPath("ledger", 0x17f)
+	assert.Nil(t, arch.backend.PutFile(pth, ioutil.NopCloser(strings.NewReader("junk"))))
+	report, err = arch.VerifySample(rng, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 15, report.Sampled)
+	assert.Contains(t, report.Failures, pth)
+	assert.Equal(t, []uint32{0x17f}, report.FailedCheckpoints)
+
+	_, err = arch.VerifySample(rng, 0)
+	assert.Error(t, err)
+}
+
+func TestVerifySampleHashes(t *testing.T) {
+	defer cleanup()
+	arch := GetTestArchive()
+	rng := Range{Low:63, High:0x1bf}
+	var prev Hash
+	for chk := range rng.Checkpoints() {
+		assert.Nil(t, arch.AddVerifiableCheckpoint(chk))
+		prev = putHashedCheckpoint(t, arch, chk, prev, 0)
+	}
+	report, err := arch.VerifySampleSeeded(rng, 1, 1)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Failures)
+
+	// A transaction set that's well-formed, but not the one its ledger
+	// header commits to.
+	has, err := arch.GetCheckpointHAS(0xff)
+	assert.Nil(t, err)
+	lhs, err := arch.readLedgerFile(0xbf)
+	assert.Nil(t, err)
+	putHashedCheckpoint(t, arch, 0xff, Hash(lhs[len(lhs) - 1].Hash), 0xf0)
+	assert.Nil(t, arch.PutCheckpointHAS(0xff, has, &CommandOptions{Force:true}))
+	pth := arch.CategoryCheckpointPath("transactions", 0xff)
+	assert.Nil(t, verifyExistingFile(arch, pth))
+	report, err = arch.VerifySampleSeeded(rng, 1, 1)
+	assert.Nil(t, err)
+	assert.Len(t, report.Failures, 1)
+	assert.Contains(t, report.Failures, pth)
+	assert.Equal(t, []uint32{0xff}, report.FailedCheckpoints)
+}
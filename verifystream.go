@@ -0,0 +1,96 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+// Number of bucket hashes VerifyStreaming remembers, to avoid re-verifying
+// the slow-moving upper-level buckets that consecutive checkpoints share.
+const verifyStreamRecent = 4096
+
+// One outcome from VerifyStreaming: either a bucket that was checked (Err
+// is nil if its gzip stream and hash were good), or a checkpoint whose HAS
+// couldn't be read, in which case Bucket is zero.
+type VerifyResult struct {
+	Checkpoint uint32
+	Path string
+	Bucket Hash
+	Err error
+}
+
+// A fixed-size set of the most recently added hashes.
+type recentHashes struct {
+	ring []Hash
+	next int
+	set map[Hash]bool
+}
+
+func newRecentHashes(n int) *recentHashes {
+	return &recentHashes{
+		ring: make([]Hash, 0, n),
+		set: make(map[Hash]bool, n),
+	}
+}
+
+func (r *recentHashes) Has(h Hash) bool {
+	return r.set[h]
+}
+
+func (r *recentHashes) Add(h Hash) {
+	if r.set[h] {
+		return
+	}
+	if len(r.ring) < cap(r.ring) {
+		r.ring = append(r.ring, h)
+	} else {
+		delete(r.set, r.ring[r.next])
+		r.ring[r.next] = h
+		r.next = (r.next + 1) % len(r.ring)
+	}
+	r.set[h] = true
+}
+
+// Walks the checkpoints of rng (clamped to the root HAS) in order and
+// verifies the gzip stream and hash of every bucket each one references,
+// sending one result per bucket checked. Unlike Scan followed by
+// ReportInvalid, no per-archive sets are accumulated: memory use is fixed,
+// at the cost of re-verifying a shared bucket if it was last seen more than
+// a few thousand buckets earlier. The channel is closed when the walk is
+// done and must be drained. An error is returned only if the root HAS
+// can't be read.
+func (arch *Archive) VerifyStreaming(rng Range) (<-chan VerifyResult, error) {
+	root, err := arch.GetRootHAS()
+	if err != nil {
+		return nil, err
+	}
+	rng = rng.Clamp(root.Range())
+	ch := make(chan VerifyResult)
+	go func() {
+		defer close(ch)
+		recent := newRecentHashes(verifyStreamRecent)
+		for chk := range rng.Checkpoints() {
+			has, e := arch.GetCheckpointHAS(chk)
+			if e != nil {
+				ch <- VerifyResult{
+					Checkpoint: chk,
+					Path: arch.CheckpointHASPath(chk),
+					Err: e,
+				}
+				continue
+			}
+			for _, bucket := range has.Buckets() {
+				if recent.Has(bucket) {
+					continue
+				}
+				recent.Add(bucket)
+				ch <- VerifyResult{
+					Checkpoint: chk,
+					Path: BucketPath(bucket),
+					Bucket: bucket,
+					Err: arch.VerifyBucketHash(bucket),
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
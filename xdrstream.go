@@ -8,8 +8,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"io/ioutil"
 	"fmt"
-	"strings"
 	"errors"
 	"compress/gzip"
 	"crypto/sha256"
@@ -35,15 +35,20 @@ func NewXdrGzStream(in io.ReadCloser) (*XdrStream, error) {
 	return &XdrStream{rdr: bufReadCloser(rdr), rdr2: in}, nil
 }
 
+// Opens a compressed XDR file, in any registered codec.
 func (a *Archive) GetXdrStream(pth string) (*XdrStream, error) {
-	if !strings.HasSuffix(pth, ".xdr.gz") {
-		return nil, errors.New("File has non-.xdr.gz suffix: " + pth)
+	if _, ok := codecForPath(pth); !ok {
+		return nil, errors.New("File has no known .xdr.* suffix: " + pth)
 	}
 	rdr, err := a.backend.GetFile(pth)
 	if err != nil {
 		return nil, err
 	}
-	return NewXdrGzStream(rdr)
+	drdr, err := newDecompressingReader(bufReadCloser(rdr), a.gzipTrailing)
+	if err != nil {
+		return nil, err
+	}
+	return &XdrStream{rdr: bufReadCloser(drdr)}, nil
 }
 
 func HashXdr(x interface{}) (Hash, error) {
@@ -101,6 +106,36 @@ func (x *XdrStream) ReadOne(in interface{}) error {
 	return err
 }
 
+// Reads the rest of the stream as length-prefixed XDR frames without
+// decoding them, checking only that the stream ends exactly on a frame
+// boundary. Returns the number of frames read.
+func (x *XdrStream) SkipFrames() (int, error) {
+	n := 0
+	for {
+		var nbytes uint32
+		err := binary.Read(x.rdr, binary.BigEndian, &nbytes)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return n, fmt.Errorf("Truncated header of XDR frame %d", n)
+			}
+			return n, err
+		}
+		nbytes &= 0x7fffffff
+		skipped, err := io.CopyN(ioutil.Discard, x.rdr, int64(nbytes))
+		if skipped != int64(nbytes) {
+			return n, fmt.Errorf("XDR frame %d of %d bytes overruns end of " +
+				"stream by %d bytes", n, nbytes, int64(nbytes) - skipped)
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
 func WriteFramedXdr(out io.Writer, in interface{}) error {
 	var tmp bytes.Buffer
 	n, err := xdr.Marshal(&tmp, in)
@@ -0,0 +1,52 @@
+// Copyright 2016 Stellar Development Foundation and contributors. Licensed
+// under the Apache License, Version 2.0. See the COPYING file at the root
+// of this distribution or at http://www.apache.org/licenses/LICENSE-2.0
+
+package archivist
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func putGzipped(arch *Archive, pth string, raw []byte) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(raw)
+	w.Close()
+	arch.backend.PutFile(pth, ioutil.NopCloser(&buf))
+}
+
+func TestVerifyCategoryFile(t *testing.T) {
+	arch := GetTestMockArchive()
+	frames := []byte{
+		0x80, 0, 0, 4, 1, 2, 3, 4,
+		0x80, 0, 0, 8, 1, 2, 3, 4, 5, 6, 7, 8,
+	}
+	for _, c := range []struct{
+		chk uint32
+		raw []byte
+		ok bool
+	}{
+		{0x3f, frames, true},
+		{0x7f, []byte{}, true},
+		{0xbf, frames[:len(frames) - 3], false},
+		{0xff, frames[:10], false},
+	} {
+		putGzipped(arch, CategoryCheckpointPath("ledger", c.chk), c.raw)
+		err := VerifyCategoryFile(arch, "ledger", c.chk)
+		if c.ok {
+			assert.NoError(t, err)
+		} else {
+			assert.Error(t, err)
+		}
+	}
+
+	arch.AddRandomCheckpointFile("results", 0x3f)
+	assert.Error(t, VerifyCategoryFile(arch, "results", 0x3f))
+	assert.Error(t, VerifyCategoryFile(arch, "results", 0x7f))
+	assert.Error(t, VerifyCategoryFile(arch, "history", 0x3f))
+}